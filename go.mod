@@ -5,4 +5,7 @@ go 1.23.4
 require (
 	github.com/mattn/go-sqlite3 v1.14.22
 	golang.org/x/crypto v0.40.0
+	rsc.io/qr v0.2.0
 )
+
+require golang.org/x/sys v0.34.0 // indirect
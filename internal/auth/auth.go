@@ -2,79 +2,150 @@ package auth
 
 import (
 	"context"
-	"crypto/rand"
-	"database/sql"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
-	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
 )
 
 const CookieName = "meowfilm_auth"
 
-var tokenTTL = 30 * 24 * time.Hour
-
 type Options struct {
-	TrustProxy   bool
+	// CookieSecure forces the Secure cookie flag. Otherwise it is set when
+	// the client reached us over HTTPS, directly or through a trusted proxy.
 	CookieSecure bool
+	// Header enables forward-auth header sign-in when set.
+	Header *HeaderAuth
+	// TrustedOrigins may send state-changing requests besides our own origin.
+	TrustedOrigins []string
 }
 
 type User struct {
-	ID       int64  `json:"userId"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	Status   string `json:"status"`
+	ID                 int64  `json:"userId"`
+	Username           string `json:"username"`
+	DisplayName        string `json:"displayName"`
+	Role               string `json:"role"`
+	Status             string `json:"status"`
+	MustChangePassword bool   `json:"mustChangePassword"`
+	// Permissions are those granted by Role.
+	Permissions []string `json:"permissions"`
+	// ProfileID is the profile the session is using; history and favorites
+	// are kept per profile.
+	ProfileID int64 `json:"profileId"`
+}
+
+func (a *Auth) newUser(u store.User) *User {
+	return &User{
+		ID:                 u.ID,
+		Username:           u.Username,
+		DisplayName:        u.DisplayName,
+		Role:               u.Role,
+		Status:             u.Status,
+		MustChangePassword: u.MustChangePassword,
+		Permissions:        a.rolePermissions(u.Role),
+	}
+}
+
+// PasswordChangePath stays reachable while a user must change their password.
+const PasswordChangePath = "/api/user/password"
+
+// passwordChangeBlocks reports whether u may not use the API until they set a
+// new password.
+func passwordChangeBlocks(u *User, r *http.Request) bool {
+	return u.MustChangePassword && r.URL.Path != PasswordChangePath
 }
 
 type Auth struct {
-	db           *db.DB
-	cookieSecure bool
+	store          *store.Store
+	cookieSecure   bool
+	header         *HeaderAuth
+	trustedOrigins []string
+	challenges     sync.Map // challenge ID -> *Challenge
 }
 
 type ctxKey int
 
 const (
 	userKey ctxKey = iota
-	tokenKey
+	sessionKey
+	scopesKey
+	headerPendingKey
 )
 
-func New(database *db.DB, opts Options) *Auth {
+func New(st *store.Store, opts Options) *Auth {
 	return &Auth{
-		db:           database,
-		cookieSecure: opts.CookieSecure,
+		store:          st,
+		cookieSecure:   opts.CookieSecure,
+		header:         opts.Header,
+		trustedOrigins: opts.TrustedOrigins,
 	}
 }
 
 func (a *Auth) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := strings.TrimSpace(readCookie(r))
-		if token == "" {
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, (*User)(nil))))
+		if bearer := readBearer(r); bearer != "" {
+			a.serveBearer(w, r, next, bearer)
 			return
 		}
-
-		u, exp := a.resolveToken(token)
-		if u == nil || exp.Before(time.Now()) {
-			a.deleteToken(token)
-			clearCookie(w, a.cookieSecure)
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, (*User)(nil))))
+		if u, err := a.headerUser(r); !errors.Is(err, store.ErrNotFound) {
+			switch {
+			case errors.Is(err, errHeaderSecondFactor):
+				// The proxy only vouches for the first factor. The user signs
+				// in through HeaderLogin and keeps using that session.
+				a.serveSession(w, r.WithContext(context.WithValue(r.Context(), headerPendingKey, true)), next, u.ID)
+				return
+			case err != nil:
+				u = nil
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
 			return
 		}
+		a.serveSession(w, r, next, 0)
+	})
+}
 
-		if u.Status != "active" {
-			a.deleteToken(token)
-			clearCookie(w, a.cookieSecure)
+// serveSession signs the request in by its session cookie. A non-zero
+// userID only accepts sessions of that user.
+func (a *Auth) serveSession(w http.ResponseWriter, r *http.Request, next http.Handler, userID int64) {
+	token := strings.TrimSpace(readCookie(r))
+	if token == "" {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, (*User)(nil))))
+		return
+	}
+
+	sess, u := a.resolveSession(token)
+	policy, now := LoadSessionPolicy(a.store.Settings), time.Now().UnixMilli()
+	if u == nil || sess.ExpiresAt <= now || policy.expiry(sess.CreatedAt, sess.LastSeenAt, sess.Remember) <= now {
+		if sess.ID != 0 {
+			a.deleteSession(sess.ID)
 		}
+		clearCookie(w, a.secureCookie(r))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, (*User)(nil))))
+		return
+	}
+	if userID != 0 && u.ID != userID {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, (*User)(nil))))
+		return
+	}
 
-		ctx := context.WithValue(r.Context(), userKey, u)
-		ctx = context.WithValue(ctx, tokenKey, token)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	if u.Status != "active" {
+		a.deleteSession(sess.ID)
+		clearCookie(w, a.secureCookie(r))
+	} else {
+		a.touchSession(w, r, sess, token, policy)
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, u)
+	ctx = context.WithValue(ctx, sessionKey, sess.ID)
+	next.ServeHTTP(w, r.WithContext(ctx))
 }
 
 func CurrentUser(r *http.Request) *User {
@@ -97,21 +168,6 @@ func RequireLoginPage(next http.Handler) http.Handler {
 	})
 }
 
-func (a *Auth) RequireAdmin(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		u := CurrentUser(r)
-		if u == nil {
-			writeJSON(w, http.StatusUnauthorized, map[string]any{"success": false, "message": "Unauthorized"})
-			return
-		}
-		if u.Role != "admin" {
-			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权限操作"})
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 func (a *Auth) RequireAuthAPI(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		u := CurrentUser(r)
@@ -123,84 +179,105 @@ func (a *Auth) RequireAuthAPI(next http.Handler) http.Handler {
 			writeJSON(w, http.StatusForbidden, map[string]any{"error": "该账户已禁用"})
 			return
 		}
+		if passwordChangeBlocks(u, r) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"error": "请先修改密码", "mustChangePassword": true})
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (a *Auth) Login(w http.ResponseWriter, username, password string) (status int, msg string) {
+// LoginResult is the outcome of a login step.
+type LoginResult struct {
+	Status  int
+	Message string // set when the step failed
+	// TwoFactor is set when the password was right but a second factor is
+	// still needed. No cookie has been issued yet.
+	TwoFactor *Challenge
+	// RecoveryCodes are shown once when 2FA enrollment completes at login.
+	RecoveryCodes []string
+}
+
+// dummyPasswordHash is checked for unknown usernames so that they take as
+// long to refuse as a wrong password and do not reveal which accounts exist.
+// It uses the current password.Hash parameters.
+const dummyPasswordHash = "$argon2id$v=19$m=19456,t=2,p=1$iamkgAdBBWhsleCEuUPPjw$nQBEyQSnEFYknO/JhilsSSc5U6sqEmSH/BRlZNk1MkI"
+
+// Login checks a username and password and signs the user in, or hands out
+// a second-factor challenge. remember asks for a persistent session.
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request, username, pass string, remember bool) LoginResult {
 	u := strings.TrimSpace(username)
-	p := password
+	p := pass
 	if u == "" || p == "" {
-		return http.StatusBadRequest, "用户名与密码不能为空"
+		return LoginResult{Status: http.StatusBadRequest, Message: "用户名与密码不能为空"}
+	}
+	policy, ip, now := LoadLoginPolicy(a.store.Settings), proxy.ClientIP(r), time.Now().UnixMilli()
+	if wait := a.loginRetryAfter(policy, u, ip, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return LoginResult{Status: http.StatusTooManyRequests, Message: retryAfterMessage(wait)}
 	}
-	var hashed string
-	var role string
-	var statusStr string
-	err := a.db.SQL().QueryRow(`SELECT password, role, status FROM users WHERE username = ? LIMIT 1`, u).Scan(&hashed, &role, &statusStr)
+	user, err := a.store.Users.ByUsername(u)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return http.StatusUnauthorized, "用户名或密码错误"
+		if errors.Is(err, store.ErrNotFound) {
+			password.Verify(dummyPasswordHash, p)
+			a.recordLoginFailure(policy, u, ip, now)
+			return LoginResult{Status: http.StatusUnauthorized, Message: "用户名或密码错误"}
 		}
-		return http.StatusInternalServerError, "请求失败"
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
 	}
-	if statusStr != "active" {
-		return http.StatusForbidden, "该账户已禁用"
+	ok, rehash := password.Verify(user.PasswordHash, p)
+	if !ok {
+		a.recordLoginFailure(policy, u, ip, now)
+		return LoginResult{Status: http.StatusUnauthorized, Message: "用户名或密码错误"}
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(p)); err != nil {
-		return http.StatusUnauthorized, "用户名或密码错误"
+	if rehash {
+		if hash, err := password.Hash(p); err == nil {
+			_ = a.store.Users.Update(user.ID, store.UserPatch{PasswordHash: &hash})
+		}
 	}
-	token, err := a.issueToken(u)
-	if err != nil || token == "" {
-		return http.StatusInternalServerError, "请求失败"
+	if user.Status == "pending" {
+		a.clearLoginFailures(u)
+		return LoginResult{Status: http.StatusForbidden, Message: "账号正在等待管理员审核"}
 	}
-	writeCookie(w, token, a.cookieSecure)
-	return http.StatusOK, ""
-}
-
-func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimSpace(readCookie(r))
-	if token != "" {
-		a.deleteToken(token)
+	if user.Status != "active" {
+		a.clearLoginFailures(u)
+		return LoginResult{Status: http.StatusForbidden, Message: "该账户已禁用"}
 	}
-	clearCookie(w, a.cookieSecure)
+	return a.SignIn(w, r, user, remember)
 }
 
-func (a *Auth) resolveToken(token string) (*User, time.Time) {
-	var u User
-	var expMS int64
-	err := a.db.SQL().QueryRow(`
-		SELECT u.id, u.username, u.role, u.status, t.expires_at
-		FROM auth_tokens t JOIN users u ON u.id = t.user_id
-		WHERE t.token = ? LIMIT 1
-	`, token).Scan(&u.ID, &u.Username, &u.Role, &u.Status, &expMS)
-	if err != nil {
-		return nil, time.Time{}
+// SignIn finishes a login whose first factor has been checked, by password
+// or by single sign-on. Users who have or need 2FA get a challenge instead
+// of a session.
+func (a *Auth) SignIn(w http.ResponseWriter, r *http.Request, user store.User, remember bool) LoginResult {
+	if enabled := a.TwoFactorEnabled(user.ID); enabled || a.TwoFactorRequired(user.Role) {
+		c, err := a.newChallenge(user, !enabled, remember)
+		if err != nil {
+			return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+		}
+		return LoginResult{Status: http.StatusOK, TwoFactor: c}
 	}
-	return &u, time.UnixMilli(expMS)
+	a.clearLoginFailures(user.Username)
+	if err := a.StartSession(w, r, user.ID, remember); err != nil {
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+	}
+	return LoginResult{Status: http.StatusOK}
 }
 
-func (a *Auth) issueToken(username string) (string, error) {
-	var userID int64
-	if err := a.db.SQL().QueryRow(`SELECT id FROM users WHERE username = ? LIMIT 1`, username).Scan(&userID); err != nil {
-		return "", err
-	}
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
-	}
-	token := base64.RawURLEncoding.EncodeToString(b)
-	now := time.Now()
-	exp := now.Add(tokenTTL)
-	_, err := a.db.SQL().Exec(`INSERT INTO auth_tokens(token, user_id, created_at, expires_at) VALUES (?,?,?,?)`,
-		token, userID, now.UnixMilli(), exp.UnixMilli())
-	if err != nil {
-		return "", err
+// Logout ends the session that made the request.
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	if id := SessionID(r); id != 0 {
+		a.deleteSession(id)
+	} else if token := strings.TrimSpace(readCookie(r)); token != "" {
+		if sess, err := a.store.Tokens.ByHash(tokenDigest(token)); err == nil {
+			a.deleteSession(sess.ID)
+		}
 	}
-	return token, nil
+	clearCookie(w, a.secureCookie(r))
 }
 
-func (a *Auth) deleteToken(token string) {
-	_, _ = a.db.SQL().Exec(`DELETE FROM auth_tokens WHERE token = ?`, token)
+func (a *Auth) secureCookie(r *http.Request) bool {
+	return a.cookieSecure || proxy.IsHTTPS(r)
 }
 
 func readCookie(r *http.Request) string {
@@ -214,7 +291,7 @@ func readCookie(r *http.Request) string {
 	return c.Value
 }
 
-func writeCookie(w http.ResponseWriter, token string, secure bool) {
+func writeCookie(w http.ResponseWriter, token string, secure bool, maxAge int) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     CookieName,
 		Value:    token,
@@ -222,7 +299,7 @@ func writeCookie(w http.ResponseWriter, token string, secure bool) {
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		Secure:   secure,
-		MaxAge:   int(tokenTTL.Seconds()),
+		MaxAge:   maxAge,
 	})
 }
 
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestDummyPasswordHashIsCurrent(t *testing.T) {
+	// Unknown usernames are only as slow as real ones while the dummy hash
+	// uses the parameters password.Hash writes today.
+	if ok, rehash := password.Verify(dummyPasswordHash, "meowfilm-unknown-user"); !ok || rehash {
+		t.Errorf("Verify = %v, %v; regenerate dummyPasswordHash with password.Hash", ok, rehash)
+	}
+}
+
+func TestLoginRehash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("right-pass-1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		bcrypt  bool
+		pass    string
+		status  int
+		upgrade bool
+	}{
+		{"bcrypt upgraded to argon2id", true, "right-pass-1", http.StatusOK, true},
+		{"bcrypt kept on a wrong password", true, "wrong", http.StatusUnauthorized, false},
+		{"argon2id left alone", false, "right-pass-1", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, u := newTestAuth(t, "alice", "right-pass-1")
+			_ = a.store.Settings.Set("login_backoff_seconds", "0")
+			if tt.bcrypt {
+				hash := string(legacy)
+				if err := a.store.Users.Update(u.ID, store.UserPatch{PasswordHash: &hash}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, _ := a.store.Users.ByID(u.ID)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			if res := a.Login(httptest.NewRecorder(), r, "alice", tt.pass, false); res.Status != tt.status {
+				t.Fatalf("Login = %d %q, want %d", res.Status, res.Message, tt.status)
+			}
+			after, _ := a.store.Users.ByID(u.ID)
+			if changed := after.PasswordHash != before.PasswordHash; changed != tt.upgrade {
+				t.Fatalf("hash changed = %v, want %v", changed, tt.upgrade)
+			}
+			if tt.upgrade {
+				if !strings.HasPrefix(after.PasswordHash, "$argon2id$") {
+					t.Errorf("hash = %s, want argon2id", after.PasswordHash)
+				}
+				if ok, rehash := password.Verify(after.PasswordHash, tt.pass); !ok || rehash {
+					t.Errorf("Verify new hash = %v, %v", ok, rehash)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jenfonro/meowfilm/internal/proxy"
+)
+
+// Requests with unsafe methods must come from our own origin, and those made
+// by a signed-in browser must also echo the CSRF token handed out by
+// /api/bootstrap in the X-CSRF-Token header. The token is the value of a
+// per-browser cookie, so it does not change when the user logs in or out.
+// Bearer-token requests carry no ambient credentials and are exempt.
+
+const (
+	CSRFCookieName = "meowfilm_csrf"
+	CSRFHeader     = "X-CSRF-Token"
+)
+
+// CSRFToken returns the browser's CSRF token, issuing the cookie first if
+// the request has none.
+func (a *Auth) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(CSRFCookieName); err == nil && len(c.Value) == 43 {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   a.secureCookie(r),
+	})
+	return token
+}
+
+// CSRF rejects cross-site state-changing requests. It must run inside
+// Middleware, which resolves the user.
+func (a *Auth) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if readBearer(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.sameOrigin(r) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请求来源无效"})
+			return
+		}
+		if CurrentUser(r) != nil && !csrfTokenMatches(r) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "安全校验失败，请刷新页面后重试", "csrf": true})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func csrfTokenMatches(r *http.Request) bool {
+	c, err := r.Cookie(CSRFCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	sent := strings.TrimSpace(r.Header.Get(CSRFHeader))
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) == 1
+}
+
+// sameOrigin checks Origin, or Referer when Origin is missing, against the
+// origin the request was sent to and the configured trusted origins.
+// Requests with neither header do not come from a browser form or script
+// and are let through.
+func (a *Auth) sameOrigin(r *http.Request) bool {
+	origin := strings.TrimSpace(r.Header.Get("Origin"))
+	if origin == "" {
+		ref := strings.TrimSpace(r.Header.Get("Referer"))
+		if ref == "" {
+			return true
+		}
+		u, err := url.Parse(ref)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	origin = normalizeOrigin(origin)
+	if origin == normalizeOrigin(proxy.Scheme(r)+"://"+r.Host) {
+		return true
+	}
+	for _, o := range a.trustedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+}
+
+// ParseTrustedOrigins reads a comma-separated list of origins such as
+// "https://film.example.com" that may send requests besides our own.
+func ParseTrustedOrigins(spec string) []string {
+	var out []string
+	for _, part := range strings.Split(spec, ",") {
+		if o := normalizeOrigin(part); o != "" {
+			out = append(out, o)
+		}
+	}
+	return out
+}
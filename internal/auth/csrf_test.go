@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCSRF(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	a.trustedOrigins = ParseTrustedOrigins("https://film.example.org/")
+
+	rec := httptest.NewRecorder()
+	if res := a.Login(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), "alice", "right-pass-1", false); res.Status != http.StatusOK {
+		t.Fatalf("Login = %d %q", res.Status, res.Message)
+	}
+	session := rec.Result().Cookies()
+	rec = httptest.NewRecorder()
+	token := a.CSRFToken(rec, httptest.NewRequest(http.MethodGet, "/api/bootstrap", nil))
+	csrfCookie := rec.Result().Cookies()
+	if len(token) != 43 || len(csrfCookie) != 1 || csrfCookie[0].Value != token {
+		t.Fatalf("CSRFToken = %q, cookies %v", token, csrfCookie)
+	}
+	bearer, _, err := a.CreateAPIToken(u.ID, "ci", []string{ScopeFull}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := a.Middleware(a.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	tests := []struct {
+		name     string
+		method   string
+		signedIn bool
+		header   string
+		origin   string
+		referer  string
+		bearer   bool
+		want     int
+	}{
+		{name: "GET needs nothing", method: http.MethodGet, signedIn: true, origin: "https://evil.example", want: http.StatusOK},
+		{name: "signed in with token", method: http.MethodPost, signedIn: true, header: token, origin: "http://example.com", want: http.StatusOK},
+		{name: "signed in without token", method: http.MethodPost, signedIn: true, origin: "http://example.com", want: http.StatusForbidden},
+		{name: "signed in with wrong token", method: http.MethodDelete, signedIn: true, header: token[1:] + "x", want: http.StatusForbidden},
+		{name: "token without origin headers", method: http.MethodPost, signedIn: true, header: token, want: http.StatusOK},
+		{name: "anonymous needs no token", method: http.MethodPost, origin: "http://example.com", want: http.StatusOK},
+		{name: "cross-site origin", method: http.MethodPost, signedIn: true, header: token, origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "cross-site anonymous", method: http.MethodPost, origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "origin case and slash ignored", method: http.MethodPost, signedIn: true, header: token, origin: "HTTP://Example.com/", want: http.StatusOK},
+		{name: "trusted origin", method: http.MethodPut, signedIn: true, header: token, origin: "https://film.example.org", want: http.StatusOK},
+		{name: "same-site referer", method: http.MethodPost, signedIn: true, header: token, referer: "http://example.com/settings", want: http.StatusOK},
+		{name: "cross-site referer", method: http.MethodPost, signedIn: true, header: token, referer: "https://evil.example/x", want: http.StatusForbidden},
+		{name: "referer without host", method: http.MethodPost, referer: "/settings", want: http.StatusForbidden},
+		{name: "bearer token exempt", method: http.MethodPost, bearer: true, origin: "https://evil.example", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/user/settings", nil)
+			if tt.signedIn {
+				for _, c := range append(session, csrfCookie...) {
+					r.AddCookie(c)
+				}
+			}
+			if tt.header != "" {
+				r.Header.Set(CSRFHeader, tt.header)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer "+bearer)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	// The cookie is reused rather than replaced.
+	r := httptest.NewRequest(http.MethodGet, "/api/bootstrap", nil)
+	r.AddCookie(csrfCookie[0])
+	rec = httptest.NewRecorder()
+	if got := a.CSRFToken(rec, r); got != token || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("CSRFToken with cookie = %q, set %v", got, rec.Result().Cookies())
+	}
+}
+
+func TestParseTrustedOrigins(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"", nil},
+		{"https://A.example/", []string{"https://a.example"}},
+		{" https://a.example , ,http://b.example:8080", []string{"https://a.example", "http://b.example:8080"}},
+	}
+	for _, tt := range tests {
+		if got := ParseTrustedOrigins(tt.spec); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTrustedOrigins(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
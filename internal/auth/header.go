@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// HeaderAuth signs in requests by a username header set by a forward-auth
+// proxy such as Authelia or Authentik. Only requests from trusted proxies are
+// considered; without the header the cookie session applies as usual.
+type HeaderAuth struct {
+	UserHeader   string
+	GroupsHeader string
+	// GroupRoles maps group names onto roles; the most privileged match wins.
+	GroupRoles map[string]string
+	// DefaultRole applies when no group matches. Empty refuses the user.
+	DefaultRole string
+	AutoCreate  bool
+	// SyncRole lets the groups demote existing users too. Without it a
+	// mapped role only replaces one it grants everything of. The last
+	// active user with full access is never demoted.
+	SyncRole bool
+	// TrustMFA accepts the header alone for users who have or need 2FA,
+	// for proxies that enforce their own second factor.
+	TrustMFA bool
+}
+
+// HeaderAuthFromEnv reads MEOWFILM_AUTH_HEADER and related variables. It
+// returns nil when header authentication is off.
+func HeaderAuthFromEnv() (*HeaderAuth, error) {
+	user := strings.TrimSpace(os.Getenv("MEOWFILM_AUTH_HEADER"))
+	if user == "" {
+		return nil, nil
+	}
+	h := &HeaderAuth{
+		UserHeader:   user,
+		GroupsHeader: strings.TrimSpace(os.Getenv("MEOWFILM_AUTH_GROUPS_HEADER")),
+		GroupRoles:   map[string]string{},
+		DefaultRole:  "user",
+		AutoCreate:   os.Getenv("MEOWFILM_AUTH_AUTO_CREATE") == "1",
+		SyncRole:     os.Getenv("MEOWFILM_AUTH_SYNC_ROLE") == "1",
+		TrustMFA:     os.Getenv("MEOWFILM_AUTH_TRUST_MFA") == "1",
+	}
+	if v, ok := os.LookupEnv("MEOWFILM_AUTH_DEFAULT_ROLE"); ok {
+		h.DefaultRole = strings.TrimSpace(v)
+		if h.DefaultRole == "none" {
+			h.DefaultRole = ""
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("MEOWFILM_AUTH_GROUP_ROLES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, ":")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("MEOWFILM_AUTH_GROUP_ROLES：无效的映射 %q", pair)
+		}
+		h.GroupRoles[group] = role
+	}
+	return h, nil
+}
+
+// CheckHeaderRoles reports header-auth settings that name roles which do
+// not exist. Roles deleted later are skipped when mapping.
+func (a *Auth) CheckHeaderRoles() error {
+	h := a.header
+	if h == nil {
+		return nil
+	}
+	if h.DefaultRole != "" && a.RoleRank(h.DefaultRole) == 0 {
+		return fmt.Errorf("MEOWFILM_AUTH_DEFAULT_ROLE：未知角色 %q", h.DefaultRole)
+	}
+	for group, role := range h.GroupRoles {
+		if a.RoleRank(role) == 0 {
+			return fmt.Errorf("MEOWFILM_AUTH_GROUP_ROLES：组 %q 映射到未知角色 %q", group, role)
+		}
+	}
+	return nil
+}
+
+// headerRole maps the groups header onto a role, or "" when the user has
+// none.
+func (a *Auth) headerRole(r *http.Request) string {
+	h, best := a.header, ""
+	if h.GroupsHeader != "" {
+		groups := strings.FieldsFunc(r.Header.Get(h.GroupsHeader), func(c rune) bool { return c == ',' || c == '|' })
+		for _, g := range groups {
+			if role := h.GroupRoles[strings.TrimSpace(g)]; a.RoleRank(role) > a.RoleRank(best) {
+				best = role
+			}
+		}
+	}
+	if best == "" && a.RoleRank(h.DefaultRole) > 0 {
+		best = h.DefaultRole
+	}
+	return best
+}
+
+// headerMayChangeRole reports whether the groups header may move u to role.
+// Changes that take nothing away always apply; others need SyncRole and
+// must leave another active user with full access.
+func (a *Auth) headerMayChangeRole(u store.User, role string) (bool, error) {
+	next := a.rolePermissions(role)
+	if lost := slices.ContainsFunc(a.rolePermissions(u.Role), func(p string) bool { return !slices.Contains(next, p) }); !lost {
+		return true, nil
+	}
+	if !a.header.SyncRole {
+		return false, nil
+	}
+	if a.FullAccess(role) {
+		return true, nil
+	}
+	last, err := a.LastFullAccessUser(u)
+	return err == nil && !last, err
+}
+
+var (
+	errHeaderUserRefused = errors.New("header user refused")
+	// errHeaderSecondFactor comes with the user the header names when they
+	// still have to pass their second factor.
+	errHeaderSecondFactor = errors.New("header user needs a second factor")
+)
+
+// headerUser resolves the user named by the proxy header. It returns
+// store.ErrNotFound when the request carries no such header.
+func (a *Auth) headerUser(r *http.Request) (*User, error) {
+	h := a.header
+	if h == nil || !proxy.ViaTrustedProxy(r) {
+		return nil, store.ErrNotFound
+	}
+	username := strings.TrimSpace(r.Header.Get(h.UserHeader))
+	if username == "" {
+		return nil, store.ErrNotFound
+	}
+	role := a.headerRole(r)
+	if role == "" {
+		return nil, errHeaderUserRefused
+	}
+
+	u, err := a.store.Users.ByUsername(username)
+	switch {
+	case errors.Is(err, store.ErrNotFound) && h.AutoCreate:
+		u = store.User{Username: username, Role: role, Status: "active"}
+		if u.ID, err = a.store.Users.Create(u); errors.Is(err, store.ErrConflict) {
+			// Created by a concurrent request.
+			u, err = a.store.Users.ByUsername(username)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case errors.Is(err, store.ErrNotFound):
+		return nil, errHeaderUserRefused
+	case err != nil:
+		return nil, err
+	case h.GroupsHeader != "" && u.Role != role:
+		ok, err := a.headerMayChangeRole(u, role)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := a.store.Users.Update(u.ID, store.UserPatch{Role: &role}); err != nil {
+				return nil, err
+			}
+			u.Role = role
+		}
+	}
+	if !h.TrustMFA {
+		if enabled := a.TwoFactorEnabled(u.ID); enabled || a.TwoFactorRequired(u.Role) {
+			return a.newUser(u), errHeaderSecondFactor
+		}
+	}
+	return a.newUser(u), nil
+}
+
+// HeaderLoginPending reports whether the request carries a forward-auth
+// header whose user has to sign in with their second factor first.
+func HeaderLoginPending(r *http.Request) bool {
+	v, _ := r.Context().Value(headerPendingKey).(bool)
+	return v && CurrentUser(r) == nil
+}
+
+// HeaderLogin starts the sign-in of the user named by the forward-auth
+// header. The proxy stands in for the password, so users who have or need
+// 2FA get a challenge; others are already signed in by the header.
+func (a *Auth) HeaderLogin(w http.ResponseWriter, r *http.Request, remember bool) LoginResult {
+	u, err := a.headerUser(r)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return LoginResult{Status: http.StatusBadRequest, Message: "未通过反代认证"}
+	case errors.Is(err, errHeaderUserRefused):
+		return LoginResult{Status: http.StatusForbidden, Message: "该账号未被授权访问"}
+	case err == nil:
+		return LoginResult{Status: http.StatusOK}
+	case !errors.Is(err, errHeaderSecondFactor):
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+	}
+	user, err := a.store.Users.ByID(u.ID)
+	if err != nil {
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+	}
+	if user.Status != "active" {
+		return LoginResult{Status: http.StatusForbidden, Message: "该账户已禁用"}
+	}
+	return a.SignIn(w, r, user, remember)
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// enableTOTP enrolls userID in 2FA and returns a function giving the
+// current code.
+func enableTOTP(t *testing.T, a *Auth, userID int64) func() string {
+	t.Helper()
+	key := []byte("12345678901234567890")
+	if err := a.store.TwoFactor.Put(store.TwoFactor{UserID: userID, Secret: totpEncoding.EncodeToString(key), Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	return func() string { return totpCode(key, time.Now().Unix()/totpStep) }
+}
+
+// headerServer serves the header-auth middleware behind a proxy trusting
+// 127.0.0.1 and records who each request was signed in as.
+func headerServer(t *testing.T, a *Auth, trustMFA bool) (http.Handler, *string) {
+	t.Helper()
+	a.header = &HeaderAuth{UserHeader: "Remote-User", DefaultRole: "user", TrustMFA: trustMFA}
+	tr, err := proxy.ParseTrusted("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	who := new(string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login/header", func(w http.ResponseWriter, r *http.Request) {
+		res := a.HeaderLogin(w, r, false)
+		if res.TwoFactor != nil {
+			w.Header().Set("X-Challenge", res.TwoFactor.ID)
+		}
+		w.WriteHeader(res.Status)
+	})
+	mux.HandleFunc("/api/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(a.LoginSecondFactor(w, r, r.URL.Query().Get("challenge"), r.URL.Query().Get("code")).Status)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		*who = ""
+		if u := CurrentUser(r); u != nil {
+			*who = u.Username
+		}
+		if HeaderLoginPending(r) {
+			*who += "(pending)"
+		}
+	})
+	return tr.Middleware(a.Middleware(mux)), who
+}
+
+func headerRequest(method, target, user string, cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if user != "" {
+		r.Header.Set("Remote-User", user)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestHeaderAuth(t *testing.T) {
+	a, alice := newTestAuth(t, "alice", "right-pass-1")
+	h, who := headerServer(t, a, false)
+
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "alice", nil))
+	if *who != "alice" {
+		t.Fatalf("without 2FA the header signs in: got %q", *who)
+	}
+
+	next := enableTOTP(t, a, alice.ID)
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "alice", nil))
+	if *who != "(pending)" {
+		t.Fatalf("with 2FA the header alone must not sign in: got %q", *who)
+	}
+
+	// A session of another user does not count for alice.
+	bob := store.User{Username: "bob", Role: "user", Status: "active"}
+	bob.ID, _ = a.store.Users.Create(bob)
+	rec := httptest.NewRecorder()
+	if err := a.StartSession(rec, headerRequest(http.MethodPost, "/", "", nil), bob.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "alice", rec.Result().Cookies()))
+	if *who != "(pending)" {
+		t.Fatalf("bob's session was accepted for alice: got %q", *who)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, headerRequest(http.MethodPost, "/api/login/header", "alice", nil))
+	challenge := rec.Header().Get("X-Challenge")
+	if rec.Code != http.StatusOK || challenge == "" {
+		t.Fatalf("HeaderLogin = %d, challenge %q", rec.Code, challenge)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, headerRequest(http.MethodPost, "/api/login/2fa?challenge="+challenge+"&code="+next(), "alice", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("LoginSecondFactor = %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "alice", cookies))
+	if *who != "alice" {
+		t.Fatalf("after the second factor the session signs in: got %q", *who)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "bob", cookies))
+	if strings.Contains(*who, "alice") {
+		t.Fatalf("alice's session followed a different header user: got %q", *who)
+	}
+}
+
+func TestHeaderAuthTrustMFA(t *testing.T) {
+	a, alice := newTestAuth(t, "alice", "right-pass-1")
+	h, who := headerServer(t, a, true)
+	enableTOTP(t, a, alice.ID)
+	h.ServeHTTP(httptest.NewRecorder(), headerRequest(http.MethodGet, "/", "alice", nil))
+	if *who != "alice" {
+		t.Fatalf("TrustMFA: got %q", *who)
+	}
+}
+
+func TestHeaderRole(t *testing.T) {
+	a, _ := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Roles.Put(store.Role{Name: "ops", Permissions: []string{PermManageUsers, PermViewStats, PermViewAuditLog}})
+	a.header = &HeaderAuth{
+		UserHeader:   "Remote-User",
+		GroupsHeader: "Remote-Groups",
+		GroupRoles:   map[string]string{"admins": "admin", "family": "shared", "ops": "ops", "gone": "deleted-role"},
+		DefaultRole:  "user",
+	}
+	tests := []struct {
+		groups string
+		want   string
+	}{
+		{"", "user"},
+		{"family", "shared"},
+		{"ops", "ops"},
+		{"family, ops", "ops"},
+		{"ops|admins", "admin"},
+		{"gone", "user"},
+		{"strangers", "user"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Remote-Groups", tt.groups)
+		if got := a.headerRole(r); got != tt.want {
+			t.Errorf("headerRole(%q) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+
+	if err := a.CheckHeaderRoles(); err == nil {
+		t.Error("CheckHeaderRoles accepted a mapping to a missing role")
+	}
+	delete(a.header.GroupRoles, "gone")
+	if err := a.CheckHeaderRoles(); err != nil {
+		t.Errorf("CheckHeaderRoles: %v", err)
+	}
+	a.header.DefaultRole = "deleted-role"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if got := a.headerRole(r); got != "" {
+		t.Errorf("headerRole with a missing default role = %q, want refusal", got)
+	}
+}
+
+func TestHeaderRoleChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		sync   bool
+		role   string // alice's role before the request
+		groups string
+		// otherAdmin is the status of a second admin, "" for none.
+		otherAdmin string
+		want       string
+	}{
+		{name: "promotes", role: "user", groups: "family", want: "shared"},
+		{name: "keeps a role without sync", role: "shared", groups: "", want: "shared"},
+		{name: "keeps the admin without sync", role: "admin", groups: "strangers", otherAdmin: "active", want: "admin"},
+		{name: "demotes with sync", sync: true, role: "shared", groups: "", want: "user"},
+		{name: "demotes an admin with another admin", sync: true, role: "admin", groups: "family", otherAdmin: "active", want: "shared"},
+		{name: "keeps the last admin", sync: true, role: "admin", groups: "family", want: "admin"},
+		{name: "a banned admin does not count", sync: true, role: "admin", groups: "family", otherAdmin: "banned", want: "admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, alice := newTestAuth(t, "alice", "right-pass-1")
+			_ = a.store.Users.Update(alice.ID, store.UserPatch{Role: &tt.role})
+			if tt.otherAdmin != "" {
+				_, _ = a.store.Users.Create(store.User{Username: "root", Role: "admin", Status: tt.otherAdmin})
+			}
+			h, _ := headerServer(t, a, true)
+			a.header.GroupsHeader = "Remote-Groups"
+			a.header.GroupRoles = map[string]string{"admins": "admin", "family": "shared"}
+			a.header.SyncRole = tt.sync
+
+			r := headerRequest(http.MethodGet, "/", "alice", nil)
+			r.Header.Set("Remote-Groups", tt.groups)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			got, err := a.store.Users.ByID(alice.ID)
+			if err != nil || got.Role != tt.want {
+				t.Errorf("role = %q, %v; want %q", got.Role, err, tt.want)
+			}
+		})
+	}
+}
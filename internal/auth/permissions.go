@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// Permissions a role can grant.
+const (
+	PermManageUsers          = "manage_users"
+	PermManageRoles          = "manage_roles"
+	PermManageSites          = "manage_sites"
+	PermManagePanCredentials = "manage_pan_credentials"
+	PermManageSettings       = "manage_settings"
+	PermManageBackups        = "manage_backups"
+	PermViewStats            = "view_stats"
+	PermViewAuditLog         = "view_audit_log"
+	// PermUseSharedSites lets a user without their own CatPawOpen browse the
+	// global site list.
+	PermUseSharedSites = "use_shared_sites"
+	// PermUseSharedPan lets a user play with the pan credentials configured
+	// in the dashboard.
+	PermUseSharedPan = "use_shared_pan"
+)
+
+// PermissionInfo describes a permission for the dashboard.
+type PermissionInfo struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+// Permissions lists every permission in display order.
+var Permissions = []PermissionInfo{
+	{PermManageUsers, "管理用户、邀请码与会话"},
+	{PermManageRoles, "管理角色"},
+	{PermManageSites, "管理站点与片源"},
+	{PermManagePanCredentials, "管理网盘凭据"},
+	{PermManageSettings, "管理系统与安全设置"},
+	{PermManageBackups, "管理备份设置与快照"},
+	{PermViewStats, "查看统计"},
+	{PermViewAuditLog, "查看审计日志"},
+	{PermUseSharedSites, "使用公共站点列表"},
+	{PermUseSharedPan, "使用公共网盘凭据"},
+}
+
+// ValidPermission reports whether name is a known permission.
+func ValidPermission(name string) bool {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func allPermissions() []string {
+	out := make([]string, 0, len(Permissions))
+	for _, p := range Permissions {
+		out = append(out, p.Name)
+	}
+	return out
+}
+
+// builtinRoles are the roles every installation has. They cannot be edited
+// or deleted.
+var builtinRoles = []store.Role{
+	{Name: "admin", Label: "管理员", Permissions: allPermissions(), Builtin: true},
+	{Name: "shared", Label: "共享用户", Permissions: []string{PermUseSharedSites, PermUseSharedPan}, Builtin: true},
+	{Name: "user", Label: "普通用户", Permissions: []string{}, Builtin: true},
+}
+
+// BuiltinRole returns the built-in role called name.
+func BuiltinRole(name string) (store.Role, bool) {
+	for _, r := range builtinRoles {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return store.Role{}, false
+}
+
+// BuiltinRoleNames lists the names of the built-in roles.
+func BuiltinRoleNames() []string {
+	out := make([]string, 0, len(builtinRoles))
+	for _, r := range builtinRoles {
+		out = append(out, r.Name)
+	}
+	return out
+}
+
+// Role looks up a built-in or custom role.
+func (a *Auth) Role(name string) (store.Role, error) {
+	if r, ok := BuiltinRole(name); ok {
+		return r, nil
+	}
+	return a.store.Roles.Get(name)
+}
+
+// RoleRank orders roles by privilege, for picking the most privileged of
+// several mapped roles: the more permissions a role grants the higher it
+// ranks, so admin comes first. Roles that do not exist rank 0.
+func (a *Auth) RoleRank(name string) int {
+	if name == "" {
+		return 0
+	}
+	r, err := a.Role(name)
+	if err != nil {
+		return 0
+	}
+	return len(r.Permissions) + 1
+}
+
+// FullAccess reports whether the role called name grants every permission,
+// as admin does. Roles that do not exist grant nothing.
+func (a *Auth) FullAccess(name string) bool {
+	r, err := a.Role(name)
+	if err != nil {
+		return false
+	}
+	for _, p := range allPermissions() {
+		if !slices.Contains(r.Permissions, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Roles returns the built-in roles followed by the custom ones.
+func (a *Auth) Roles() ([]store.Role, error) {
+	custom, err := a.store.Roles.List()
+	if err != nil {
+		return nil, err
+	}
+	return append(slices.Clone(builtinRoles), custom...), nil
+}
+
+func (a *Auth) rolePermissions(role string) []string {
+	r, err := a.Role(role)
+	if err != nil {
+		return []string{}
+	}
+	return r.Permissions
+}
+
+// Can reports whether the user's role grants perm.
+func (u *User) Can(perm string) bool {
+	return u != nil && slices.Contains(u.Permissions, perm)
+}
+
+// CanAll reports whether the user holds every permission in perms.
+func (u *User) CanAll(perms []string) bool {
+	for _, p := range perms {
+		if !u.Can(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequirePermission lets the request through only for users whose role
+// grants perm.
+func (a *Auth) RequirePermission(perm string, next http.Handler) http.Handler {
+	return a.requirePermissions([]string{perm}, next)
+}
+
+// LastFullAccessUser reports whether u is the only active user whose role
+// grants every permission. Demoting, banning or deleting that user would
+// leave nobody able to run the dashboard.
+func (a *Auth) LastFullAccessUser(u store.User) (bool, error) {
+	if u.Status != "active" || !a.FullAccess(u.Role) {
+		return false, nil
+	}
+	users, err := a.store.Users.List()
+	if err != nil {
+		return false, err
+	}
+	for _, other := range users {
+		if other.ID != u.ID && other.Status == "active" && a.FullAccess(other.Role) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RequireFullAccess lets the request through only for users holding every
+// permission, for actions that expose or replace all credentials at once,
+// such as downloading or restoring the database.
+func (a *Auth) RequireFullAccess(next http.Handler) http.Handler {
+	return a.requirePermissions(allPermissions(), next)
+}
+
+func (a *Auth) requirePermissions(perms []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := CurrentUser(r)
+		if u == nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]any{"success": false, "message": "Unauthorized"})
+			return
+		}
+		if u.Status != "active" || !u.CanAll(perms) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权限操作"})
+			return
+		}
+		if passwordChangeBlocks(u, r) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请先修改密码", "mustChangePassword": true})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
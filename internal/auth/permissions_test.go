@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestRequirePermission(t *testing.T) {
+	a := New(store.NewMemory(), Options{})
+	if err := a.store.Roles.Put(store.Role{Name: "editor", Label: "编辑", Permissions: []string{PermManageSites, PermViewStats}}); err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		// user is nil for an anonymous request.
+		user *store.User
+		h    http.Handler
+		path string
+		want int
+	}{
+		{name: "anonymous", h: a.RequirePermission(PermManageSites, ok), want: http.StatusUnauthorized},
+		{name: "admin", user: &store.User{Role: "admin", Status: "active"}, h: a.RequirePermission(PermManageSites, ok), want: http.StatusOK},
+		{name: "custom role granted", user: &store.User{Role: "editor", Status: "active"}, h: a.RequirePermission(PermManageSites, ok), want: http.StatusOK},
+		{name: "custom role not granted", user: &store.User{Role: "editor", Status: "active"}, h: a.RequirePermission(PermManageUsers, ok), want: http.StatusForbidden},
+		{name: "plain user", user: &store.User{Role: "user", Status: "active"}, h: a.RequirePermission(PermViewStats, ok), want: http.StatusForbidden},
+		{name: "unknown role", user: &store.User{Role: "gone", Status: "active"}, h: a.RequirePermission(PermViewStats, ok), want: http.StatusForbidden},
+		{name: "disabled admin", user: &store.User{Role: "admin", Status: "disabled"}, h: a.RequirePermission(PermManageSites, ok), want: http.StatusForbidden},
+		{name: "admin must change password", user: &store.User{Role: "admin", Status: "active", MustChangePassword: true}, h: a.RequirePermission(PermManageSites, ok), want: http.StatusForbidden},
+		{name: "password change path allowed", user: &store.User{Role: "admin", Status: "active", MustChangePassword: true}, h: a.RequirePermission(PermManageSites, ok), path: PasswordChangePath, want: http.StatusOK},
+		{name: "full access for admin", user: &store.User{Role: "admin", Status: "active"}, h: a.RequireFullAccess(ok), want: http.StatusOK},
+		{name: "full access denied to partial role", user: &store.User{Role: "editor", Status: "active"}, h: a.RequireFullAccess(ok), want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "/api/dashboard/sites"
+			}
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			var u *User
+			if tt.user != nil {
+				u = a.newUser(*tt.user)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+	u := &User{Permissions: []string{PermManageSites, PermViewStats}}
+	tests := []struct {
+		name  string
+		user  *User
+		perms []string
+		want  bool
+	}{
+		{"none asked", u, nil, true},
+		{"one held", u, []string{PermViewStats}, true},
+		{"all held", u, []string{PermManageSites, PermViewStats}, true},
+		{"one missing", u, []string{PermManageSites, PermManageUsers}, false},
+		{"nil user", nil, []string{PermViewStats}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.CanAll(tt.perms); got != tt.want {
+				t.Errorf("CanAll(%v) = %v, want %v", tt.perms, got, tt.want)
+			}
+			if len(tt.perms) == 1 && tt.user.Can(tt.perms[0]) != tt.want {
+				t.Errorf("Can(%s) != %v", tt.perms[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleRank(t *testing.T) {
+	a := New(store.NewMemory(), Options{})
+	if err := a.store.Roles.Put(store.Role{Name: "editor", Label: "编辑", Permissions: []string{PermManageSites, PermViewStats, PermViewAuditLog}}); err != nil {
+		t.Fatal(err)
+	}
+	order := []string{"admin", "editor", "shared", "user"}
+	for i := 1; i < len(order); i++ {
+		if a.RoleRank(order[i-1]) <= a.RoleRank(order[i]) {
+			t.Errorf("%s does not rank above %s", order[i-1], order[i])
+		}
+	}
+	for _, name := range []string{"", "gone"} {
+		if got := a.RoleRank(name); got != 0 {
+			t.Errorf("RoleRank(%q) = %d, want 0", name, got)
+		}
+	}
+	if a.RoleRank("user") <= 0 {
+		t.Error("a role without permissions should still outrank an unknown one")
+	}
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// ErrNoSession is returned by SwitchProfile for requests that did not sign in
+// with a session cookie, such as those using an access token.
+var ErrNoSession = errors.New("no session")
+
+// CheckProfilePIN verifies pin for p, which passes when p has no PIN. Wrong
+// PINs count towards the login backoff and lockout of that profile; while it
+// is locked the PIN is not checked and the wait is returned.
+func (a *Auth) CheckProfilePIN(p store.Profile, pin string) (bool, time.Duration) {
+	if p.PINHash == "" {
+		return true, 0
+	}
+	policy, now := LoadLoginPolicy(a.store.Settings), time.Now().UnixMilli()
+	key := strconv.FormatInt(p.UserID, 10) + ":" + strconv.FormatInt(p.ID, 10)
+	if f, err := a.store.LoginFailures.Get(store.LoginScopeProfile, key); err == nil {
+		if wait := policy.retryAfter(f, now); wait > 0 {
+			return false, wait
+		}
+	}
+	if ok, _ := password.Verify(p.PINHash, pin); !ok {
+		a.recordFailure(policy, store.LoginScopeProfile, key, now)
+		return false, 0
+	}
+	_ = a.store.LoginFailures.Delete(store.LoginScopeProfile, key)
+	return true, 0
+}
+
+// SwitchProfile makes profileID the active profile of the request's session.
+// The caller checks that the profile exists and its PIN.
+func (a *Auth) SwitchProfile(r *http.Request, profileID int64) error {
+	id := SessionID(r)
+	if id == 0 {
+		return ErrNoSession
+	}
+	return a.store.Tokens.SetProfile(id, profileID)
+}
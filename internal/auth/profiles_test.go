@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestCheckProfilePIN(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Settings.Set("login_max_failures", "2")
+	_ = a.store.Settings.Set("login_backoff_seconds", "0")
+	hash, err := password.Hash("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := store.Profile{UserID: u.ID, ID: 1, PINHash: hash}
+	other := store.Profile{UserID: u.ID, ID: 2, PINHash: hash}
+
+	if ok, wait := a.CheckProfilePIN(store.Profile{UserID: u.ID, ID: 3}, ""); !ok || wait != 0 {
+		t.Errorf("no PIN = %v, %v; want it to pass", ok, wait)
+	}
+	for i := 1; i <= 2; i++ {
+		if ok, wait := a.CheckProfilePIN(kid, "0000"); ok || wait != 0 {
+			t.Fatalf("attempt %d = %v, %v", i, ok, wait)
+		}
+	}
+	if ok, wait := a.CheckProfilePIN(kid, "1234"); ok || wait <= 0 {
+		t.Errorf("locked = %v, %v; want a wait", ok, wait)
+	}
+	// The lockout is per profile and leaves the password login alone.
+	if ok, wait := a.CheckProfilePIN(other, "1234"); !ok || wait != 0 {
+		t.Errorf("other profile = %v, %v", ok, wait)
+	}
+	if _, err := a.store.LoginFailures.Get(store.LoginScopeUser, "alice"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user failures: %v, want none", err)
+	}
+}
+
+func TestSwitchProfileNeedsSession(t *testing.T) {
+	a, _ := newTestAuth(t, "alice", "right-pass-1")
+	err := a.SwitchProfile(httptest.NewRequest(http.MethodPost, "/api/profiles/switch", nil), 1)
+	if !errors.Is(err, ErrNoSession) {
+		t.Errorf("SwitchProfile = %v, want ErrNoSession", err)
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// sessionTouchInterval throttles last-seen writes, and with them renewals,
+// for busy sessions.
+const sessionTouchInterval = time.Minute
+
+// SessionPolicy bounds how long a login session lasts. Every request slides
+// the expiry to Idle (ShortIdle without "remember me") past the last
+// activity, but never beyond Absolute after the login.
+type SessionPolicy struct {
+	Absolute  time.Duration // 0 means no limit
+	Idle      time.Duration
+	ShortIdle time.Duration
+}
+
+// Defaults used when the session_* settings are unset.
+const (
+	DefaultSessionAbsoluteDays   = 90
+	DefaultSessionIdleDays       = 30
+	DefaultSessionShortIdleHours = 12
+)
+
+// LoadSessionPolicy reads the policy from the session_absolute_days,
+// session_idle_days and session_short_idle_hours settings.
+func LoadSessionPolicy(settings store.SettingsRepo) SessionPolicy {
+	get := func(key string, def, least int) int {
+		n, err := strconv.Atoi(strings.TrimSpace(settings.Get(key)))
+		if err != nil || n < least {
+			return def
+		}
+		return n
+	}
+	return SessionPolicy{
+		Absolute:  time.Duration(get("session_absolute_days", DefaultSessionAbsoluteDays, 0)) * 24 * time.Hour,
+		Idle:      time.Duration(get("session_idle_days", DefaultSessionIdleDays, 1)) * 24 * time.Hour,
+		ShortIdle: time.Duration(get("session_short_idle_hours", DefaultSessionShortIdleHours, 1)) * time.Hour,
+	}
+}
+
+// expiry is when a session created at createdAt and last seen at lastSeenAt
+// ends under p.
+func (p SessionPolicy) expiry(createdAt, lastSeenAt int64, remember bool) int64 {
+	idle := p.ShortIdle
+	if remember {
+		idle = p.Idle
+	}
+	exp := lastSeenAt + idle.Milliseconds()
+	if p.Absolute > 0 {
+		exp = min(exp, createdAt+p.Absolute.Milliseconds())
+	}
+	return exp
+}
+
+// cookieMaxAge is the Max-Age for a session cookie expiring at expiresAt.
+// Sessions without "remember me" get a browser-session cookie.
+func cookieMaxAge(remember bool, expiresAt, now int64) int {
+	if !remember {
+		return 0
+	}
+	return int(max((expiresAt-now)/1000, 1))
+}
+
+// maxUserAgentLen caps the user agent stored with a session.
+const maxUserAgentLen = 512
+
+// tokenDigest is how session cookies and personal access tokens are stored,
+// so a copy of the database cannot be replayed as credentials.
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SessionID returns the ID of the login session that authenticated r, or 0.
+func SessionID(r *http.Request) int64 {
+	if r == nil {
+		return 0
+	}
+	id, _ := r.Context().Value(sessionKey).(int64)
+	return id
+}
+
+func userAgent(r *http.Request) string {
+	ua := strings.TrimSpace(r.UserAgent())
+	if len(ua) > maxUserAgentLen {
+		ua = ua[:maxUserAgentLen]
+	}
+	return ua
+}
+
+// resolveSession looks up the session for a cookie value. The session is
+// returned even when its user is gone, so the caller can delete it.
+func (a *Auth) resolveSession(token string) (store.Token, *User) {
+	sess, err := a.store.Tokens.ByHash(tokenDigest(token))
+	if err != nil {
+		return store.Token{}, nil
+	}
+	u, err := a.store.Users.ByID(sess.UserID)
+	if err != nil {
+		return sess, nil
+	}
+	user := a.newUser(u)
+	user.ProfileID = sess.ProfileID
+	return sess, user
+}
+
+// touchSession records activity on sess and slides its expiry, refreshing
+// the cookie of a remembered session to match.
+func (a *Auth) touchSession(w http.ResponseWriter, r *http.Request, sess store.Token, token string, policy SessionPolicy) {
+	now := time.Now().UnixMilli()
+	ip, ua := proxy.ClientIP(r), userAgent(r)
+	if now-sess.LastSeenAt < sessionTouchInterval.Milliseconds() && ip == sess.IP && ua == sess.UserAgent {
+		return
+	}
+	exp := policy.expiry(sess.CreatedAt, now, sess.Remember)
+	if err := a.store.Tokens.Touch(sess.ID, now, exp, ip, ua); err != nil {
+		return
+	}
+	if sess.Remember {
+		writeCookie(w, token, a.secureCookie(r), cookieMaxAge(true, exp, now))
+	}
+}
+
+func (a *Auth) deleteSession(id int64) {
+	_ = a.store.Tokens.Delete(id)
+}
+
+// StartSession signs userID in on w. Without remember the cookie ends with
+// the browser session.
+func (a *Auth) StartSession(w http.ResponseWriter, r *http.Request, userID int64, remember bool) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UnixMilli()
+	exp := LoadSessionPolicy(a.store.Settings).expiry(now, now, remember)
+	_, err := a.store.Tokens.Create(store.Token{
+		Hash:       tokenDigest(token),
+		UserID:     userID,
+		CreatedAt:  now,
+		ExpiresAt:  exp,
+		LastSeenAt: now,
+		UserAgent:  userAgent(r),
+		IP:         proxy.ClientIP(r),
+		Remember:   remember,
+	})
+	if err != nil {
+		return err
+	}
+	writeCookie(w, token, a.secureCookie(r), cookieMaxAge(remember, exp, now))
+	return nil
+}
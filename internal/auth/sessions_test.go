@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// sessionRequest is a GET carrying token as the session cookie.
+func sessionRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/user/settings", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	return r
+}
+
+func TestSessionsAreStoredAsDigests(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	rec := httptest.NewRecorder()
+	if err := a.StartSession(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), u.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == CookieName {
+			token = c.Value
+		}
+	}
+	list, err := a.store.Tokens.List(u.ID)
+	if err != nil || len(list) != 1 || token == "" {
+		t.Fatalf("List = %v, %v; cookie %q", list, err, token)
+	}
+	if list[0].Hash != tokenDigest(token) || strings.Contains(list[0].Hash, token) {
+		t.Errorf("stored %q for cookie %q, want its digest only", list[0].Hash, token)
+	}
+	if _, err := a.store.Tokens.ByHash(token); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("ByHash(cookie) = %v, want not found", err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CurrentUser(r) == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	policy := LoadSessionPolicy(a.store.Settings)
+	now := time.Now().UnixMilli()
+	day := (24 * time.Hour).Milliseconds()
+
+	tests := []struct {
+		name       string
+		remember   bool
+		createdAt  int64
+		lastSeenAt int64
+		expiresAt  int64 // 0 takes the policy's expiry
+		ok         bool
+	}{
+		{"fresh", false, now, now, 0, true},
+		{"remembered within idle", true, now - 20*day, now - 20*day, 0, true},
+		// The policy is checked again on every request, so it also ends
+		// sessions stored with a later expiry.
+		{"short idle passed", false, now - day, now - policy.ShortIdle.Milliseconds() - 1, now + day, false},
+		{"remembered idle passed", true, now - 40*day, now - policy.Idle.Milliseconds() - 1, now + day, false},
+		{"absolute passed", true, now - policy.Absolute.Milliseconds() - 1, now, now + day, false},
+		{"stored expiry passed", true, now, now, now - 1, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := "session-" + string(rune('a'+i))
+			exp := tt.expiresAt
+			if exp == 0 {
+				exp = policy.expiry(tt.createdAt, tt.lastSeenAt, tt.remember)
+			}
+			id, err := a.store.Tokens.Create(store.Token{
+				Hash: tokenDigest(token), UserID: u.ID, Remember: tt.remember,
+				CreatedAt: tt.createdAt, LastSeenAt: tt.lastSeenAt, ExpiresAt: exp,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, sessionRequest(token))
+			if got := rec.Code == 200; got != tt.ok {
+				t.Fatalf("signed in = %v, want %v", got, tt.ok)
+			}
+			if _, err := a.store.Tokens.ByID(id); !tt.ok && !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("expired session kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionTouchIsThrottled(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	h := a.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	now := time.Now().UnixMilli()
+	// The IP and user agent match the test request, so only time matters.
+	id, err := a.store.Tokens.Create(store.Token{
+		Hash: tokenDigest("session"), UserID: u.ID, Remember: true,
+		CreatedAt: now, LastSeenAt: now, ExpiresAt: now + time.Hour.Milliseconds(), IP: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveAt := func(lastSeen int64) store.Token {
+		t.Helper()
+		if err := a.store.Tokens.Touch(id, lastSeen, now+time.Hour.Milliseconds(), "192.0.2.1", ""); err != nil {
+			t.Fatal(err)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), sessionRequest("session"))
+		sess, err := a.store.Tokens.ByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	recent := now - sessionTouchInterval.Milliseconds()/2
+	if sess := serveAt(recent); sess.LastSeenAt != recent || sess.ExpiresAt != now+time.Hour.Milliseconds() {
+		t.Errorf("touched within the interval: %+v", sess)
+	}
+	stale := now - sessionTouchInterval.Milliseconds()
+	if sess := serveAt(stale); sess.LastSeenAt <= stale || sess.ExpiresAt <= now+time.Hour.Milliseconds() {
+		t.Errorf("not touched after the interval: %+v", sess)
+	}
+}
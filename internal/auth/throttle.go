@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// LoginPolicy controls brute-force protection on login. Every failure makes
+// the next attempt for the same username or client IP wait BackoffBase,
+// doubling each time; reaching the failure limit locks the key for Lockout.
+// Failures are forgotten once Lockout has passed without another one.
+type LoginPolicy struct {
+	MaxFailures   int           `json:"maxFailures"`
+	IPMaxFailures int           `json:"ipMaxFailures"`
+	Lockout       time.Duration `json:"-"`
+	BackoffBase   time.Duration `json:"-"`
+}
+
+// Defaults used when the login_* settings are unset.
+const (
+	DefaultLoginMaxFailures    = 5
+	DefaultLoginIPMaxFailures  = 20
+	DefaultLoginLockoutMinutes = 15
+	DefaultLoginBackoffSeconds = 1
+)
+
+// LoadLoginPolicy reads the policy from the login_max_failures,
+// login_ip_max_failures, login_lockout_minutes and login_backoff_seconds
+// settings. A limit of 0 disables lockout for that scope.
+func LoadLoginPolicy(settings store.SettingsRepo) LoginPolicy {
+	get := func(key string, def int) int {
+		n, err := strconv.Atoi(strings.TrimSpace(settings.Get(key)))
+		if err != nil || n < 0 {
+			return def
+		}
+		return n
+	}
+	return LoginPolicy{
+		MaxFailures:   get("login_max_failures", DefaultLoginMaxFailures),
+		IPMaxFailures: get("login_ip_max_failures", DefaultLoginIPMaxFailures),
+		Lockout:       time.Duration(get("login_lockout_minutes", DefaultLoginLockoutMinutes)) * time.Minute,
+		BackoffBase:   time.Duration(get("login_backoff_seconds", DefaultLoginBackoffSeconds)) * time.Second,
+	}
+}
+
+func (p LoginPolicy) limit(scope string) int {
+	if scope == store.LoginScopeIP {
+		return p.IPMaxFailures
+	}
+	return p.MaxFailures
+}
+
+// backoff is the wait after the given number of consecutive failures.
+func (p LoginPolicy) backoff(failures int) time.Duration {
+	if failures <= 0 || p.BackoffBase <= 0 {
+		return 0
+	}
+	d := time.Duration(float64(p.BackoffBase) * math.Pow(2, float64(min(failures-1, 30))))
+	if p.Lockout > 0 && d > p.Lockout {
+		d = p.Lockout
+	}
+	return d
+}
+
+// current drops failures that have aged out of the policy window.
+func (p LoginPolicy) current(f store.LoginFailure, now int64) store.LoginFailure {
+	if f.LockedUntil > now {
+		return f
+	}
+	if f.LastFailureAt+p.Lockout.Milliseconds() <= now {
+		f.Failures = 0
+	}
+	f.LockedUntil = 0
+	return f
+}
+
+// retryAfter returns how long the key has to wait before its next attempt.
+func (p LoginPolicy) retryAfter(f store.LoginFailure, now int64) time.Duration {
+	f = p.current(f, now)
+	if f.LockedUntil > now {
+		return time.Duration(f.LockedUntil-now) * time.Millisecond
+	}
+	if wait := f.LastFailureAt + p.backoff(f.Failures).Milliseconds() - now; wait > 0 {
+		return time.Duration(wait) * time.Millisecond
+	}
+	return 0
+}
+
+func loginKeys(username, ip string) [][2]string {
+	keys := [][2]string{{store.LoginScopeUser, strings.ToLower(username)}}
+	if ip != "" {
+		keys = append(keys, [2]string{store.LoginScopeIP, ip})
+	}
+	return keys
+}
+
+// loginRetryAfter reports how long a login for username from ip must wait,
+// or 0 if it may proceed.
+func (a *Auth) loginRetryAfter(p LoginPolicy, username, ip string, now int64) time.Duration {
+	var wait time.Duration
+	for _, k := range loginKeys(username, ip) {
+		f, err := a.store.LoginFailures.Get(k[0], k[1])
+		if err != nil {
+			continue
+		}
+		wait = max(wait, p.retryAfter(f, now))
+	}
+	return wait
+}
+
+func (a *Auth) recordLoginFailure(p LoginPolicy, username, ip string, now int64) {
+	for _, k := range loginKeys(username, ip) {
+		a.recordFailure(p, k[0], k[1], now)
+	}
+}
+
+func (a *Auth) recordFailure(p LoginPolicy, scope, key string, now int64) {
+	f, err := a.store.LoginFailures.Get(scope, key)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return
+	}
+	f = p.current(f, now)
+	f.Failures++
+	f.LastFailureAt = now
+	if limit := p.limit(scope); limit > 0 && f.Failures >= limit {
+		f.LockedUntil = now + p.Lockout.Milliseconds()
+	}
+	_ = a.store.LoginFailures.Put(f)
+}
+
+// CheckPassword verifies the current password of u, such as before a
+// sensitive account change. Wrong passwords count towards the same backoff
+// and lockout as failed logins for the username and client IP; while either
+// is locked the password is not checked and the wait is returned.
+func (a *Auth) CheckPassword(r *http.Request, u store.User, pass string) (bool, time.Duration) {
+	ok, wait, _ := a.checkThrottled(r, u.Username, func() (bool, error) {
+		ok, _ := password.Verify(u.PasswordHash, pass)
+		return ok, nil
+	})
+	return ok, wait
+}
+
+// checkThrottled runs check, which verifies something only username should
+// know, under the login backoff: while the username or client IP has to
+// wait, check is skipped and the wait returned. A failed check counts as a
+// failed login and a passing one clears the username's failures.
+func (a *Auth) checkThrottled(r *http.Request, username string, check func() (bool, error)) (bool, time.Duration, error) {
+	policy, ip, now := LoadLoginPolicy(a.store.Settings), proxy.ClientIP(r), time.Now().UnixMilli()
+	if wait := a.loginRetryAfter(policy, username, ip, now); wait > 0 {
+		return false, wait, nil
+	}
+	ok, err := check()
+	if err != nil {
+		return false, 0, err
+	}
+	if !ok {
+		a.recordLoginFailure(policy, username, ip, now)
+		return false, 0, nil
+	}
+	a.clearLoginFailures(username)
+	return true, 0, nil
+}
+
+// CheckFromClient is checkThrottled for steps that have no account to charge
+// yet, such as redeeming an invitation code: only the client IP waits and
+// counts the failure.
+func (a *Auth) CheckFromClient(r *http.Request, check func() (bool, error)) (bool, time.Duration, error) {
+	policy, ip, now := LoadLoginPolicy(a.store.Settings), proxy.ClientIP(r), time.Now().UnixMilli()
+	if ip != "" {
+		if f, err := a.store.LoginFailures.Get(store.LoginScopeIP, ip); err == nil {
+			if wait := policy.retryAfter(f, now); wait > 0 {
+				return false, wait, nil
+			}
+		}
+	}
+	ok, err := check()
+	if err != nil {
+		return false, 0, err
+	}
+	if !ok && ip != "" {
+		a.recordFailure(policy, store.LoginScopeIP, ip, now)
+	}
+	return ok, 0, nil
+}
+
+// clearLoginFailures forgets the username's failures after a successful
+// login. The client IP keeps its count, so one valid account cannot be used
+// to reset the limit while guessing others.
+func (a *Auth) clearLoginFailures(username string) {
+	_ = a.store.LoginFailures.Delete(store.LoginScopeUser, strings.ToLower(username))
+}
+
+func retryAfterMessage(wait time.Duration) string {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs >= 120 {
+		return "登录失败次数过多，请 " + strconv.Itoa((secs+59)/60) + " 分钟后再试"
+	}
+	return "登录失败次数过多，请 " + strconv.Itoa(secs) + " 秒后再试"
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// newTestAuth returns an Auth on a memory store holding one active user.
+func newTestAuth(t *testing.T, username, pass string) (*Auth, store.User) {
+	t.Helper()
+	st := store.NewMemory()
+	hash, err := password.Hash(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := store.User{Username: username, PasswordHash: hash, Role: "user", Status: "active"}
+	if u.ID, err = st.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	return New(st, Options{}), u
+}
+
+func TestCheckPassword(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Settings.Set("login_max_failures", "3")
+	_ = a.store.Settings.Set("login_backoff_seconds", "0")
+	r := httptest.NewRequest(http.MethodPost, "/api/user/password", nil)
+
+	for i := 1; i <= 3; i++ {
+		if ok, wait := a.CheckPassword(r, u, "wrong"); ok || wait != 0 {
+			t.Fatalf("attempt %d: CheckPassword = %v, %v", i, ok, wait)
+		}
+	}
+	if ok, wait := a.CheckPassword(r, u, "right-pass-1"); ok || wait <= 0 {
+		t.Fatalf("locked CheckPassword = %v, %v; want a wait", ok, wait)
+	}
+	if _, wait := a.CheckPassword(r, u, "right-pass-1"); wait <= 0 {
+		t.Fatal("the right password unlocked the account")
+	}
+	res := a.Login(httptest.NewRecorder(), r, "alice", "right-pass-1", false)
+	if res.Status != http.StatusTooManyRequests {
+		t.Errorf("Login after failed password checks = %d, want 429", res.Status)
+	}
+
+	_ = a.store.LoginFailures.Delete(store.LoginScopeUser, "alice")
+	_ = a.store.LoginFailures.Delete(store.LoginScopeIP, "192.0.2.1")
+	if ok, wait := a.CheckPassword(r, u, "right-pass-1"); !ok || wait != 0 {
+		t.Errorf("CheckPassword after unlock = %v, %v", ok, wait)
+	}
+}
+
+func TestLoginPolicyBackoff(t *testing.T) {
+	p := LoginPolicy{BackoffBase: time.Second, Lockout: 15 * time.Minute}
+	tests := []struct {
+		name     string
+		policy   LoginPolicy
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", p, 0, 0},
+		{"first failure", p, 1, time.Second},
+		{"doubles", p, 2, 2 * time.Second},
+		{"keeps doubling", p, 4, 8 * time.Second},
+		{"capped at lockout", p, 20, 15 * time.Minute},
+		{"no backoff configured", LoginPolicy{Lockout: time.Minute}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.backoff(tt.failures); got != tt.want {
+				t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginPolicyRetryAfter(t *testing.T) {
+	p := LoginPolicy{BackoffBase: time.Second, Lockout: 15 * time.Minute}
+	const now = int64(10_000_000)
+	lockout := p.Lockout.Milliseconds()
+	tests := []struct {
+		name string
+		f    store.LoginFailure
+		want time.Duration
+	}{
+		{"no failures", store.LoginFailure{}, 0},
+		{"failure just now", store.LoginFailure{Failures: 1, LastFailureAt: now}, time.Second},
+		{"backoff partly waited", store.LoginFailure{Failures: 1, LastFailureAt: now - 400}, 600 * time.Millisecond},
+		{"backoff over", store.LoginFailure{Failures: 3, LastFailureAt: now - 5000}, 0},
+		{"locked", store.LoginFailure{Failures: 5, LastFailureAt: now, LockedUntil: now + 60_000}, time.Minute},
+		{"lock expired, failures aged out", store.LoginFailure{Failures: 5, LastFailureAt: now - lockout, LockedUntil: now}, 0},
+		{"lock expired, recent failure still backs off", store.LoginFailure{Failures: 5, LastFailureAt: now - 1000, LockedUntil: now - 1}, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.retryAfter(tt.f, now); got != tt.want {
+				t.Errorf("retryAfter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadLoginPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		want     LoginPolicy
+	}{
+		{
+			name: "defaults",
+			want: LoginPolicy{MaxFailures: 5, IPMaxFailures: 20, Lockout: 15 * time.Minute, BackoffBase: time.Second},
+		},
+		{
+			name:     "configured",
+			settings: map[string]string{"login_max_failures": "3", "login_ip_max_failures": " 0 ", "login_lockout_minutes": "60", "login_backoff_seconds": "0"},
+			want:     LoginPolicy{MaxFailures: 3, IPMaxFailures: 0, Lockout: time.Hour, BackoffBase: 0},
+		},
+		{
+			name:     "invalid values fall back",
+			settings: map[string]string{"login_max_failures": "-1", "login_lockout_minutes": "soon"},
+			want:     LoginPolicy{MaxFailures: 5, IPMaxFailures: 20, Lockout: 15 * time.Minute, BackoffBase: time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemory()
+			for k, v := range tt.settings {
+				_ = st.Settings.Set(k, v)
+			}
+			if got := LoadLoginPolicy(st.Settings); got != tt.want {
+				t.Errorf("LoadLoginPolicy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	type attempt struct {
+		username, pass, ip string
+		want               int
+	}
+	const (
+		here  = "192.0.2.1"
+		there = "198.51.100.7"
+	)
+	tests := []struct {
+		name     string
+		settings map[string]string
+		attempts []attempt
+	}{
+		{
+			name:     "user limit locks the username from every address",
+			settings: map[string]string{"login_max_failures": "3", "login_ip_max_failures": "0"},
+			attempts: []attempt{
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 429},
+				{"alice", "alice-pass-1", there, 429},
+				{"bob", "bob-pass-1", here, 200},
+			},
+		},
+		{
+			name:     "IP limit locks every username from the address",
+			settings: map[string]string{"login_max_failures": "0", "login_ip_max_failures": "3"},
+			attempts: []attempt{
+				{"ghost1", "wrong", here, 401},
+				{"ghost2", "wrong", here, 401},
+				{"ghost3", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 429},
+				{"alice", "alice-pass-1", there, 200},
+			},
+		},
+		{
+			name:     "success resets the username count",
+			settings: map[string]string{"login_max_failures": "3", "login_ip_max_failures": "0"},
+			attempts: []attempt{
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 200},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 200},
+			},
+		},
+		{
+			name:     "success keeps the IP count",
+			settings: map[string]string{"login_max_failures": "0", "login_ip_max_failures": "3"},
+			attempts: []attempt{
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 200},
+				{"bob", "wrong", here, 401},
+				{"bob", "bob-pass-1", here, 429},
+			},
+		},
+		{
+			name:     "backoff delays the next attempt",
+			settings: map[string]string{"login_max_failures": "0", "login_ip_max_failures": "0", "login_backoff_seconds": "30"},
+			attempts: []attempt{
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 429},
+				{"bob", "bob-pass-1", there, 200},
+			},
+		},
+		{
+			name:     "zero limits never lock",
+			settings: map[string]string{"login_max_failures": "0", "login_ip_max_failures": "0"},
+			attempts: []attempt{
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "wrong", here, 401},
+				{"alice", "alice-pass-1", here, 200},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAuth(t, "alice", "alice-pass-1")
+			hash, _ := password.Hash("bob-pass-1")
+			if _, err := a.store.Users.Create(store.User{Username: "bob", PasswordHash: hash, Role: "user", Status: "active"}); err != nil {
+				t.Fatal(err)
+			}
+			_ = a.store.Settings.Set("login_backoff_seconds", "0")
+			for k, v := range tt.settings {
+				_ = a.store.Settings.Set(k, v)
+			}
+			for i, at := range tt.attempts {
+				r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+				r.RemoteAddr = at.ip + ":1234"
+				rec := httptest.NewRecorder()
+				res := a.Login(rec, r, at.username, at.pass, false)
+				if res.Status != at.want {
+					t.Fatalf("attempt %d (%s from %s) = %d %q, want %d", i+1, at.username, at.ip, res.Status, res.Message, at.want)
+				}
+				if res.Status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("attempt %d: 429 without Retry-After", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfterMessage(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{1500 * time.Millisecond, "登录失败次数过多，请 2 秒后再试"},
+		{119 * time.Second, "登录失败次数过多，请 119 秒后再试"},
+		{15 * time.Minute, "登录失败次数过多，请 15 分钟后再试"},
+		{121 * time.Second, "登录失败次数过多，请 3 分钟后再试"},
+	}
+	for _, tt := range tests {
+		if got := retryAfterMessage(tt.wait); got != tt.want {
+			t.Errorf("retryAfterMessage(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
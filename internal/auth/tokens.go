@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// Personal access tokens are sent as "Authorization: Bearer mfp_...". Their
+// scopes limit what a request may do:
+//
+//	full          everything the owner can do
+//	read          GET/HEAD requests under /api/
+//	history:read  GET/HEAD on play history, search history and favorites
+//
+// Only full tokens reach /dashboard/: it serves database downloads and
+// decrypted credentials that a read-only token must not expose.
+const (
+	ScopeFull        = "full"
+	ScopeRead        = "read"
+	ScopeHistoryRead = "history:read"
+)
+
+// Scopes lists the valid token scopes.
+var Scopes = []string{ScopeFull, ScopeRead, ScopeHistoryRead}
+
+const apiTokenPrefix = "mfp_"
+
+// apiTokenTouchInterval throttles last_used_at writes.
+const apiTokenTouchInterval = time.Minute
+
+var historyPaths = map[string]bool{
+	"/api/playhistory":      true,
+	"/api/playhistory/one":  true,
+	"/api/searchhistory":    true,
+	"/api/favorites":        true,
+	"/api/favorites/status": true,
+}
+
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIToken issues a personal access token for userID. The returned
+// secret is not stored and cannot be shown again. A zero expiresAt means the
+// token never expires.
+func (a *Auth) CreateAPIToken(userID int64, name string, scopes []string, expiresAt time.Time) (string, store.APIToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", store.APIToken{}, err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	t := store.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Hash:      tokenDigest(secret),
+		Prefix:    secret[:len(apiTokenPrefix)+6],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if !expiresAt.IsZero() {
+		t.ExpiresAt = expiresAt.UnixMilli()
+	}
+	id, err := a.store.APITokens.Create(t)
+	if err != nil {
+		return "", store.APIToken{}, err
+	}
+	t.ID = id
+	return secret, t, nil
+}
+
+// TokenScopes returns the scopes of the personal access token that
+// authenticated r, or nil for cookie sessions and anonymous requests.
+func TokenScopes(r *http.Request) []string {
+	if r == nil {
+		return nil
+	}
+	scopes, _ := r.Context().Value(scopesKey).([]string)
+	return scopes
+}
+
+func readBearer(r *http.Request) string {
+	h := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// serveBearer authenticates a request carrying a bearer token. Unlike a
+// stale cookie, a bad token is rejected outright instead of falling back to
+// an anonymous request.
+func (a *Auth) serveBearer(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	u, scopes := a.resolveAPIToken(token)
+	if u == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="meowfilm"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"success": false, "message": "令牌无效或已过期"})
+		return
+	}
+	if u.Status != "active" {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "该账户已禁用"})
+		return
+	}
+	if !scopeAllows(scopes, r) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "令牌权限不足"})
+		return
+	}
+	ctx := context.WithValue(r.Context(), userKey, u)
+	ctx = context.WithValue(ctx, scopesKey, scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (a *Auth) resolveAPIToken(token string) (*User, []string) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil
+	}
+	t, err := a.store.APITokens.ByHash(tokenDigest(token))
+	if err != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	if t.ExpiresAt > 0 && t.ExpiresAt <= now.UnixMilli() {
+		return nil, nil
+	}
+	u, err := a.store.Users.ByID(t.UserID)
+	if err != nil {
+		return nil, nil
+	}
+	if now.UnixMilli()-t.LastUsedAt >= apiTokenTouchInterval.Milliseconds() {
+		_ = a.store.APITokens.Touch(t.ID, now.UnixMilli())
+	}
+	scopes := t.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeRead}
+	}
+	return a.newUser(u), scopes
+}
+
+func scopeAllows(scopes []string, r *http.Request) bool {
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	for _, s := range scopes {
+		switch s {
+		case ScopeFull:
+			return true
+		case ScopeRead:
+			if readOnly && strings.HasPrefix(r.URL.Path, "/api/") {
+				return true
+			}
+		case ScopeHistoryRead:
+			if readOnly && historyPaths[r.URL.Path] {
+				return true
+			}
+		}
+	}
+	return false
+}
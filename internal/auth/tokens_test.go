@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func bearerRequest(method, target, token string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestBearerScopes(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CurrentUser(r) == nil {
+			w.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	token := func(scope string, expiresAt time.Time) string {
+		secret, _, err := a.CreateAPIToken(u.ID, scope, []string{scope}, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	full := token(ScopeFull, time.Time{})
+	read := token(ScopeRead, time.Time{})
+	history := token(ScopeHistoryRead, time.Time{})
+	expired := token(ScopeFull, time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   int
+	}{
+		{"unknown token", http.MethodGet, "/api/playhistory", "mfp_unknown", http.StatusUnauthorized},
+		{"not a token", http.MethodGet, "/api/playhistory", "abc", http.StatusUnauthorized},
+		{"expired token", http.MethodGet, "/api/playhistory", expired, http.StatusUnauthorized},
+		{"full on dashboard", http.MethodPost, "/dashboard/user/update", full, 200},
+		{"read on api", http.MethodGet, "/api/user/settings", read, 200},
+		{"read HEAD on api", http.MethodHead, "/api/favorites", read, 200},
+		{"read POST", http.MethodPost, "/api/playhistory", read, http.StatusForbidden},
+		{"read on dashboard download", http.MethodGet, "/dashboard/backup/download", read, http.StatusForbidden},
+		{"read on dashboard pan settings", http.MethodGet, "/dashboard/pan/settings", read, http.StatusForbidden},
+		{"history on history", http.MethodGet, "/api/playhistory", history, 200},
+		{"history on favorites", http.MethodGet, "/api/favorites/status", history, 200},
+		{"history outside history", http.MethodGet, "/api/user/settings", history, http.StatusForbidden},
+		{"history POST", http.MethodPost, "/api/searchhistory", history, http.StatusForbidden},
+		{"history on dashboard", http.MethodGet, "/dashboard/backup/download", history, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, bearerRequest(tt.method, tt.target, tt.token))
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestBearerTouchIsThrottled(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	secret, tok, err := a.CreateAPIToken(u.ID, "script", []string{ScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	lastUsed := func() int64 {
+		t.Helper()
+		list, err := a.store.APITokens.ListForUser(u.ID)
+		if err != nil || len(list) != 1 {
+			t.Fatalf("ListForUser = %v, %v", list, err)
+		}
+		return list[0].LastUsedAt
+	}
+	serve := func() {
+		h.ServeHTTP(httptest.NewRecorder(), bearerRequest(http.MethodGet, "/api/playhistory", secret))
+	}
+
+	serve()
+	first := lastUsed()
+	if first == 0 {
+		t.Fatal("first use was not recorded")
+	}
+	// A use within the interval is not written.
+	stale := first - apiTokenTouchInterval.Milliseconds()/2
+	_ = a.store.APITokens.Touch(tok.ID, stale)
+	serve()
+	if got := lastUsed(); got != stale {
+		t.Errorf("last used = %d, want %d left alone", got, stale)
+	}
+	// Once the interval has passed it is.
+	stale = first - apiTokenTouchInterval.Milliseconds()
+	_ = a.store.APITokens.Touch(tok.ID, stale)
+	serve()
+	if got := lastUsed(); got <= stale {
+		t.Errorf("last used = %d, not updated after the interval", got)
+	}
+}
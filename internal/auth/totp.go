@@ -0,0 +1,339 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// TOTP follows RFC 6238 with the parameters authenticator apps assume:
+// HMAC-SHA1, 6 digits and a 30 second step. One step of clock drift is
+// accepted either way.
+const (
+	totpIssuer   = "MeowFilm"
+	totpStep     = 30
+	totpDigits   = 6
+	totpSkew     = 1
+	recoveryKeep = 10
+)
+
+// challengeTTL bounds the time between the password and the second factor.
+const challengeTTL = 5 * time.Minute
+
+// challengeMaxAttempts is how many wrong codes a challenge tolerates.
+const challengeMaxAttempts = 5
+
+var (
+	ErrTOTPNotPending = errors.New("totp enrollment not pending")
+	ErrTOTPInvalid    = errors.New("invalid totp code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorRoles returns the roles that must use two-factor login, from the
+// comma-separated "totp_required_roles" setting.
+func TwoFactorRoles(settings store.SettingsRepo) []string {
+	out := []string{}
+	for _, role := range strings.Split(settings.Get("totp_required_roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			out = append(out, role)
+		}
+	}
+	return out
+}
+
+// TwoFactorRequired reports whether users with role must use two-factor login.
+func (a *Auth) TwoFactorRequired(role string) bool {
+	for _, r := range TwoFactorRoles(a.store.Settings) {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPProvisioning is what an authenticator app needs to enroll.
+type TOTPProvisioning struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUrl"`
+}
+
+// BeginTOTP stores a fresh, not yet enabled secret for the user, replacing
+// any pending one. It must not be called for users with 2FA enabled.
+func (a *Auth) BeginTOTP(userID int64, username string) (TOTPProvisioning, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return TOTPProvisioning{}, err
+	}
+	secret := totpEncoding.EncodeToString(b)
+	err := a.store.TwoFactor.Put(store.TwoFactor{UserID: userID, Secret: secret, CreatedAt: time.Now().UnixMilli()})
+	if err != nil {
+		return TOTPProvisioning{}, err
+	}
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpStep))
+	return TOTPProvisioning{Secret: secret, URI: "otpauth://totp/" + label + "?" + q.Encode()}, nil
+}
+
+// ConfirmTOTP enables the pending enrollment once code matches it and returns
+// the new recovery codes. Wrong codes count towards the login backoff of the
+// user and client IP, like CheckPassword; while either has to wait the code
+// is not checked and the wait is returned.
+func (a *Auth) ConfirmTOTP(r *http.Request, userID int64, code string) ([]string, time.Duration, error) {
+	t, err := a.store.TwoFactor.Get(userID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && t.Enabled) {
+		return nil, 0, ErrTOTPNotPending
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	u, err := a.store.Users.ByID(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	var step int64
+	ok, wait, err := a.checkThrottled(r, u.Username, func() (bool, error) {
+		var ok bool
+		step, ok = matchTOTP(t.Secret, code, time.Now())
+		return ok, nil
+	})
+	if wait > 0 || err != nil {
+		return nil, wait, err
+	}
+	if !ok {
+		return nil, 0, ErrTOTPInvalid
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, 0, err
+	}
+	t.Enabled = true
+	t.LastStep = step
+	t.RecoveryCodes = hashes
+	if err := a.store.TwoFactor.Put(t); err != nil {
+		return nil, 0, err
+	}
+	return codes, 0, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes.
+func (a *Auth) RegenerateRecoveryCodes(userID int64) ([]string, error) {
+	t, err := a.store.TwoFactor.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Enabled {
+		return nil, ErrTOTPNotPending
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	t.RecoveryCodes = hashes
+	return codes, a.store.TwoFactor.Put(t)
+}
+
+// TwoFactorEnabled reports whether the user has confirmed a TOTP enrollment.
+func (a *Auth) TwoFactorEnabled(userID int64) bool {
+	t, err := a.store.TwoFactor.Get(userID)
+	return err == nil && t.Enabled
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, consumes a recovery
+// code. Each TOTP code is accepted only once. Wrong codes are throttled as in
+// ConfirmTOTP.
+func (a *Auth) VerifySecondFactor(r *http.Request, userID int64, code string) (bool, time.Duration, error) {
+	t, err := a.store.TwoFactor.Get(userID)
+	if err != nil || !t.Enabled {
+		return false, 0, err
+	}
+	u, err := a.store.Users.ByID(userID)
+	if err != nil {
+		return false, 0, err
+	}
+	return a.checkThrottled(r, u.Username, func() (bool, error) {
+		if step, ok := matchTOTP(t.Secret, code, time.Now()); ok {
+			return a.store.TwoFactor.UseStep(userID, step)
+		}
+		normalized := normalizeRecoveryCode(code)
+		if normalized == "" {
+			return false, nil
+		}
+		return a.store.TwoFactor.UseRecoveryCode(userID, tokenDigest(normalized))
+	})
+}
+
+// matchTOTP returns the time step code belongs to, within the allowed skew.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpStep
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		if hmac.Equal([]byte(totpCode(key, current+d)), []byte(code)) {
+			return current + d, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newRecoveryCodes returns codes formatted "xxxxx-xxxxx" and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryKeep)
+	hashes := make([]string, 0, recoveryKeep)
+	for i := 0; i < recoveryKeep; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, tokenDigest(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	if len(code) != 10 {
+		return ""
+	}
+	return code
+}
+
+// Challenge is the pending second step of a login whose password was right.
+type Challenge struct {
+	ID        string `json:"challenge"`
+	Setup     bool   `json:"setupRequired"` // the user must enroll first
+	ExpiresAt int64  `json:"expiresAt"`
+	userID    int64
+	username  string
+	remember  bool
+	attempts  atomic.Int32
+}
+
+func (a *Auth) newChallenge(u store.User, setup, remember bool) (*Challenge, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	a.challenges.Range(func(k, v any) bool {
+		if v.(*Challenge).ExpiresAt <= now.UnixMilli() {
+			a.challenges.Delete(k)
+		}
+		return true
+	})
+	c := &Challenge{
+		ID:        base64.RawURLEncoding.EncodeToString(b),
+		Setup:     setup,
+		ExpiresAt: now.Add(challengeTTL).UnixMilli(),
+		userID:    u.ID,
+		username:  u.Username,
+		remember:  remember,
+	}
+	a.challenges.Store(c.ID, c)
+	return c, nil
+}
+
+func (a *Auth) challenge(id string) *Challenge {
+	v, ok := a.challenges.Load(strings.TrimSpace(id))
+	if !ok {
+		return nil
+	}
+	c := v.(*Challenge)
+	if c.ExpiresAt <= time.Now().UnixMilli() {
+		a.challenges.Delete(c.ID)
+		return nil
+	}
+	return c
+}
+
+// ChallengeTOTP starts enrollment for a login challenge whose user has to
+// set up 2FA before signing in.
+func (a *Auth) ChallengeTOTP(id string) (TOTPProvisioning, error) {
+	c := a.challenge(id)
+	if c == nil || !c.Setup {
+		return TOTPProvisioning{}, ErrTOTPNotPending
+	}
+	return a.BeginTOTP(c.userID, c.username)
+}
+
+// LoginSecondFactor completes a login challenge with a TOTP or recovery code
+// and issues the session cookie. For setup challenges the code confirms the
+// new enrollment and the result carries the recovery codes.
+func (a *Auth) LoginSecondFactor(w http.ResponseWriter, r *http.Request, id, code string) LoginResult {
+	c := a.challenge(id)
+	if c == nil {
+		return LoginResult{Status: http.StatusUnauthorized, Message: "验证已过期，请重新登录"}
+	}
+	var (
+		ok       bool
+		recovery []string
+		wait     time.Duration
+		err      error
+	)
+	if c.Setup {
+		recovery, wait, err = a.ConfirmTOTP(r, c.userID, code)
+		ok = err == nil && wait == 0
+		if errors.Is(err, ErrTOTPInvalid) || errors.Is(err, ErrTOTPNotPending) {
+			err = nil
+		}
+	} else {
+		ok, wait, err = a.VerifySecondFactor(r, c.userID, code)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return LoginResult{Status: http.StatusTooManyRequests, Message: retryAfterMessage(wait)}
+	}
+	if err != nil {
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+	}
+	if !ok {
+		if c.attempts.Add(1) >= challengeMaxAttempts {
+			a.challenges.Delete(c.ID)
+			return LoginResult{Status: http.StatusUnauthorized, Message: "验证码错误次数过多，请重新登录"}
+		}
+		return LoginResult{Status: http.StatusUnauthorized, Message: "验证码错误"}
+	}
+
+	a.challenges.Delete(c.ID)
+	if err := a.StartSession(w, r, c.userID, c.remember); err != nil {
+		return LoginResult{Status: http.StatusInternalServerError, Message: "请求失败"}
+	}
+	return LoginResult{Status: http.StatusOK, RecoveryCodes: recovery}
+}
@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA-1 secret of the RFC 6238 test vectors.
+var rfcKey = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfcKey, tt.unix/totpStep); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpStep
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		ok       bool
+	}{
+		{"current step", secret, totpCode(rfcKey, step), step, true},
+		{"previous step", secret, totpCode(rfcKey, step-1), step - 1, true},
+		{"next step", secret, totpCode(rfcKey, step+1), step + 1, true},
+		{"two steps ago", secret, totpCode(rfcKey, step-2), 0, false},
+		{"spaces ignored", secret, " 050 471 ", step, true},
+		{"lower-case secret", strings.ToLower(secret), "050471", step, true},
+		{"wrong code", secret, "000000", 0, false},
+		{"too short", secret, "05047", 0, false},
+		{"bad secret", "not base32!", "050471", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchTOTP(tt.secret, tt.code, now)
+			if ok != tt.ok || got != tt.wantStep {
+				t.Errorf("matchTOTP = %d, %v; want %d, %v", got, ok, tt.wantStep, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Settings.Set("login_backoff_seconds", "0")
+	r := httptest.NewRequest(http.MethodPost, "/api/user/2fa/enable", nil)
+	if _, _, err := a.ConfirmTOTP(r, u.ID, "123456"); !errors.Is(err, ErrTOTPNotPending) {
+		t.Fatalf("confirm without enrollment: %v", err)
+	}
+	p, err := a.BeginTOTP(u.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(p.URI, "otpauth://totp/MeowFilm:alice?") || !strings.Contains(p.URI, "secret="+p.Secret) {
+		t.Errorf("URI = %s", p.URI)
+	}
+	if a.TwoFactorEnabled(u.ID) {
+		t.Error("enabled before confirmation")
+	}
+	key, err := totpEncoding.DecodeString(p.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := totpCode(key, time.Now().Unix()/totpStep)
+	wrong := "000000"
+	if current == wrong {
+		wrong = "111111"
+	}
+
+	if _, _, err := a.ConfirmTOTP(r, u.ID, wrong); !errors.Is(err, ErrTOTPInvalid) {
+		t.Errorf("confirm with a wrong code: %v", err)
+	}
+	codes, _, err := a.ConfirmTOTP(r, u.ID, current)
+	if err != nil || len(codes) != recoveryKeep {
+		t.Fatalf("ConfirmTOTP = %d codes, %v", len(codes), err)
+	}
+	if !a.TwoFactorEnabled(u.ID) {
+		t.Error("not enabled after confirmation")
+	}
+	if _, _, err := a.ConfirmTOTP(r, u.ID, current); !errors.Is(err, ErrTOTPNotPending) {
+		t.Errorf("second confirmation: %v", err)
+	}
+	if ok, _, _ := a.VerifySecondFactor(r, u.ID, current); ok {
+		t.Error("the confirmation code was accepted again at login")
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Settings.Set("login_backoff_seconds", "0")
+	r := httptest.NewRequest(http.MethodPost, "/api/user/2fa/disable", nil)
+	code := enableTOTP(t, a, u.ID)
+	recovery, err := a.RegenerateRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := code()
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"current code", first, true},
+		{"replayed code", first, false},
+		{"recovery code", recovery[0], true},
+		{"used recovery code", recovery[0], false},
+		{"recovery code without dash, upper case", strings.ToUpper(strings.ReplaceAll(recovery[1], "-", "")), true},
+		{"unknown recovery code", "aaaaa-bbbbb", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, err := a.VerifySecondFactor(r, u.ID, tt.code)
+			if err != nil || ok != tt.want {
+				t.Errorf("VerifySecondFactor(%q) = %v, %v; want %v", tt.code, ok, err, tt.want)
+			}
+		})
+	}
+
+	other, bob := newTestAuth(t, "bob", "right-pass-1")
+	if ok, _, _ := other.VerifySecondFactor(r, bob.ID, first); ok {
+		t.Error("code accepted for a user without 2FA")
+	}
+}
+
+// TestSecondFactorThrottled checks that wrong codes outside a login
+// challenge count towards the login backoff too.
+func TestSecondFactorThrottled(t *testing.T) {
+	a, u := newTestAuth(t, "alice", "right-pass-1")
+	_ = a.store.Settings.Set("login_max_failures", "3")
+	_ = a.store.Settings.Set("login_backoff_seconds", "0")
+	r := httptest.NewRequest(http.MethodPost, "/api/user/2fa/recovery-codes", nil)
+	code := enableTOTP(t, a, u.ID)
+
+	for i := 1; i <= 3; i++ {
+		if ok, wait, err := a.VerifySecondFactor(r, u.ID, "aaaaa-bbbbb"); ok || wait != 0 || err != nil {
+			t.Fatalf("attempt %d: VerifySecondFactor = %v, %v, %v", i, ok, wait, err)
+		}
+	}
+	if ok, wait, _ := a.VerifySecondFactor(r, u.ID, code()); ok || wait <= 0 {
+		t.Errorf("locked out: VerifySecondFactor = %v, %v; want a wait", ok, wait)
+	}
+	// The lockout covers enrolling as well.
+	if _, err := a.BeginTOTP(u.ID, u.Username); err != nil {
+		t.Fatal(err)
+	}
+	if _, wait, err := a.ConfirmTOTP(r, u.ID, "000000"); wait <= 0 || err != nil {
+		t.Errorf("locked out: ConfirmTOTP wait = %v, %v", wait, err)
+	}
+}
+
+func TestLoginSecondFactor(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup makes 2FA required for the role instead of enabling it.
+		setup bool
+		codes func(current string) []string
+		want  []int
+	}{
+		{
+			name:  "right code signs in",
+			codes: func(current string) []string { return []string{current} },
+			want:  []int{http.StatusOK},
+		},
+		{
+			name:  "challenge is single use",
+			codes: func(current string) []string { return []string{current, current} },
+			want:  []int{http.StatusOK, http.StatusUnauthorized},
+		},
+		{
+			name: "too many wrong codes drop the challenge",
+			codes: func(current string) []string {
+				return []string{"000000", "000000", "000000", "000000", "000000", current}
+			},
+			want: []int{401, 401, 401, 401, 401, 401},
+		},
+		{
+			name:  "required enrollment at login",
+			setup: true,
+			codes: func(current string) []string { return []string{current} },
+			want:  []int{http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, u := newTestAuth(t, "alice", "right-pass-1")
+			_ = a.store.Settings.Set("login_backoff_seconds", "0")
+			_ = a.store.Settings.Set("login_max_failures", "0")
+			var code func() string
+			if tt.setup {
+				_ = a.store.Settings.Set("totp_required_roles", "user")
+			} else {
+				code = enableTOTP(t, a, u.ID)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			res := a.Login(httptest.NewRecorder(), r, "alice", "right-pass-1", false)
+			if res.Status != http.StatusOK || res.TwoFactor == nil || res.TwoFactor.Setup != tt.setup {
+				t.Fatalf("Login = %+v, want a challenge with setup=%v", res, tt.setup)
+			}
+			if tt.setup {
+				p, err := a.ChallengeTOTP(res.TwoFactor.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key, _ := totpEncoding.DecodeString(p.Secret)
+				code = func() string { return totpCode(key, time.Now().Unix()/totpStep) }
+			} else if _, err := a.ChallengeTOTP(res.TwoFactor.ID); !errors.Is(err, ErrTOTPNotPending) {
+				t.Errorf("ChallengeTOTP for an enrolled user: %v", err)
+			}
+
+			for i, c := range tt.codes(code()) {
+				rec := httptest.NewRecorder()
+				got := a.LoginSecondFactor(rec, r, res.TwoFactor.ID, c)
+				if got.Status != tt.want[i] {
+					t.Fatalf("code %d: %d %q, want %d", i+1, got.Status, got.Message, tt.want[i])
+				}
+				signedIn := len(rec.Result().Cookies()) > 0
+				if signedIn != (got.Status == http.StatusOK) {
+					t.Errorf("code %d: cookie set = %v with status %d", i+1, signedIn, got.Status)
+				}
+				if tt.setup && got.Status == http.StatusOK && len(got.RecoveryCodes) != recoveryKeep {
+					t.Errorf("enrollment returned %d recovery codes", len(got.RecoveryCodes))
+				}
+			}
+		})
+	}
+}
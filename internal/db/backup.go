@@ -0,0 +1,425 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const snapshotPrefix = "meowfilm-"
+const snapshotSuffix = ".db"
+
+// Snapshot describes a snapshot file in SnapshotDir.
+type Snapshot struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// SnapshotDir is where scheduled snapshots are written: "<MEOWFILM_DATA_DIR>/backups",
+// or next to the database file when no data dir is configured.
+func (d *DB) SnapshotDir() string {
+	base := strings.TrimSpace(os.Getenv("MEOWFILM_DATA_DIR"))
+	if base == "" {
+		base = filepath.Dir(d.path)
+	}
+	return filepath.Join(base, "backups")
+}
+
+// SnapshotFileName returns the file name used for a snapshot taken at t.
+func SnapshotFileName(t time.Time) string {
+	return snapshotPrefix + t.Format("20060102-150405") + snapshotSuffix
+}
+
+// SnapshotTo writes a consistent copy of the live database to dst, which must
+// not exist yet. Readers and writers are not blocked while it runs.
+func (d *DB) SnapshotTo(dst string) error {
+	if d == nil || d.db == nil {
+		return errors.New("database not initialized")
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	_, err := d.db.Exec(`VACUUM INTO ?`, dst)
+	return err
+}
+
+// WriteSnapshot streams a consistent copy of the live database to w.
+func (d *DB) WriteSnapshot(w io.Writer) (int64, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(d.path), ".snapshot-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	tmp := filepath.Join(tmpDir, "data.db")
+	if err := d.SnapshotTo(tmp); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	return io.Copy(w, f)
+}
+
+// WriteScheduledSnapshot writes a new snapshot into SnapshotDir and removes
+// the oldest ones so that at most keep files remain.
+func (d *DB) WriteScheduledSnapshot(keep int) (string, error) {
+	dir := d.SnapshotDir()
+	dst := filepath.Join(dir, SnapshotFileName(time.Now()))
+	if _, err := os.Stat(dst); err == nil {
+		return "", fmt.Errorf("snapshot %s already exists", filepath.Base(dst))
+	}
+	if err := d.SnapshotTo(dst); err != nil {
+		_ = os.Remove(dst)
+		return "", err
+	}
+	if keep > 0 {
+		if err := rotateSnapshots(dir, keep); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// ListSnapshots returns the snapshots in SnapshotDir, newest first.
+func (d *DB) ListSnapshots() ([]Snapshot, error) {
+	entries, err := os.ReadDir(d.SnapshotDir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Snapshot{}, nil
+		}
+		return nil, err
+	}
+	out := []Snapshot{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, Snapshot{Name: name, Size: info.Size(), CreatedAt: info.ModTime().UnixMilli()})
+	}
+	// Names embed the timestamp, so lexical order is chronological.
+	sort.Slice(out, func(i, j int) bool { return out[i].Name > out[j].Name })
+	return out, nil
+}
+
+func rotateSnapshots(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	var firstErr error
+	for i := keep; i < len(names); i++ {
+		if err := os.Remove(filepath.Join(dir, names[i])); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// readOnlyDSN opens the database file at path read-only.
+func readOnlyDSN(path string) string { return fileDSN(path, "mode=ro") }
+
+// ErrInvalidSnapshot matches Restore errors caused by a file that fails
+// ValidateSnapshot, as opposed to errors while applying it.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+type snapshotError struct{ err error }
+
+func (e snapshotError) Error() string        { return e.err.Error() }
+func (e snapshotError) Unwrap() error        { return e.err }
+func (e snapshotError) Is(target error) bool { return target == ErrInvalidSnapshot }
+
+// ValidateSnapshot checks that the file at path is an intact MeowFilm
+// database this binary can open, and returns its schema version. A snapshot
+// at the latest version must have every table and column this binary uses;
+// older ones are checked again by Restore once migrated.
+func ValidateSnapshot(path string) (int, error) {
+	raw, err := sql.Open("sqlite3", readOnlyDSN(path))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = raw.Close() }()
+
+	var check string
+	if err := raw.QueryRow(`PRAGMA quick_check`).Scan(&check); err != nil {
+		return 0, fmt.Errorf("不是有效的数据库文件：%w", err)
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("数据库文件已损坏：%s", check)
+	}
+
+	version, err := readSchemaVersion(raw)
+	if err != nil {
+		return 0, err
+	}
+	if latest := LatestSchemaVersion(); version > latest {
+		return 0, fmt.Errorf("备份的数据库版本（%d）高于当前程序支持的版本（%d）", version, latest)
+	}
+	for _, t := range []string{"settings", "users", "search_history", "play_history", "favorites", "auth_tokens"} {
+		var cnt int
+		if err := raw.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name=?`, t).Scan(&cnt); err != nil {
+			return 0, err
+		}
+		if cnt == 0 {
+			return 0, fmt.Errorf("不是 MeowFilm 数据库：缺少表 %q", t)
+		}
+	}
+	if version == LatestSchemaVersion() {
+		if err := checkSchema(raw); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+var expected struct {
+	once   sync.Once
+	schema map[string][]string
+	err    error
+}
+
+// expectedSchema returns the columns of every table a freshly migrated
+// database has.
+func expectedSchema() (map[string][]string, error) {
+	expected.once.Do(func() {
+		raw, err := sql.Open("sqlite3", "file::memory:")
+		if err != nil {
+			expected.err = err
+			return
+		}
+		defer func() { _ = raw.Close() }()
+		raw.SetMaxOpenConns(1)
+		d := &DB{db: raw, settingsCache: map[string]string{}}
+		if err := d.migrate(); err != nil {
+			expected.err = err
+			return
+		}
+		expected.schema, expected.err = readSchema(raw)
+	})
+	return expected.schema, expected.err
+}
+
+func readSchema(q queryer) (map[string][]string, error) {
+	rows, err := q.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]string, len(tables))
+	for _, t := range tables {
+		cols, err := q.Query(`SELECT name FROM pragma_table_info(?)`, t)
+		if err != nil {
+			return nil, err
+		}
+		for cols.Next() {
+			var c string
+			if err := cols.Scan(&c); err != nil {
+				_ = cols.Close()
+				return nil, err
+			}
+			out[t] = append(out[t], c)
+		}
+		_ = cols.Close()
+		if err := cols.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// checkSchema makes sure q has every table and column of the latest schema.
+func checkSchema(q queryer) error {
+	want, err := expectedSchema()
+	if err != nil {
+		return err
+	}
+	have, err := readSchema(q)
+	if err != nil {
+		return err
+	}
+	for t, cols := range want {
+		got, ok := have[t]
+		if !ok {
+			return fmt.Errorf("不是 MeowFilm 数据库：缺少表 %q", t)
+		}
+		for _, c := range cols {
+			if !slices.Contains(got, c) {
+				return fmt.Errorf("数据库结构不完整：表 %q 缺少列 %q", t, c)
+			}
+		}
+	}
+	return nil
+}
+
+// Restore replaces the live database contents with the database at src. A
+// copy of src is migrated, checked against the latest schema and given its
+// default admin and encrypted secrets first; only then is it copied over the
+// live database with the SQLite online backup API. Any failure before that
+// leaves the live database untouched. A src that fails ValidateSnapshot is
+// reported as ErrInvalidSnapshot.
+func (d *DB) Restore(src string) error {
+	if _, err := ValidateSnapshot(src); err != nil {
+		return snapshotError{err}
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(d.path), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	prepared := filepath.Join(tmpDir, "restore.db")
+	if err := d.prepareRestore(src, prepared); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	srcDB, err := sql.Open("sqlite3", readOnlyDSN(prepared))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = srcDB.Close() }()
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = srcConn.Close() }()
+	dstConn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dstConn.Close() }()
+
+	err = dstConn.Raw(func(dc any) error {
+		return srcConn.Raw(func(sc any) error {
+			dst, ok := dc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("unexpected sqlite driver connection")
+			}
+			s, ok := sc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("unexpected sqlite driver connection")
+			}
+			bk, err := dst.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := bk.Step(-1)
+				if err != nil {
+					_ = bk.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			return bk.Finish()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.settingsCache = map[string]string{}
+	d.settingsVersion++
+	version := d.settingsVersion
+	d.mu.Unlock()
+
+	if err := d.initSecrets(); err != nil {
+		return err
+	}
+	d.publish(Change{Kind: ChangeSettings, Version: version})
+	return nil
+}
+
+// prepareRestore writes a copy of src to dst and brings it to the state Open
+// would leave it in.
+func (d *DB) prepareRestore(src, dst string) error {
+	srcDB, err := sql.Open("sqlite3", readOnlyDSN(src))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = srcDB.Close() }()
+	if err := d.checkSnapshotSecrets(srcDB); err != nil {
+		return err
+	}
+	if _, err := srcDB.Exec(`VACUUM INTO ?`, dst); err != nil {
+		return err
+	}
+
+	raw, err := sql.Open("sqlite3", fileDSN(dst, "_busy_timeout=5000&_txlock=immediate"))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = raw.Close() }()
+	tmp := &DB{db: raw, path: dst, settingsCache: map[string]string{}}
+	if err := tmp.migrate(); err != nil {
+		return err
+	}
+	if err := checkSchema(raw); err != nil {
+		return err
+	}
+	_ = tmp.cleanupLegacySettings()
+	if err := tmp.ensureDefaultAdmin(); err != nil {
+		return err
+	}
+	return tmp.initSecrets()
+}
+
+// checkSnapshotSecrets makes sure the configured master key can decrypt the
+// secrets in a snapshot before it replaces the live database.
+func (d *DB) checkSnapshotSecrets(src queryer) error {
+	var cnt int
+	if err := src.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='data_keys'`).Scan(&cnt); err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	master := d.secrets.master
+	d.mu.Unlock()
+	_, err := loadSecretKeys(src, master)
+	return err
+}
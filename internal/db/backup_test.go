@@ -0,0 +1,215 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeOldDB creates a database at path migrated only up to version.
+func writeOldDB(t *testing.T, path string, version int, setup string) {
+	t.Helper()
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = raw.Close() }()
+	saved := migrations
+	defer func() { migrations = saved }()
+	for i, m := range migrations {
+		if m.version == version {
+			migrations = saved[:i+1]
+		}
+	}
+	d := &DB{db: raw, path: path, settingsCache: map[string]string{}}
+	if err := d.migrate(); err != nil {
+		t.Fatalf("migrate to %d: %v", version, err)
+	}
+	if setup != "" {
+		if _, err := raw.Exec(setup); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	// "?" and "#" in the data dir and snapshot name must not be read as URI
+	// syntax.
+	d, err := openWithKey(t, filepath.Join(t.TempDir(), "data #1?", "data.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetSetting("site_name", "before"); err != nil {
+		t.Fatal(err)
+	}
+	snap := filepath.Join(t.TempDir(), "snap #1?.db")
+	if err := d.SnapshotTo(snap); err != nil {
+		t.Fatalf("SnapshotTo: %v", err)
+	}
+	if v, err := ValidateSnapshot(snap); err != nil || v != LatestSchemaVersion() {
+		t.Fatalf("ValidateSnapshot = %d, %v", v, err)
+	}
+	_ = d.SetSetting("site_name", "after")
+
+	if err := d.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := d.GetSetting("site_name"); got != "before" {
+		t.Errorf("site_name = %q after restore, want %q", got, "before")
+	}
+}
+
+func TestRestoreMigratesOldSnapshot(t *testing.T) {
+	d := openTestDB(t)
+	snap := filepath.Join(t.TempDir(), "old.db")
+	writeOldDB(t, snap, 1, `INSERT INTO settings(key, value) VALUES ('site_name', 'old')`)
+
+	if v, err := ValidateSnapshot(snap); err != nil || v != 1 {
+		t.Fatalf("ValidateSnapshot = %d, %v", v, err)
+	}
+	if err := d.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if v, _ := d.SchemaVersion(); v != LatestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", v, LatestSchemaVersion())
+	}
+	if got := d.GetSetting("site_name"); got != "old" {
+		t.Errorf("site_name = %q, want %q", got, "old")
+	}
+	var admins int
+	if err := d.SQL().QueryRow(`SELECT COUNT(1) FROM users WHERE role = 'admin'`).Scan(&admins); err != nil || admins != 1 {
+		t.Errorf("admins = %d, %v; want the default admin", admins, err)
+	}
+	if err := checkSchema(d.SQL()); err != nil {
+		t.Errorf("checkSchema after restore: %v", err)
+	}
+}
+
+func TestRestoreRejectsLeavesLiveUntouched(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(t *testing.T, d *DB, path string)
+		want  string
+		// invalid is set when ValidateSnapshot refuses the file.
+		invalid bool
+	}{
+		{
+			name: "not a database",
+			write: func(t *testing.T, d *DB, path string) {
+				if err := os.WriteFile(path, []byte("hello, this is not sqlite at all"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    "不是有效的数据库文件",
+			invalid: true,
+		},
+		{
+			name: "missing tables",
+			write: func(t *testing.T, d *DB, path string) {
+				raw, err := sql.Open("sqlite3", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = raw.Close() }()
+				if _, err := raw.Exec(`CREATE TABLE settings (key TEXT PRIMARY KEY, value TEXT)`); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    "缺少表",
+			invalid: true,
+		},
+		{
+			name: "latest version missing a column",
+			write: func(t *testing.T, d *DB, path string) {
+				if err := d.SnapshotTo(path); err != nil {
+					t.Fatal(err)
+				}
+				raw, err := sql.Open("sqlite3", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = raw.Close() }()
+				if _, err := raw.Exec(`ALTER TABLE audit_log DROP COLUMN status`); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    "缺少列",
+			invalid: true,
+		},
+		{
+			name: "newer than this binary",
+			write: func(t *testing.T, d *DB, path string) {
+				if err := d.SnapshotTo(path); err != nil {
+					t.Fatal(err)
+				}
+				raw, err := sql.Open("sqlite3", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = raw.Close() }()
+				if _, err := raw.Exec(`INSERT INTO schema_version(version, name, applied_at) VALUES (9999, 'future', 0)`); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    "高于当前程序支持的版本",
+			invalid: true,
+		},
+		{
+			name: "migration fails",
+			write: func(t *testing.T, d *DB, path string) {
+				// Migration 15 creates roles; a stray table makes it fail.
+				writeOldDB(t, path, 14, `CREATE TABLE roles (x INTEGER)`)
+			},
+			want: "数据库迁移失败",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDB(t)
+			_ = d.SetSetting("site_name", "live")
+			path := filepath.Join(t.TempDir(), "bad.db")
+			tt.write(t, d, path)
+
+			err := d.Restore(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Restore error = %v, want %q", err, tt.want)
+			}
+			if errors.Is(err, ErrInvalidSnapshot) != tt.invalid {
+				t.Errorf("errors.Is(err, ErrInvalidSnapshot) = %v", !tt.invalid)
+			}
+			if got := d.GetSetting("site_name"); got != "live" {
+				t.Errorf("site_name = %q, live database was changed", got)
+			}
+			if v, _ := d.SchemaVersion(); v != LatestSchemaVersion() {
+				t.Errorf("schema version = %d, want %d", v, LatestSchemaVersion())
+			}
+		})
+	}
+}
+
+func TestScheduledSnapshotRotation(t *testing.T) {
+	d := openTestDB(t)
+	dir := d.SnapshotDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"meowfilm-20200101-000000.db", "meowfilm-20200102-000000.db", "meowfilm-20200103-000000.db"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := d.WriteScheduledSnapshot(2)
+	if err != nil {
+		t.Fatalf("WriteScheduledSnapshot: %v", err)
+	}
+	list, err := d.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != filepath.Base(path) || list[1].Name != "meowfilm-20200103-000000.db" {
+		t.Errorf("snapshots after rotation = %+v", list)
+	}
+}
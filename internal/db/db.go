@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -11,14 +12,18 @@ import (
 	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jenfonro/meowfilm/internal/password"
 )
 
 type DB struct {
 	mu              sync.Mutex
 	db              *sql.DB
+	path            string
 	settingsCache   map[string]string
 	settingsVersion int64
+	subs            subscribers
+	secrets         secretKeys
 }
 
 func Open() (*DB, error) {
@@ -29,7 +34,7 @@ func Open() (*DB, error) {
 	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
 		return nil, err
 	}
-	raw, err := sql.Open("sqlite3", filePath+"?_journal_mode=WAL&_busy_timeout=5000")
+	raw, err := sql.Open("sqlite3", fileDSN(filePath, "_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"))
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +42,7 @@ func Open() (*DB, error) {
 		_ = raw.Close()
 		return nil, err
 	}
-	d := &DB{db: raw, settingsCache: map[string]string{}}
+	d := &DB{db: raw, path: filePath, settingsCache: map[string]string{}}
 	if err := d.initSchema(fresh); err != nil {
 		_ = raw.Close()
 		return nil, err
@@ -45,6 +50,13 @@ func Open() (*DB, error) {
 	return d, nil
 }
 
+// fileDSN is the URI DSN of the database file at path with the given query.
+// The path is escaped so "?" or "#" in a file name are not read as URI
+// syntax.
+func fileDSN(path, query string) string {
+	return (&url.URL{Scheme: "file", Path: path, RawQuery: query}).String()
+}
+
 func resolveDBFile() (filePath string, fresh bool, _ error) {
 	if v := strings.TrimSpace(os.Getenv("MEOWFILM_DB_FILE")); v != "" {
 		fp := filepath.Clean(v)
@@ -99,11 +111,15 @@ func (d *DB) Close() error {
 	if d == nil || d.db == nil {
 		return nil
 	}
+	d.CloseSubscriptions()
 	return d.db.Close()
 }
 
 func (d *DB) SQL() *sql.DB { return d.db }
 
+// Path returns the database file backing this DB.
+func (d *DB) Path() string { return d.path }
+
 func (d *DB) GetSetting(key string) string {
 	k := strings.TrimSpace(key)
 	if k == "" {
@@ -149,10 +165,24 @@ func (d *DB) SetSetting(key, value string) error {
 		d.settingsVersion++
 	}
 	d.settingsCache[k] = v
+	version := d.settingsVersion
 	d.mu.Unlock()
+	if changes > 0 {
+		d.publish(Change{Kind: ChangeSettings, Version: version, Key: k})
+	}
 	return nil
 }
 
+// MarkSettingsChanged bumps the settings version for changes made outside
+// SetSetting, such as writes to the sites table, and notifies subscribers.
+func (d *DB) MarkSettingsChanged(key string) {
+	d.mu.Lock()
+	d.settingsVersion++
+	version := d.settingsVersion
+	d.mu.Unlock()
+	d.publish(Change{Kind: ChangeSettings, Version: version, Key: key})
+}
+
 func (d *DB) SettingsVersion() int64 {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -160,97 +190,22 @@ func (d *DB) SettingsVersion() int64 {
 }
 
 func (d *DB) initSchema(fresh bool) error {
+	if err := d.migrate(); err != nil {
+		return err
+	}
 	if fresh {
-		_, err := d.db.Exec(`
-			CREATE TABLE IF NOT EXISTS settings (
-			  key TEXT PRIMARY KEY,
-			  value TEXT
-			);
-			CREATE TABLE IF NOT EXISTS users (
-			  id INTEGER PRIMARY KEY AUTOINCREMENT,
-			  username TEXT UNIQUE NOT NULL,
-			  password TEXT NOT NULL,
-			  role TEXT DEFAULT 'user',
-			  status TEXT DEFAULT 'active',
-			  cat_api_base TEXT DEFAULT '',
-			  cat_api_key TEXT DEFAULT '',
-			  cat_proxy TEXT DEFAULT '',
-			  search_thread_count INTEGER DEFAULT 5,
-			  cat_sites TEXT DEFAULT '[]',
-			  cat_site_status TEXT DEFAULT '{}',
-			  cat_site_home TEXT DEFAULT '{}',
-			  cat_site_order TEXT DEFAULT '[]',
-			  cat_site_availability TEXT DEFAULT '{}',
-			  cat_search_order TEXT DEFAULT '[]',
-			  cat_search_cover_site TEXT DEFAULT ''
-			);
-			CREATE TABLE IF NOT EXISTS search_history (
-			  id INTEGER PRIMARY KEY AUTOINCREMENT,
-			  user_id INTEGER NOT NULL,
-			  keyword TEXT NOT NULL,
-			  updated_at INTEGER NOT NULL,
-			  UNIQUE(user_id, keyword)
-			);
-			CREATE INDEX IF NOT EXISTS idx_search_history_user_id_updated_at ON search_history(user_id, updated_at DESC);
-				CREATE TABLE IF NOT EXISTS play_history (
-				  id INTEGER PRIMARY KEY AUTOINCREMENT,
-				  user_id INTEGER NOT NULL,
-				  site_key TEXT NOT NULL,
-				  site_name TEXT DEFAULT '',
-				  spider_api TEXT NOT NULL,
-				  video_id TEXT NOT NULL,
-				  video_title TEXT NOT NULL,
-				  video_poster TEXT DEFAULT '',
-				  video_remark TEXT DEFAULT '',
-				  pan_label TEXT DEFAULT '',
-				  play_flag TEXT DEFAULT '',
-				  content_key TEXT DEFAULT '',
-				  episode_index INTEGER DEFAULT 0,
-				  episode_name TEXT DEFAULT '',
-				  updated_at INTEGER NOT NULL,
-				  UNIQUE(user_id, site_key, video_id)
-				);
-			CREATE INDEX IF NOT EXISTS idx_play_history_user_id_updated_at ON play_history(user_id, updated_at DESC);
-			CREATE INDEX IF NOT EXISTS idx_play_history_user_id_content_key_updated_at ON play_history(user_id, content_key, updated_at DESC);
-			CREATE TABLE IF NOT EXISTS favorites (
-			  id INTEGER PRIMARY KEY AUTOINCREMENT,
-			  user_id INTEGER NOT NULL,
-			  site_key TEXT NOT NULL,
-			  site_name TEXT DEFAULT '',
-			  spider_api TEXT NOT NULL,
-			  video_id TEXT NOT NULL,
-			  video_title TEXT NOT NULL,
-			  video_poster TEXT DEFAULT '',
-			  video_remark TEXT DEFAULT '',
-			  updated_at INTEGER NOT NULL,
-			  UNIQUE(user_id, site_key, video_id)
-			);
-			CREATE INDEX IF NOT EXISTS idx_favorites_user_id_updated_at ON favorites(user_id, updated_at DESC);
-			CREATE TABLE IF NOT EXISTS auth_tokens (
-			  token TEXT PRIMARY KEY,
-			  user_id INTEGER NOT NULL,
-			  created_at INTEGER NOT NULL,
-			  expires_at INTEGER NOT NULL
-			);
-			CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id);
-			CREATE INDEX IF NOT EXISTS idx_auth_tokens_expires_at ON auth_tokens(expires_at);
-		`)
-		if err != nil {
-			return err
-		}
 		if err := d.seedDefaults(); err != nil {
 			return err
 		}
-	} else {
-		if err := requireSchema(d.db); err != nil {
-			return err
-		}
 	}
 
 	// One-time cleanup for removed settings keys.
 	_ = d.cleanupLegacySettings()
 
-	return d.ensureDefaultAdmin()
+	if err := d.ensureDefaultAdmin(); err != nil {
+		return err
+	}
+	return d.initSecrets()
 }
 
 func (d *DB) cleanupLegacySettings() error {
@@ -289,73 +244,7 @@ func (d *DB) cleanupLegacySettings() error {
 	return nil
 }
 
-func requireSchema(db *sql.DB) error {
-	if db == nil {
-		return errors.New("database not initialized")
-	}
-
-	requiredTables := []string{"settings", "users", "search_history", "play_history", "favorites", "auth_tokens"}
-	for _, t := range requiredTables {
-		if err := requireSQLiteTable(db, t); err != nil {
-			return err
-		}
-	}
-
-	requiredColumns := [][2]string{
-		{"settings", "key"},
-		{"settings", "value"},
-		{"users", "username"},
-		{"users", "password"},
-		{"users", "role"},
-		{"users", "status"},
-		{"users", "cat_api_base"},
-		{"users", "cat_api_key"},
-		{"users", "cat_proxy"},
-		{"users", "search_thread_count"},
-		{"users", "cat_sites"},
-		{"users", "cat_site_status"},
-		{"users", "cat_site_home"},
-		{"users", "cat_site_order"},
-		{"users", "cat_site_availability"},
-		{"users", "cat_search_order"},
-		{"users", "cat_search_cover_site"},
-		{"play_history", "pan_label"},
-	}
-	for _, pair := range requiredColumns {
-		if err := requireSQLiteColumn(db, pair[0], pair[1]); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func requireSQLiteTable(db *sql.DB, table string) error {
-	t := strings.TrimSpace(table)
-	if t == "" {
-		return errors.New("empty table name")
-	}
-	var cnt int
-	if err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name=?`, t).Scan(&cnt); err != nil {
-		return err
-	}
-	if cnt == 0 {
-		return fmt.Errorf("检测到旧数据库（不再兼容）：缺少表 %q；请删除数据库文件后重启（默认 data.db）", t)
-	}
-	return nil
-}
-
-func requireSQLiteColumn(db *sql.DB, table, column string) error {
-	ok, err := hasSQLiteColumn(db, table, column)
-	if err != nil {
-		return err
-	}
-	if !ok {
-		return fmt.Errorf("检测到旧数据库（不再兼容）：缺少列 %s.%s；请删除数据库文件后重启（默认 data.db）", table, column)
-	}
-	return nil
-}
-
-func hasSQLiteColumn(db *sql.DB, table, column string) (bool, error) {
+func hasSQLiteColumn(db queryer, table, column string) (bool, error) {
 	if db == nil {
 		return false, nil
 	}
@@ -415,15 +304,8 @@ func (d *DB) seedDefaults() error {
 		{"douban_img_proxy", "direct-browser"},
 		{"douban_img_custom", ""},
 		{"video_source_api_base", ""},
-		{"video_source_sites", "[]"},
 		{"catpawopen_servers", "[]"},
 		{"catpawopen_active", ""},
-		{"video_source_site_status", "{}"},
-		{"video_source_site_home", "{}"},
-		{"video_source_site_search", "{}"},
-		{"video_source_site_order", "[]"},
-		{"video_source_site_availability", "{}"},
-		{"video_source_site_error", "{}"},
 		{"video_source_search_order", "[]"},
 		{"video_source_search_cover_site", ""},
 		{"magic_episode_rules", `["{\"pattern\":\".*?([Ss]\\\\d{1,2})?(?:[第EePpXx\\\\.\\\\-\\\\_\\\\( ]{1,2}|^)(\\\\d{1,3})(?!\\\\d).*?\\\\.(mp4|mkv)\",\"replace\":\"$1E$2\"}"]`},
@@ -453,11 +335,11 @@ func (d *DB) ensureDefaultAdmin() error {
 		return nil
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte("admin"), 10)
+	hashed, err := password.Hash("admin")
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec(`INSERT INTO users(username,password,role,status) VALUES (?,?, 'admin','active')`, "admin", string(hashed))
+	_, err = d.db.Exec(`INSERT INTO users(username,password,role,status,must_change_password) VALUES (?,?, 'admin','active',1)`, "admin", hashed)
 	return err
 }
 
@@ -0,0 +1,100 @@
+package db
+
+import "sync"
+
+// Change kinds delivered to subscribers.
+const (
+	ChangeSettings  = "settings"
+	ChangeUserSites = "user_sites"
+)
+
+// Change describes a write that connected clients may want to react to.
+type Change struct {
+	Kind string
+	// Version is the settings version after the change.
+	Version int64
+	// Key is the settings key that changed, "sites" for the global site list,
+	// or empty when everything may have changed (e.g. after a restore).
+	Key string
+	// UserID owns the changed sites for ChangeUserSites.
+	UserID int64
+}
+
+const subscriberBuffer = 16
+
+type subscribers struct {
+	mu     sync.Mutex
+	chans  map[chan Change]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel receiving every Change published after the call,
+// and a function that ends the subscription. The channel is closed when the
+// subscription ends or CloseSubscriptions is called. Slow subscribers lose
+// their oldest pending changes rather than blocking writers.
+func (d *DB) Subscribe() (<-chan Change, func()) {
+	ch := make(chan Change, subscriberBuffer)
+	s := &d.subs
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if s.chans == nil {
+		s.chans = map[chan Change]struct{}{}
+	}
+	s.chans[ch] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if _, ok := s.chans[ch]; ok {
+				delete(s.chans, ch)
+				close(ch)
+			}
+			s.mu.Unlock()
+		})
+	}
+}
+
+// CloseSubscriptions closes every subscriber channel and rejects new ones, so
+// long-lived streams can finish before shutdown.
+func (d *DB) CloseSubscriptions() {
+	s := &d.subs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.chans {
+		delete(s.chans, ch)
+		close(ch)
+	}
+}
+
+// NotifyUserSitesChanged tells subscribers that the site list of userID changed.
+func (d *DB) NotifyUserSitesChanged(userID int64) {
+	d.publish(Change{Kind: ChangeUserSites, Version: d.SettingsVersion(), UserID: userID})
+}
+
+func (d *DB) publish(c Change) {
+	s := &d.subs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.chans {
+		select {
+		case ch <- c:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSlowSubscriberDropsOldest(t *testing.T) {
+	d := openTestDB(t)
+	changes, cancel := d.Subscribe()
+	defer cancel()
+
+	// Nobody reads while these are published; the writes must not block.
+	const extra = 3
+	for i := 0; i < subscriberBuffer+extra; i++ {
+		if err := d.SetSetting("key_"+strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := extra; i < subscriberBuffer+extra; i++ {
+		if c := <-changes; c.Key != "key_"+strconv.Itoa(i) {
+			t.Fatalf("got %q, want key_%d: the oldest changes should be dropped", c.Key, i)
+		}
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change %+v", c)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Error("channel still open after cancel")
+	}
+}
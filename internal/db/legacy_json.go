@@ -0,0 +1,156 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// The helpers below decode the JSON blobs that older schema versions kept in
+// settings/users columns. They mirror the tolerant parsing the HTTP layer used
+// at the time, so migrated rows keep the state users actually saw.
+
+type legacySite struct {
+	key  string
+	name string
+	api  string
+	typ  any
+}
+
+func legacySitesFromJSON(text string) []legacySite {
+	var raw []map[string]any
+	if err := json.Unmarshal([]byte(text), &raw); err != nil {
+		return []legacySite{}
+	}
+	out := make([]legacySite, 0, len(raw))
+	seen := map[string]struct{}{}
+	for _, it := range raw {
+		key, _ := it["key"].(string)
+		api, _ := it["api"].(string)
+		name, _ := it["name"].(string)
+		key = strings.TrimSpace(key)
+		api = strings.TrimSpace(api)
+		if key == "" || api == "" {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		var typ any
+		if v, ok := it["type"].(float64); ok {
+			typ = int(v)
+		}
+		out = append(out, legacySite{key: key, name: name, api: api, typ: typ})
+	}
+	return out
+}
+
+func legacyBoolMapFromJSON(text string) map[string]bool {
+	var raw map[string]any
+	_ = json.Unmarshal([]byte(text), &raw)
+	out := make(map[string]bool, len(raw))
+	for k, v := range raw {
+		if k == "" {
+			continue
+		}
+		switch vv := v.(type) {
+		case bool:
+			out[k] = vv
+		case string:
+			out[k] = strings.TrimSpace(vv) == "1" || strings.EqualFold(strings.TrimSpace(vv), "true")
+		case float64:
+			out[k] = vv != 0
+		default:
+			out[k] = false
+		}
+	}
+	return out
+}
+
+func legacyStringMapFromJSON(text string) map[string]string {
+	var raw map[string]any
+	_ = json.Unmarshal([]byte(text), &raw)
+	out := make(map[string]string, len(raw))
+	for k, v := range raw {
+		key := strings.TrimSpace(k)
+		s, ok := v.(string)
+		if key == "" || !ok || strings.TrimSpace(s) == "" {
+			continue
+		}
+		out[key] = strings.TrimSpace(s)
+	}
+	return out
+}
+
+func legacyStringsFromJSON(text string) []string {
+	var raw []any
+	if err := json.Unmarshal([]byte(text), &raw); err != nil {
+		return []string{}
+	}
+	out := make([]string, 0, len(raw))
+	seen := map[string]struct{}{}
+	for _, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
+
+// legacyApplyOrder sorts sites by their index in order; unlisted sites keep
+// their relative position after the listed ones.
+func legacyApplyOrder(sites []legacySite, order []string) []legacySite {
+	idx := map[string]int{}
+	for i, k := range order {
+		idx[k] = i
+	}
+	out := append([]legacySite(nil), sites...)
+	sort.SliceStable(out, func(i, j int) bool {
+		oi, ok := idx[out[i].key]
+		if !ok {
+			oi = 1_000_000_000
+		}
+		oj, ok := idx[out[j].key]
+		if !ok {
+			oj = 1_000_000_000
+		}
+		return oi < oj
+	})
+	return out
+}
+
+// legacyDefaultHome matches the home default for sites without a stored flag:
+// the "baseset" config-center spider is hidden from the home page.
+func legacyDefaultHome(api string) bool {
+	const marker = "/spider/"
+	i := strings.Index(api, marker)
+	if i < 0 {
+		return true
+	}
+	rest := api[i+len(marker):]
+	j := strings.Index(rest, "/")
+	if j < 0 {
+		return true
+	}
+	return rest[:j] != "baseset"
+}
+
+func legacyAvailability(v string) string {
+	switch s := strings.TrimSpace(v); s {
+	case "valid", "invalid", "unknown", "unchecked", "skipped", "category_error", "search_error":
+		return s
+	default:
+		return "unchecked"
+	}
+}
@@ -0,0 +1,22 @@
+package db
+
+// Optimize runs PRAGMA optimize and checkpoints the WAL back into the main
+// database file, truncating it. It returns the number of WAL frames that
+// were checkpointed.
+func (d *DB) Optimize() (int, error) {
+	if _, err := d.db.Exec(`PRAGMA optimize`); err != nil {
+		return 0, err
+	}
+	var busy, logFrames, checkpointed int
+	if err := d.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return 0, err
+	}
+	return checkpointed, nil
+}
+
+// Vacuum rebuilds the database file to reclaim free pages. It needs about as
+// much free disk space as the database itself and blocks writers while it runs.
+func (d *DB) Vacuum() error {
+	_, err := d.db.Exec(`VACUUM`)
+	return err
+}
@@ -0,0 +1,753 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/password"
+)
+
+// migration is a single forward schema step. Pending migrations are applied in
+// version order at Open(), each one inside its own transaction together with
+// its schema_version row, so a failed step leaves the database untouched.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations must stay sorted by version and must never be edited once
+// released; add a new entry instead.
+var migrations = []migration{
+	{version: 1, name: "baseline", up: migrateBaseline},
+	{version: 2, name: "user_sites", up: migrateUserSites},
+	{version: 3, name: "sites", up: migrateSites},
+	{version: 4, name: "data_keys", up: migrateDataKeys},
+	{version: 5, name: "user_retention", up: migrateUserRetention},
+	{version: 6, name: "api_tokens", up: migrateAPITokens},
+	{version: 7, name: "session_digests", up: migrateSessionDigests},
+	{version: 8, name: "login_failures", up: migrateLoginFailures},
+	{version: 9, name: "user_totp", up: migrateUserTOTP},
+	{version: 10, name: "user_identities", up: migrateUserIdentities},
+	{version: 11, name: "must_change_password", up: migrateMustChangePassword},
+	{version: 12, name: "display_name", up: migrateDisplayName},
+	{version: 13, name: "session_remember", up: migrateSessionRemember},
+	{version: 14, name: "invitations", up: migrateInvitations},
+	{version: 15, name: "roles", up: migrateRoles},
+	{version: 16, name: "profiles", up: migrateProfiles},
+	{version: 17, name: "audit_log", up: migrateAuditLog},
+}
+
+// LatestSchemaVersion is the schema version this binary writes.
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version recorded in the open database.
+func (d *DB) SchemaVersion() (int, error) {
+	return readSchemaVersion(d.db)
+}
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (d *DB) migrate() error {
+	if _, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+		  version INTEGER PRIMARY KEY,
+		  name TEXT NOT NULL DEFAULT '',
+		  applied_at INTEGER NOT NULL
+		)
+	`); err != nil {
+		return err
+	}
+
+	current, err := readSchemaVersion(d.db)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return fmt.Errorf("数据库版本（%d）高于当前程序支持的版本（%d）；请升级 MeowFilm 后再启动", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := d.applyMigration(m); err != nil {
+			return fmt.Errorf("数据库迁移失败（版本 %d %s）：%w", m.version, m.name, err)
+		}
+		current = m.version
+	}
+	return nil
+}
+
+func (d *DB) applyMigration(m migration) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version(version, name, applied_at) VALUES (?,?,?)`,
+		m.version, m.name, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func readSchemaVersion(q queryer) (int, error) {
+	var cnt int
+	if err := q.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='schema_version'`).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	if cnt == 0 {
+		return 0, nil
+	}
+	var v sql.NullInt64
+	if err := q.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// migrateBaseline brings both fresh files and databases created before
+// schema_version existed to the v1 layout. Older files may lack columns that
+// were added over time, so those are appended instead of rejected.
+func migrateBaseline(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+		  key TEXT PRIMARY KEY,
+		  value TEXT
+		);
+		CREATE TABLE IF NOT EXISTS users (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  username TEXT UNIQUE NOT NULL,
+		  password TEXT NOT NULL,
+		  role TEXT DEFAULT 'user',
+		  status TEXT DEFAULT 'active',
+		  cat_api_base TEXT DEFAULT '',
+		  cat_api_key TEXT DEFAULT '',
+		  cat_proxy TEXT DEFAULT '',
+		  search_thread_count INTEGER DEFAULT 5,
+		  cat_sites TEXT DEFAULT '[]',
+		  cat_site_status TEXT DEFAULT '{}',
+		  cat_site_home TEXT DEFAULT '{}',
+		  cat_site_order TEXT DEFAULT '[]',
+		  cat_site_availability TEXT DEFAULT '{}',
+		  cat_search_order TEXT DEFAULT '[]',
+		  cat_search_cover_site TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS search_history (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  keyword TEXT NOT NULL,
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, keyword)
+		);
+		CREATE TABLE IF NOT EXISTS play_history (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  site_key TEXT NOT NULL,
+		  site_name TEXT DEFAULT '',
+		  spider_api TEXT NOT NULL,
+		  video_id TEXT NOT NULL,
+		  video_title TEXT NOT NULL,
+		  video_poster TEXT DEFAULT '',
+		  video_remark TEXT DEFAULT '',
+		  pan_label TEXT DEFAULT '',
+		  play_flag TEXT DEFAULT '',
+		  content_key TEXT DEFAULT '',
+		  episode_index INTEGER DEFAULT 0,
+		  episode_name TEXT DEFAULT '',
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, site_key, video_id)
+		);
+		CREATE TABLE IF NOT EXISTS favorites (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  site_key TEXT NOT NULL,
+		  site_name TEXT DEFAULT '',
+		  spider_api TEXT NOT NULL,
+		  video_id TEXT NOT NULL,
+		  video_title TEXT NOT NULL,
+		  video_poster TEXT DEFAULT '',
+		  video_remark TEXT DEFAULT '',
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, site_key, video_id)
+		);
+		CREATE TABLE IF NOT EXISTS auth_tokens (
+		  token TEXT PRIMARY KEY,
+		  user_id INTEGER NOT NULL,
+		  created_at INTEGER NOT NULL,
+		  expires_at INTEGER NOT NULL
+		);
+	`); err != nil {
+		return err
+	}
+
+	columns := []struct{ table, column, decl string }{
+		{"users", "role", "TEXT DEFAULT 'user'"},
+		{"users", "status", "TEXT DEFAULT 'active'"},
+		{"users", "cat_api_base", "TEXT DEFAULT ''"},
+		{"users", "cat_api_key", "TEXT DEFAULT ''"},
+		{"users", "cat_proxy", "TEXT DEFAULT ''"},
+		{"users", "search_thread_count", "INTEGER DEFAULT 5"},
+		{"users", "cat_sites", "TEXT DEFAULT '[]'"},
+		{"users", "cat_site_status", "TEXT DEFAULT '{}'"},
+		{"users", "cat_site_home", "TEXT DEFAULT '{}'"},
+		{"users", "cat_site_order", "TEXT DEFAULT '[]'"},
+		{"users", "cat_site_availability", "TEXT DEFAULT '{}'"},
+		{"users", "cat_search_order", "TEXT DEFAULT '[]'"},
+		{"users", "cat_search_cover_site", "TEXT DEFAULT ''"},
+		{"play_history", "site_name", "TEXT DEFAULT ''"},
+		{"play_history", "video_poster", "TEXT DEFAULT ''"},
+		{"play_history", "video_remark", "TEXT DEFAULT ''"},
+		{"play_history", "pan_label", "TEXT DEFAULT ''"},
+		{"play_history", "play_flag", "TEXT DEFAULT ''"},
+		{"play_history", "content_key", "TEXT DEFAULT ''"},
+		{"play_history", "episode_index", "INTEGER DEFAULT 0"},
+		{"play_history", "episode_name", "TEXT DEFAULT ''"},
+		{"favorites", "site_name", "TEXT DEFAULT ''"},
+		{"favorites", "video_poster", "TEXT DEFAULT ''"},
+		{"favorites", "video_remark", "TEXT DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(tx, c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_search_history_user_id_updated_at ON search_history(user_id, updated_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_play_history_user_id_updated_at ON play_history(user_id, updated_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_play_history_user_id_content_key_updated_at ON play_history(user_id, content_key, updated_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_favorites_user_id_updated_at ON favorites(user_id, updated_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id);
+		CREATE INDEX IF NOT EXISTS idx_auth_tokens_expires_at ON auth_tokens(expires_at);
+	`)
+	return err
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, decl string) error {
+	ok, err := hasSQLiteColumn(tx, table, column)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + strings.TrimSpace(decl))
+	return err
+}
+
+// migrateUserSites moves the per-user site JSON columns on users into
+// relational rows: user_sites holds one row per site of a user's own
+// CatPawOpen, user_search_order the user's preferred search order.
+func migrateUserSites(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE user_sites (
+		  user_id INTEGER NOT NULL,
+		  site_key TEXT NOT NULL,
+		  name TEXT NOT NULL DEFAULT '',
+		  api TEXT NOT NULL,
+		  type INTEGER,
+		  enabled INTEGER NOT NULL DEFAULT 1,
+		  home INTEGER NOT NULL DEFAULT 1,
+		  search INTEGER NOT NULL DEFAULT 1,
+		  position INTEGER NOT NULL DEFAULT 0,
+		  availability TEXT NOT NULL DEFAULT 'unchecked',
+		  PRIMARY KEY (user_id, site_key)
+		);
+		CREATE INDEX idx_user_sites_user_id_position ON user_sites(user_id, position);
+		CREATE TABLE user_search_order (
+		  user_id INTEGER NOT NULL,
+		  site_key TEXT NOT NULL,
+		  position INTEGER NOT NULL,
+		  PRIMARY KEY (user_id, site_key)
+		);
+		CREATE INDEX idx_user_search_order_user_id_position ON user_search_order(user_id, position);
+	`); err != nil {
+		return err
+	}
+
+	type legacyRow struct {
+		id                                                  int64
+		sites, status, home, order, availability, searchOrd sql.NullString
+	}
+	rows, err := tx.Query(`
+		SELECT id, cat_sites, cat_site_status, cat_site_home, cat_site_order, cat_site_availability, cat_search_order
+		FROM users
+	`)
+	if err != nil {
+		return err
+	}
+	legacy := []legacyRow{}
+	for rows.Next() {
+		var r legacyRow
+		if err := rows.Scan(&r.id, &r.sites, &r.status, &r.home, &r.order, &r.availability, &r.searchOrd); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		legacy = append(legacy, r)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range legacy {
+		sites := legacySitesFromJSON(r.sites.String)
+		status := legacyBoolMapFromJSON(r.status.String)
+		home := legacyBoolMapFromJSON(r.home.String)
+		availability := legacyStringMapFromJSON(r.availability.String)
+		ordered := legacyApplyOrder(sites, legacyStringsFromJSON(r.order.String))
+		for i, s := range ordered {
+			enabled, ok := status[s.key]
+			if !ok {
+				enabled = true
+			}
+			h, ok := home[s.key]
+			if !ok {
+				h = legacyDefaultHome(s.api)
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO user_sites(user_id, site_key, name, api, type, enabled, home, search, position, availability)
+				VALUES (?,?,?,?,?,?,?,1,?,?)
+			`, r.id, s.key, s.name, s.api, s.typ, enabled, h, i, legacyAvailability(availability[s.key])); err != nil {
+				return err
+			}
+		}
+		for i, k := range legacyStringsFromJSON(r.searchOrd.String) {
+			if _, err := tx.Exec(`INSERT INTO user_search_order(user_id, site_key, position) VALUES (?,?,?)`, r.id, k, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range []string{"cat_sites", "cat_site_status", "cat_site_home", "cat_site_order", "cat_site_availability", "cat_search_order"} {
+		if _, err := tx.Exec(`ALTER TABLE users DROP COLUMN ` + c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSites moves the global site list out of the video_source_* settings
+// keys into the sites table, one row per site, and removes those keys.
+func migrateSites(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE sites (
+		  site_key TEXT PRIMARY KEY,
+		  name TEXT NOT NULL DEFAULT '',
+		  api TEXT NOT NULL,
+		  type INTEGER,
+		  enabled INTEGER NOT NULL DEFAULT 1,
+		  home INTEGER NOT NULL DEFAULT 1,
+		  search INTEGER NOT NULL DEFAULT 1,
+		  position INTEGER NOT NULL DEFAULT 0,
+		  availability TEXT NOT NULL DEFAULT 'unchecked',
+		  error TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX idx_sites_position ON sites(position);
+	`); err != nil {
+		return err
+	}
+
+	keys := []string{
+		"video_source_sites",
+		"video_source_site_status",
+		"video_source_site_home",
+		"video_source_site_search",
+		"video_source_site_order",
+		"video_source_site_availability",
+		"video_source_site_error",
+	}
+	values := map[string]string{}
+	for _, k := range keys {
+		var v sql.NullString
+		err := tx.QueryRow(`SELECT value FROM settings WHERE key = ?`, k).Scan(&v)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		values[k] = v.String
+	}
+
+	sites := legacySitesFromJSON(values["video_source_sites"])
+	status := legacyBoolMapFromJSON(values["video_source_site_status"])
+	home := legacyBoolMapFromJSON(values["video_source_site_home"])
+	search := legacyBoolMapFromJSON(values["video_source_site_search"])
+	availability := legacyStringMapFromJSON(values["video_source_site_availability"])
+	errs := legacyStringMapFromJSON(values["video_source_site_error"])
+	for i, s := range legacyApplyOrder(sites, legacyStringsFromJSON(values["video_source_site_order"])) {
+		enabled, ok := status[s.key]
+		if !ok {
+			enabled = true
+		}
+		h, ok := home[s.key]
+		if !ok {
+			h = legacyDefaultHome(s.api)
+		}
+		se, ok := search[s.key]
+		if !ok {
+			se = true
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO sites(site_key, name, api, type, enabled, home, search, position, availability, error)
+			VALUES (?,?,?,?,?,?,?,?,?,?)
+		`, s.key, s.name, s.api, s.typ, enabled, h, se, i, legacyAvailability(availability[s.key]), errs[s.key]); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		if _, err := tx.Exec(`DELETE FROM settings WHERE key = ?`, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDataKeys adds the table holding wrapped data keys for secret
+// encryption (see secrets.go).
+func migrateDataKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE data_keys (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  wrapped_key TEXT NOT NULL,
+		  created_at INTEGER NOT NULL
+		)
+	`)
+	return err
+}
+
+// migrateUserRetention adds per-user overrides of the retention policy (see
+// retention.go).
+func migrateUserRetention(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE user_retention (
+		  user_id INTEGER NOT NULL,
+		  kind TEXT NOT NULL,
+		  max_rows INTEGER NOT NULL DEFAULT 0,
+		  max_days INTEGER NOT NULL DEFAULT 0,
+		  PRIMARY KEY(user_id, kind)
+		)
+	`)
+	return err
+}
+
+// migrateAPITokens adds personal access tokens. Only a SHA-256 hash of each
+// token is stored.
+func migrateAPITokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE api_tokens (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  name TEXT NOT NULL,
+		  token_hash TEXT NOT NULL UNIQUE,
+		  prefix TEXT NOT NULL,
+		  scopes TEXT NOT NULL,
+		  created_at INTEGER NOT NULL,
+		  expires_at INTEGER NOT NULL DEFAULT 0,
+		  last_used_at INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX idx_api_tokens_user_id ON api_tokens(user_id);
+	`)
+	return err
+}
+
+// migrateSessionDigests rebuilds auth_tokens so sessions are stored as
+// SHA-256 digests of the cookie value, with a numeric ID that can be shown to
+// users, and records the client and last-seen time of each session.
+func migrateSessionDigests(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE auth_sessions (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  token_hash TEXT NOT NULL UNIQUE,
+		  user_id INTEGER NOT NULL,
+		  created_at INTEGER NOT NULL,
+		  expires_at INTEGER NOT NULL,
+		  last_seen_at INTEGER NOT NULL DEFAULT 0,
+		  user_agent TEXT NOT NULL DEFAULT '',
+		  ip TEXT NOT NULL DEFAULT ''
+		)
+	`); err != nil {
+		return err
+	}
+
+	type session struct {
+		token              string
+		userID             int64
+		createdAt, expires int64
+	}
+	var sessions []session
+	rows, err := tx.Query(`SELECT token, user_id, created_at, expires_at FROM auth_tokens`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var s session
+		if err := rows.Scan(&s.token, &s.userID, &s.createdAt, &s.expires); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		sessions = append(sessions, s)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		sum := sha256.Sum256([]byte(s.token))
+		if _, err := tx.Exec(`
+			INSERT INTO auth_sessions(token_hash, user_id, created_at, expires_at, last_seen_at)
+			VALUES (?,?,?,?,?)
+		`, hex.EncodeToString(sum[:]), s.userID, s.createdAt, s.expires, s.createdAt); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		DROP TABLE auth_tokens;
+		ALTER TABLE auth_sessions RENAME TO auth_tokens;
+		CREATE INDEX idx_auth_tokens_user_id ON auth_tokens(user_id);
+		CREATE INDEX idx_auth_tokens_expires_at ON auth_tokens(expires_at);
+	`)
+	return err
+}
+
+// migrateLoginFailures adds failed-login tracking per username and client IP
+// for brute-force protection.
+func migrateLoginFailures(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE login_failures (
+		  scope TEXT NOT NULL,
+		  key TEXT NOT NULL,
+		  failures INTEGER NOT NULL DEFAULT 0,
+		  last_failure_at INTEGER NOT NULL,
+		  locked_until INTEGER NOT NULL DEFAULT 0,
+		  PRIMARY KEY(scope, key)
+		)
+	`)
+	return err
+}
+
+// migrateUserTOTP adds TOTP two-factor enrollments. recovery_codes is a
+// space-separated list of SHA-256 hashes of the unused codes.
+func migrateUserTOTP(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE user_totp (
+		  user_id INTEGER PRIMARY KEY,
+		  secret TEXT NOT NULL,
+		  enabled INTEGER NOT NULL DEFAULT 0,
+		  created_at INTEGER NOT NULL,
+		  last_step INTEGER NOT NULL DEFAULT 0,
+		  recovery_codes TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+// migrateUserIdentities links accounts at OpenID Connect providers to users.
+func migrateUserIdentities(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE user_identities (
+		  issuer TEXT NOT NULL,
+		  subject TEXT NOT NULL,
+		  user_id INTEGER NOT NULL,
+		  created_at INTEGER NOT NULL,
+		  last_login_at INTEGER NOT NULL DEFAULT 0,
+		  PRIMARY KEY(issuer, subject)
+		);
+		CREATE INDEX idx_user_identities_user ON user_identities(user_id);
+	`)
+	return err
+}
+
+// migrateMustChangePassword adds users.must_change_password and sets it for
+// an admin account still using the default admin/admin.
+func migrateMustChangePassword(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE users ADD COLUMN must_change_password INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	var (
+		id   int64
+		hash string
+	)
+	err := tx.QueryRow(`SELECT id, password FROM users WHERE username = 'admin'`).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ok, _ := password.Verify(hash, "admin"); ok {
+		_, err = tx.Exec(`UPDATE users SET must_change_password = 1 WHERE id = ?`, id)
+	}
+	return err
+}
+
+// migrateDisplayName adds users.display_name, which stays empty until the
+// user sets one on their profile.
+func migrateDisplayName(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// migrateSessionRemember adds auth_tokens.remember. Existing sessions used
+// persistent cookies, so they count as remembered.
+func migrateSessionRemember(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE auth_tokens ADD COLUMN remember INTEGER NOT NULL DEFAULT 1`)
+	return err
+}
+
+// migrateInvitations adds invitation codes. A zero max_uses or expires_at
+// means no limit.
+func migrateInvitations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE invitations (
+		  code TEXT PRIMARY KEY,
+		  role TEXT NOT NULL DEFAULT 'user',
+		  cat_api_base TEXT NOT NULL DEFAULT '',
+		  max_uses INTEGER NOT NULL DEFAULT 1,
+		  uses INTEGER NOT NULL DEFAULT 0,
+		  expires_at INTEGER NOT NULL DEFAULT 0,
+		  created_by INTEGER NOT NULL DEFAULT 0,
+		  created_at INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// migrateRoles adds custom roles. The admin, shared and user roles are
+// built in and not stored.
+func migrateRoles(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE roles (
+		  name TEXT PRIMARY KEY,
+		  label TEXT NOT NULL DEFAULT '',
+		  permissions TEXT NOT NULL DEFAULT '',
+		  created_at INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// migrateProfiles adds profiles under an account and scopes play history,
+// search history and favorites to one. Existing rows belong to profile 0, the
+// account's default profile, which has no profiles row until it is edited.
+func migrateProfiles(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE profiles (
+		  user_id INTEGER NOT NULL,
+		  id INTEGER NOT NULL,
+		  name TEXT NOT NULL DEFAULT '',
+		  avatar TEXT NOT NULL DEFAULT '',
+		  pin_hash TEXT NOT NULL DEFAULT '',
+		  created_at INTEGER NOT NULL,
+		  PRIMARY KEY(user_id, id)
+		);
+		ALTER TABLE auth_tokens ADD COLUMN profile_id INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE search_history_new (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  profile_id INTEGER NOT NULL DEFAULT 0,
+		  keyword TEXT NOT NULL,
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, profile_id, keyword)
+		);
+		INSERT INTO search_history_new(id, user_id, keyword, updated_at)
+		  SELECT id, user_id, keyword, updated_at FROM search_history;
+		DROP TABLE search_history;
+		ALTER TABLE search_history_new RENAME TO search_history;
+		CREATE INDEX idx_search_history_user_id_updated_at ON search_history(user_id, profile_id, updated_at DESC);
+
+		CREATE TABLE play_history_new (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  profile_id INTEGER NOT NULL DEFAULT 0,
+		  site_key TEXT NOT NULL,
+		  site_name TEXT DEFAULT '',
+		  spider_api TEXT NOT NULL,
+		  video_id TEXT NOT NULL,
+		  video_title TEXT NOT NULL,
+		  video_poster TEXT DEFAULT '',
+		  video_remark TEXT DEFAULT '',
+		  pan_label TEXT DEFAULT '',
+		  play_flag TEXT DEFAULT '',
+		  content_key TEXT DEFAULT '',
+		  episode_index INTEGER DEFAULT 0,
+		  episode_name TEXT DEFAULT '',
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, profile_id, site_key, video_id)
+		);
+		INSERT INTO play_history_new(
+		  id, user_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark,
+		  pan_label, play_flag, content_key, episode_index, episode_name, updated_at
+		)
+		  SELECT id, user_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark,
+		    pan_label, play_flag, content_key, episode_index, episode_name, updated_at
+		  FROM play_history;
+		DROP TABLE play_history;
+		ALTER TABLE play_history_new RENAME TO play_history;
+		CREATE INDEX idx_play_history_user_id_updated_at ON play_history(user_id, profile_id, updated_at DESC);
+		CREATE INDEX idx_play_history_user_id_content_key_updated_at ON play_history(user_id, profile_id, content_key, updated_at DESC);
+
+		CREATE TABLE favorites_new (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  user_id INTEGER NOT NULL,
+		  profile_id INTEGER NOT NULL DEFAULT 0,
+		  site_key TEXT NOT NULL,
+		  site_name TEXT DEFAULT '',
+		  spider_api TEXT NOT NULL,
+		  video_id TEXT NOT NULL,
+		  video_title TEXT NOT NULL,
+		  video_poster TEXT DEFAULT '',
+		  video_remark TEXT DEFAULT '',
+		  updated_at INTEGER NOT NULL,
+		  UNIQUE(user_id, profile_id, site_key, video_id)
+		);
+		INSERT INTO favorites_new(id, user_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at)
+		  SELECT id, user_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at
+		  FROM favorites;
+		DROP TABLE favorites;
+		ALTER TABLE favorites_new RENAME TO favorites;
+		CREATE INDEX idx_favorites_user_id_updated_at ON favorites(user_id, profile_id, updated_at DESC);
+	`)
+	return err
+}
+
+// migrateAuditLog adds the log of changes made in the dashboard. before and
+// after hold JSON summaries written by the handlers.
+func migrateAuditLog(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE audit_log (
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  created_at INTEGER NOT NULL,
+		  actor_id INTEGER NOT NULL DEFAULT 0,
+		  actor TEXT NOT NULL DEFAULT '',
+		  ip TEXT NOT NULL DEFAULT '',
+		  action TEXT NOT NULL,
+		  target TEXT NOT NULL DEFAULT '',
+		  before TEXT NOT NULL DEFAULT '',
+		  after TEXT NOT NULL DEFAULT '',
+		  status INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX idx_audit_log_created_at ON audit_log(created_at);
+		CREATE INDEX idx_audit_log_action ON audit_log(action, created_at);
+	`)
+	return err
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMigrationsFromEveryVersion(t *testing.T) {
+	starts := []int{0}
+	for _, m := range migrations[:len(migrations)-1] {
+		starts = append(starts, m.version)
+	}
+	for _, from := range starts {
+		t.Run(migrationName(from), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.db")
+			if from > 0 {
+				writeOldDB(t, path, from, "")
+			}
+			d := openAt(t, path)
+
+			if v, err := d.SchemaVersion(); err != nil || v != LatestSchemaVersion() {
+				t.Fatalf("schema version = %d, %v; want %d", v, err, LatestSchemaVersion())
+			}
+			if err := checkSchema(d.SQL()); err != nil {
+				t.Errorf("checkSchema: %v", err)
+			}
+			var steps int
+			if err := d.SQL().QueryRow(`SELECT COUNT(1) FROM schema_version`).Scan(&steps); err != nil || steps != len(migrations) {
+				t.Errorf("schema_version rows = %d, %v; want %d", steps, err, len(migrations))
+			}
+			if err := d.migrate(); err != nil {
+				t.Errorf("second migrate: %v", err)
+			}
+		})
+	}
+}
+
+func migrationName(version int) string {
+	for _, m := range migrations {
+		if m.version == version {
+			return m.name
+		}
+	}
+	return "empty"
+}
+
+// legacySchema is a database written before schema_version existed, lacking
+// columns that were added later.
+const legacySchema = `
+	CREATE TABLE settings (key TEXT PRIMARY KEY, value TEXT);
+	CREATE TABLE users (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  username TEXT UNIQUE NOT NULL,
+	  password TEXT NOT NULL,
+	  role TEXT DEFAULT 'user',
+	  cat_api_base TEXT DEFAULT '',
+	  cat_sites TEXT DEFAULT '[]',
+	  cat_site_status TEXT DEFAULT '{}',
+	  cat_site_home TEXT DEFAULT '{}',
+	  cat_site_order TEXT DEFAULT '[]'
+	);
+	CREATE TABLE search_history (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  user_id INTEGER NOT NULL,
+	  keyword TEXT NOT NULL,
+	  updated_at INTEGER NOT NULL,
+	  UNIQUE(user_id, keyword)
+	);
+	CREATE TABLE play_history (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  user_id INTEGER NOT NULL,
+	  site_key TEXT NOT NULL,
+	  spider_api TEXT NOT NULL,
+	  video_id TEXT NOT NULL,
+	  video_title TEXT NOT NULL,
+	  updated_at INTEGER NOT NULL,
+	  UNIQUE(user_id, site_key, video_id)
+	);
+	CREATE TABLE favorites (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  user_id INTEGER NOT NULL,
+	  site_key TEXT NOT NULL,
+	  spider_api TEXT NOT NULL,
+	  video_id TEXT NOT NULL,
+	  video_title TEXT NOT NULL,
+	  updated_at INTEGER NOT NULL,
+	  UNIQUE(user_id, site_key, video_id)
+	);
+	CREATE TABLE auth_tokens (
+	  token TEXT PRIMARY KEY,
+	  user_id INTEGER NOT NULL,
+	  created_at INTEGER NOT NULL,
+	  expires_at INTEGER NOT NULL
+	);
+`
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminHash, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{legacySchema, nil},
+		{`INSERT INTO users(id, username, password, role) VALUES (1, 'admin', ?, 'admin')`, []any{string(adminHash)}},
+		{`INSERT INTO users(id, username, password, cat_api_base, cat_sites, cat_site_status, cat_site_home, cat_site_order) VALUES (2, 'bob', 'x', 'http://cat/', ?, ?, ?, ?)`, []any{
+			`[{"key":"a","name":"A","api":"http://cat/spider/a/1","type":3},{"key":"b","name":"B","api":"http://cat/spider/b/1"},{"key":"cfg","api":"http://cat/spider/baseset/1"}]`,
+			`{"a":false}`, `{"b":false}`, `["b","a"]`,
+		}},
+		{`INSERT INTO settings(key, value) VALUES ('video_source_sites', ?), ('video_source_site_search', '{"g2":false}'), ('video_source_site_error', '{"g1":"down"}'), ('site_name', 'legacy')`, []any{
+			`[{"key":"g1","name":"G1","api":"http://g/spider/g1/1"},{"key":"g2","name":"G2","api":"http://g/spider/g2/1"}]`,
+		}},
+		{`INSERT INTO auth_tokens(token, user_id, created_at, expires_at) VALUES ('cookie-value', 2, 100, 9999999999999)`, nil},
+		{`INSERT INTO play_history(user_id, site_key, spider_api, video_id, video_title, updated_at) VALUES (2, 'a', 'http://cat/spider/a/1', 'v1', 'Title', 1)`, nil},
+	} {
+		if _, err := raw.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatalf("setup %q: %v", stmt.query, err)
+		}
+	}
+	_ = raw.Close()
+
+	d := openAt(t, path)
+	if v, err := d.SchemaVersion(); err != nil || v != LatestSchemaVersion() {
+		t.Fatalf("schema version = %d, %v", v, err)
+	}
+	if err := checkSchema(d.SQL()); err != nil {
+		t.Fatalf("checkSchema: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("cookie-value"))
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		want  string
+	}{
+		{
+			name:  "user sites keep order and flags",
+			query: `SELECT group_concat(site_key || ':' || enabled || home || search || ':' || COALESCE(type, ''), ' ') FROM (SELECT * FROM user_sites WHERE user_id = 2 ORDER BY position)`,
+			want:  "b:101: a:011:3 cfg:101:",
+		},
+		{
+			name:  "global sites keep search flags and errors",
+			query: `SELECT group_concat(site_key || ':' || search || ':' || error, ' ') FROM (SELECT * FROM sites ORDER BY position)`,
+			want:  "g1:1:down g2:0:",
+		},
+		{
+			name:  "site settings keys removed",
+			query: `SELECT COUNT(1) FROM settings WHERE key LIKE 'video_source_site%'`,
+			want:  "0",
+		},
+		{
+			name:  "other settings kept",
+			query: `SELECT value FROM settings WHERE key = 'site_name'`,
+			want:  "legacy",
+		},
+		{
+			name:  "sessions stored as digests",
+			query: `SELECT user_id || ':' || last_seen_at || ':' || remember || ':' || profile_id FROM auth_tokens WHERE token_hash = ?`,
+			args:  []any{hex.EncodeToString(sum[:])},
+			want:  "2:100:1:0",
+		},
+		{
+			name:  "history moved to the default profile",
+			query: `SELECT profile_id || ':' || video_title FROM play_history WHERE user_id = 2`,
+			want:  "0:Title",
+		},
+		{
+			name:  "default admin password must be changed",
+			query: `SELECT group_concat(username || ':' || must_change_password, ' ') FROM (SELECT * FROM users ORDER BY id)`,
+			want:  "admin:1 bob:0",
+		},
+		{
+			name:  "missing columns added with defaults",
+			query: `SELECT status || ':' || search_thread_count || ':' || display_name FROM users WHERE id = 2`,
+			want:  "active:5:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got sql.NullString
+			if err := d.SQL().QueryRow(tt.query, tt.args...).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.String != tt.want {
+				t.Errorf("got %q, want %q", got.String, tt.want)
+			}
+		})
+	}
+}
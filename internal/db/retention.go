@@ -0,0 +1,260 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Retention limits how much play history, search history and favorites each
+// user keeps. The global policy lives in the "retention_policy" setting; a
+// user_retention row replaces the global rule for that user and kind. Zero
+// means no limit.
+
+// RetentionKinds are the tables a retention policy applies to.
+var RetentionKinds = []string{"play_history", "search_history", "favorites"}
+
+// ErrUnknownRetentionKind is returned for a kind not in RetentionKinds.
+var ErrUnknownRetentionKind = errors.New("unknown retention kind")
+
+type RetentionRule struct {
+	MaxRows int `json:"maxRows"`
+	MaxDays int `json:"maxDays"`
+}
+
+func (r RetentionRule) limited() bool { return r.MaxRows > 0 || r.MaxDays > 0 }
+
+// RetentionPolicy maps a kind to its rule. Missing kinds are unlimited.
+type RetentionPolicy map[string]RetentionRule
+
+// RetentionUserReport counts the rows removed (or that would be removed) for
+// one user.
+type RetentionUserReport struct {
+	UserID   int64            `json:"userId"`
+	Username string           `json:"username"`
+	Removed  map[string]int64 `json:"removed"`
+}
+
+type RetentionReport struct {
+	DryRun bool                  `json:"dryRun"`
+	Totals map[string]int64      `json:"totals"`
+	Users  []RetentionUserReport `json:"users"`
+}
+
+func isRetentionKind(kind string) bool {
+	for _, k := range RetentionKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanRetentionPolicy(p RetentionPolicy) (RetentionPolicy, error) {
+	out := RetentionPolicy{}
+	for kind, rule := range p {
+		if !isRetentionKind(kind) {
+			return nil, ErrUnknownRetentionKind
+		}
+		if rule.MaxRows < 0 || rule.MaxDays < 0 {
+			return nil, errors.New("retention limits must not be negative")
+		}
+		out[kind] = rule
+	}
+	return out, nil
+}
+
+// GlobalRetention returns the policy applied to users without an override.
+func (d *DB) GlobalRetention() RetentionPolicy {
+	var p RetentionPolicy
+	if err := json.Unmarshal([]byte(d.GetSetting("retention_policy")), &p); err != nil || p == nil {
+		return RetentionPolicy{}
+	}
+	p, err := cleanRetentionPolicy(p)
+	if err != nil {
+		return RetentionPolicy{}
+	}
+	return p
+}
+
+func (d *DB) SetGlobalRetention(p RetentionPolicy) error {
+	p, err := cleanRetentionPolicy(p)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return d.SetSetting("retention_policy", string(b))
+}
+
+// UserRetention returns the overrides stored for a user.
+func (d *DB) UserRetention(userID int64) (RetentionPolicy, error) {
+	all, err := loadUserRetention(d.db, &userID)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := all[userID]; ok {
+		return p, nil
+	}
+	return RetentionPolicy{}, nil
+}
+
+// SetUserRetention replaces a user's overrides; kinds missing from p fall
+// back to the global policy.
+func (d *DB) SetUserRetention(userID int64, p RetentionPolicy) error {
+	p, err := cleanRetentionPolicy(p)
+	if err != nil {
+		return err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`DELETE FROM user_retention WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for kind, rule := range p {
+		if _, err := tx.Exec(`INSERT INTO user_retention(user_id, kind, max_rows, max_days) VALUES (?,?,?,?)`, userID, kind, rule.MaxRows, rule.MaxDays); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func loadUserRetention(q queryer, userID *int64) (map[int64]RetentionPolicy, error) {
+	query := `SELECT user_id, kind, max_rows, max_days FROM user_retention`
+	args := []any{}
+	if userID != nil {
+		query += ` WHERE user_id = ?`
+		args = append(args, *userID)
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int64]RetentionPolicy{}
+	for rows.Next() {
+		var (
+			id   int64
+			kind string
+			rule RetentionRule
+		)
+		if err := rows.Scan(&id, &kind, &rule.MaxRows, &rule.MaxDays); err != nil {
+			return nil, err
+		}
+		if !isRetentionKind(kind) {
+			continue
+		}
+		if out[id] == nil {
+			out[id] = RetentionPolicy{}
+		}
+		out[id][kind] = rule
+	}
+	return out, rows.Err()
+}
+
+// ApplyRetention enforces the retention policies as of now. With dryRun set
+// nothing is deleted and the report shows what would be.
+func (d *DB) ApplyRetention(now time.Time, dryRun bool) (RetentionReport, error) {
+	report := RetentionReport{DryRun: dryRun, Totals: map[string]int64{}, Users: []RetentionUserReport{}}
+	for _, kind := range RetentionKinds {
+		report.Totals[kind] = 0
+	}
+	global := d.GlobalRetention()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	overrides, err := loadUserRetention(tx, nil)
+	if err != nil {
+		return report, err
+	}
+	type userRow struct {
+		id       int64
+		username string
+	}
+	var users []userRow
+	rows, err := tx.Query(`SELECT id, username FROM users ORDER BY id`)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var u userRow
+		if err := rows.Scan(&u.id, &u.username); err != nil {
+			_ = rows.Close()
+			return report, err
+		}
+		users = append(users, u)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	for _, u := range users {
+		entry := RetentionUserReport{UserID: u.id, Username: u.username, Removed: map[string]int64{}}
+		removed := false
+		for _, kind := range RetentionKinds {
+			rule := global[kind]
+			if o, ok := overrides[u.id][kind]; ok {
+				rule = o
+			}
+			if !rule.limited() {
+				continue
+			}
+			n, err := applyRetentionRule(tx, kind, u.id, rule, now, dryRun)
+			if err != nil {
+				return report, err
+			}
+			if n > 0 {
+				entry.Removed[kind] = n
+				report.Totals[kind] += n
+				removed = true
+			}
+		}
+		if removed {
+			report.Users = append(report.Users, entry)
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// applyRetentionRule removes one user's rows of kind that are older than
+// rule.MaxDays or beyond the newest rule.MaxRows of each profile, returning
+// how many.
+func applyRetentionRule(tx *sql.Tx, kind string, userID int64, rule RetentionRule, now time.Time, dryRun bool) (int64, error) {
+	conds := []string{}
+	args := []any{userID}
+	if rule.MaxDays > 0 {
+		conds = append(conds, `updated_at < ?`)
+		args = append(args, now.Add(-time.Duration(rule.MaxDays)*24*time.Hour).Unix())
+	}
+	if rule.MaxRows > 0 {
+		conds = append(conds, `rowid NOT IN (SELECT k.rowid FROM `+kind+` AS k WHERE k.user_id = ? AND k.profile_id = `+kind+`.profile_id ORDER BY k.updated_at DESC, k.rowid DESC LIMIT ?)`)
+		args = append(args, userID, rule.MaxRows)
+	}
+	where := `user_id = ? AND (` + strings.Join(conds, ` OR `) + `)`
+	if dryRun {
+		var n int64
+		err := tx.QueryRow(`SELECT COUNT(1) FROM `+kind+` WHERE `+where, args...).Scan(&n)
+		return n, err
+	}
+	res, err := tx.Exec(`DELETE FROM `+kind+` WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
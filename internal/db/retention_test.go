@@ -0,0 +1,94 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	d := openTestDB(t)
+	now := time.Now()
+	old := now.Add(-20 * 24 * time.Hour).Unix()
+	// The admin account (1) is created by Open.
+	for _, q := range []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO users(id, username, password) VALUES (2, 'bob', 'x')`, nil},
+		{`INSERT INTO play_history(user_id, profile_id, site_key, spider_api, video_id, video_title, updated_at) VALUES
+			(1, 0, 's', 'api', 'a', 'A', 1), (1, 0, 's', 'api', 'b', 'B', 2), (1, 0, 's', 'api', 'c', 'C', 3),
+			(1, 1, 's', 'api', 'a', 'A', 1), (1, 1, 's', 'api', 'b', 'B', 2), (1, 1, 's', 'api', 'c', 'C', 3),
+			(2, 0, 's', 'api', 'a', 'A', 1), (2, 0, 's', 'api', 'b', 'B', 2), (2, 0, 's', 'api', 'c', 'C', 3)`, nil},
+		{`INSERT INTO search_history(user_id, profile_id, keyword, updated_at) VALUES (1, 0, 'old', ?), (1, 0, 'new', ?)`, []any{old, now.Unix()}},
+		{`INSERT INTO favorites(user_id, profile_id, site_key, spider_api, video_id, video_title, updated_at) VALUES
+			(2, 0, 's', 'api', 'a', 'A', 1), (2, 0, 's', 'api', 'b', 'B', 2)`, nil},
+	} {
+		if _, err := d.SQL().Exec(q.query, q.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.SetGlobalRetention(RetentionPolicy{
+		"play_history":   {MaxRows: 2},
+		"search_history": {MaxDays: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob's overrides replace the global rule for their kinds: no limit on
+	// play history, and a limit on favorites where the global has none.
+	if err := d.SetUserRetention(2, RetentionPolicy{"play_history": {}, "favorites": {MaxRows: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(query string) int {
+		t.Helper()
+		var n int
+		if err := d.SQL().QueryRow(`SELECT COUNT(1) FROM ` + query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	want := map[string]int64{"play_history": 2, "search_history": 1, "favorites": 1}
+
+	preview, err := d.ApplyRetention(now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, n := range want {
+		if preview.Totals[kind] != n {
+			t.Errorf("dry run %s = %d, want %d", kind, preview.Totals[kind], n)
+		}
+	}
+	if got := count(`play_history`) + count(`search_history`) + count(`favorites`); got != 13 {
+		t.Fatalf("dry run deleted rows: %d left, want 13", got)
+	}
+
+	report, err := d.ApplyRetention(now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, n := range want {
+		if report.Totals[kind] != n {
+			t.Errorf("%s removed %d, dry run said %d", kind, report.Totals[kind], n)
+		}
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		// MaxRows applies per profile and keeps the newest rows.
+		{`play_history WHERE user_id = 1 AND profile_id = 0 AND video_id IN ('b', 'c')`, 2},
+		{`play_history WHERE user_id = 1 AND profile_id = 1 AND video_id IN ('b', 'c')`, 2},
+		{`play_history WHERE user_id = 1`, 4},
+		{`play_history WHERE user_id = 2`, 3},
+		{`search_history WHERE keyword = 'new'`, 1},
+		{`search_history`, 1},
+		{`favorites WHERE user_id = 2 AND video_id = 'b'`, 1},
+		{`favorites`, 1},
+	}
+	for _, tt := range tests {
+		if got := count(tt.query); got != tt.want {
+			t.Errorf("%s: %d rows, want %d", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secrets (pan credentials in pan_login_settings, the OIDC client secret in
+// oidc_settings, users.cat_api_key and TOTP secrets in user_totp) use
+// envelope encryption: values are sealed with AES-256-GCM under a random data
+// key, and the data key is stored in data_keys wrapped by the master key from
+// MEOWFILM_MASTER_KEY or MEOWFILM_MASTER_KEY_FILE. Without a master key the
+// values are stored as plain text, as before.
+
+const sealedPrefix = "enc:v1:"
+
+// panSecretFields are the pan_login_settings fields that hold credentials.
+var panSecretFields = []string{"cookie", "authorization", "username", "password", "refresh_token"}
+
+type secretKeys struct {
+	master  []byte
+	current int64
+	data    map[int64][]byte
+}
+
+// MasterKeyFromEnv returns the master key configured through
+// MEOWFILM_MASTER_KEY or MEOWFILM_MASTER_KEY_FILE, or nil if none is set.
+func MasterKeyFromEnv() ([]byte, error) {
+	if v := strings.TrimSpace(os.Getenv("MEOWFILM_MASTER_KEY")); v != "" {
+		key, err := ParseMasterKey([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("MEOWFILM_MASTER_KEY：%w", err)
+		}
+		return key, nil
+	}
+	if p := strings.TrimSpace(os.Getenv("MEOWFILM_MASTER_KEY_FILE")); p != "" {
+		return ReadMasterKeyFile(p)
+	}
+	return nil, nil
+}
+
+// ReadMasterKeyFile reads a master key file as accepted by ParseMasterKey.
+func ReadMasterKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseMasterKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s：%w", path, err)
+	}
+	return key, nil
+}
+
+// ParseMasterKey accepts a 32-byte key as base64, hex or raw bytes.
+func ParseMasterKey(b []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(b))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(b) == 32 {
+		return append([]byte(nil), b...), nil
+	}
+	return nil, errors.New("主密钥必须是 32 字节（base64 或 hex 编码）")
+}
+
+// EncryptionEnabled reports whether secrets are encrypted at rest.
+func (d *DB) EncryptionEnabled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.secrets.master != nil
+}
+
+// initSecrets loads the data keys with the configured master key, creating
+// the first one if needed, and seals any secrets still stored as plain text.
+func (d *DB) initSecrets() error {
+	master, err := MasterKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	keys, err := loadSecretKeys(d.db, master)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		d.mu.Lock()
+		d.secrets = keys
+		d.mu.Unlock()
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if keys.current == 0 {
+		if keys, err = addDataKey(tx, keys); err != nil {
+			return err
+		}
+	}
+	err = rewriteSecrets(tx, func(v string) (string, error) {
+		if strings.HasPrefix(v, sealedPrefix) {
+			return v, nil
+		}
+		return keys.seal(v)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.secrets = keys
+	delete(d.settingsCache, "pan_login_settings")
+	delete(d.settingsCache, "oidc_settings")
+	d.mu.Unlock()
+	return nil
+}
+
+func loadSecretKeys(q queryer, master []byte) (secretKeys, error) {
+	keys := secretKeys{master: master, data: map[int64][]byte{}}
+	rows, err := q.Query(`SELECT id, wrapped_key FROM data_keys ORDER BY id`)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id      int64
+			wrapped string
+		)
+		if err := rows.Scan(&id, &wrapped); err != nil {
+			return keys, err
+		}
+		if master == nil {
+			return keys, errors.New("数据库中的敏感数据已加密，请通过 MEOWFILM_MASTER_KEY 或 MEOWFILM_MASTER_KEY_FILE 提供主密钥")
+		}
+		dataKey, err := unwrapDataKey(master, wrapped)
+		if err != nil {
+			return keys, errors.New("主密钥与数据库不匹配，无法解密数据密钥")
+		}
+		keys.data[id] = dataKey
+		keys.current = id
+	}
+	return keys, rows.Err()
+}
+
+func addDataKey(tx *sql.Tx, keys secretKeys) (secretKeys, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return keys, err
+	}
+	wrapped, err := gcmSeal(keys.master, dataKey, []byte("meowfilm-data-key"))
+	if err != nil {
+		return keys, err
+	}
+	res, err := tx.Exec(`INSERT INTO data_keys(wrapped_key, created_at) VALUES (?, ?)`, base64.StdEncoding.EncodeToString(wrapped), time.Now().UnixMilli())
+	if err != nil {
+		return keys, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return keys, err
+	}
+	data := map[int64][]byte{id: dataKey}
+	for k, v := range keys.data {
+		data[k] = v
+	}
+	return secretKeys{master: keys.master, current: id, data: data}, nil
+}
+
+func unwrapDataKey(master []byte, wrapped string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(master, b, []byte("meowfilm-data-key"))
+}
+
+func (k secretKeys) seal(plain string) (string, error) {
+	if plain == "" || k.master == nil {
+		return plain, nil
+	}
+	b, err := gcmSeal(k.data[k.current], []byte(plain), nil)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + strconv.FormatInt(k.current, 10) + ":" + base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+func (k secretKeys) open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	idText, payload, ok := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("invalid sealed value")
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid sealed value")
+	}
+	dataKey, ok := k.data[id]
+	if !ok {
+		return "", fmt.Errorf("data key %d not available", id)
+	}
+	b, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+	plain, err := gcmOpen(dataKey, b, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func gcmSeal(key, plain, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// SealSecret encrypts a secret for storage. It returns plain unchanged when
+// no master key is configured.
+func (d *DB) SealSecret(plain string) (string, error) {
+	d.mu.Lock()
+	keys := d.secrets
+	d.mu.Unlock()
+	return keys.seal(plain)
+}
+
+// OpenSecret decrypts a value written by SealSecret. Plain-text values are
+// returned as is.
+func (d *DB) OpenSecret(stored string) (string, error) {
+	d.mu.Lock()
+	keys := d.secrets
+	d.mu.Unlock()
+	return keys.open(stored)
+}
+
+// PanLoginSettings returns pan_login_settings with credentials decrypted.
+// Fields that cannot be decrypted keep their sealed value and the first
+// such error is returned with the settings; SetPanLoginSettings stores
+// sealed values back unchanged, so saving the result loses nothing.
+func (d *DB) PanLoginSettings() (map[string]any, error) {
+	var store map[string]any
+	if err := json.Unmarshal([]byte(d.GetSetting("pan_login_settings")), &store); err != nil || store == nil {
+		return map[string]any{}, nil
+	}
+	d.mu.Lock()
+	keys := d.secrets
+	d.mu.Unlock()
+	return store, mapPanSecrets(store, keys.open)
+}
+
+// SetPanLoginSettings stores pan_login_settings, encrypting credentials.
+// Values that are already sealed, such as fields PanLoginSettings could not
+// decrypt, are stored as they are.
+func (d *DB) SetPanLoginSettings(store map[string]any) error {
+	d.mu.Lock()
+	keys := d.secrets
+	d.mu.Unlock()
+	sealed := map[string]any{}
+	for k, v := range store {
+		if m, ok := v.(map[string]any); ok {
+			cp := make(map[string]any, len(m))
+			for f, fv := range m {
+				cp[f] = fv
+			}
+			v = cp
+		}
+		sealed[k] = v
+	}
+	err := mapPanSecrets(sealed, func(v string) (string, error) {
+		if strings.HasPrefix(v, sealedPrefix) {
+			return v, nil
+		}
+		return keys.seal(v)
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	return d.SetSetting("pan_login_settings", string(b))
+}
+
+// mapPanSecrets applies conv to every credential field in store, in place.
+// Fields that fail to convert are left as they are and the first error is
+// returned.
+func mapPanSecrets(store map[string]any, conv func(string) (string, error)) error {
+	var firstErr error
+	for _, v := range store {
+		m, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, f := range panSecretFields {
+			s, ok := m[f].(string)
+			if !ok || s == "" {
+				continue
+			}
+			out, err := conv(s)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			m[f] = out
+		}
+	}
+	return firstErr
+}
+
+// rewriteSecrets passes every stored secret through conv inside tx.
+func rewriteSecrets(tx *sql.Tx, conv func(string) (string, error)) error {
+	err := rewriteSettingJSON(tx, "pan_login_settings", func(store map[string]any) error {
+		return mapPanSecrets(store, conv)
+	})
+	if err != nil {
+		return err
+	}
+	err = rewriteSettingJSON(tx, "oidc_settings", func(s map[string]any) error {
+		secret, ok := s["clientSecret"].(string)
+		if !ok || secret == "" {
+			return nil
+		}
+		out, err := conv(secret)
+		if err != nil {
+			return fmt.Errorf("oidc_settings clientSecret: %w", err)
+		}
+		s["clientSecret"] = out
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := rewriteColumn(tx, conv, "users", "id", "cat_api_key"); err != nil {
+		return err
+	}
+	return rewriteColumn(tx, conv, "user_totp", "user_id", "secret")
+}
+
+// rewriteSettingJSON applies fn to the JSON object stored under key and
+// writes it back. Missing or malformed settings are left alone.
+func rewriteSettingJSON(tx *sql.Tx, key string, fn func(map[string]any) error) error {
+	var raw sql.NullString
+	if err := tx.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&raw); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var m map[string]any
+	if !raw.Valid || json.Unmarshal([]byte(raw.String), &m) != nil || m == nil {
+		return nil
+	}
+	if err := fn(m); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE settings SET value = ? WHERE key = ?`, string(b), key)
+	return err
+}
+
+// rewriteColumn passes every non-empty value of table.column through conv.
+func rewriteColumn(tx *sql.Tx, conv func(string) (string, error), table, idColumn, column string) error {
+	rows, err := tx.Query(`SELECT ` + idColumn + `, ` + column + ` FROM ` + table + ` WHERE ` + column + ` IS NOT NULL AND ` + column + ` != ''`)
+	if err != nil {
+		return err
+	}
+	type rowValue struct {
+		id    int64
+		value string
+	}
+	var values []rowValue
+	for rows.Next() {
+		var v rowValue
+		if err := rows.Scan(&v.id, &v.value); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		values = append(values, v)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, v := range values {
+		out, err := conv(v.value)
+		if err != nil {
+			return fmt.Errorf("%s %d %s: %w", table, v.id, column, err)
+		}
+		if out == v.value {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE `+table+` SET `+column+` = ? WHERE `+idColumn+` = ?`, out, v.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateMasterKey re-encrypts every secret under a fresh data key wrapped by
+// newMaster and drops the old data keys. It is meant for offline use: other
+// processes holding the old keys cannot read the rotated values.
+func (d *DB) RotateMasterKey(newMaster []byte) error {
+	if len(newMaster) != 32 {
+		return errors.New("主密钥必须是 32 字节")
+	}
+	d.mu.Lock()
+	old := d.secrets
+	d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	next, err := addDataKey(tx, secretKeys{master: newMaster, data: map[int64][]byte{}})
+	if err != nil {
+		return err
+	}
+	err = rewriteSecrets(tx, func(v string) (string, error) {
+		plain, err := old.open(v)
+		if err != nil {
+			return "", err
+		}
+		return next.seal(plain)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM data_keys WHERE id != ?`, next.current); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.secrets = next
+	delete(d.settingsCache, "pan_login_settings")
+	delete(d.settingsCache, "oidc_settings")
+	d.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,297 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testMasterKey = bytes.Repeat([]byte{1}, 32)
+	testNewKey    = bytes.Repeat([]byte{2}, 32)
+)
+
+// openWithKey opens the database at path with master as MEOWFILM_MASTER_KEY
+// (none when nil).
+func openWithKey(t *testing.T, path string, master []byte) (*DB, error) {
+	t.Helper()
+	t.Setenv("MEOWFILM_DATA_DIR", filepath.Dir(path))
+	t.Setenv("MEOWFILM_DB_FILE", path)
+	t.Setenv("MEOWFILM_MASTER_KEY", "")
+	t.Setenv("MEOWFILM_MASTER_KEY_FILE", "")
+	if master != nil {
+		t.Setenv("MEOWFILM_MASTER_KEY", base64.StdEncoding.EncodeToString(master))
+	}
+	d, err := Open()
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = d.Close() })
+	return d, nil
+}
+
+// openAt opens the database file at path as the server would.
+func openAt(t *testing.T, path string) *DB {
+	t.Helper()
+	d, err := openWithKey(t, path, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return d
+}
+
+// openTestDB opens a fresh database in a temporary directory.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	return openAt(t, filepath.Join(t.TempDir(), "data.db"))
+}
+
+func TestParseMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	tests := []struct {
+		name  string
+		input []byte
+		ok    bool
+	}{
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key)), true},
+		{"base64 with newline", []byte(base64.StdEncoding.EncodeToString(key) + "\n"), true},
+		{"hex", []byte(hex.EncodeToString(key)), true},
+		{"raw bytes", key, true},
+		{"too short", []byte(base64.StdEncoding.EncodeToString(key[:16])), false},
+		{"garbage", []byte("not a key"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMasterKey(tt.input)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok=%v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, key) {
+				t.Errorf("key = %x", got)
+			}
+		})
+	}
+}
+
+func TestSealAndOpen(t *testing.T) {
+	keys := secretKeys{master: testMasterKey, current: 3, data: map[int64][]byte{3: bytes.Repeat([]byte{9}, 32)}}
+	sealed, err := keys.seal("cookie=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := []byte(sealed)
+	tamper[len(tamper)-2] ^= 1
+
+	tests := []struct {
+		name    string
+		keys    secretKeys
+		stored  string
+		want    string
+		wantErr bool
+	}{
+		{name: "sealed round trip", keys: keys, stored: sealed, want: "cookie=1"},
+		{name: "plain text passes through", keys: keys, stored: "plain", want: "plain"},
+		{name: "tampered", keys: keys, stored: string(tamper), wantErr: true},
+		{name: "unknown data key", keys: secretKeys{master: testMasterKey, data: map[int64][]byte{}}, stored: sealed, wantErr: true},
+		{name: "malformed", keys: keys, stored: sealedPrefix + "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.open(tt.stored)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("open err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("open = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if !strings.HasPrefix(sealed, sealedPrefix+"3:") {
+		t.Errorf("sealed = %q, want the data key id after the prefix", sealed)
+	}
+	for _, k := range []secretKeys{keys, {}} {
+		if got, _ := k.seal(""); got != "" {
+			t.Errorf("seal(\"\") = %q", got)
+		}
+	}
+	if got, _ := (secretKeys{}).seal("plain"); got != "plain" {
+		t.Errorf("seal without master key = %q, want plain text", got)
+	}
+}
+
+// writeSecrets stores one secret of every kind.
+func writeSecrets(t *testing.T, d *DB) {
+	t.Helper()
+	if err := d.SetPanLoginSettings(map[string]any{"quark": map[string]any{"cookie": "pan-cookie"}}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.SealSecret("cat-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SQL().Exec(`UPDATE users SET cat_api_key = ? WHERE username = 'admin'`, key); err != nil {
+		t.Fatal(err)
+	}
+	clientSecret, err := d.SealSecret("client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetSetting("oidc_settings", `{"enabled":true,"clientSecret":"`+clientSecret+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := d.SealSecret("totp-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SQL().Exec(`INSERT INTO user_totp(user_id, secret, created_at) VALUES (1, ?, ?)`, secret, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSecrets reads every secret back through d and checks how it is stored.
+func checkSecrets(t *testing.T, d *DB, sealed bool) {
+	t.Helper()
+	store, err := d.PanLoginSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store["quark"].(map[string]any)["cookie"]; got != "pan-cookie" {
+		t.Errorf("pan cookie = %v", got)
+	}
+	if strings.Contains(d.GetSetting("pan_login_settings"), "pan-cookie") == sealed {
+		t.Errorf("pan_login_settings stored as %s", d.GetSetting("pan_login_settings"))
+	}
+	for _, c := range []struct{ query, want string }{
+		{`SELECT json_extract(value, '$.clientSecret') FROM settings WHERE key = 'oidc_settings'`, "client-secret"},
+		{`SELECT cat_api_key FROM users WHERE username = 'admin'`, "cat-key"},
+		{`SELECT secret FROM user_totp WHERE user_id = 1`, "totp-secret"},
+	} {
+		var stored string
+		if err := d.SQL().QueryRow(c.query).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(stored, sealedPrefix) != sealed {
+			t.Errorf("%s stored as %q, sealed=%v", c.want, stored, sealed)
+		}
+		if plain, err := d.OpenSecret(stored); err != nil || plain != c.want {
+			t.Errorf("OpenSecret(%q) = %q, %v; want %q", stored, plain, err, c.want)
+		}
+	}
+}
+
+func TestSecretsEncryptedOnStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	d, err := openWithKey(t, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSecrets(t, d)
+	checkSecrets(t, d, false)
+	_ = d.Close()
+
+	d, err = openWithKey(t, path, testMasterKey)
+	if err != nil {
+		t.Fatalf("open with master key: %v", err)
+	}
+	if !d.EncryptionEnabled() {
+		t.Error("EncryptionEnabled = false")
+	}
+	checkSecrets(t, d, true)
+	_ = d.Close()
+
+	tests := []struct {
+		name   string
+		master []byte
+		want   string
+	}{
+		{"no master key", nil, "已加密"},
+		{"wrong master key", testNewKey, "不匹配"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openWithKey(t, path, tt.master); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("open err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	tests := []struct {
+		name string
+		// old is the master key before rotation; nil rotates plain-text
+		// secrets.
+		old []byte
+	}{
+		{"from a master key", testMasterKey},
+		{"from plain text", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.db")
+			d, err := openWithKey(t, path, tt.old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeSecrets(t, d)
+			if err := d.RotateMasterKey(testNewKey[:16]); err == nil {
+				t.Error("RotateMasterKey accepted a short key")
+			}
+			if err := d.RotateMasterKey(testNewKey); err != nil {
+				t.Fatalf("RotateMasterKey: %v", err)
+			}
+			checkSecrets(t, d, true)
+			var keys int
+			if err := d.SQL().QueryRow(`SELECT COUNT(1) FROM data_keys`).Scan(&keys); err != nil || keys != 1 {
+				t.Errorf("data keys = %d, %v; want 1", keys, err)
+			}
+			_ = d.Close()
+
+			if _, err := openWithKey(t, path, tt.old); err == nil {
+				t.Error("database still opens with the old key")
+			}
+			d, err = openWithKey(t, path, testNewKey)
+			if err != nil {
+				t.Fatalf("open with new key: %v", err)
+			}
+			checkSecrets(t, d, true)
+		})
+	}
+}
+
+func TestPanSecretsKeptWhenUndecryptable(t *testing.T) {
+	d, err := openWithKey(t, filepath.Join(t.TempDir(), "data.db"), testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const lost = sealedPrefix + "999:AAAA"
+	if err := d.SetSetting("pan_login_settings", `{"quark":{"cookie":"`+lost+`"}}`); err != nil {
+		t.Fatal(err)
+	}
+	store, err := d.PanLoginSettings()
+	if err == nil {
+		t.Error("PanLoginSettings hid the decrypt error")
+	}
+	quark := store["quark"].(map[string]any)
+	if quark["cookie"] != lost {
+		t.Fatalf("cookie = %v, want the sealed value kept", quark["cookie"])
+	}
+
+	// Saving another pan must not clear or re-seal the lost value.
+	store["baidu"] = map[string]any{"cookie": "baidu-cookie"}
+	if err := d.SetPanLoginSettings(store); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = d.PanLoginSettings()
+	if got := store["quark"].(map[string]any)["cookie"]; got != lost {
+		t.Errorf("quark cookie after save = %v", got)
+	}
+	if got := store["baidu"].(map[string]any)["cookie"]; got != "baidu-cookie" {
+		t.Errorf("baidu cookie after save = %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+// Package maintenance runs periodic housekeeping tasks and remembers the
+// outcome of their last run.
+package maintenance
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrUnknownTask is returned by RunNow for a name that was not registered.
+var ErrUnknownTask = errors.New("unknown task")
+
+// Task is a unit of periodic work.
+type Task struct {
+	Name string
+	// Interval is consulted on every tick, so it can follow live settings.
+	// A non-positive interval disables the task.
+	Interval func() time.Duration
+	// Run does the work and returns a short summary of what it did.
+	Run func(now time.Time) (string, error)
+	// Since is when the task last ran before this process started, if known.
+	// Without it the first run waits a full interval from New, so restarts
+	// do not run every task at once.
+	Since time.Time
+}
+
+// Status is the outcome of a task's last run.
+type Status struct {
+	Name       string `json:"name"`
+	Interval   int64  `json:"intervalSeconds"`
+	LastRun    int64  `json:"lastRun"`
+	DurationMs int64  `json:"durationMs"`
+	Result     string `json:"result"`
+	Error      string `json:"error"`
+	Running    bool   `json:"running"`
+}
+
+type Janitor struct {
+	tick  time.Duration
+	tasks []Task
+
+	mu     sync.Mutex
+	last   map[string]time.Time
+	status map[string]*Status
+}
+
+// New returns a janitor that checks the tasks once a minute.
+func New(tasks ...Task) *Janitor {
+	j := &Janitor{
+		tick:   time.Minute,
+		tasks:  tasks,
+		last:   map[string]time.Time{},
+		status: map[string]*Status{},
+	}
+	start := time.Now()
+	for _, t := range tasks {
+		j.last[t.Name] = t.Since
+		if t.Since.IsZero() {
+			j.last[t.Name] = start
+		}
+		j.status[t.Name] = &Status{Name: t.Name}
+	}
+	return j
+}
+
+// Run runs due tasks until stop is closed.
+func (j *Janitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(j.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			j.runDue(now)
+		}
+	}
+}
+
+// runDue runs every task whose interval has passed since its last run.
+func (j *Janitor) runDue(now time.Time) {
+	for _, t := range j.tasks {
+		interval := t.Interval()
+		if interval <= 0 {
+			continue
+		}
+		j.mu.Lock()
+		due := now.Sub(j.last[t.Name]) >= interval
+		j.mu.Unlock()
+		if due {
+			j.run(t, now)
+		}
+	}
+}
+
+// RunNow runs the named task immediately, whatever its schedule.
+func (j *Janitor) RunNow(name string) (Status, error) {
+	for _, t := range j.tasks {
+		if t.Name == name {
+			return j.run(t, time.Now()), nil
+		}
+	}
+	return Status{}, ErrUnknownTask
+}
+
+func (j *Janitor) run(t Task, now time.Time) Status {
+	j.mu.Lock()
+	st := j.status[t.Name]
+	if st.Running {
+		out := *st
+		j.mu.Unlock()
+		return out
+	}
+	st.Running = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	result, err := t.Run(now)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Printf("maintenance %s: %v", t.Name, err)
+	}
+
+	interval := t.Interval()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.last[t.Name] = now
+	st.Interval = int64(max(interval, 0) / time.Second)
+	st.Running = false
+	st.LastRun = now.UnixMilli()
+	st.DurationMs = elapsed.Milliseconds()
+	st.Result = result
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	}
+	return *st
+}
+
+// Status reports every task in registration order.
+func (j *Janitor) Status() []Status {
+	out := make([]Status, 0, len(j.tasks))
+	for _, t := range j.tasks {
+		interval := t.Interval()
+		j.mu.Lock()
+		st := *j.status[t.Name]
+		j.mu.Unlock()
+		st.Interval = int64(max(interval, 0) / time.Second)
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package maintenance
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunDue(t *testing.T) {
+	tests := []struct {
+		name     string
+		since    time.Duration // before New; 0 leaves Since unset
+		interval time.Duration
+		after    time.Duration // after New
+		want     bool
+	}{
+		{"fresh janitor waits", 0, time.Hour, time.Minute, false},
+		{"fresh janitor runs after the interval", 0, time.Hour, time.Hour + time.Minute, true},
+		{"known last run is overdue", 2 * time.Hour, time.Hour, time.Minute, true},
+		{"known last run is recent", 10 * time.Minute, time.Hour, time.Minute, false},
+		{"disabled", 2 * time.Hour, 0, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := 0
+			task := Task{
+				Name:     "task",
+				Interval: func() time.Duration { return tt.interval },
+				Run: func(time.Time) (string, error) {
+					ran++
+					return "ok", nil
+				},
+			}
+			if tt.since > 0 {
+				task.Since = time.Now().Add(-tt.since)
+			}
+			j := New(task)
+			j.runDue(time.Now().Add(tt.after))
+			if (ran > 0) != tt.want {
+				t.Fatalf("ran %d times, want run=%v", ran, tt.want)
+			}
+			if tt.want {
+				// The run resets the schedule.
+				j.runDue(time.Now().Add(tt.after + time.Minute))
+				if ran != 1 {
+					t.Errorf("ran %d times a minute after running", ran)
+				}
+			}
+		})
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	j := New(Task{
+		Name:     "fails",
+		Interval: func() time.Duration { return time.Hour },
+		Run:      func(time.Time) (string, error) { return "", errors.New("boom") },
+	})
+	st, err := j.RunNow("fails")
+	if err != nil || st.Error != "boom" || st.LastRun == 0 || st.Interval != 3600 {
+		t.Errorf("RunNow = %+v, %v", st, err)
+	}
+	if _, err := j.RunNow("missing"); !errors.Is(err, ErrUnknownTask) {
+		t.Errorf("RunNow(missing) err = %v", err)
+	}
+	if got := j.Status(); len(got) != 1 || got[0].Error != "boom" {
+		t.Errorf("Status = %+v", got)
+	}
+}
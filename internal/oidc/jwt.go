@@ -0,0 +1,251 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for RS384/RS512 and friends
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes an RSA or EC (P-256, P-384) key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key with kid, refetching the JWKS when it is unknown
+// so provider key rotation is picked up.
+func (c *Client) key(ctx context.Context, p *provider, kid string) (jwk, error) {
+	c.mu.Lock()
+	keys, fetchedAt := p.keys, p.keysFetchedAt
+	c.mu.Unlock()
+	if k, ok := pickKey(keys, kid); ok {
+		return k, nil
+	}
+	if time.Since(fetchedAt) < jwksRefreshMin {
+		return jwk{}, errors.New("signing key not found")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.JWKSURI, nil)
+	if err != nil {
+		return jwk{}, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.doJSON(req, &set); err != nil {
+		return jwk{}, fmt.Errorf("jwks: %w", err)
+	}
+	keys = map[string]jwk{}
+	for _, k := range set.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			keys[k.Kid] = k
+		}
+	}
+	c.mu.Lock()
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	c.mu.Unlock()
+	if k, ok := pickKey(keys, kid); ok {
+		return k, nil
+	}
+	return jwk{}, errors.New("signing key not found")
+}
+
+// pickKey finds kid, or the only key when the token names none.
+func pickKey(keys map[string]jwk, kid string) (jwk, bool) {
+	if k, ok := keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, true
+		}
+	}
+	return jwk{}, false
+}
+
+// verify checks the ID token signature and its standard claims.
+func (c *Client) verify(ctx context.Context, p *provider, clientID, raw, nonce string) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id_token: malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id_token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("id_token: bad signature encoding")
+	}
+	k, err := c.key(ctx, p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := k.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, pub, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id_token claims: %w", err)
+	}
+	now := time.Now()
+	if strings.TrimRight(claims.String("iss"), "/") != strings.TrimRight(p.Issuer, "/") {
+		return nil, errors.New("id_token: issuer mismatch")
+	}
+	aud := claims.Strings("aud")
+	found := false
+	for _, a := range aud {
+		found = found || a == clientID
+	}
+	if !found {
+		return nil, errors.New("id_token: audience mismatch")
+	}
+	if azp := claims.String("azp"); len(aud) > 1 && azp != clientID {
+		return nil, errors.New("id_token: authorized party mismatch")
+	}
+	exp, _ := claims["exp"].(float64)
+	if exp == 0 || now.Add(-clockSkew).Unix() > int64(exp) {
+		return nil, errors.New("id_token: expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && int64(iat) > now.Add(clockSkew).Unix() {
+		return nil, errors.New("id_token: issued in the future")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("id_token: nonce mismatch")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("id_token: missing sub")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("id_token: unsupported alg %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if !hash.Available() {
+		return fmt.Errorf("id_token: unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	bad := errors.New("id_token: invalid signature")
+	switch alg[:2] {
+	case "RS", "PS":
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return bad
+		}
+		if alg[:2] == "PS" {
+			if rsa.VerifyPSS(key, hash, digest, sig, nil) != nil {
+				return bad
+			}
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return bad
+		}
+		return nil
+	case "ES":
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return bad
+		}
+		// The signature is r and s, each padded to the curve size, on the
+		// curve that goes with the alg: P-256 for ES256, P-384 for ES384.
+		bits := key.Curve.Params().BitSize
+		if bits != hash.Size()*8 || len(sig) != 2*((bits+7)/8) {
+			return bad
+		}
+		half := len(sig) / 2
+		r, s := new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return bad
+		}
+		return nil
+	}
+	return fmt.Errorf("id_token: unsupported alg %q", alg)
+}
+
+func decodeSegment(seg string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
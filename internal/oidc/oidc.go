@@ -0,0 +1,261 @@
+// Package oidc implements the relying-party side of OpenID Connect login:
+// discovery, the authorization code flow with PKCE, and ID token
+// verification against the issuer's JWKS.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryTTL is how long provider metadata is cached.
+const discoveryTTL = time.Hour
+
+// jwksRefreshMin limits refetching the key set when an unknown key ID shows up.
+const jwksRefreshMin = 10 * time.Second
+
+// clockSkew is tolerated on exp and iat.
+const clockSkew = time.Minute
+
+// Config is a relying party registration at one issuer.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Client talks to OpenID providers and caches their metadata and keys.
+type Client struct {
+	HTTP *http.Client
+
+	mu        sync.Mutex
+	providers map[string]*provider
+}
+
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	fetchedAt     time.Time
+	keys          map[string]jwk
+	keysFetchedAt time.Time
+}
+
+func NewClient() *Client {
+	return &Client{HTTP: &http.Client{Timeout: 15 * time.Second}, providers: map[string]*provider{}}
+}
+
+// Claims are the verified claims of an ID token, merged with userinfo.
+type Claims map[string]any
+
+// String returns a string claim, or "".
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that may be a single string or an array of them.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := []string{}
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// AuthRequest holds the per-login secrets that must survive the redirect.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewAuthRequest generates state, nonce and PKCE verifier.
+func NewAuthRequest() (AuthRequest, error) {
+	var out AuthRequest
+	for _, dst := range []*string{&out.State, &out.Nonce, &out.Verifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return AuthRequest{}, err
+		}
+		*dst = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return out, nil
+}
+
+// AuthURL returns the provider URL that starts the login.
+func (c *Client) AuthURL(ctx context.Context, cfg Config, req AuthRequest) (string, error) {
+	p, err := c.provider(ctx, cfg.Issuer)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.ClientID)
+	q.Set("redirect_uri", cfg.RedirectURL)
+	q.Set("scope", strings.Join(scopes(cfg.Scopes), " "))
+	q.Set("state", req.State)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+func scopes(extra []string) []string {
+	out := []string{"openid"}
+	for _, s := range extra {
+		if s = strings.TrimSpace(s); s != "" && s != "openid" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Exchange redeems the authorization code and returns the verified claims.
+func (c *Client) Exchange(ctx context.Context, cfg Config, req AuthRequest, code string) (Claims, error) {
+	p, err := c.provider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", req.Verifier)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hreq.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		hreq.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	var tok struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		ErrorDesc   string `json:"error_description"`
+	}
+	if err := c.doJSON(hreq, &tok); err != nil && tok.Error == "" {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tok.Error, tok.ErrorDesc)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("token endpoint: no id_token")
+	}
+	claims, err := c.verify(ctx, p, cfg.ClientID, tok.IDToken, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if p.UserinfoEndpoint != "" && tok.AccessToken != "" {
+		if info, err := c.userinfo(ctx, p, tok.AccessToken); err == nil && info.String("sub") == claims.String("sub") {
+			for k, v := range info {
+				if _, ok := claims[k]; !ok {
+					claims[k] = v
+				}
+			}
+		}
+	}
+	return claims, nil
+}
+
+func (c *Client) userinfo(ctx context.Context, p *provider, accessToken string) (Claims, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	var out Claims
+	if err := c.doJSON(req, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// provider returns the cached discovery document for issuer.
+func (c *Client) provider(ctx context.Context, issuer string) (*provider, error) {
+	issuer = strings.TrimRight(strings.TrimSpace(issuer), "/")
+	if issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	c.mu.Lock()
+	p := c.providers[issuer]
+	c.mu.Unlock()
+	if p != nil && time.Since(p.fetchedAt) < discoveryTTL {
+		return p, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	next := &provider{}
+	if err := c.doJSON(req, next); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimRight(next.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery: issuer mismatch %q", next.Issuer)
+	}
+	if next.AuthorizationEndpoint == "" || next.TokenEndpoint == "" || next.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	next.fetchedAt = time.Now()
+	if p != nil && p.JWKSURI == next.JWKSURI {
+		next.keys, next.keysFetchedAt = p.keys, p.keysFetchedAt
+	}
+	c.mu.Lock()
+	c.providers[issuer] = next
+	c.mu.Unlock()
+	return next, nil
+}
+
+func (c *Client) doJSON(req *http.Request, dst any) error {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	jsonErr := json.Unmarshal(body, dst)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return jsonErr
+}
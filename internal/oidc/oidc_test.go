@@ -0,0 +1,411 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a mock OpenID provider. It hands out whatever ID token the
+// test last set and checks the PKCE verifier of each code redemption.
+type testIssuer struct {
+	*httptest.Server
+	rsa          *rsa.PrivateKey
+	p256, p384   *ecdsa.PrivateKey
+	mu           sync.Mutex
+	idToken      string
+	verifier     string
+	jwksRequests int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{}
+	var err error
+	if iss.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if iss.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if iss.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]string{
+			"issuer":                 iss.URL,
+			"authorization_endpoint": iss.URL + "/authorize",
+			"token_endpoint":         iss.URL + "/token",
+			"userinfo_endpoint":      iss.URL + "/userinfo",
+			"jwks_uri":               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		iss.jwksRequests++
+		iss.mu.Unlock()
+		enc := base64.RawURLEncoding.EncodeToString
+		ec := func(kid string, k *ecdsa.PrivateKey, crv string) map[string]string {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			return map[string]string{"kty": "EC", "kid": kid, "crv": crv, "x": enc(k.X.FillBytes(make([]byte, size))), "y": enc(k.Y.FillBytes(make([]byte, size)))}
+		}
+		writeTestJSON(w, map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc(iss.rsa.N.Bytes()), "e": enc(big.NewInt(int64(iss.rsa.E)).Bytes())},
+			ec("p256", iss.p256, "P-256"),
+			ec("p384", iss.p384, "P-384"),
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": enc(iss.rsa.N.Bytes()), "e": "AQAB"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != iss.verifier {
+			w.WriteHeader(http.StatusBadRequest)
+			writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeTestJSON(w, map[string]string{"id_token": iss.idToken, "access_token": "at", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeTestJSON(w, map[string]any{"sub": "user-1", "groups": []string{"family"}, "nonce": "from-userinfo"})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func writeTestJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// sign builds a JWT with the given header and claims, signed by the key
+// that goes with alg and kid.
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := segment(t, header) + "." + segment(t, claims)
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	var sig []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		var err error
+		switch alg[:2] {
+		case "RS":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsa, hash, digest)
+		case "PS":
+			sig, err = rsa.SignPSS(rand.Reader, iss.rsa, hash, digest, nil)
+		case "ES":
+			key := iss.p256
+			if kid == "p384" {
+				key = iss.p384
+			}
+			r, s, e := ecdsa.Sign(rand.Reader, key, digest)
+			size := (key.Curve.Params().BitSize + 7) / 8
+			sig, err = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), e
+		case "HS":
+			// An attacker using the public key as an HMAC secret.
+			mac := hmac.New(hash.New, iss.rsa.N.Bytes())
+			mac.Write([]byte(signed))
+			sig = mac.Sum(nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (iss *testIssuer) claims(nonce string) map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"iss":                iss.URL,
+		"sub":                "user-1",
+		"aud":                "meowfilm",
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              nonce,
+		"preferred_username": "alice",
+	}
+}
+
+// login runs the authorization code flow against iss with the ID token
+// that mint builds from the request nonce.
+func login(t *testing.T, c *Client, iss *testIssuer, mint func(nonce string) string) (Claims, error) {
+	t.Helper()
+	cfg := Config{Issuer: iss.URL + "/", ClientID: "meowfilm", RedirectURL: "https://films.example/api/oidc/callback", Scopes: []string{"profile", "openid"}}
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := c.AuthURL(context.Background(), cfg, req)
+	if err != nil {
+		t.Fatalf("AuthURL: %v", err)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("state") != req.State || q.Get("nonce") != req.Nonce || q.Get("scope") != "openid profile" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("AuthURL = %s", target)
+	}
+	iss.mu.Lock()
+	iss.verifier = q.Get("code_challenge")
+	iss.idToken = mint(req.Nonce)
+	iss.mu.Unlock()
+	return c.Exchange(context.Background(), cfg, req, "good-code")
+}
+
+func TestExchange(t *testing.T) {
+	iss := newTestIssuer(t)
+	c := NewClient()
+	tests := []struct {
+		name    string
+		mint    func(iss *testIssuer, nonce string) string
+		wantErr string
+	}{
+		{name: "RS256", mint: func(iss *testIssuer, nonce string) string { return iss.sign(t, "RS256", "rsa", iss.claims(nonce)) }},
+		{name: "RS384", mint: func(iss *testIssuer, nonce string) string { return iss.sign(t, "RS384", "rsa", iss.claims(nonce)) }},
+		{name: "PS256", mint: func(iss *testIssuer, nonce string) string { return iss.sign(t, "PS256", "rsa", iss.claims(nonce)) }},
+		{name: "ES256", mint: func(iss *testIssuer, nonce string) string { return iss.sign(t, "ES256", "p256", iss.claims(nonce)) }},
+		{name: "ES384", mint: func(iss *testIssuer, nonce string) string { return iss.sign(t, "ES384", "p384", iss.claims(nonce)) }},
+		{
+			name:    "alg none",
+			mint:    func(iss *testIssuer, nonce string) string { return iss.sign(t, "none", "rsa", iss.claims(nonce)) },
+			wantErr: "unsupported alg",
+		},
+		{
+			name:    "HS256 with the public key as secret",
+			mint:    func(iss *testIssuer, nonce string) string { return iss.sign(t, "HS256", "rsa", iss.claims(nonce)) },
+			wantErr: "unsupported alg",
+		},
+		{
+			name:    "RS256 claimed for an EC key",
+			mint:    func(iss *testIssuer, nonce string) string { return iss.sign(t, "RS256", "p256", iss.claims(nonce)) },
+			wantErr: "invalid signature",
+		},
+		{
+			name: "ES256 made with the P-384 key",
+			mint: func(iss *testIssuer, nonce string) string {
+				return signES(t, "ES256", "p384", iss.p384, crypto.SHA256, 48, iss.claims(nonce))
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "ES256 with r and s padded past the curve size",
+			mint: func(iss *testIssuer, nonce string) string {
+				return signES(t, "ES256", "p256", iss.p256, crypto.SHA256, 33, iss.claims(nonce))
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "ES256 with r and s padded to the curve size",
+			mint: func(iss *testIssuer, nonce string) string {
+				return signES(t, "ES256", "p256", iss.p256, crypto.SHA256, 32, iss.claims(nonce))
+			},
+		},
+		{
+			name: "tampered claims",
+			mint: func(iss *testIssuer, nonce string) string {
+				tok := strings.Split(iss.sign(t, "RS256", "rsa", iss.claims(nonce)), ".")
+				c := iss.claims(nonce)
+				c["preferred_username"] = "admin"
+				return tok[0] + "." + segment(t, c) + "." + tok[2]
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "key meant for encryption",
+			mint:    func(iss *testIssuer, nonce string) string { return iss.sign(t, "RS256", "enc", iss.claims(nonce)) },
+			wantErr: "signing key not found",
+		},
+		{
+			name: "nonce mismatch",
+			mint: func(iss *testIssuer, nonce string) string {
+				return iss.sign(t, "RS256", "rsa", iss.claims("replayed"))
+			},
+			wantErr: "nonce mismatch",
+		},
+		{
+			name: "audience mismatch",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				c["aud"] = "other-app"
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "audience mismatch",
+		},
+		{
+			name: "audience list without azp",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				c["aud"] = []string{"meowfilm", "other-app"}
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "authorized party mismatch",
+		},
+		{
+			name: "issuer mismatch",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				c["iss"] = "https://evil.example"
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "issuer mismatch",
+		},
+		{
+			name: "expired",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				c["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "no expiry",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				delete(c, "exp")
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "issued in the future",
+			mint: func(iss *testIssuer, nonce string) string {
+				c := iss.claims(nonce)
+				c["iat"] = time.Now().Add(2 * clockSkew).Unix()
+				return iss.sign(t, "RS256", "rsa", c)
+			},
+			wantErr: "issued in the future",
+		},
+		{
+			name:    "malformed",
+			mint:    func(iss *testIssuer, nonce string) string { return "a.b" },
+			wantErr: "malformed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := login(t, c, iss, func(nonce string) string { return tt.mint(iss, nonce) })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if claims.String("preferred_username") != "alice" || claims.String("sub") != "user-1" {
+				t.Errorf("claims = %v", claims)
+			}
+			// Userinfo adds claims but does not override the ID token.
+			if got := claims.Strings("groups"); len(got) != 1 || got[0] != "family" || claims.String("nonce") == "from-userinfo" {
+				t.Errorf("userinfo merge: %v", claims)
+			}
+		})
+	}
+}
+
+// signES signs with key over hash, writing r and s in size bytes each.
+func signES(t *testing.T, alg, kid string, key *ecdsa.PrivateKey, hash crypto.Hash, size int, claims map[string]any) string {
+	t.Helper()
+	signed := segment(t, map[string]string{"alg": alg, "kid": kid}) + "." + segment(t, claims)
+	h := hash.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func segment(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestExchangeRejectsWrongCode(t *testing.T) {
+	iss := newTestIssuer(t)
+	c := NewClient()
+	cfg := Config{Issuer: iss.URL, ClientID: "meowfilm"}
+	req, _ := NewAuthRequest()
+	if _, err := c.AuthURL(context.Background(), cfg, req); err != nil {
+		t.Fatal(err)
+	}
+	iss.verifier = "not-this-request"
+	if _, err := c.Exchange(context.Background(), cfg, req, "good-code"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("Exchange with the wrong verifier = %v", err)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	iss := newTestIssuer(t)
+	c := NewClient()
+	if _, err := c.provider(context.Background(), iss.URL+"/"); err != nil {
+		t.Fatalf("provider: %v", err)
+	}
+	// A provider claiming to be another issuer is refused.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]string{"issuer": iss.URL, "authorization_endpoint": "x", "token_endpoint": "x", "jwks_uri": "x"})
+	}))
+	defer other.Close()
+	if _, err := c.provider(context.Background(), other.URL); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Fatalf("provider for a mismatched issuer = %v", err)
+	}
+	if _, err := c.provider(context.Background(), ""); err == nil {
+		t.Fatal("provider accepted an empty issuer")
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	iss := newTestIssuer(t)
+	c := NewClient()
+	for i := 0; i < 3; i++ {
+		if _, err := login(t, c, iss, func(nonce string) string { return iss.sign(t, "RS256", "rsa", iss.claims(nonce)) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unknown key IDs refetch the set, but not more often than jwksRefreshMin.
+	for i := 0; i < 3; i++ {
+		_, _ = login(t, c, iss, func(nonce string) string { return iss.sign(t, "RS256", "rotated", iss.claims(nonce)) })
+	}
+	if iss.jwksRequests != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", iss.jwksRequests)
+	}
+}
@@ -0,0 +1,112 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argonHash hashes pw with the given parameters and key length.
+func argonHash(pw string, memory, time uint32, threads uint8, keyLen uint32) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pw), salt, time, memory, threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, time, threads, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func TestVerify(t *testing.T) {
+	current, err := Hash("secret-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("secret-1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		hash, pw   string
+		ok, rehash bool
+	}{
+		{"argon2id", current, "secret-1", true, false},
+		{"argon2id wrong password", current, "secret-2", false, false},
+		{"bcrypt", string(legacy), "secret-1", true, true},
+		{"bcrypt wrong password", string(legacy), "secret-2", false, true},
+		{"older argon2id parameters", argonHash("secret-1", 8*1024, 1, 1, argonKeyLen), "secret-1", true, true},
+		{"shorter argon2id key", argonHash("secret-1", argonMemory, argonTime, argonThreads, 16), "secret-1", true, true},
+		{"empty hash", "", "", false, false},
+		{"unknown scheme", "plain-text", "plain-text", false, false},
+		{"malformed argon2id", "$argon2id$v=19$m=0,t=2,p=1$c2FsdA$a2V5", "secret-1", false, false},
+		{"missing fields", "$argon2id$v=19$secret", "secret-1", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := Verify(tt.hash, tt.pw)
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("Verify = %v, %v; want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+
+	again, _ := Hash("secret-1")
+	if again == current || !strings.HasPrefix(again, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("Hash = %s, want a fresh salt and the current parameters", again)
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		user   string
+		pw     string
+		want   string
+	}{
+		{"long enough", Policy{MinLength: 8, MinClasses: 1}, "alice", "abcdefgh", ""},
+		{"too short", Policy{MinLength: 8, MinClasses: 1}, "alice", "abcdefg", "不能少于 8"},
+		{"runes not bytes", Policy{MinLength: 4, MinClasses: 1}, "alice", "密码密码", ""},
+		{"too long", Policy{MinLength: 1, MinClasses: 1}, "alice", strings.Repeat("a", MaxLength+1), "不能超过"},
+		{"too few classes", Policy{MinLength: 1, MinClasses: 3}, "alice", "abcDEF", "3 类"},
+		{"enough classes", Policy{MinLength: 1, MinClasses: 4}, "alice", "aB1!", ""},
+		{"contains username", Policy{MinLength: 1, MinClasses: 1, RejectUsername: true}, "Alice", "my-alice-pw", "用户名"},
+		{"username allowed", Policy{MinLength: 1, MinClasses: 1}, "alice", "my-alice-pw", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.user, tt.pw)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Check = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Check = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		want     Policy
+	}{
+		{"defaults", nil, Policy{DefaultMinLength, DefaultMinClasses, true}},
+		{"configured", map[string]string{"password_min_length": " 12 ", "password_min_classes": "3", "password_reject_username": "0"}, Policy{12, 3, false}},
+		{"out of range", map[string]string{"password_min_length": "0", "password_min_classes": "5"}, Policy{DefaultMinLength, DefaultMinClasses, true}},
+		{"not numbers", map[string]string{"password_min_length": "x", "password_min_classes": "-"}, Policy{DefaultMinLength, DefaultMinClasses, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LoadPolicy(func(key string) string { return tt.settings[key] })
+			if got != tt.want {
+				t.Errorf("LoadPolicy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package password
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy is the password policy from settings.
+type Policy struct {
+	MinLength int `json:"minLength"`
+	// MinClasses is how many of lower case, upper case, digits and symbols a
+	// password must mix.
+	MinClasses int `json:"minClasses"`
+	// RejectUsername refuses passwords that contain the username.
+	RejectUsername bool `json:"rejectUsername"`
+}
+
+// MaxLength caps passwords so hashing cost stays bounded.
+const MaxLength = 128
+
+// Defaults used when the password_* settings are unset.
+const (
+	DefaultMinLength  = 8
+	DefaultMinClasses = 1
+)
+
+// LoadPolicy reads password_min_length, password_min_classes and
+// password_reject_username through get.
+func LoadPolicy(get func(string) string) Policy {
+	num := func(key string, def, lo, hi int) int {
+		n, err := strconv.Atoi(strings.TrimSpace(get(key)))
+		if err != nil || n < lo || n > hi {
+			return def
+		}
+		return n
+	}
+	return Policy{
+		MinLength:      num("password_min_length", DefaultMinLength, 1, MaxLength),
+		MinClasses:     num("password_min_classes", DefaultMinClasses, 1, 4),
+		RejectUsername: strings.TrimSpace(get("password_reject_username")) != "0",
+	}
+}
+
+// Check returns a user-facing error when pw violates the policy.
+func (p Policy) Check(username, pw string) error {
+	n := utf8.RuneCountInString(pw)
+	if n < p.MinLength {
+		return errors.New("密码长度不能少于 " + strconv.Itoa(p.MinLength) + " 个字符")
+	}
+	if n > MaxLength {
+		return errors.New("密码长度不能超过 " + strconv.Itoa(MaxLength) + " 个字符")
+	}
+	var lower, upper, digit, other bool
+	for _, c := range pw {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return errors.New("密码需至少包含小写字母、大写字母、数字、符号中的 " + strconv.Itoa(p.MinClasses) + " 类")
+	}
+	if u := strings.ToLower(strings.TrimSpace(username)); p.RejectUsername && u != "" && strings.Contains(strings.ToLower(pw), u) {
+		return errors.New("密码不能包含用户名")
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+// Package proxy resolves the original client address and scheme of requests
+// that arrive through trusted reverse proxies such as nginx or Caddy.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Forwarding headers a trusted proxy can be configured to set.
+const (
+	HeaderXForwardedFor = "x-forwarded-for"
+	HeaderForwarded     = "forwarded"
+)
+
+// Trusted is the set of proxy networks whose forwarding headers are believed.
+type Trusted struct {
+	Networks []netip.Prefix
+	// Header is the forwarding header the proxies set: HeaderXForwardedFor
+	// (with X-Forwarded-Proto, the default) or HeaderForwarded. The other one
+	// is ignored, since proxies usually pass it through from the client.
+	Header string
+}
+
+// privateNetworks is what MEOWFILM_TRUST_PROXY=1 trusts: loopback and the
+// private ranges a reverse proxy on the same host or LAN connects from.
+var privateNetworks = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"fc00::/7", "fe80::/10",
+}
+
+// ParseTrusted parses MEOWFILM_TRUST_PROXY: a comma-separated list of CIDRs
+// or addresses. "1" means loopback and private networks, "*" means any peer,
+// and "" or "0" trusts nothing.
+func ParseTrusted(spec string) (Trusted, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "", "0":
+		return Trusted{}, nil
+	case "1":
+		return ParseTrusted(strings.Join(privateNetworks, ","))
+	case "*":
+		return Trusted{Networks: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}}, nil
+	}
+	var out []netip.Prefix
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(part); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return Trusted{}, fmt.Errorf("无效的代理地址 %q", part)
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	if len(out) == 0 {
+		return Trusted{}, errors.New("未指定代理地址")
+	}
+	return Trusted{Networks: out}, nil
+}
+
+// ParseHeader parses MEOWFILM_PROXY_HEADER, the forwarding header the trusted
+// proxies set. "" means X-Forwarded-For.
+func ParseHeader(spec string) (string, error) {
+	switch h := strings.ToLower(strings.TrimSpace(spec)); h {
+	case "", HeaderXForwardedFor:
+		return HeaderXForwardedFor, nil
+	case HeaderForwarded:
+		return h, nil
+	}
+	return "", fmt.Errorf("不支持的转发头 %q，可选 X-Forwarded-For 或 Forwarded", spec)
+}
+
+// Enabled reports whether any proxy is trusted.
+func (t Trusted) Enabled() bool {
+	return len(t.Networks) > 0
+}
+
+// Contains reports whether ip belongs to a trusted proxy.
+func (t Trusted) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t.Networks {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client describes where a request originally came from.
+type Client struct {
+	IP     string
+	Scheme string
+	// Proxied is set when the values came from forwarding headers.
+	Proxied bool
+	// ViaTrusted is set when the direct peer is a trusted proxy.
+	ViaTrusted bool
+}
+
+type ctxKey struct{}
+
+// Middleware resolves the client of every request and stores it in the
+// request context for ClientIP, Scheme and IsHTTPS.
+func (t Trusted) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := t.Resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, c)))
+	})
+}
+
+// Resolve works out the client of r. Forwarding headers are only read when
+// the direct peer is trusted, and only the one configured in t.Header. The
+// client is the right-most address in the chain that is not itself a trusted
+// proxy, so addresses a client puts in front of the chain are skipped.
+func (t Trusted) Resolve(r *http.Request) Client {
+	c := Client{IP: remoteIP(r), Scheme: "http"}
+	if r.TLS != nil {
+		c.Scheme = "https"
+	}
+	if !t.Enabled() || !t.Contains(c.IP) {
+		return c
+	}
+	c.ViaTrusted = true
+
+	var hops []hop
+	if t.Header == HeaderForwarded {
+		hops = forwardedHops(r.Header.Values("Forwarded"))
+	} else {
+		for _, ip := range splitList(r.Header.Values("X-Forwarded-For")) {
+			hops = append(hops, hop{ip: forwardedNode(ip)})
+		}
+		if proto := splitList(r.Header.Values("X-Forwarded-Proto")); len(proto) > 0 {
+			// Only the proxy facing the client knows the original scheme.
+			for i := range hops {
+				hops[i].proto = proto[0]
+			}
+			if len(hops) == 0 {
+				hops = append(hops, hop{ip: c.IP, proto: proto[0]})
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return c
+	}
+
+	chosen := hops[0]
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ip == "" || !t.Contains(hops[i].ip) {
+			chosen = hops[i]
+			break
+		}
+	}
+	if chosen.ip != "" {
+		c.IP = chosen.ip
+	}
+	switch p := strings.ToLower(chosen.proto); p {
+	case "http", "https":
+		c.Scheme = p
+	}
+	c.Proxied = true
+	return c
+}
+
+type hop struct {
+	ip    string
+	proto string
+}
+
+// forwardedHops parses RFC 7239 Forwarded headers, e.g.
+// `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`.
+func forwardedHops(values []string) []hop {
+	var out []hop
+	for _, elem := range splitList(values) {
+		var h hop
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case "for":
+				h.ip = forwardedNode(v)
+			case "proto":
+				h.proto = v
+			}
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// forwardedNode strips the port and brackets from a Forwarded node. Obfuscated
+// identifiers and "unknown" yield "".
+func forwardedNode(v string) string {
+	if strings.HasPrefix(v, "[") {
+		if end := strings.Index(v, "]"); end > 0 {
+			v = v[1:end]
+		}
+	} else if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	if _, err := netip.ParseAddr(v); err != nil {
+		return ""
+	}
+	return v
+}
+
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func fromContext(r *http.Request) (Client, bool) {
+	c, ok := r.Context().Value(ctxKey{}).(Client)
+	return c, ok
+}
+
+// ClientIP returns the original client address of r, falling back to the
+// direct peer when the middleware did not run.
+func ClientIP(r *http.Request) string {
+	if c, ok := fromContext(r); ok {
+		return c.IP
+	}
+	return remoteIP(r)
+}
+
+// Scheme returns "https" or "http" as seen by the client.
+func Scheme(r *http.Request) string {
+	if c, ok := fromContext(r); ok {
+		return c.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// ViaTrustedProxy reports whether r was sent by a trusted proxy, so headers
+// the proxy sets can be believed.
+func ViaTrustedProxy(r *http.Request) bool {
+	c, ok := fromContext(r)
+	return ok && c.ViaTrusted
+}
+
+// IsHTTPS reports whether the client used HTTPS.
+func IsHTTPS(r *http.Request) bool {
+	return Scheme(r) == "https"
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustTrusted(t *testing.T, spec, header string) Trusted {
+	t.Helper()
+	tr, err := ParseTrusted(spec)
+	if err != nil {
+		t.Fatalf("ParseTrusted(%q): %v", spec, err)
+	}
+	if tr.Header, err = ParseHeader(header); err != nil {
+		t.Fatalf("ParseHeader(%q): %v", header, err)
+	}
+	return tr
+}
+
+func TestParseTrusted(t *testing.T) {
+	tests := []struct {
+		spec    string
+		enabled bool
+		wantErr bool
+		inside  []string
+		outside []string
+	}{
+		{spec: "", enabled: false, outside: []string{"127.0.0.1"}},
+		{spec: "0", enabled: false, outside: []string{"127.0.0.1"}},
+		{spec: "1", enabled: true, inside: []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "::1", "::ffff:10.0.0.1"}, outside: []string{"8.8.8.8", "2001:db8::1"}},
+		{spec: "*", enabled: true, inside: []string{"8.8.8.8", "2001:db8::1"}},
+		{spec: "172.18.0.0/16, 127.0.0.1", enabled: true, inside: []string{"172.18.5.5", "127.0.0.1"}, outside: []string{"172.19.0.1", "127.0.0.2"}},
+		{spec: "not-an-ip", wantErr: true},
+		{spec: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		tr, err := ParseTrusted(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTrusted(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if tr.Enabled() != tt.enabled {
+			t.Errorf("ParseTrusted(%q).Enabled() = %v", tt.spec, tr.Enabled())
+		}
+		for _, ip := range tt.inside {
+			if !tr.Contains(ip) {
+				t.Errorf("ParseTrusted(%q) does not contain %s", tt.spec, ip)
+			}
+		}
+		for _, ip := range tt.outside {
+			if tr.Contains(ip) {
+				t.Errorf("ParseTrusted(%q) contains %s", tt.spec, ip)
+			}
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	for spec, want := range map[string]string{
+		"":                HeaderXForwardedFor,
+		"X-Forwarded-For": HeaderXForwardedFor,
+		"Forwarded":       HeaderForwarded,
+		" forwarded ":     HeaderForwarded,
+	} {
+		if got, err := ParseHeader(spec); err != nil || got != want {
+			t.Errorf("ParseHeader(%q) = %q, %v; want %q", spec, got, err, want)
+		}
+	}
+	if _, err := ParseHeader("X-Real-IP"); err == nil {
+		t.Error("ParseHeader accepted X-Real-IP")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      string
+		header     string
+		peer       string
+		tls        bool
+		headers    map[string][]string
+		wantIP     string
+		wantScheme string
+		wantVia    bool
+	}{
+		{
+			name:       "no trusted proxies ignores headers",
+			peer:       "203.0.113.7:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}},
+			wantIP:     "203.0.113.7",
+			wantScheme: "http",
+		},
+		{
+			name:       "untrusted peer cannot set its address",
+			trust:      "127.0.0.1",
+			peer:       "203.0.113.7:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=1.2.3.4"}},
+			wantIP:     "203.0.113.7",
+			wantScheme: "http",
+		},
+		{
+			name:       "direct TLS",
+			peer:       "203.0.113.7:5000",
+			tls:        true,
+			wantIP:     "203.0.113.7",
+			wantScheme: "https",
+		},
+		{
+			name:       "proxy appends client to X-Forwarded-For",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.9"}, "X-Forwarded-Proto": {"https"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "https",
+			wantVia:    true,
+		},
+		{
+			name:       "client-supplied X-Forwarded-For entries are skipped",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 5.6.7.8", "198.51.100.9"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "client-supplied Forwarded is ignored in X-Forwarded-For mode",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"Forwarded": {"for=1.2.3.4;proto=https"}, "X-Forwarded-For": {"198.51.100.9"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "Forwarded alone is ignored in X-Forwarded-For mode",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"Forwarded": {"for=1.2.3.4"}},
+			wantIP:     "127.0.0.1",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "chain of trusted proxies",
+			trust:      "127.0.0.1, 10.0.0.0/8",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.9, 10.0.0.5"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "garbage right-most entry does not fall back to spoofed ones",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, unknown"}},
+			wantIP:     "127.0.0.1",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "X-Forwarded-For with port",
+			trust:      "127.0.0.1",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.9:1234"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "Forwarded mode reads Forwarded",
+			trust:      "127.0.0.1",
+			header:     "Forwarded",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711";proto=https`}},
+			wantIP:     "2001:db8::1",
+			wantScheme: "https",
+			wantVia:    true,
+		},
+		{
+			name:       "client-supplied X-Forwarded-For is ignored in Forwarded mode",
+			trust:      "127.0.0.1",
+			header:     "Forwarded",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=198.51.100.9"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+		{
+			name:       "client-supplied Forwarded elements are skipped",
+			trust:      "127.0.0.1",
+			header:     "Forwarded",
+			peer:       "127.0.0.1:40000",
+			headers:    map[string][]string{"Forwarded": {"for=1.2.3.4", "for=198.51.100.9"}},
+			wantIP:     "198.51.100.9",
+			wantScheme: "http",
+			wantVia:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := mustTrusted(t, tt.trust, tt.header)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			c := tr.Resolve(r)
+			if c.IP != tt.wantIP || c.Scheme != tt.wantScheme || c.ViaTrusted != tt.wantVia {
+				t.Errorf("Resolve = %+v; want IP %s, scheme %s, via %v", c, tt.wantIP, tt.wantScheme, tt.wantVia)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tr := mustTrusted(t, "127.0.0.1", "")
+	var gotIP string
+	var gotHTTPS, gotVia bool
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIP, gotHTTPS, gotVia = ClientIP(r), IsHTTPS(r), ViaTrustedProxy(r)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if gotIP != "198.51.100.9" || !gotHTTPS || !gotVia {
+		t.Errorf("got ip %s, https %v, via %v", gotIP, gotHTTPS, gotVia)
+	}
+}
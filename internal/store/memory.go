@@ -0,0 +1,1130 @@
+package store
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMemory returns repositories that keep everything in process memory.
+// All repositories share one lock, so a Store behaves like a single database.
+func NewMemory() *Store {
+	m := &memory{
+		users:       map[int64]User{},
+		tokens:      map[int64]Token{},
+		totp:        map[int64]TwoFactor{},
+		settings:    map[string]string{},
+		searchOrder: map[int64][]string{},
+		userSites:   map[int64][]Site{},
+	}
+	return &Store{
+		Users:         memUsers{m},
+		Tokens:        memTokens{m},
+		APITokens:     memAPITokens{m},
+		LoginFailures: memLoginFailures{m},
+		TwoFactor:     memTwoFactor{m},
+		Identities:    memIdentities{m},
+		Invitations:   memInvitations{m},
+		Roles:         memRoles{m},
+		Profiles:      memProfiles{m},
+		Audit:         memAudit{m},
+		Settings:      memSettings{m},
+		Favorites:     memFavorites{m},
+		PlayHistory:   memPlayHistory{m},
+		SearchHistory: memSearchHistory{m},
+		Sites:         memSites{m},
+		UserSites:     memUserSites{m},
+	}
+}
+
+type searchEntry struct {
+	userID    int64
+	profileID int64
+	keyword   string
+	updatedAt int64
+}
+
+type memory struct {
+	mu              sync.Mutex
+	nextUserID      int64
+	users           map[int64]User
+	nextTokenID     int64
+	tokens          map[int64]Token
+	nextAPITokenID  int64
+	apiTokens       []APIToken
+	loginFailures   []LoginFailure
+	totp            map[int64]TwoFactor
+	identities      []Identity
+	invitations     []Invitation
+	roles           []Role
+	profiles        []Profile
+	nextAuditID     int64
+	audit           []AuditEntry
+	settings        map[string]string
+	settingsVersion int64
+	favorites       []Favorite
+	playHistory     []PlayHistory
+	searchHistory   []searchEntry
+	searchOrder     map[int64][]string
+	sites           []Site
+	userSites       map[int64][]Site
+}
+
+type memUsers struct{ m *memory }
+
+func (r memUsers) ByID(id int64) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	u, ok := r.m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (r memUsers) ByUsername(username string) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, u := range r.m.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (r memUsers) List() ([]User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := make([]User, 0, len(r.m.users))
+	for _, u := range r.m.users {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ai, aj := out[i].Role == "admin", out[j].Role == "admin"
+		if ai != aj {
+			return ai
+		}
+		return out[i].Username < out[j].Username
+	})
+	return out, nil
+}
+
+func (r memUsers) Count() (int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return len(r.m.users), nil
+}
+
+func (r memUsers) Create(u User) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.createUser(u)
+}
+
+// createUser inserts u; the caller holds m.mu.
+func (m *memory) createUser(u User) (int64, error) {
+	for _, cur := range m.users {
+		if cur.Username == u.Username {
+			return 0, ErrConflict
+		}
+	}
+	if u.Role == "" {
+		u.Role = "user"
+	}
+	if u.Status == "" {
+		u.Status = "active"
+	}
+	if u.SearchThreadCount < 1 {
+		u.SearchThreadCount = 5
+	}
+	m.nextUserID++
+	u.ID = m.nextUserID
+	m.users[u.ID] = u
+	return u.ID, nil
+}
+
+func (r memUsers) Update(id int64, p UserPatch) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.updateUser(id, p)
+}
+
+func (m *memory) updateUser(id int64, p UserPatch) error {
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.Username != nil && *p.Username != u.Username {
+		for _, cur := range m.users {
+			if cur.Username == *p.Username {
+				return ErrConflict
+			}
+		}
+		u.Username = *p.Username
+	}
+	set := func(dst *string, v *string) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&u.PasswordHash, p.PasswordHash)
+	set(&u.Role, p.Role)
+	set(&u.Status, p.Status)
+	set(&u.CatAPIBase, p.CatAPIBase)
+	set(&u.CatAPIKey, p.CatAPIKey)
+	set(&u.CatProxy, p.CatProxy)
+	set(&u.SearchCoverSite, p.SearchCoverSite)
+	set(&u.DisplayName, p.DisplayName)
+	if p.SearchThreadCount != nil {
+		u.SearchThreadCount = *p.SearchThreadCount
+	}
+	if p.MustChangePassword != nil {
+		u.MustChangePassword = *p.MustChangePassword
+	}
+	if p.SearchSiteOrder != nil {
+		m.searchOrder[id] = slices.Clone(p.SearchSiteOrder)
+	}
+	m.users[id] = u
+	return nil
+}
+
+func (r memUsers) Import(id int64, in UserImport) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	// The patch is the only part that can fail, so apply it first.
+	if err := r.m.updateUser(id, in.Patch); err != nil {
+		return err
+	}
+	for _, f := range in.Favorites {
+		f.UserID, f.ProfileID = id, in.ProfileID
+		r.m.upsertFavorite(f)
+	}
+	for _, h := range in.PlayHistory {
+		h.UserID, h.ProfileID = id, in.ProfileID
+		r.m.recordPlay(h)
+	}
+	for _, e := range in.SearchHistory {
+		r.m.touchSearch(id, in.ProfileID, e.Keyword, e.UpdatedAt)
+	}
+	return nil
+}
+
+func (r memUsers) SearchOrder(id int64) ([]string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return append([]string{}, r.m.searchOrder[id]...), nil
+}
+
+func (r memUsers) Delete(id int64) (UserDeletion, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if _, ok := r.m.users[id]; !ok {
+		return UserDeletion{}, ErrNotFound
+	}
+	var out UserDeletion
+	for k, t := range r.m.tokens {
+		if t.UserID == id {
+			delete(r.m.tokens, k)
+			out.Tokens++
+		}
+	}
+	removeWhere(&r.m.apiTokens, func(t APIToken) bool { return t.UserID == id })
+	delete(r.m.totp, id)
+	delete(r.m.searchOrder, id)
+	delete(r.m.userSites, id)
+	removeWhere(&r.m.identities, func(i Identity) bool { return i.UserID == id })
+	removeWhere(&r.m.profiles, func(p Profile) bool { return p.UserID == id })
+	out.SearchHistory = int64(removeWhere(&r.m.searchHistory, func(e searchEntry) bool { return e.userID == id }))
+	out.PlayHistory = int64(removeWhere(&r.m.playHistory, func(h PlayHistory) bool { return h.UserID == id }))
+	out.Favorites = int64(removeWhere(&r.m.favorites, func(f Favorite) bool { return f.UserID == id }))
+	delete(r.m.users, id)
+	return out, nil
+}
+
+// removeWhere drops the elements matching drop in place and returns how many
+// were removed.
+func removeWhere[T any](list *[]T, drop func(T) bool) int {
+	kept := (*list)[:0]
+	for _, v := range *list {
+		if !drop(v) {
+			kept = append(kept, v)
+		}
+	}
+	n := len(*list) - len(kept)
+	*list = kept
+	return n
+}
+
+type memTokens struct{ m *memory }
+
+func (r memTokens) Create(t Token) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.tokens {
+		if e.Hash == t.Hash {
+			return 0, ErrConflict
+		}
+	}
+	r.m.nextTokenID++
+	t.ID = r.m.nextTokenID
+	r.m.tokens[t.ID] = t
+	return t.ID, nil
+}
+
+func (r memTokens) ByHash(hash string) (Token, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, t := range r.m.tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return Token{}, ErrNotFound
+}
+
+func (r memTokens) ByID(id int64) (Token, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	t, ok := r.m.tokens[id]
+	if !ok {
+		return Token{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (r memTokens) List(userID int64) ([]Token, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []Token{}
+	for _, t := range r.m.tokens {
+		if userID == 0 || t.UserID == userID {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LastSeenAt != out[j].LastSeenAt {
+			return out[i].LastSeenAt > out[j].LastSeenAt
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out, nil
+}
+
+func (r memTokens) Touch(id int64, at, expiresAt int64, ip, userAgent string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if t, ok := r.m.tokens[id]; ok {
+		t.LastSeenAt, t.ExpiresAt, t.IP, t.UserAgent = at, expiresAt, ip, userAgent
+		r.m.tokens[id] = t
+	}
+	return nil
+}
+
+func (r memTokens) SetProfile(id, profileID int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if t, ok := r.m.tokens[id]; ok {
+		t.ProfileID = profileID
+		r.m.tokens[id] = t
+	}
+	return nil
+}
+
+func (r memTokens) Delete(id int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.tokens, id)
+	return nil
+}
+
+func (r memTokens) DeleteForUser(userID, exceptID int64) (int64, error) {
+	return r.deleteWhere(func(t Token) bool { return t.UserID == userID && t.ID != exceptID }), nil
+}
+
+func (r memTokens) DeleteExpired(now int64) (int64, error) {
+	return r.deleteWhere(func(t Token) bool { return t.ExpiresAt <= now }), nil
+}
+
+func (r memTokens) deleteWhere(drop func(Token) bool) int64 {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var n int64
+	for k, t := range r.m.tokens {
+		if drop(t) {
+			delete(r.m.tokens, k)
+			n++
+		}
+	}
+	return n
+}
+
+type memAPITokens struct{ m *memory }
+
+func (r memAPITokens) Create(t APIToken) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.apiTokens {
+		if e.Hash == t.Hash {
+			return 0, ErrConflict
+		}
+	}
+	r.m.nextAPITokenID++
+	t.ID = r.m.nextAPITokenID
+	t.Scopes = append([]string(nil), t.Scopes...)
+	r.m.apiTokens = append(r.m.apiTokens, t)
+	return t.ID, nil
+}
+
+func (r memAPITokens) ByHash(hash string) (APIToken, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, t := range r.m.apiTokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return APIToken{}, ErrNotFound
+}
+
+func (r memAPITokens) ListForUser(userID int64) ([]APIToken, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []APIToken{}
+	for _, t := range r.m.apiTokens {
+		if t.UserID == userID {
+			out = append(out, t)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+func (r memAPITokens) Delete(userID, id int64) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.apiTokens, func(t APIToken) bool { return t.ID == id && t.UserID == userID })
+	return n > 0, nil
+}
+
+func (r memAPITokens) Touch(id int64, at int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i := range r.m.apiTokens {
+		if r.m.apiTokens[i].ID == id {
+			r.m.apiTokens[i].LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+func (r memAPITokens) DeleteExpired(now int64) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.apiTokens, func(t APIToken) bool { return t.ExpiresAt > 0 && t.ExpiresAt <= now })
+	return int64(n), nil
+}
+
+type memLoginFailures struct{ m *memory }
+
+func (r memLoginFailures) Get(scope, key string) (LoginFailure, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, f := range r.m.loginFailures {
+		if f.Scope == scope && f.Key == key {
+			return f, nil
+		}
+	}
+	return LoginFailure{Scope: scope, Key: key}, ErrNotFound
+}
+
+func (r memLoginFailures) Put(f LoginFailure) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i, e := range r.m.loginFailures {
+		if e.Scope == f.Scope && e.Key == f.Key {
+			r.m.loginFailures[i] = f
+			return nil
+		}
+	}
+	r.m.loginFailures = append(r.m.loginFailures, f)
+	return nil
+}
+
+func (r memLoginFailures) Delete(scope, key string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	removeWhere(&r.m.loginFailures, func(f LoginFailure) bool { return f.Scope == scope && f.Key == key })
+	return nil
+}
+
+func (r memLoginFailures) List() ([]LoginFailure, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := append([]LoginFailure{}, r.m.loginFailures...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].LastFailureAt > out[j].LastFailureAt })
+	return out, nil
+}
+
+func (r memLoginFailures) DeleteStale(at int64) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.loginFailures, func(f LoginFailure) bool { return f.LastFailureAt < at && f.LockedUntil < at })
+	return int64(n), nil
+}
+
+type memTwoFactor struct{ m *memory }
+
+func (r memTwoFactor) Get(userID int64) (TwoFactor, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	t, ok := r.m.totp[userID]
+	if !ok {
+		return TwoFactor{UserID: userID}, ErrNotFound
+	}
+	t.RecoveryCodes = append([]string{}, t.RecoveryCodes...)
+	return t, nil
+}
+
+func (r memTwoFactor) Put(t TwoFactor) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	t.RecoveryCodes = append([]string{}, t.RecoveryCodes...)
+	r.m.totp[t.UserID] = t
+	return nil
+}
+
+func (r memTwoFactor) Delete(userID int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.totp, userID)
+	return nil
+}
+
+func (r memTwoFactor) UseStep(userID, step int64) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	t, ok := r.m.totp[userID]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep = step
+	r.m.totp[userID] = t
+	return true, nil
+}
+
+func (r memTwoFactor) UseRecoveryCode(userID int64, hash string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	t, ok := r.m.totp[userID]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if removeWhere(&t.RecoveryCodes, func(c string) bool { return c == hash }) == 0 {
+		return false, nil
+	}
+	r.m.totp[userID] = t
+	return true, nil
+}
+
+type memIdentities struct{ m *memory }
+
+func (r memIdentities) Get(issuer, subject string) (Identity, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, id := range r.m.identities {
+		if id.Issuer == issuer && id.Subject == subject {
+			return id, nil
+		}
+	}
+	return Identity{Issuer: issuer, Subject: subject}, ErrNotFound
+}
+
+func (r memIdentities) ListForUser(userID int64) ([]Identity, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []Identity{}
+	for _, id := range r.m.identities {
+		if id.UserID == userID {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+func (r memIdentities) Link(id Identity) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.identities {
+		if e.Issuer == id.Issuer && e.Subject == id.Subject {
+			return ErrConflict
+		}
+	}
+	r.m.identities = append(r.m.identities, id)
+	return nil
+}
+
+func (r memIdentities) Touch(issuer, subject string, at int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i, e := range r.m.identities {
+		if e.Issuer == issuer && e.Subject == subject {
+			r.m.identities[i].LastLoginAt = at
+		}
+	}
+	return nil
+}
+
+func (r memIdentities) Delete(issuer, subject string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	removeWhere(&r.m.identities, func(e Identity) bool { return e.Issuer == issuer && e.Subject == subject })
+	return nil
+}
+
+type memInvitations struct{ m *memory }
+
+func (r memInvitations) Create(inv Invitation) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.invitations {
+		if e.Code == inv.Code {
+			return ErrConflict
+		}
+	}
+	r.m.invitations = append(r.m.invitations, inv)
+	return nil
+}
+
+func (r memInvitations) Get(code string) (Invitation, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.invitations {
+		if e.Code == code {
+			return e, nil
+		}
+	}
+	return Invitation{}, ErrNotFound
+}
+
+func (r memInvitations) List() ([]Invitation, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := append([]Invitation{}, r.m.invitations...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt > out[j].CreatedAt })
+	return out, nil
+}
+
+func (r memInvitations) Delete(code string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := len(r.m.invitations)
+	removeWhere(&r.m.invitations, func(e Invitation) bool { return e.Code == code })
+	return len(r.m.invitations) < n, nil
+}
+
+func (r memInvitations) Redeem(code string, now int64, u User) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i, e := range r.m.invitations {
+		if e.Code != code || !e.Usable(now) {
+			continue
+		}
+		u.Role, u.CatAPIBase = e.Role, e.CatAPIBase
+		id, err := r.m.createUser(u)
+		if err != nil {
+			return 0, err
+		}
+		r.m.invitations[i].Uses++
+		return id, nil
+	}
+	return 0, ErrNotFound
+}
+
+type memRoles struct{ m *memory }
+
+func (r memRoles) Get(name string) (Role, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, e := range r.m.roles {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return Role{}, ErrNotFound
+}
+
+func (r memRoles) List() ([]Role, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := append([]Role{}, r.m.roles...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (r memRoles) Put(role Role) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i, e := range r.m.roles {
+		if e.Name == role.Name {
+			role.CreatedAt = e.CreatedAt
+			r.m.roles[i] = role
+			return nil
+		}
+	}
+	r.m.roles = append(r.m.roles, role)
+	return nil
+}
+
+func (r memRoles) Delete(name string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := len(r.m.roles)
+	removeWhere(&r.m.roles, func(e Role) bool { return e.Name == name })
+	return len(r.m.roles) < n, nil
+}
+
+func (r memRoles) CountUsers(name string) (int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := 0
+	for _, u := range r.m.users {
+		if u.Role == name {
+			n++
+		}
+	}
+	return n, nil
+}
+
+type memProfiles struct{ m *memory }
+
+func (r memProfiles) Get(userID, id int64) (Profile, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, p := range r.m.profiles {
+		if p.UserID == userID && p.ID == id {
+			return p, nil
+		}
+	}
+	return Profile{}, ErrNotFound
+}
+
+func (r memProfiles) List(userID int64) ([]Profile, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []Profile{}
+	for _, p := range r.m.profiles {
+		if p.UserID == userID {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (r memProfiles) Create(p Profile) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	p.ID = 1
+	for _, cur := range r.m.profiles {
+		if cur.UserID == p.UserID && cur.ID >= p.ID {
+			p.ID = cur.ID + 1
+		}
+	}
+	r.m.profiles = append(r.m.profiles, p)
+	return p.ID, nil
+}
+
+func (r memProfiles) Put(p Profile) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for i, cur := range r.m.profiles {
+		if cur.UserID == p.UserID && cur.ID == p.ID {
+			p.CreatedAt = cur.CreatedAt
+			r.m.profiles[i] = p
+			return nil
+		}
+	}
+	r.m.profiles = append(r.m.profiles, p)
+	return nil
+}
+
+func (r memProfiles) Delete(userID, id int64) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if removeWhere(&r.m.profiles, func(p Profile) bool { return p.UserID == userID && p.ID == id }) == 0 {
+		return false, nil
+	}
+	removeWhere(&r.m.searchHistory, func(e searchEntry) bool { return e.userID == userID && e.profileID == id })
+	removeWhere(&r.m.playHistory, func(h PlayHistory) bool { return h.UserID == userID && h.ProfileID == id })
+	removeWhere(&r.m.favorites, func(f Favorite) bool { return f.UserID == userID && f.ProfileID == id })
+	for k, t := range r.m.tokens {
+		if t.UserID == userID && t.ProfileID == id {
+			t.ProfileID = DefaultProfileID
+			r.m.tokens[k] = t
+		}
+	}
+	return true, nil
+}
+
+type memAudit struct{ m *memory }
+
+func (r memAudit) Append(e AuditEntry) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.nextAuditID++
+	e.ID = r.m.nextAuditID
+	r.m.audit = append(r.m.audit, e)
+	return e.ID, nil
+}
+
+func (r memAudit) List(f AuditFilter) ([]AuditEntry, int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	match := []AuditEntry{}
+	for _, e := range r.m.audit {
+		if (f.Actor == "" || e.Actor == f.Actor) &&
+			strings.HasPrefix(e.Action, f.Action) &&
+			(f.Target == "" || e.Target == f.Target) &&
+			(f.Since <= 0 || e.CreatedAt >= f.Since) &&
+			(f.Until <= 0 || e.CreatedAt < f.Until) {
+			match = append(match, e)
+		}
+	}
+	sort.SliceStable(match, func(i, j int) bool {
+		if match[i].CreatedAt != match[j].CreatedAt {
+			return match[i].CreatedAt > match[j].CreatedAt
+		}
+		return match[i].ID > match[j].ID
+	})
+	total := len(match)
+	if f.Offset > 0 {
+		match = match[min(f.Offset, len(match)):]
+	}
+	if f.Limit > 0 && len(match) > f.Limit {
+		match = match[:f.Limit]
+	}
+	return match, total, nil
+}
+
+type memSettings struct{ m *memory }
+
+func (r memSettings) Get(key string) string {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.settings[strings.TrimSpace(key)]
+}
+
+func (r memSettings) Set(key, value string) error {
+	k := strings.TrimSpace(key)
+	if k == "" {
+		return nil
+	}
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if cur, ok := r.m.settings[k]; !ok || cur != value {
+		r.m.settingsVersion++
+	}
+	r.m.settings[k] = value
+	return nil
+}
+
+func (r memSettings) Version() int64 {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.settingsVersion
+}
+
+type memFavorites struct{ m *memory }
+
+func (r memFavorites) List(userID, profileID int64, limit int) ([]Favorite, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []Favorite{}
+	for _, f := range r.m.favorites {
+		if f.UserID == userID && f.ProfileID == profileID {
+			out = append(out, f)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].UpdatedAt > out[j].UpdatedAt })
+	if limit >= 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r memFavorites) Exists(userID, profileID int64, siteKey, videoID string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, f := range r.m.favorites {
+		if f.UserID == userID && f.ProfileID == profileID && f.SiteKey == siteKey && f.VideoID == videoID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memFavorites) Upsert(f Favorite) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.upsertFavorite(f)
+	return nil
+}
+
+func (m *memory) upsertFavorite(f Favorite) {
+	for i, cur := range m.favorites {
+		if cur.UserID == f.UserID && cur.ProfileID == f.ProfileID && cur.SiteKey == f.SiteKey && cur.VideoID == f.VideoID {
+			m.favorites[i] = f
+			return
+		}
+	}
+	m.favorites = append(m.favorites, f)
+}
+
+func (r memFavorites) Delete(userID, profileID int64, siteKey, videoID string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.favorites, func(f Favorite) bool {
+		return f.UserID == userID && f.ProfileID == profileID && f.SiteKey == siteKey && f.VideoID == videoID
+	})
+	return n > 0, nil
+}
+
+type memPlayHistory struct{ m *memory }
+
+func (r memPlayHistory) List(userID, profileID int64, limit int) ([]PlayHistory, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []PlayHistory{}
+	for _, h := range r.m.playHistory {
+		if h.UserID == userID && h.ProfileID == profileID {
+			out = append(out, h)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].UpdatedAt > out[j].UpdatedAt })
+	if limit >= 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r memPlayHistory) Latest(userID, profileID int64, siteKey, videoID string) (PlayHistory, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var (
+		best  PlayHistory
+		found bool
+	)
+	for _, h := range r.m.playHistory {
+		if h.UserID == userID && h.ProfileID == profileID && h.SiteKey == siteKey && h.VideoID == videoID && (!found || h.UpdatedAt > best.UpdatedAt) {
+			best, found = h, true
+		}
+	}
+	if !found {
+		return PlayHistory{}, ErrNotFound
+	}
+	return best, nil
+}
+
+func (r memPlayHistory) Poster(userID, profileID int64, contentKey string) (string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var (
+		poster string
+		at     int64
+	)
+	for _, h := range r.m.playHistory {
+		if h.UserID == userID && h.ProfileID == profileID && h.ContentKey == contentKey && h.VideoPoster != "" && (poster == "" || h.UpdatedAt > at) {
+			poster, at = h.VideoPoster, h.UpdatedAt
+		}
+	}
+	return strings.TrimSpace(poster), nil
+}
+
+func (r memPlayHistory) Record(h PlayHistory) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.recordPlay(h)
+	return nil
+}
+
+func (m *memory) recordPlay(h PlayHistory) {
+	removeWhere(&m.playHistory, func(cur PlayHistory) bool {
+		if cur.UserID != h.UserID || cur.ProfileID != h.ProfileID {
+			return false
+		}
+		return cur.ContentKey == h.ContentKey || cur.VideoTitle == h.VideoTitle ||
+			(cur.SiteKey == h.SiteKey && cur.VideoID == h.VideoID)
+	})
+	m.playHistory = append(m.playHistory, h)
+}
+
+func (r memPlayHistory) DeleteContent(userID, profileID int64, contentKey string) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.playHistory, func(h PlayHistory) bool {
+		return h.UserID == userID && h.ProfileID == profileID && h.ContentKey == contentKey
+	})
+	return int64(n), nil
+}
+
+func (r memPlayHistory) DeleteVideo(userID, profileID int64, siteKey, videoID string) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	n := removeWhere(&r.m.playHistory, func(h PlayHistory) bool {
+		return h.UserID == userID && h.ProfileID == profileID && h.SiteKey == siteKey && h.VideoID == videoID
+	})
+	return int64(n), nil
+}
+
+type memSearchHistory struct{ m *memory }
+
+func (r memSearchHistory) List(userID, profileID int64, limit int) ([]string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	entries := []searchEntry{}
+	for _, e := range r.m.searchHistory {
+		if e.userID == userID && e.profileID == profileID {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].updatedAt > entries[j].updatedAt })
+	out := []string{}
+	for _, e := range entries {
+		if limit >= 0 && len(out) >= limit {
+			break
+		}
+		out = append(out, e.keyword)
+	}
+	return out, nil
+}
+
+func (r memSearchHistory) Entries(userID, profileID int64) ([]SearchEntry, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	out := []SearchEntry{}
+	for _, e := range r.m.searchHistory {
+		if e.userID == userID && e.profileID == profileID {
+			out = append(out, SearchEntry{Keyword: e.keyword, UpdatedAt: e.updatedAt})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].UpdatedAt > out[j].UpdatedAt })
+	return out, nil
+}
+
+func (r memSearchHistory) Touch(userID, profileID int64, keyword string, at int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.touchSearch(userID, profileID, keyword, at)
+	return nil
+}
+
+func (m *memory) touchSearch(userID, profileID int64, keyword string, at int64) {
+	for i, e := range m.searchHistory {
+		if e.userID == userID && e.profileID == profileID && e.keyword == keyword {
+			m.searchHistory[i].updatedAt = at
+			return
+		}
+	}
+	m.searchHistory = append(m.searchHistory, searchEntry{userID: userID, profileID: profileID, keyword: keyword, updatedAt: at})
+}
+
+func (r memSearchHistory) Delete(userID, profileID int64, keyword string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	removeWhere(&r.m.searchHistory, func(e searchEntry) bool {
+		return e.userID == userID && e.profileID == profileID && e.keyword == keyword
+	})
+	return nil
+}
+
+func (r memSearchHistory) Clear(userID, profileID int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	removeWhere(&r.m.searchHistory, func(e searchEntry) bool { return e.userID == userID && e.profileID == profileID })
+	return nil
+}
+
+// replaceSites runs next on a copy of *list and stores the result; the
+// caller holds m.mu.
+func replaceSites(list *[]Site, next func(cur []Site) ([]Site, bool)) (bool, error) {
+	out, ok := next(slices.Clone(*list))
+	if !ok {
+		return false, nil
+	}
+	seen := map[string]bool{}
+	for _, s := range out {
+		if seen[s.Key] {
+			return false, ErrConflict
+		}
+		seen[s.Key] = true
+	}
+	*list = slices.Clone(out)
+	return true, nil
+}
+
+// editSite applies fn to the site with key in list; the caller holds m.mu.
+func editSite(list []Site, key string, fn func(s *Site)) bool {
+	for i := range list {
+		if list[i].Key == key {
+			fn(&list[i])
+			list[i].Key = key
+			return true
+		}
+	}
+	return false
+}
+
+type memSites struct{ m *memory }
+
+func (r memSites) List() ([]Site, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return append([]Site{}, r.m.sites...), nil
+}
+
+func (r memSites) Replace(next func(cur []Site) ([]Site, bool)) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	changed, err := replaceSites(&r.m.sites, next)
+	if changed {
+		r.m.settingsVersion++
+	}
+	return changed, err
+}
+
+func (r memSites) Edit(key string, fn func(s *Site)) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	found := editSite(r.m.sites, key, fn)
+	if found {
+		r.m.settingsVersion++
+	}
+	return found, nil
+}
+
+type memUserSites struct{ m *memory }
+
+func (r memUserSites) List(userID int64) ([]Site, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return append([]Site{}, r.m.userSites[userID]...), nil
+}
+
+func (r memUserSites) Replace(userID int64, next func(cur []Site) ([]Site, bool)) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	list := r.m.userSites[userID]
+	changed, err := replaceSites(&list, next)
+	if changed {
+		r.m.userSites[userID] = list
+	}
+	return changed, err
+}
+
+func (r memUserSites) Edit(userID int64, key string, fn func(s *Site)) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return editSite(r.m.userSites[userID], key, fn), nil
+}
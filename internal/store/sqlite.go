@@ -0,0 +1,1363 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+)
+
+// NewSQLite returns repositories backed by database.
+func NewSQLite(database *db.DB) *Store {
+	return &Store{
+		Users:         sqliteUsers{database},
+		Tokens:        sqliteTokens{database},
+		APITokens:     sqliteAPITokens{database},
+		LoginFailures: sqliteLoginFailures{database},
+		TwoFactor:     sqliteTwoFactor{database},
+		Identities:    sqliteIdentities{database},
+		Invitations:   sqliteInvitations{database},
+		Roles:         sqliteRoles{database},
+		Profiles:      sqliteProfiles{database},
+		Audit:         sqliteAudit{database},
+		Settings:      sqliteSettings{database},
+		Favorites:     sqliteFavorites{database},
+		PlayHistory:   sqlitePlayHistory{database},
+		SearchHistory: sqliteSearchHistory{database},
+		Sites:         sqliteSites{database},
+		UserSites:     sqliteUserSites{database},
+	}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func conflict(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && se.Code == sqlite3.ErrConstraint {
+		return ErrConflict
+	}
+	return err
+}
+
+type sqliteUsers struct{ db *db.DB }
+
+const userColumns = `
+	id, username, password, COALESCE(role, 'user'), COALESCE(status, 'active'),
+	COALESCE(cat_api_base, ''), COALESCE(cat_api_key, ''), COALESCE(cat_proxy, ''),
+	COALESCE(search_thread_count, 5), COALESCE(cat_search_cover_site, ''),
+	display_name, must_change_password`
+
+func (r sqliteUsers) scan(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Status, &u.CatAPIBase, &u.CatAPIKey, &u.CatProxy, &u.SearchThreadCount, &u.SearchCoverSite, &u.DisplayName, &u.MustChangePassword); err != nil {
+		return User{}, notFound(err)
+	}
+	plain, err := r.db.OpenSecret(u.CatAPIKey)
+	if err != nil {
+		return User{}, err
+	}
+	u.CatAPIKey = plain
+	return u, nil
+}
+
+func (r sqliteUsers) ByID(id int64) (User, error) {
+	return r.scan(r.db.SQL().QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ? LIMIT 1`, id))
+}
+
+func (r sqliteUsers) ByUsername(username string) (User, error) {
+	return r.scan(r.db.SQL().QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ? LIMIT 1`, username))
+}
+
+func (r sqliteUsers) List() ([]User, error) {
+	rows, err := r.db.SQL().Query(`
+		SELECT ` + userColumns + `
+		FROM users
+		ORDER BY CASE WHEN role = 'admin' THEN 0 ELSE 1 END, username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		u, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteUsers) Count() (int, error) {
+	var n int
+	err := r.db.SQL().QueryRow(`SELECT COUNT(1) FROM users`).Scan(&n)
+	return n, err
+}
+
+func (r sqliteUsers) Create(u User) (int64, error) {
+	return r.insert(r.db.SQL(), u)
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (r sqliteUsers) insert(q execer, u User) (int64, error) {
+	key, err := r.db.SealSecret(u.CatAPIKey)
+	if err != nil {
+		return 0, err
+	}
+	if u.Status == "" {
+		u.Status = "active"
+	}
+	if u.SearchThreadCount < 1 {
+		u.SearchThreadCount = 5
+	}
+	res, err := q.Exec(`
+		INSERT INTO users(username, password, role, status, cat_api_base, cat_api_key, cat_proxy, search_thread_count, cat_search_cover_site, display_name, must_change_password)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)
+	`, u.Username, u.PasswordHash, u.Role, u.Status, u.CatAPIBase, key, u.CatProxy, u.SearchThreadCount, u.SearchCoverSite, u.DisplayName, u.MustChangePassword)
+	if err != nil {
+		return 0, conflict(err)
+	}
+	return res.LastInsertId()
+}
+
+func (r sqliteUsers) Update(id int64, p UserPatch) error {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := r.update(tx, id, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r sqliteUsers) update(tx *sql.Tx, id int64, p UserPatch) error {
+	sets := []string{}
+	args := []any{}
+	add := func(column string, v any) {
+		sets = append(sets, column+" = ?")
+		args = append(args, v)
+	}
+	if p.Username != nil {
+		add("username", *p.Username)
+	}
+	if p.PasswordHash != nil {
+		add("password", *p.PasswordHash)
+	}
+	if p.Role != nil {
+		add("role", *p.Role)
+	}
+	if p.Status != nil {
+		add("status", *p.Status)
+	}
+	if p.CatAPIBase != nil {
+		add("cat_api_base", *p.CatAPIBase)
+	}
+	if p.CatAPIKey != nil {
+		key, err := r.db.SealSecret(*p.CatAPIKey)
+		if err != nil {
+			return err
+		}
+		add("cat_api_key", key)
+	}
+	if p.CatProxy != nil {
+		add("cat_proxy", *p.CatProxy)
+	}
+	if p.SearchThreadCount != nil {
+		add("search_thread_count", *p.SearchThreadCount)
+	}
+	if p.SearchCoverSite != nil {
+		add("cat_search_cover_site", *p.SearchCoverSite)
+	}
+	if p.DisplayName != nil {
+		add("display_name", *p.DisplayName)
+	}
+	if p.MustChangePassword != nil {
+		add("must_change_password", *p.MustChangePassword)
+	}
+	if len(sets) == 0 && p.SearchSiteOrder == nil {
+		return nil
+	}
+	if len(sets) > 0 {
+		args = append(args, id)
+		res, err := tx.Exec(`UPDATE users SET `+strings.Join(sets, ", ")+` WHERE id = ?`, args...)
+		if err != nil {
+			return conflict(err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrNotFound
+		}
+	} else if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, id).Scan(&id); err != nil {
+		return notFound(err)
+	}
+	if p.SearchSiteOrder != nil {
+		if _, err := tx.Exec(`DELETE FROM user_search_order WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+		for i, key := range p.SearchSiteOrder {
+			if _, err := tx.Exec(`INSERT INTO user_search_order(user_id, site_key, position) VALUES (?,?,?)`, id, key, i); err != nil {
+				return conflict(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r sqliteUsers) Import(id int64, in UserImport) error {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, f := range in.Favorites {
+		f.UserID, f.ProfileID = id, in.ProfileID
+		if err := upsertFavorite(tx, f); err != nil {
+			return err
+		}
+	}
+	for _, h := range in.PlayHistory {
+		h.UserID, h.ProfileID = id, in.ProfileID
+		if err := recordPlay(tx, h); err != nil {
+			return err
+		}
+	}
+	for _, e := range in.SearchHistory {
+		if err := touchSearch(tx, id, in.ProfileID, e.Keyword, e.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	if err := r.update(tx, id, in.Patch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r sqliteUsers) SearchOrder(id int64) ([]string, error) {
+	rows, err := r.db.SQL().Query(`SELECT site_key FROM user_search_order WHERE user_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(key) != "" {
+			out = append(out, key)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteUsers) Delete(id int64) (UserDeletion, error) {
+	var out UserDeletion
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return out, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	exec := func(dst *int64, query string) error {
+		res, err := tx.Exec(query, id)
+		if err != nil {
+			return err
+		}
+		if dst != nil {
+			*dst, _ = res.RowsAffected()
+		}
+		return nil
+	}
+	for _, step := range []struct {
+		dst   *int64
+		query string
+	}{
+		{&out.Tokens, `DELETE FROM auth_tokens WHERE user_id = ?`},
+		{&out.SearchHistory, `DELETE FROM search_history WHERE user_id = ?`},
+		{&out.PlayHistory, `DELETE FROM play_history WHERE user_id = ?`},
+		{&out.Favorites, `DELETE FROM favorites WHERE user_id = ?`},
+		{nil, `DELETE FROM user_sites WHERE user_id = ?`},
+		{nil, `DELETE FROM user_search_order WHERE user_id = ?`},
+		{nil, `DELETE FROM user_retention WHERE user_id = ?`},
+		{nil, `DELETE FROM api_tokens WHERE user_id = ?`},
+		{nil, `DELETE FROM user_totp WHERE user_id = ?`},
+		{nil, `DELETE FROM user_identities WHERE user_id = ?`},
+		{nil, `DELETE FROM profiles WHERE user_id = ?`},
+	} {
+		if err := exec(step.dst, step.query); err != nil {
+			return UserDeletion{}, err
+		}
+	}
+	var deleted int64
+	if err := exec(&deleted, `DELETE FROM users WHERE id = ?`); err != nil {
+		return UserDeletion{}, err
+	}
+	if deleted == 0 {
+		return UserDeletion{}, ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return UserDeletion{}, err
+	}
+	return out, nil
+}
+
+type sqliteTokens struct{ db *db.DB }
+
+const tokenColumns = `id, token_hash, user_id, created_at, expires_at, last_seen_at, user_agent, ip, remember, profile_id`
+
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	var t Token
+	err := row.Scan(&t.ID, &t.Hash, &t.UserID, &t.CreatedAt, &t.ExpiresAt, &t.LastSeenAt, &t.UserAgent, &t.IP, &t.Remember, &t.ProfileID)
+	return t, notFound(err)
+}
+
+func (r sqliteTokens) Create(t Token) (int64, error) {
+	res, err := r.db.SQL().Exec(`
+		INSERT INTO auth_tokens(token_hash, user_id, created_at, expires_at, last_seen_at, user_agent, ip, remember, profile_id)
+		VALUES (?,?,?,?,?,?,?,?,?)
+	`, t.Hash, t.UserID, t.CreatedAt, t.ExpiresAt, t.LastSeenAt, t.UserAgent, t.IP, t.Remember, t.ProfileID)
+	if err != nil {
+		return 0, conflict(err)
+	}
+	return res.LastInsertId()
+}
+
+func (r sqliteTokens) ByHash(hash string) (Token, error) {
+	return scanToken(r.db.SQL().QueryRow(`SELECT `+tokenColumns+` FROM auth_tokens WHERE token_hash = ? LIMIT 1`, hash))
+}
+
+func (r sqliteTokens) ByID(id int64) (Token, error) {
+	return scanToken(r.db.SQL().QueryRow(`SELECT `+tokenColumns+` FROM auth_tokens WHERE id = ? LIMIT 1`, id))
+}
+
+func (r sqliteTokens) List(userID int64) ([]Token, error) {
+	query := `SELECT ` + tokenColumns + ` FROM auth_tokens`
+	args := []any{}
+	if userID != 0 {
+		query += ` WHERE user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := r.db.SQL().Query(query+` ORDER BY last_seen_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteTokens) Touch(id int64, at, expiresAt int64, ip, userAgent string) error {
+	_, err := r.db.SQL().Exec(`UPDATE auth_tokens SET last_seen_at = ?, expires_at = ?, ip = ?, user_agent = ? WHERE id = ?`, at, expiresAt, ip, userAgent, id)
+	return err
+}
+
+func (r sqliteTokens) SetProfile(id, profileID int64) error {
+	_, err := r.db.SQL().Exec(`UPDATE auth_tokens SET profile_id = ? WHERE id = ?`, profileID, id)
+	return err
+}
+
+func (r sqliteTokens) Delete(id int64) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM auth_tokens WHERE id = ?`, id)
+	return err
+}
+
+func (r sqliteTokens) DeleteForUser(userID, exceptID int64) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM auth_tokens WHERE user_id = ? AND id != ?`, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r sqliteTokens) DeleteExpired(now int64) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM auth_tokens WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type sqliteAPITokens struct{ db *db.DB }
+
+const apiTokenColumns = `id, user_id, name, token_hash, prefix, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var (
+		t      APIToken
+		scopes string
+	)
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Hash, &t.Prefix, &scopes, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+		return APIToken{}, notFound(err)
+	}
+	t.Scopes = strings.Fields(scopes)
+	return t, nil
+}
+
+func (r sqliteAPITokens) Create(t APIToken) (int64, error) {
+	res, err := r.db.SQL().Exec(`
+		INSERT INTO api_tokens(user_id, name, token_hash, prefix, scopes, created_at, expires_at, last_used_at)
+		VALUES (?,?,?,?,?,?,?,0)
+	`, t.UserID, t.Name, t.Hash, t.Prefix, strings.Join(t.Scopes, " "), t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return 0, conflict(err)
+	}
+	return res.LastInsertId()
+}
+
+func (r sqliteAPITokens) ByHash(hash string) (APIToken, error) {
+	return scanAPIToken(r.db.SQL().QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = ? LIMIT 1`, hash))
+}
+
+func (r sqliteAPITokens) ListForUser(userID int64) ([]APIToken, error) {
+	rows, err := r.db.SQL().Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteAPITokens) Delete(userID, id int64) (bool, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r sqliteAPITokens) Touch(id int64, at int64) error {
+	_, err := r.db.SQL().Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, at, id)
+	return err
+}
+
+func (r sqliteAPITokens) DeleteExpired(now int64) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM api_tokens WHERE expires_at > 0 AND expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type sqliteLoginFailures struct{ db *db.DB }
+
+func (r sqliteLoginFailures) Get(scope, key string) (LoginFailure, error) {
+	f := LoginFailure{Scope: scope, Key: key}
+	err := r.db.SQL().QueryRow(`SELECT failures, last_failure_at, locked_until FROM login_failures WHERE scope = ? AND key = ?`, scope, key).
+		Scan(&f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	return f, notFound(err)
+}
+
+func (r sqliteLoginFailures) Put(f LoginFailure) error {
+	_, err := r.db.SQL().Exec(`
+		INSERT INTO login_failures(scope, key, failures, last_failure_at, locked_until)
+		VALUES (?,?,?,?,?)
+		ON CONFLICT(scope, key) DO UPDATE SET
+		  failures = excluded.failures,
+		  last_failure_at = excluded.last_failure_at,
+		  locked_until = excluded.locked_until
+	`, f.Scope, f.Key, f.Failures, f.LastFailureAt, f.LockedUntil)
+	return err
+}
+
+func (r sqliteLoginFailures) Delete(scope, key string) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+func (r sqliteLoginFailures) List() ([]LoginFailure, error) {
+	rows, err := r.db.SQL().Query(`
+		SELECT scope, key, failures, last_failure_at, locked_until
+		FROM login_failures
+		ORDER BY last_failure_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []LoginFailure{}
+	for rows.Next() {
+		var f LoginFailure
+		if err := rows.Scan(&f.Scope, &f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteLoginFailures) DeleteStale(at int64) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM login_failures WHERE last_failure_at < ? AND locked_until < ?`, at, at)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sqliteTwoFactor seals TOTP secrets like other credentials.
+type sqliteTwoFactor struct{ db *db.DB }
+
+func (r sqliteTwoFactor) Get(userID int64) (TwoFactor, error) {
+	t := TwoFactor{UserID: userID}
+	var (
+		enabled int
+		codes   string
+	)
+	err := r.db.SQL().QueryRow(`SELECT secret, enabled, created_at, last_step, recovery_codes FROM user_totp WHERE user_id = ?`, userID).
+		Scan(&t.Secret, &enabled, &t.CreatedAt, &t.LastStep, &codes)
+	if err != nil {
+		return t, notFound(err)
+	}
+	secret, err := r.db.OpenSecret(t.Secret)
+	if err != nil {
+		return t, err
+	}
+	t.Secret = secret
+	t.Enabled = enabled == 1
+	t.RecoveryCodes = strings.Fields(codes)
+	return t, nil
+}
+
+func (r sqliteTwoFactor) Put(t TwoFactor) error {
+	secret, err := r.db.SealSecret(t.Secret)
+	if err != nil {
+		return err
+	}
+	enabled := 0
+	if t.Enabled {
+		enabled = 1
+	}
+	_, err = r.db.SQL().Exec(`
+		INSERT INTO user_totp(user_id, secret, enabled, created_at, last_step, recovery_codes)
+		VALUES (?,?,?,?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET
+		  secret = excluded.secret,
+		  enabled = excluded.enabled,
+		  created_at = excluded.created_at,
+		  last_step = excluded.last_step,
+		  recovery_codes = excluded.recovery_codes
+	`, t.UserID, secret, enabled, t.CreatedAt, t.LastStep, strings.Join(t.RecoveryCodes, " "))
+	return err
+}
+
+func (r sqliteTwoFactor) Delete(userID int64) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID)
+	return err
+}
+
+func (r sqliteTwoFactor) UseStep(userID, step int64) (bool, error) {
+	res, err := r.db.SQL().Exec(`UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r sqliteTwoFactor) UseRecoveryCode(userID int64, hash string) (bool, error) {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var codes string
+	if err := tx.QueryRow(`SELECT recovery_codes FROM user_totp WHERE user_id = ?`, userID).Scan(&codes); err != nil {
+		return false, notFound(err)
+	}
+	list := strings.Fields(codes)
+	if removeWhere(&list, func(c string) bool { return c == hash }) == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`UPDATE user_totp SET recovery_codes = ? WHERE user_id = ?`, strings.Join(list, " "), userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+type sqliteIdentities struct{ db *db.DB }
+
+func (r sqliteIdentities) Get(issuer, subject string) (Identity, error) {
+	id := Identity{Issuer: issuer, Subject: subject}
+	err := r.db.SQL().QueryRow(`SELECT user_id, created_at, last_login_at FROM user_identities WHERE issuer = ? AND subject = ?`, issuer, subject).
+		Scan(&id.UserID, &id.CreatedAt, &id.LastLoginAt)
+	return id, notFound(err)
+}
+
+func (r sqliteIdentities) ListForUser(userID int64) ([]Identity, error) {
+	rows, err := r.db.SQL().Query(`
+		SELECT issuer, subject, user_id, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = ?
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Identity{}
+	for rows.Next() {
+		var id Identity
+		if err := rows.Scan(&id.Issuer, &id.Subject, &id.UserID, &id.CreatedAt, &id.LastLoginAt); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteIdentities) Link(id Identity) error {
+	_, err := r.db.SQL().Exec(`INSERT INTO user_identities(issuer, subject, user_id, created_at, last_login_at) VALUES (?,?,?,?,?)`,
+		id.Issuer, id.Subject, id.UserID, id.CreatedAt, id.LastLoginAt)
+	return conflict(err)
+}
+
+func (r sqliteIdentities) Touch(issuer, subject string, at int64) error {
+	_, err := r.db.SQL().Exec(`UPDATE user_identities SET last_login_at = ? WHERE issuer = ? AND subject = ?`, at, issuer, subject)
+	return err
+}
+
+func (r sqliteIdentities) Delete(issuer, subject string) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM user_identities WHERE issuer = ? AND subject = ?`, issuer, subject)
+	return err
+}
+
+type sqliteInvitations struct{ db *db.DB }
+
+const invitationColumns = `code, role, cat_api_base, max_uses, uses, expires_at, created_by, created_at`
+
+func scanInvitation(row interface{ Scan(...any) error }) (Invitation, error) {
+	var i Invitation
+	err := row.Scan(&i.Code, &i.Role, &i.CatAPIBase, &i.MaxUses, &i.Uses, &i.ExpiresAt, &i.CreatedBy, &i.CreatedAt)
+	return i, notFound(err)
+}
+
+func (r sqliteInvitations) Create(inv Invitation) error {
+	_, err := r.db.SQL().Exec(`INSERT INTO invitations(`+invitationColumns+`) VALUES (?,?,?,?,?,?,?,?)`,
+		inv.Code, inv.Role, inv.CatAPIBase, inv.MaxUses, inv.Uses, inv.ExpiresAt, inv.CreatedBy, inv.CreatedAt)
+	return conflict(err)
+}
+
+func (r sqliteInvitations) Get(code string) (Invitation, error) {
+	return scanInvitation(r.db.SQL().QueryRow(`SELECT `+invitationColumns+` FROM invitations WHERE code = ?`, code))
+}
+
+func (r sqliteInvitations) List() ([]Invitation, error) {
+	rows, err := r.db.SQL().Query(`SELECT ` + invitationColumns + ` FROM invitations ORDER BY created_at DESC, code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Invitation{}
+	for rows.Next() {
+		i, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteInvitations) Delete(code string) (bool, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM invitations WHERE code = ?`, code)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r sqliteInvitations) Redeem(code string, now int64, u User) (int64, error) {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.Exec(`
+		UPDATE invitations SET uses = uses + 1
+		WHERE code = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at = 0 OR expires_at > ?)
+	`, code, now)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
+	}
+	inv, err := scanInvitation(tx.QueryRow(`SELECT `+invitationColumns+` FROM invitations WHERE code = ?`, code))
+	if err != nil {
+		return 0, err
+	}
+	u.Role, u.CatAPIBase = inv.Role, inv.CatAPIBase
+	id, err := sqliteUsers{r.db}.insert(tx, u)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+type sqliteRoles struct{ db *db.DB }
+
+func scanRole(row interface{ Scan(...any) error }) (Role, error) {
+	var (
+		role  Role
+		perms string
+	)
+	if err := row.Scan(&role.Name, &role.Label, &perms, &role.CreatedAt); err != nil {
+		return Role{}, notFound(err)
+	}
+	role.Permissions = strings.Fields(perms)
+	return role, nil
+}
+
+func (r sqliteRoles) Get(name string) (Role, error) {
+	return scanRole(r.db.SQL().QueryRow(`SELECT name, label, permissions, created_at FROM roles WHERE name = ?`, name))
+}
+
+func (r sqliteRoles) List() ([]Role, error) {
+	rows, err := r.db.SQL().Query(`SELECT name, label, permissions, created_at FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, role)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteRoles) Put(role Role) error {
+	_, err := r.db.SQL().Exec(`
+		INSERT INTO roles(name, label, permissions, created_at) VALUES (?,?,?,?)
+		ON CONFLICT(name) DO UPDATE SET label = excluded.label, permissions = excluded.permissions
+	`, role.Name, role.Label, strings.Join(role.Permissions, " "), role.CreatedAt)
+	return err
+}
+
+func (r sqliteRoles) Delete(name string) (bool, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM roles WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r sqliteRoles) CountUsers(name string) (int, error) {
+	var n int
+	err := r.db.SQL().QueryRow(`SELECT COUNT(1) FROM users WHERE role = ?`, name).Scan(&n)
+	return n, err
+}
+
+type sqliteProfiles struct{ db *db.DB }
+
+const profileColumns = `user_id, id, name, avatar, pin_hash, created_at`
+
+func scanProfile(row interface{ Scan(...any) error }) (Profile, error) {
+	var p Profile
+	err := row.Scan(&p.UserID, &p.ID, &p.Name, &p.Avatar, &p.PINHash, &p.CreatedAt)
+	return p, notFound(err)
+}
+
+func (r sqliteProfiles) Get(userID, id int64) (Profile, error) {
+	return scanProfile(r.db.SQL().QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE user_id = ? AND id = ?`, userID, id))
+}
+
+func (r sqliteProfiles) List(userID int64) ([]Profile, error) {
+	rows, err := r.db.SQL().Query(`SELECT `+profileColumns+` FROM profiles WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Profile{}
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteProfiles) Create(p Profile) (int64, error) {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var id int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM profiles WHERE user_id = ?`, p.UserID).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO profiles(user_id, id, name, avatar, pin_hash, created_at) VALUES (?,?,?,?,?,?)
+	`, p.UserID, id, p.Name, p.Avatar, p.PINHash, p.CreatedAt); err != nil {
+		return 0, conflict(err)
+	}
+	return id, tx.Commit()
+}
+
+func (r sqliteProfiles) Put(p Profile) error {
+	_, err := r.db.SQL().Exec(`
+		INSERT INTO profiles(user_id, id, name, avatar, pin_hash, created_at) VALUES (?,?,?,?,?,?)
+		ON CONFLICT(user_id, id) DO UPDATE SET name = excluded.name, avatar = excluded.avatar, pin_hash = excluded.pin_hash
+	`, p.UserID, p.ID, p.Name, p.Avatar, p.PINHash, p.CreatedAt)
+	return err
+}
+
+func (r sqliteProfiles) Delete(userID, id int64) (bool, error) {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.Exec(`DELETE FROM profiles WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	for _, query := range []string{
+		`DELETE FROM search_history WHERE user_id = ? AND profile_id = ?`,
+		`DELETE FROM play_history WHERE user_id = ? AND profile_id = ?`,
+		`DELETE FROM favorites WHERE user_id = ? AND profile_id = ?`,
+		`UPDATE auth_tokens SET profile_id = 0 WHERE user_id = ? AND profile_id = ?`,
+	} {
+		if _, err := tx.Exec(query, userID, id); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+type sqliteAudit struct{ db *db.DB }
+
+func (r sqliteAudit) Append(e AuditEntry) (int64, error) {
+	res, err := r.db.SQL().Exec(`
+		INSERT INTO audit_log(created_at, actor_id, actor, ip, action, target, before, after, status)
+		VALUES (?,?,?,?,?,?,?,?,?)
+	`, e.CreatedAt, e.ActorID, e.Actor, e.IP, e.Action, e.Target, e.Before, e.After, e.Status)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r sqliteAudit) List(f AuditFilter) ([]AuditEntry, int, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "substr(action, 1, length(?)) = ?")
+		args = append(args, f.Action, f.Action)
+	}
+	if f.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, f.Target)
+	}
+	if f.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	cond := strings.Join(where, " AND ")
+	var total int
+	if err := r.db.SQL().QueryRow(`SELECT COUNT(1) FROM audit_log WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := r.db.SQL().Query(`
+		SELECT id, created_at, actor_id, actor, ip, action, target, before, after, status
+		FROM audit_log WHERE `+cond+`
+		ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?
+	`, append(args, limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Actor, &e.IP, &e.Action, &e.Target, &e.Before, &e.After, &e.Status); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, e)
+	}
+	return out, total, rows.Err()
+}
+
+type sqliteSettings struct{ db *db.DB }
+
+func (r sqliteSettings) Get(key string) string       { return r.db.GetSetting(key) }
+func (r sqliteSettings) Set(key, value string) error { return r.db.SetSetting(key, value) }
+func (r sqliteSettings) Version() int64              { return r.db.SettingsVersion() }
+
+type sqliteFavorites struct{ db *db.DB }
+
+func (r sqliteFavorites) List(userID, profileID int64, limit int) ([]Favorite, error) {
+	rows, err := r.db.SQL().Query(`
+		SELECT site_key, COALESCE(site_name, ''), spider_api, video_id, video_title,
+		  COALESCE(video_poster, ''), COALESCE(video_remark, ''), updated_at
+		FROM favorites
+		WHERE user_id = ? AND profile_id = ?
+		ORDER BY updated_at DESC
+		LIMIT ?
+	`, userID, profileID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Favorite{}
+	for rows.Next() {
+		f := Favorite{UserID: userID, ProfileID: profileID}
+		if err := rows.Scan(&f.SiteKey, &f.SiteName, &f.SpiderAPI, &f.VideoID, &f.VideoTitle, &f.VideoPoster, &f.VideoRemark, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteFavorites) Exists(userID, profileID int64, siteKey, videoID string) (bool, error) {
+	var v int
+	err := r.db.SQL().QueryRow(`SELECT 1 FROM favorites WHERE user_id=? AND profile_id=? AND site_key=? AND video_id=? LIMIT 1`, userID, profileID, siteKey, videoID).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r sqliteFavorites) Upsert(f Favorite) error {
+	return upsertFavorite(r.db.SQL(), f)
+}
+
+func upsertFavorite(q execer, f Favorite) error {
+	_, err := q.Exec(`
+		INSERT INTO favorites(user_id, profile_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at)
+		VALUES(?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(user_id, profile_id, site_key, video_id) DO UPDATE SET
+		  site_name=excluded.site_name,
+		  spider_api=excluded.spider_api,
+		  video_title=excluded.video_title,
+		  video_poster=excluded.video_poster,
+		  video_remark=excluded.video_remark,
+		  updated_at=excluded.updated_at
+	`, f.UserID, f.ProfileID, f.SiteKey, f.SiteName, f.SpiderAPI, f.VideoID, f.VideoTitle, f.VideoPoster, f.VideoRemark, f.UpdatedAt)
+	return err
+}
+
+func (r sqliteFavorites) Delete(userID, profileID int64, siteKey, videoID string) (bool, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM favorites WHERE user_id=? AND profile_id=? AND site_key=? AND video_id=?`, userID, profileID, siteKey, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+type sqlitePlayHistory struct{ db *db.DB }
+
+const playHistoryColumns = `
+	COALESCE(content_key, ''), site_key, COALESCE(site_name, ''), spider_api, video_id, video_title,
+	COALESCE(video_poster, ''), COALESCE(video_remark, ''), COALESCE(pan_label, ''), COALESCE(play_flag, ''),
+	COALESCE(episode_index, 0), COALESCE(episode_name, ''), updated_at`
+
+func scanPlayHistory(row interface{ Scan(...any) error }, userID, profileID int64) (PlayHistory, error) {
+	h := PlayHistory{UserID: userID, ProfileID: profileID}
+	err := row.Scan(&h.ContentKey, &h.SiteKey, &h.SiteName, &h.SpiderAPI, &h.VideoID, &h.VideoTitle, &h.VideoPoster, &h.VideoRemark, &h.PanLabel, &h.PlayFlag, &h.EpisodeIndex, &h.EpisodeName, &h.UpdatedAt)
+	return h, notFound(err)
+}
+
+func (r sqlitePlayHistory) List(userID, profileID int64, limit int) ([]PlayHistory, error) {
+	rows, err := r.db.SQL().Query(`
+		SELECT `+playHistoryColumns+`
+		FROM play_history
+		WHERE user_id = ? AND profile_id = ?
+		ORDER BY updated_at DESC
+		LIMIT ?
+	`, userID, profileID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []PlayHistory{}
+	for rows.Next() {
+		h, err := scanPlayHistory(rows, userID, profileID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (r sqlitePlayHistory) Latest(userID, profileID int64, siteKey, videoID string) (PlayHistory, error) {
+	return scanPlayHistory(r.db.SQL().QueryRow(`
+		SELECT `+playHistoryColumns+`
+		FROM play_history
+		WHERE user_id=? AND profile_id=? AND site_key=? AND video_id=?
+		ORDER BY updated_at DESC
+		LIMIT 1
+	`, userID, profileID, siteKey, videoID), userID, profileID)
+}
+
+func (r sqlitePlayHistory) Poster(userID, profileID int64, contentKey string) (string, error) {
+	var poster string
+	err := r.db.SQL().QueryRow(`
+		SELECT video_poster
+		FROM play_history
+		WHERE user_id = ? AND profile_id = ? AND content_key = ? AND video_poster <> ''
+		ORDER BY updated_at DESC
+		LIMIT 1
+	`, userID, profileID, contentKey).Scan(&poster)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return strings.TrimSpace(poster), err
+}
+
+func (r sqlitePlayHistory) Record(h PlayHistory) error {
+	tx, err := r.db.SQL().Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := recordPlay(tx, h); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordPlay(q execer, h PlayHistory) error {
+	if _, err := q.Exec(`
+		DELETE FROM play_history
+		WHERE user_id = ? AND profile_id = ? AND (content_key = ? OR video_title = ?)
+	`, h.UserID, h.ProfileID, h.ContentKey, h.VideoTitle); err != nil {
+		return err
+	}
+	_, err := q.Exec(`
+		INSERT INTO play_history(
+		  user_id, profile_id, content_key, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark,
+		  pan_label, play_flag, episode_index, episode_name, updated_at
+		)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(user_id, profile_id, site_key, video_id) DO UPDATE SET
+		  content_key = excluded.content_key,
+		  site_name = excluded.site_name,
+		  spider_api = excluded.spider_api,
+		  video_title = excluded.video_title,
+		  video_poster = excluded.video_poster,
+		  video_remark = excluded.video_remark,
+		  pan_label = excluded.pan_label,
+		  play_flag = excluded.play_flag,
+		  episode_index = excluded.episode_index,
+		  episode_name = excluded.episode_name,
+		  updated_at = excluded.updated_at
+	`, h.UserID, h.ProfileID, h.ContentKey, h.SiteKey, h.SiteName, h.SpiderAPI, h.VideoID, h.VideoTitle, h.VideoPoster, h.VideoRemark, h.PanLabel, h.PlayFlag, h.EpisodeIndex, h.EpisodeName, h.UpdatedAt)
+	return err
+}
+
+func (r sqlitePlayHistory) DeleteContent(userID, profileID int64, contentKey string) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM play_history WHERE user_id=? AND profile_id=? AND content_key=?`, userID, profileID, contentKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r sqlitePlayHistory) DeleteVideo(userID, profileID int64, siteKey, videoID string) (int64, error) {
+	res, err := r.db.SQL().Exec(`DELETE FROM play_history WHERE user_id=? AND profile_id=? AND site_key=? AND video_id=?`, userID, profileID, siteKey, videoID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type sqliteSearchHistory struct{ db *db.DB }
+
+func (r sqliteSearchHistory) List(userID, profileID int64, limit int) ([]string, error) {
+	rows, err := r.db.SQL().Query(`SELECT keyword FROM search_history WHERE user_id=? AND profile_id=? ORDER BY updated_at DESC LIMIT ?`, userID, profileID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var kw string
+		if err := rows.Scan(&kw); err != nil {
+			return nil, err
+		}
+		out = append(out, kw)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteSearchHistory) Entries(userID, profileID int64) ([]SearchEntry, error) {
+	rows, err := r.db.SQL().Query(`SELECT keyword, updated_at FROM search_history WHERE user_id=? AND profile_id=? ORDER BY updated_at DESC`, userID, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SearchEntry{}
+	for rows.Next() {
+		var e SearchEntry
+		if err := rows.Scan(&e.Keyword, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (r sqliteSearchHistory) Touch(userID, profileID int64, keyword string, at int64) error {
+	return touchSearch(r.db.SQL(), userID, profileID, keyword, at)
+}
+
+func touchSearch(q execer, userID, profileID int64, keyword string, at int64) error {
+	_, err := q.Exec(`
+		INSERT INTO search_history(user_id, profile_id, keyword, updated_at)
+		VALUES(?,?,?,?)
+		ON CONFLICT(user_id, profile_id, keyword) DO UPDATE SET updated_at = excluded.updated_at
+	`, userID, profileID, keyword, at)
+	return err
+}
+
+func (r sqliteSearchHistory) Delete(userID, profileID int64, keyword string) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM search_history WHERE user_id=? AND profile_id=? AND keyword=?`, userID, profileID, keyword)
+	return err
+}
+
+func (r sqliteSearchHistory) Clear(userID, profileID int64) error {
+	_, err := r.db.SQL().Exec(`DELETE FROM search_history WHERE user_id=? AND profile_id=?`, userID, profileID)
+	return err
+}
+
+// siteTable is the sites table, or one user's rows of user_sites when user
+// is set. Writes notify subscribers like the dashboard settings do.
+type siteTable struct {
+	db   *db.DB
+	user *int64
+}
+
+func (t siteTable) list(q interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}) ([]Site, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if t.user == nil {
+		rows, err = q.Query(`
+			SELECT site_key, name, api, type, enabled, home, search, availability, error
+			FROM sites
+			ORDER BY position, site_key
+		`)
+	} else {
+		rows, err = q.Query(`
+			SELECT site_key, name, api, type, enabled, home, search, availability, ''
+			FROM user_sites
+			WHERE user_id = ?
+			ORDER BY position, site_key
+		`, *t.user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Site{}
+	for rows.Next() {
+		var (
+			s   Site
+			typ sql.NullInt64
+		)
+		if err := rows.Scan(&s.Key, &s.Name, &s.API, &typ, &s.Enabled, &s.Home, &s.Search, &s.Availability, &s.Error); err != nil {
+			return nil, err
+		}
+		if typ.Valid {
+			n := int(typ.Int64)
+			s.Type = &n
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func (t siteTable) replace(next func(cur []Site) ([]Site, bool)) (bool, error) {
+	tx, err := t.db.SQL().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	cur, err := t.list(tx)
+	if err != nil {
+		return false, err
+	}
+	list, ok := next(cur)
+	if !ok {
+		return false, nil
+	}
+	if t.user == nil {
+		_, err = tx.Exec(`DELETE FROM sites`)
+	} else {
+		_, err = tx.Exec(`DELETE FROM user_sites WHERE user_id = ?`, *t.user)
+	}
+	if err != nil {
+		return false, err
+	}
+	for i, s := range list {
+		if err := t.insert(tx, s, i); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	t.changed()
+	return true, nil
+}
+
+func (t siteTable) insert(tx *sql.Tx, s Site, position int) error {
+	var typ any
+	if s.Type != nil {
+		typ = *s.Type
+	}
+	var err error
+	if t.user == nil {
+		_, err = tx.Exec(`
+			INSERT INTO sites(site_key, name, api, type, enabled, home, search, position, availability, error)
+			VALUES (?,?,?,?,?,?,?,?,?,?)
+		`, s.Key, s.Name, s.API, typ, s.Enabled, s.Home, s.Search, position, s.Availability, s.Error)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO user_sites(user_id, site_key, name, api, type, enabled, home, search, position, availability)
+			VALUES (?,?,?,?,?,?,?,?,?,?)
+		`, *t.user, s.Key, s.Name, s.API, typ, s.Enabled, s.Home, s.Search, position, s.Availability)
+	}
+	return conflict(err)
+}
+
+func (t siteTable) edit(key string, fn func(s *Site)) (bool, error) {
+	tx, err := t.db.SQL().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	cur, err := t.list(tx)
+	if err != nil {
+		return false, err
+	}
+	i := slices.IndexFunc(cur, func(s Site) bool { return s.Key == key })
+	if i < 0 {
+		return false, nil
+	}
+	s := cur[i]
+	fn(&s)
+	var typ any
+	if s.Type != nil {
+		typ = *s.Type
+	}
+	if t.user == nil {
+		_, err = tx.Exec(`
+			UPDATE sites SET name = ?, api = ?, type = ?, enabled = ?, home = ?, search = ?, availability = ?, error = ?
+			WHERE site_key = ?
+		`, s.Name, s.API, typ, s.Enabled, s.Home, s.Search, s.Availability, s.Error, key)
+	} else {
+		_, err = tx.Exec(`
+			UPDATE user_sites SET name = ?, api = ?, type = ?, enabled = ?, home = ?, search = ?, availability = ?
+			WHERE user_id = ? AND site_key = ?
+		`, s.Name, s.API, typ, s.Enabled, s.Home, s.Search, s.Availability, *t.user, key)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	t.changed()
+	return true, nil
+}
+
+func (t siteTable) changed() {
+	if t.user == nil {
+		t.db.MarkSettingsChanged("sites")
+	} else {
+		t.db.NotifyUserSitesChanged(*t.user)
+	}
+}
+
+type sqliteSites struct{ db *db.DB }
+
+func (r sqliteSites) List() ([]Site, error) { return siteTable{db: r.db}.list(r.db.SQL()) }
+
+func (r sqliteSites) Replace(next func(cur []Site) ([]Site, bool)) (bool, error) {
+	return siteTable{db: r.db}.replace(next)
+}
+
+func (r sqliteSites) Edit(key string, fn func(s *Site)) (bool, error) {
+	return siteTable{db: r.db}.edit(key, fn)
+}
+
+type sqliteUserSites struct{ db *db.DB }
+
+func (r sqliteUserSites) List(userID int64) ([]Site, error) {
+	return siteTable{db: r.db, user: &userID}.list(r.db.SQL())
+}
+
+func (r sqliteUserSites) Replace(userID int64, next func(cur []Site) ([]Site, bool)) (bool, error) {
+	return siteTable{db: r.db, user: &userID}.replace(next)
+}
+
+func (r sqliteUserSites) Edit(userID int64, key string, fn func(s *Site)) (bool, error) {
+	return siteTable{db: r.db, user: &userID}.edit(key, fn)
+}
@@ -0,0 +1,459 @@
+// Package store defines typed repositories for the data the HTTP layer reads
+// and writes, with a SQLite implementation backed by internal/db and an
+// in-memory implementation for tests and experiments.
+package store
+
+import "errors"
+
+// ErrNotFound is returned when the requested row does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a write would violate a uniqueness rule, such
+// as a duplicate username.
+var ErrConflict = errors.New("conflict")
+
+// Store bundles the repositories.
+type Store struct {
+	Users         UserRepo
+	Tokens        TokenRepo
+	APITokens     APITokenRepo
+	LoginFailures LoginFailureRepo
+	TwoFactor     TwoFactorRepo
+	Identities    IdentityRepo
+	Invitations   InvitationRepo
+	Roles         RoleRepo
+	Profiles      ProfileRepo
+	Audit         AuditRepo
+	Settings      SettingsRepo
+	Favorites     FavoriteRepo
+	PlayHistory   PlayHistoryRepo
+	SearchHistory SearchHistoryRepo
+	Sites         SiteRepo
+	UserSites     UserSiteRepo
+}
+
+type User struct {
+	ID                int64
+	Username          string
+	PasswordHash      string
+	Role              string
+	Status            string
+	CatAPIBase        string
+	CatAPIKey         string
+	CatProxy          string
+	SearchThreadCount int
+	SearchCoverSite   string
+	DisplayName       string
+	// MustChangePassword blocks the API until the user sets a new password.
+	MustChangePassword bool
+}
+
+// UserPatch lists the user fields to change; nil fields are left alone.
+type UserPatch struct {
+	Username           *string
+	PasswordHash       *string
+	Role               *string
+	Status             *string
+	CatAPIBase         *string
+	CatAPIKey          *string
+	CatProxy           *string
+	SearchThreadCount  *int
+	SearchCoverSite    *string
+	DisplayName        *string
+	MustChangePassword *bool
+	// SearchSiteOrder replaces the user's search order; an empty non-nil
+	// slice clears it.
+	SearchSiteOrder []string
+}
+
+// UserDeletion reports how many rows were removed with a user.
+type UserDeletion struct {
+	Tokens        int64
+	SearchHistory int64
+	PlayHistory   int64
+	Favorites     int64
+}
+
+// UserImport is what an archive import writes. Favorites and play history
+// are stored as with Upsert and Record, search entries as with Touch.
+type UserImport struct {
+	ProfileID     int64
+	Favorites     []Favorite
+	PlayHistory   []PlayHistory
+	SearchHistory []SearchEntry
+	Patch         UserPatch
+}
+
+type UserRepo interface {
+	ByID(id int64) (User, error)
+	ByUsername(username string) (User, error)
+	// List returns every user, admins first, then by username.
+	List() ([]User, error)
+	Count() (int, error)
+	// Create inserts u and returns its new ID.
+	Create(u User) (int64, error)
+	Update(id int64, patch UserPatch) error
+	// SearchOrder returns the site keys in the user's preferred search order.
+	SearchOrder(id int64) ([]string, error)
+	// Delete removes the user together with everything they own.
+	Delete(id int64) (UserDeletion, error)
+	// Import writes the rows of an archive import for one profile and
+	// applies the settings patch, all or nothing.
+	Import(id int64, in UserImport) error
+}
+
+// Token is a login session. Only the SHA-256 hash of the cookie value is
+// stored.
+type Token struct {
+	ID         int64
+	Hash       string
+	UserID     int64
+	CreatedAt  int64
+	ExpiresAt  int64
+	LastSeenAt int64
+	UserAgent  string
+	IP         string
+	// Remember marks a persistent session; others end with the browser and
+	// expire sooner when idle.
+	Remember bool
+	// ProfileID is the profile the session is using.
+	ProfileID int64
+}
+
+type TokenRepo interface {
+	// Create inserts t and returns its new ID.
+	Create(t Token) (int64, error)
+	ByHash(hash string) (Token, error)
+	ByID(id int64) (Token, error)
+	// List returns the sessions of userID, or of every user when userID is 0,
+	// most recently seen first.
+	List(userID int64) ([]Token, error)
+	// Touch records activity on a session and moves its expiry.
+	Touch(id int64, at, expiresAt int64, ip, userAgent string) error
+	SetProfile(id, profileID int64) error
+	Delete(id int64) error
+	// DeleteForUser removes the user's sessions except exceptID (0 keeps none).
+	DeleteForUser(userID, exceptID int64) (int64, error)
+	DeleteExpired(now int64) (int64, error)
+}
+
+// APIToken is a personal access token. Only the SHA-256 hash of the secret
+// is stored; Prefix keeps its first characters so users can tell tokens apart.
+type APIToken struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Hash       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  int64
+	ExpiresAt  int64 // 0 means the token does not expire
+	LastUsedAt int64
+}
+
+type APITokenRepo interface {
+	// Create inserts t and returns its new ID.
+	Create(t APIToken) (int64, error)
+	ByHash(hash string) (APIToken, error)
+	// ListForUser returns the user's tokens, newest first.
+	ListForUser(userID int64) ([]APIToken, error)
+	// Delete removes one of the user's tokens and reports whether it existed.
+	Delete(userID, id int64) (bool, error)
+	Touch(id int64, at int64) error
+	DeleteExpired(now int64) (int64, error)
+}
+
+// Login failure scopes.
+const (
+	LoginScopeUser = "user"
+	LoginScopeIP   = "ip"
+	// LoginScopeProfile tracks wrong PINs, keyed by "userID:profileID".
+	LoginScopeProfile = "profile"
+)
+
+// LoginFailure tracks failed logins for one username or client IP.
+type LoginFailure struct {
+	Scope         string
+	Key           string
+	Failures      int
+	LastFailureAt int64
+	LockedUntil   int64
+}
+
+type LoginFailureRepo interface {
+	Get(scope, key string) (LoginFailure, error)
+	Put(f LoginFailure) error
+	Delete(scope, key string) error
+	// List returns every tracked entry, most recent failure first.
+	List() ([]LoginFailure, error)
+	// DeleteStale removes entries whose last failure is before at and that
+	// are no longer locked.
+	DeleteStale(at int64) (int64, error)
+}
+
+// TwoFactor is a user's TOTP enrollment. It stays disabled until the first
+// code is verified.
+type TwoFactor struct {
+	UserID    int64
+	Secret    string // base32
+	Enabled   bool
+	CreatedAt int64
+	// LastStep is the last accepted time step, so a code cannot be replayed.
+	LastStep int64
+	// RecoveryCodes holds the SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string
+}
+
+type TwoFactorRepo interface {
+	Get(userID int64) (TwoFactor, error)
+	// Put inserts or replaces the user's enrollment.
+	Put(t TwoFactor) error
+	Delete(userID int64) error
+	// UseStep records step as accepted unless it is not newer than LastStep.
+	UseStep(userID, step int64) (bool, error)
+	// UseRecoveryCode consumes the recovery code with the given hash.
+	UseRecoveryCode(userID int64, hash string) (bool, error)
+}
+
+// Identity links an account at an external identity provider to a user.
+type Identity struct {
+	Issuer      string
+	Subject     string
+	UserID      int64
+	CreatedAt   int64
+	LastLoginAt int64
+}
+
+type IdentityRepo interface {
+	Get(issuer, subject string) (Identity, error)
+	ListForUser(userID int64) ([]Identity, error)
+	// Link creates the identity, failing with ErrConflict if it is taken.
+	Link(id Identity) error
+	Touch(issuer, subject string, at int64) error
+	Delete(issuer, subject string) error
+}
+
+// Invitation lets people register an account with a preset role and
+// CatPawOpen base.
+type Invitation struct {
+	Code       string
+	Role       string
+	CatAPIBase string
+	MaxUses    int // 0 means unlimited
+	Uses       int
+	ExpiresAt  int64 // 0 means the code does not expire
+	CreatedBy  int64
+	CreatedAt  int64
+}
+
+// Usable reports whether the invitation can still be redeemed at now.
+func (i Invitation) Usable(now int64) bool {
+	return (i.MaxUses == 0 || i.Uses < i.MaxUses) && (i.ExpiresAt == 0 || i.ExpiresAt > now)
+}
+
+type InvitationRepo interface {
+	// Create inserts inv, failing with ErrConflict if the code is taken.
+	Create(inv Invitation) error
+	Get(code string) (Invitation, error)
+	// List returns every invitation, newest first.
+	List() ([]Invitation, error)
+	Delete(code string) (bool, error)
+	// Redeem creates u with the invitation's role and CatPawOpen base and
+	// counts the use, all or nothing. It fails with ErrNotFound when the code
+	// is unknown, used up or expired, and ErrConflict when the username is
+	// taken.
+	Redeem(code string, now int64, u User) (int64, error)
+}
+
+// Role is a named set of permissions that users are assigned.
+type Role struct {
+	Name        string
+	Label       string
+	Permissions []string
+	Builtin     bool
+	CreatedAt   int64
+}
+
+// RoleRepo holds the custom roles; built-in roles live in code.
+type RoleRepo interface {
+	Get(name string) (Role, error)
+	// List returns the custom roles by name.
+	List() ([]Role, error)
+	// Put inserts or replaces the role.
+	Put(role Role) error
+	Delete(name string) (bool, error)
+	// CountUsers reports how many users have the role.
+	CountUsers(name string) (int, error)
+}
+
+// DefaultProfileID is the profile every account has. It only gets a profiles
+// row once it is named or given a PIN.
+const DefaultProfileID = 0
+
+// Profile is a household member under an account, with their own play
+// history, search history and favorites. IDs are numbered per user.
+type Profile struct {
+	UserID    int64
+	ID        int64
+	Name      string
+	Avatar    string
+	PINHash   string // empty when the profile has no PIN
+	CreatedAt int64
+}
+
+type ProfileRepo interface {
+	Get(userID, id int64) (Profile, error)
+	// List returns the user's stored profiles by ID.
+	List(userID int64) ([]Profile, error)
+	// Create inserts p under the next free ID and returns it.
+	Create(p Profile) (int64, error)
+	// Put inserts or replaces p.
+	Put(p Profile) error
+	// Delete removes the profile together with its history and favorites,
+	// and moves sessions using it back to the default profile.
+	Delete(userID, id int64) (bool, error)
+}
+
+// AuditEntry records one change made in the dashboard.
+type AuditEntry struct {
+	ID        int64
+	CreatedAt int64
+	ActorID   int64
+	Actor     string // username at the time of the change
+	IP        string
+	Action    string // dashboard path, such as "user/ban"
+	Target    string
+	Before    string // JSON summary, empty when not recorded
+	After     string
+	Status    int // HTTP status of the response
+}
+
+// AuditFilter selects audit entries; zero fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string // prefix of the action
+	Target string
+	Since  int64
+	Until  int64 // exclusive
+	Limit  int
+	Offset int
+}
+
+type AuditRepo interface {
+	// Append stores e and returns its new ID.
+	Append(e AuditEntry) (int64, error)
+	// List returns a page of the entries matching f, newest first, and how
+	// many match in total.
+	List(f AuditFilter) ([]AuditEntry, int, error)
+}
+
+type SettingsRepo interface {
+	Get(key string) string
+	Set(key, value string) error
+	Version() int64
+}
+
+type Favorite struct {
+	UserID      int64
+	ProfileID   int64
+	SiteKey     string
+	SiteName    string
+	SpiderAPI   string
+	VideoID     string
+	VideoTitle  string
+	VideoPoster string
+	VideoRemark string
+	UpdatedAt   int64
+}
+
+type FavoriteRepo interface {
+	// List returns up to limit favorites, newest first. A negative limit
+	// returns all of them.
+	List(userID, profileID int64, limit int) ([]Favorite, error)
+	Exists(userID, profileID int64, siteKey, videoID string) (bool, error)
+	Upsert(f Favorite) error
+	Delete(userID, profileID int64, siteKey, videoID string) (bool, error)
+}
+
+type PlayHistory struct {
+	UserID       int64
+	ProfileID    int64
+	ContentKey   string
+	SiteKey      string
+	SiteName     string
+	SpiderAPI    string
+	VideoID      string
+	VideoTitle   string
+	VideoPoster  string
+	VideoRemark  string
+	PanLabel     string
+	PlayFlag     string
+	EpisodeIndex int
+	EpisodeName  string
+	UpdatedAt    int64
+}
+
+type PlayHistoryRepo interface {
+	// List returns up to limit records, newest first. A negative limit
+	// returns all of them.
+	List(userID, profileID int64, limit int) ([]PlayHistory, error)
+	Latest(userID, profileID int64, siteKey, videoID string) (PlayHistory, error)
+	// Poster returns the most recent non-empty poster recorded for contentKey.
+	Poster(userID, profileID int64, contentKey string) (string, error)
+	// Record stores h as the only record for its content: earlier records
+	// with the same content key or title are replaced.
+	Record(h PlayHistory) error
+	DeleteContent(userID, profileID int64, contentKey string) (int64, error)
+	DeleteVideo(userID, profileID int64, siteKey, videoID string) (int64, error)
+}
+
+type SearchEntry struct {
+	Keyword   string
+	UpdatedAt int64
+}
+
+type SearchHistoryRepo interface {
+	// List returns up to limit keywords, most recently used first.
+	List(userID, profileID int64, limit int) ([]string, error)
+	// Entries returns every keyword with its last use, most recent first.
+	Entries(userID, profileID int64) ([]SearchEntry, error)
+	Touch(userID, profileID int64, keyword string, at int64) error
+	Delete(userID, profileID int64, keyword string) error
+	Clear(userID, profileID int64) error
+}
+
+// Site is one entry of a site list: the global list in the dashboard or the
+// list read from a user's own CatPawOpen.
+type Site struct {
+	Key          string
+	Name         string
+	API          string
+	Type         *int
+	Enabled      bool
+	Home         bool
+	Search       bool
+	Availability string
+	// Error is the message of the last failed check. Only global sites are
+	// checked.
+	Error string
+}
+
+// SiteRepo holds the global site list. Lists are in display order.
+type SiteRepo interface {
+	List() ([]Site, error)
+	// Replace swaps the list for the one next builds from the current list,
+	// atomically. next returns false to leave the list as it is; Replace
+	// reports whether it was changed.
+	Replace(next func(cur []Site) ([]Site, bool)) (bool, error)
+	// Edit applies fn to the site with key and reports whether it exists.
+	// Changes to the key are ignored.
+	Edit(key string, fn func(s *Site)) (bool, error)
+}
+
+// UserSiteRepo holds the site list of each user's own CatPawOpen, like
+// SiteRepo does for the global one.
+type UserSiteRepo interface {
+	List(userID int64) ([]Site, error)
+	Replace(userID int64, next func(cur []Site) ([]Site, bool)) (bool, error)
+	Edit(userID int64, key string, fn func(s *Site)) (bool, error)
+}
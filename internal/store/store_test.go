@@ -0,0 +1,273 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+)
+
+// backends runs fn against every Store implementation, each test on a fresh
+// one.
+func backends(t *testing.T, fn func(t *testing.T, st *Store)) {
+	t.Run("memory", func(t *testing.T) { fn(t, NewMemory()) })
+	t.Run("sqlite", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("MEOWFILM_DATA_DIR", dir)
+		t.Setenv("MEOWFILM_DB_FILE", filepath.Join(dir, "data.db"))
+		t.Setenv("MEOWFILM_MASTER_KEY", "")
+		t.Setenv("MEOWFILM_MASTER_KEY_FILE", "")
+		database, err := db.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = database.Close() })
+		fn(t, NewSQLite(database))
+	})
+}
+
+func createUser(t *testing.T, st *Store, username string) int64 {
+	t.Helper()
+	id, err := st.Users.Create(User{Username: username, Role: "user", Status: "active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// addUserData gives the user's profile a session, search, play record and
+// favorite.
+func addUserData(t *testing.T, st *Store, userID, profileID int64, hash string) {
+	t.Helper()
+	id, err := st.Tokens.Create(Token{Hash: hash, UserID: userID, CreatedAt: 1, ExpiresAt: 1 << 50, LastSeenAt: 1})
+	if err == nil {
+		err = st.Tokens.SetProfile(id, profileID)
+	}
+	if err == nil {
+		err = st.SearchHistory.Touch(userID, profileID, "film", 1)
+	}
+	if err == nil {
+		err = st.PlayHistory.Record(PlayHistory{UserID: userID, ProfileID: profileID, ContentKey: "film", SiteKey: "s", SpiderAPI: "api", VideoID: "1", VideoTitle: "Film", UpdatedAt: 1})
+	}
+	if err == nil {
+		err = st.Favorites.Upsert(Favorite{UserID: userID, ProfileID: profileID, SiteKey: "s", SpiderAPI: "api", VideoID: "1", VideoTitle: "Film", UpdatedAt: 1})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// profileRows counts the search, play and favorite rows of one profile.
+func profileRows(t *testing.T, st *Store, userID, profileID int64) int {
+	t.Helper()
+	searches, err1 := st.SearchHistory.Entries(userID, profileID)
+	history, err2 := st.PlayHistory.List(userID, profileID, -1)
+	favorites, err3 := st.Favorites.List(userID, profileID, -1)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		t.Fatal(err)
+	}
+	return len(searches) + len(history) + len(favorites)
+}
+
+func TestUsersDeleteCascades(t *testing.T) {
+	backends(t, func(t *testing.T, st *Store) {
+		alice, bob := createUser(t, st, "alice"), createUser(t, st, "bob")
+		addUserData(t, st, alice, 0, "alice-0")
+		addUserData(t, st, alice, 1, "alice-1")
+		addUserData(t, st, bob, 0, "bob-0")
+		for _, err := range []error{
+			st.Profiles.Put(Profile{UserID: alice, ID: 1, Name: "Kid"}),
+			st.Identities.Link(Identity{Issuer: "https://idp", Subject: "alice", UserID: alice}),
+			st.TwoFactor.Put(TwoFactor{UserID: alice, Secret: "SECRET", Enabled: true}),
+			st.Users.Update(alice, UserPatch{SearchSiteOrder: []string{"s"}}),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := st.APITokens.Create(APIToken{UserID: alice, Name: "script", Hash: "alice-api", Prefix: "mfp_"}); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := st.Users.Delete(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (UserDeletion{Tokens: 2, SearchHistory: 2, PlayHistory: 2, Favorites: 2}); got != want {
+			t.Errorf("Delete = %+v, want %+v", got, want)
+		}
+		if _, err := st.Users.ByID(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ByID after delete: %v", err)
+		}
+		if _, err := st.TwoFactor.Get(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("2FA left behind: %v", err)
+		}
+		sessions, _ := st.Tokens.List(alice)
+		tokens, _ := st.APITokens.ListForUser(alice)
+		identities, _ := st.Identities.ListForUser(alice)
+		profiles, _ := st.Profiles.List(alice)
+		order, _ := st.Users.SearchOrder(alice)
+		if n := len(sessions) + len(tokens) + len(identities) + len(profiles) + len(order) + profileRows(t, st, alice, 0) + profileRows(t, st, alice, 1); n != 0 {
+			t.Errorf("%d rows left behind", n)
+		}
+		if _, err := st.Users.Delete(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second Delete: %v", err)
+		}
+
+		bobSessions, _ := st.Tokens.List(bob)
+		if len(bobSessions) != 1 || profileRows(t, st, bob, 0) != 3 {
+			t.Errorf("bob's data was touched: %d sessions, %d rows", len(bobSessions), profileRows(t, st, bob, 0))
+		}
+	})
+}
+
+func TestProfilesDelete(t *testing.T) {
+	backends(t, func(t *testing.T, st *Store) {
+		alice, bob := createUser(t, st, "alice"), createUser(t, st, "bob")
+		addUserData(t, st, alice, 0, "alice-0")
+		addUserData(t, st, alice, 1, "alice-1")
+		addUserData(t, st, bob, 1, "bob-1")
+		for _, p := range []Profile{{UserID: alice, ID: 1, Name: "Kid"}, {UserID: bob, ID: 1, Name: "Kid"}} {
+			if err := st.Profiles.Put(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if ok, err := st.Profiles.Delete(alice, 1); err != nil || !ok {
+			t.Fatalf("Delete = %v, %v", ok, err)
+		}
+		if _, err := st.Profiles.Get(alice, 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get after delete: %v", err)
+		}
+		if n := profileRows(t, st, alice, 1); n != 0 {
+			t.Errorf("%d rows left in the deleted profile", n)
+		}
+		if n := profileRows(t, st, alice, 0); n != 3 {
+			t.Errorf("default profile has %d rows, want 3", n)
+		}
+		// The session on the deleted profile falls back to the default.
+		sessions, _ := st.Tokens.List(alice)
+		for _, s := range sessions {
+			if s.ProfileID != DefaultProfileID {
+				t.Errorf("session %s on profile %d", s.Hash, s.ProfileID)
+			}
+		}
+		if len(sessions) != 2 {
+			t.Errorf("sessions = %d, want 2", len(sessions))
+		}
+		if _, err := st.Profiles.Get(bob, 1); err != nil || profileRows(t, st, bob, 1) != 3 {
+			t.Errorf("bob's profile was touched: %v", err)
+		}
+		if ok, err := st.Profiles.Delete(alice, 1); err != nil || ok {
+			t.Errorf("second Delete = %v, %v", ok, err)
+		}
+	})
+}
+
+func TestInvitationsRedeem(t *testing.T) {
+	backends(t, func(t *testing.T, st *Store) {
+		for _, inv := range []Invitation{
+			{Code: "ONCE", Role: "shared", CatAPIBase: "http://cat/", MaxUses: 1, CreatedAt: 1},
+			{Code: "EXPIRED", Role: "user", ExpiresAt: 1000, CreatedAt: 1},
+			{Code: "UNLIMITED", Role: "user", CreatedAt: 1},
+		} {
+			if err := st.Invitations.Create(inv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := st.Invitations.Create(Invitation{Code: "ONCE", Role: "user"}); !errors.Is(err, ErrConflict) {
+			t.Errorf("duplicate Create: %v, want conflict", err)
+		}
+		createUser(t, st, "taken")
+
+		// The cases run in order against the same invitations.
+		tests := []struct {
+			name     string
+			code     string
+			username string
+			now      int64
+			want     error
+		}{
+			{"unknown", "MISSING", "a", 10, ErrNotFound},
+			{"taken username", "ONCE", "taken", 10, ErrConflict},
+			{"redeemed", "ONCE", "a", 10, nil},
+			{"used up", "ONCE", "b", 10, ErrNotFound},
+			{"before expiry", "EXPIRED", "b", 999, nil},
+			{"expired", "EXPIRED", "c", 1000, ErrNotFound},
+			{"unlimited", "UNLIMITED", "c", 10, nil},
+			{"unlimited again", "UNLIMITED", "d", 10, nil},
+		}
+		for _, tt := range tests {
+			id, err := st.Invitations.Redeem(tt.code, tt.now, User{Username: tt.username, Status: "active"})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+				continue
+			}
+			if err == nil {
+				if u, err := st.Users.ByID(id); err != nil || u.Username != tt.username {
+					t.Errorf("%s: user = %+v, %v", tt.name, u, err)
+				}
+			}
+		}
+
+		a, err := st.Users.ByUsername("a")
+		if err != nil || a.Role != "shared" || a.CatAPIBase != "http://cat/" {
+			t.Errorf("a = %+v, %v; want the invitation's role and CatPawOpen", a, err)
+		}
+		for code, uses := range map[string]int{"ONCE": 1, "EXPIRED": 1, "UNLIMITED": 2} {
+			if inv, err := st.Invitations.Get(code); err != nil || inv.Uses != uses {
+				t.Errorf("%s uses = %d, %v; want %d", code, inv.Uses, err, uses)
+			}
+		}
+		if _, err := st.Users.ByUsername("b"); err != nil {
+			t.Errorf("b: %v", err)
+		}
+	})
+}
+
+func TestAuditList(t *testing.T) {
+	backends(t, func(t *testing.T, st *Store) {
+		for _, e := range []AuditEntry{
+			{CreatedAt: 100, Actor: "alice", Action: "user/ban", Target: "bob", Status: 200},
+			{CreatedAt: 200, Actor: "alice", Action: "user/update", Target: "carol", Status: 200},
+			{CreatedAt: 300, Actor: "root", Action: "settings/site", Status: 200},
+			{CreatedAt: 300, Actor: "root", Action: "users/import", Status: 400},
+		} {
+			if _, err := st.Audit.Append(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			filter AuditFilter
+			want   []string // actions, newest first
+			total  int
+		}{
+			{"everything", AuditFilter{}, []string{"users/import", "settings/site", "user/update", "user/ban"}, 4},
+			{"actor", AuditFilter{Actor: "alice"}, []string{"user/update", "user/ban"}, 2},
+			{"action prefix", AuditFilter{Action: "user/"}, []string{"user/update", "user/ban"}, 2},
+			{"target", AuditFilter{Target: "carol"}, []string{"user/update"}, 1},
+			{"since is inclusive", AuditFilter{Since: 200}, []string{"users/import", "settings/site", "user/update"}, 3},
+			{"until is exclusive", AuditFilter{Until: 200}, []string{"user/ban"}, 1},
+			{"page", AuditFilter{Limit: 2, Offset: 1}, []string{"settings/site", "user/update"}, 4},
+			{"page past the end", AuditFilter{Limit: 2, Offset: 10}, []string{}, 4},
+			{"combined", AuditFilter{Actor: "alice", Action: "user/", Since: 150}, []string{"user/update"}, 1},
+		}
+		for _, tt := range tests {
+			list, total, err := st.Audit.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range list {
+				got = append(got, e.Action)
+			}
+			if !slices.Equal(got, tt.want) || total != tt.total {
+				t.Errorf("%s: got %v (total %d), want %v (total %d)", tt.name, got, total, tt.want, tt.total)
+			}
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jenfonro/meowfilm/internal/proxy"
 	"github.com/jenfonro/meowfilm/server"
 	"github.com/jenfonro/meowfilm/server/static"
 )
@@ -19,11 +20,23 @@ func main() {
 	flag.StringVar(&addr, "addr", envDefault("MEOWFILM_ADDR", ":8080"), "listen address")
 	flag.Parse()
 
+	if flag.Arg(0) == "rotate-key" {
+		os.Exit(runRotateKey(flag.Args()[1:]))
+	}
+
 	log.Printf("meowfilm version : %s", static.ServerVersion())
 
+	trusted, err := proxy.ParseTrusted(os.Getenv("MEOWFILM_TRUST_PROXY"))
+	if err != nil {
+		log.Fatalf("MEOWFILM_TRUST_PROXY: %v", err)
+	}
+	if trusted.Header, err = proxy.ParseHeader(os.Getenv("MEOWFILM_PROXY_HEADER")); err != nil {
+		log.Fatalf("MEOWFILM_PROXY_HEADER: %v", err)
+	}
+
 	s, err := server.New(server.Config{
-		Addr:       addr,
-		TrustProxy: os.Getenv("MEOWFILM_TRUST_PROXY") == "1",
+		Addr:           addr,
+		TrustedProxies: trusted,
 	})
 	if err != nil {
 		log.Fatalf("init server: %v", err)
@@ -34,6 +47,7 @@ func main() {
 		Handler:           s.Handler(),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
+	httpServer.RegisterOnShutdown(s.CloseEvents)
 
 	go func() {
 		log.Printf("meowfilm listening on %s", httpServer.Addr)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+)
+
+// runRotateKey implements "meowfilm rotate-key": it re-encrypts the stored
+// secrets under a new master key. The server must be stopped while it runs.
+// The current key comes from MEOWFILM_MASTER_KEY / MEOWFILM_MASTER_KEY_FILE
+// as usual (none if the secrets are still plain text).
+//
+// Snapshots, including the one written just before rotating, keep their
+// secrets sealed under the old key: they need the old key to be restored,
+// and should be deleted if the key was rotated because it leaked.
+func runRotateKey(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintln(out, "usage: meowfilm rotate-key [-new-key KEY | -new-key-file FILE]")
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Re-encrypts the stored secrets under a new master key. Stop the server first;")
+		fmt.Fprintln(out, "the current key is read from MEOWFILM_MASTER_KEY / MEOWFILM_MASTER_KEY_FILE.")
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "A snapshot is written before rotating. It and every older snapshot stay")
+		fmt.Fprintln(out, "encrypted under the old key: keep the old key to restore them, or delete them")
+		fmt.Fprintln(out, "if the old key leaked.")
+		fmt.Fprintln(out, "")
+		fs.PrintDefaults()
+	}
+	newKey := fs.String("new-key", "", "new master key (base64 or hex, 32 bytes); defaults to MEOWFILM_NEW_MASTER_KEY")
+	newKeyFile := fs.String("new-key-file", "", "file containing the new master key")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var (
+		key []byte
+		err error
+	)
+	switch {
+	case strings.TrimSpace(*newKeyFile) != "":
+		key, err = db.ReadMasterKeyFile(*newKeyFile)
+	case strings.TrimSpace(*newKey) != "":
+		key, err = db.ParseMasterKey([]byte(*newKey))
+	case strings.TrimSpace(os.Getenv("MEOWFILM_NEW_MASTER_KEY")) != "":
+		key, err = db.ParseMasterKey([]byte(os.Getenv("MEOWFILM_NEW_MASTER_KEY")))
+	default:
+		err = fmt.Errorf("missing -new-key, -new-key-file or MEOWFILM_NEW_MASTER_KEY")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-key: %v\n", err)
+		return 2
+	}
+
+	database, err := db.Open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-key: open database: %v\n", err)
+		return 1
+	}
+	defer func() { _ = database.Close() }()
+
+	snapshot, err := database.WriteScheduledSnapshot(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-key: snapshot before rotation: %v\n", err)
+		return 1
+	}
+	if err := database.RotateMasterKey(key); err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("secrets re-encrypted with the new master key (previous state saved to %s)\n", snapshot)
+	fmt.Println("update MEOWFILM_MASTER_KEY / MEOWFILM_MASTER_KEY_FILE before starting the server")
+	fmt.Fprintf(os.Stderr, "warning: the snapshots in %s, including %s, are still encrypted under the old master key.\n", database.SnapshotDir(), filepath.Base(snapshot))
+	fmt.Fprintln(os.Stderr, "warning: keep the old key to restore them, or delete them if the old key leaked.")
+	return 0
+}
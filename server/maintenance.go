@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/maintenance"
+	"github.com/jenfonro/meowfilm/internal/store"
+	"github.com/jenfonro/meowfilm/server/routes"
+)
+
+// newJanitor sets up the background housekeeping tasks. Intervals backed by
+// settings are re-read on every tick so dashboard changes apply live.
+func newJanitor(database *db.DB, st *store.Store) *maintenance.Janitor {
+	every := func(d time.Duration) func() time.Duration {
+		return func() time.Duration { return d }
+	}
+
+	// Scheduled snapshots every "backup_interval_hours" (0 disables them),
+	// keeping "backup_keep" of them.
+	var lastSnapshot time.Time
+	if list, err := database.ListSnapshots(); err == nil && len(list) > 0 {
+		lastSnapshot = time.UnixMilli(list[0].CreatedAt)
+	}
+	// VACUUM runs days apart, longer than the process may live, so its last
+	// run is kept in "maintenance_vacuum_last".
+	var lastVacuum time.Time
+	if ms := db.ParseIntDefault(database.GetSetting("maintenance_vacuum_last"), 0); ms > 0 {
+		lastVacuum = time.UnixMilli(int64(ms))
+	}
+
+	return maintenance.New(
+		maintenance.Task{
+			Name:     "tokens",
+			Interval: every(time.Hour),
+			Run: func(now time.Time) (string, error) {
+				n, err := st.Tokens.DeleteExpired(now.UnixMilli())
+				if err != nil {
+					return "", err
+				}
+				m, err := st.APITokens.DeleteExpired(now.UnixMilli())
+				if err != nil {
+					return "", err
+				}
+				// Failure counters older than the lockout window no longer count.
+				window := max(auth.LoadLoginPolicy(st.Settings).Lockout, time.Hour)
+				f, err := st.LoginFailures.DeleteStale(now.Add(-window).UnixMilli())
+				return fmt.Sprintf("清理过期登录 %d 个、访问令牌 %d 个、登录失败记录 %d 条", n, m, f), err
+			},
+		},
+		maintenance.Task{
+			Name:     "qr_sessions",
+			Interval: every(5 * time.Minute),
+			Run: func(now time.Time) (string, error) {
+				return fmt.Sprintf("清理过期扫码会话 %d 个", routes.ExpireQRSessions(now)), nil
+			},
+		},
+		maintenance.Task{
+			Name:     "retention",
+			Interval: every(time.Hour),
+			Run: func(now time.Time) (string, error) {
+				report, err := database.ApplyRetention(now, false)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("清理播放记录 %d 条、搜索记录 %d 条、收藏 %d 条",
+					report.Totals["play_history"], report.Totals["search_history"], report.Totals["favorites"]), nil
+			},
+		},
+		maintenance.Task{
+			Name:     "optimize",
+			Interval: every(6 * time.Hour),
+			Run: func(time.Time) (string, error) {
+				frames, err := database.Optimize()
+				return fmt.Sprintf("WAL 检查点写回 %d 页", frames), err
+			},
+		},
+		maintenance.Task{
+			Name: "vacuum",
+			Interval: func() time.Duration {
+				days := db.ParseIntDefault(database.GetSetting("maintenance_vacuum_days"), 0)
+				return time.Duration(days) * 24 * time.Hour
+			},
+			Run: func(now time.Time) (string, error) {
+				if err := database.Vacuum(); err != nil {
+					return "", err
+				}
+				if err := database.SetSetting("maintenance_vacuum_last", strconv.FormatInt(now.UnixMilli(), 10)); err != nil {
+					return "", err
+				}
+				return "已完成", nil
+			},
+			Since: lastVacuum,
+		},
+		maintenance.Task{
+			Name: "snapshot",
+			Interval: func() time.Duration {
+				hours := db.ParseIntDefault(database.GetSetting("backup_interval_hours"), 0)
+				return time.Duration(hours) * time.Hour
+			},
+			Run: func(time.Time) (string, error) {
+				keep := db.ParseIntDefault(database.GetSetting("backup_keep"), 7)
+				path, err := database.WriteScheduledSnapshot(keep)
+				if err != nil {
+					return "", err
+				}
+				return filepath.Base(path), nil
+			},
+			Since: lastSnapshot,
+		},
+	)
+}
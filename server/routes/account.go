@@ -0,0 +1,209 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func passwordPolicy(database *db.DB) password.Policy {
+	return password.LoadPolicy(database.GetSetting)
+}
+
+// handleAPIUserPassword changes the caller's password. It is the one API a
+// user flagged with must_change_password can still reach.
+func handleAPIUserPassword(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后修改密码"})
+		return
+	}
+	f := formFields(r, "currentPassword", "newPassword")
+	row, err := st.Users.ByID(u.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	// Users created through single sign-on have no password to confirm.
+	if row.PasswordHash != "" {
+		if !checkCurrentPassword(w, r, authMw, row, f["currentPassword"], "当前密码错误") {
+			return
+		}
+	}
+	if f["newPassword"] == f["currentPassword"] {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "新密码不能与当前密码相同"})
+		return
+	}
+	if err := passwordPolicy(database).Check(row.Username, f["newPassword"]); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": err.Error()})
+		return
+	}
+	hash, err := password.Hash(f["newPassword"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	cleared := false
+	if err := st.Users.Update(u.ID, store.UserPatch{PasswordHash: &hash, MustChangePassword: &cleared}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "修改失败"})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "revoked": revokeOtherSessions(r, st, u.ID)})
+}
+
+// revokeOtherSessions ends the user's login sessions except the one making
+// the request, after a change to their account.
+func revokeOtherSessions(r *http.Request, st *store.Store, userID int64) int64 {
+	n, _ := st.Tokens.DeleteForUser(userID, auth.SessionID(r))
+	return n
+}
+
+const maxDisplayNameLength = 32
+
+func cleanDisplayName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return "", false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// handleAPIUserProfile returns the caller's account and changes their display
+// name. An empty display name falls back to the username.
+func handleAPIUserProfile(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	u := auth.CurrentUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		row, err := st.Users.ByID(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{
+			"success":     true,
+			"username":    row.Username,
+			"displayName": row.DisplayName,
+			"role":        row.Role,
+			"hasPassword": row.PasswordHash != "",
+		})
+	case http.MethodPost:
+		if auth.TokenScopes(r) != nil {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后修改资料"})
+			return
+		}
+		name, ok := cleanDisplayName(formFields(r, "displayName")["displayName"])
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "显示名称最多 32 个字符且不能包含控制字符"})
+			return
+		}
+		if err := st.Users.Update(u.ID, store.UserPatch{DisplayName: &name}); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "修改失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "displayName": name, "revoked": revokeOtherSessions(r, st, u.ID)})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleAPIUserDelete deletes the caller's account with everything it owns.
+// The current password confirms the request; accounts without one confirm
+// with their username instead. The last active user holding every permission
+// cannot delete itself.
+func handleAPIUserDelete(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后删除账号"})
+		return
+	}
+	f := formFields(r, "currentPassword", "confirm")
+	row, err := st.Users.ByID(u.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if row.PasswordHash != "" {
+		if !checkCurrentPassword(w, r, authMw, row, f["currentPassword"], "当前密码错误") {
+			return
+		}
+	} else if strings.TrimSpace(f["confirm"]) != row.Username {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请输入用户名确认删除"})
+		return
+	}
+	last, err := authMw.LastFullAccessUser(row)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if last {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "不能删除唯一的管理员账号"})
+		return
+	}
+	deleted, err := st.Users.Delete(u.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "删除失败"})
+		return
+	}
+	authMw.Logout(w, r)
+	writeJSON(w, 200, map[string]any{
+		"success": true,
+		"deleted": map[string]any{
+			"tokenDeleted":       deleted.Tokens,
+			"historyDeleted":     deleted.SearchHistory,
+			"playHistoryDeleted": deleted.PlayHistory,
+			"favoritesDeleted":   deleted.Favorites,
+		},
+	})
+}
+
+func handleDashboardPasswordSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{"success": true, "policy": passwordPolicy(database)})
+	case http.MethodPost:
+		parseForm(r)
+		minLength := db.ParseIntDefault(r.FormValue("minLength"), -1)
+		minClasses := db.ParseIntDefault(r.FormValue("minClasses"), -1)
+		if minLength < 1 || minLength > password.MaxLength {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "最小长度必须是 1-128 的整数"})
+			return
+		}
+		if minClasses < 1 || minClasses > 4 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "字符类别数必须是 1-4 的整数"})
+			return
+		}
+		reject := "0"
+		if boolFromForm(r.FormValue("rejectUsername")) {
+			reject = "1"
+		}
+		keys := []string{"password_min_length", "password_min_classes", "password_reject_username"}
+		before := auditSettings(database, keys...)
+		_ = database.SetSetting("password_min_length", strconv.Itoa(minLength))
+		_ = database.SetSetting("password_min_classes", strconv.Itoa(minClasses))
+		_ = database.SetSetting("password_reject_username", reject)
+		auditNoteDiff(r, "", before, auditSettings(database, keys...))
+		writeJSON(w, 200, map[string]any{"success": true, "policy": passwordPolicy(database)})
+	default:
+		methodNotAllowed(w)
+	}
+}
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// signedIn returns a memory store holding one user and the session cookie
+// that signs them in.
+func signedIn(t *testing.T, username, pass, role string) (*store.Store, *auth.Auth, store.User, []*http.Cookie) {
+	t.Helper()
+	st := store.NewMemory()
+	hash, err := password.Hash(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := store.User{Username: username, PasswordHash: hash, Role: role, Status: "active"}
+	if u.ID, err = st.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	authMw := auth.New(st, auth.Options{})
+	rec := httptest.NewRecorder()
+	if err := authMw.StartSession(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), u.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	return st, authMw, u, rec.Result().Cookies()
+}
+
+func postForm(h http.Handler, target string, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestUserDeleteThrottlesPasswordChecks(t *testing.T) {
+	st, authMw, u, cookies := signedIn(t, "alice", "right-pass-1", "user")
+	_ = st.Settings.Set("login_max_failures", "3")
+	_ = st.Settings.Set("login_backoff_seconds", "0")
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserDelete(w, r, st, authMw)
+	}))
+
+	for i := 1; i <= 3; i++ {
+		if rec := postForm(h, "/api/user/delete", cookies, url.Values{"currentPassword": {"guess"}}); rec.Code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: status %d, want 400", i, rec.Code)
+		}
+	}
+	rec := postForm(h, "/api/user/delete", cookies, url.Values{"currentPassword": {"right-pass-1"}})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked: status %d, want 429 with Retry-After", rec.Code)
+	}
+	if _, err := st.Users.ByID(u.ID); err != nil {
+		t.Fatalf("account deleted while locked: %v", err)
+	}
+
+	_ = st.LoginFailures.Delete(store.LoginScopeUser, "alice")
+	_ = st.LoginFailures.Delete(store.LoginScopeIP, "192.0.2.1")
+	if rec := postForm(h, "/api/user/delete", cookies, url.Values{"currentPassword": {"right-pass-1"}}); rec.Code != http.StatusOK {
+		t.Fatalf("after unlock: status %d, body %s", rec.Code, rec.Body)
+	}
+	if _, err := st.Users.ByID(u.ID); err == nil {
+		t.Error("account still exists")
+	}
+}
+
+func TestUserDeleteKeepsLastFullAccessUser(t *testing.T) {
+	st, authMw, u, cookies := signedIn(t, "solo", "Solo-pass-12", "super")
+	admin, _ := auth.BuiltinRole("admin")
+	_ = st.Roles.Put(store.Role{Name: "super", Permissions: admin.Permissions})
+	// A banned admin cannot take over the dashboard.
+	_, _ = st.Users.Create(store.User{Username: "old", Role: "admin", Status: "banned"})
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserDelete(w, r, st, authMw)
+	}))
+
+	if rec := postForm(h, "/api/user/delete", cookies, url.Values{"currentPassword": {"Solo-pass-12"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("last full-access user: status %d, want 400", rec.Code)
+	}
+	if _, err := st.Users.ByID(u.ID); err != nil {
+		t.Fatalf("last full-access user deleted: %v", err)
+	}
+
+	_, _ = st.Users.Create(store.User{Username: "other", Role: "admin", Status: "active"})
+	if rec := postForm(h, "/api/user/delete", cookies, url.Values{"currentPassword": {"Solo-pass-12"}}); rec.Code != http.StatusOK {
+		t.Fatalf("with another admin: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"math"
 	"net/http"
 	"net/url"
@@ -11,35 +13,26 @@ import (
 
 	"github.com/jenfonro/meowfilm/internal/auth"
 	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
 )
 
-type userSettingsRow struct {
-	CatAPIBase      string
-	CatAPIKey       string
-	CatProxy        string
-	ThreadCount     int
-	SearchOrder     string
-	SearchCoverSite string
-	CatSites        string
-	CatSiteStatus   string
-	CatSiteHome     string
-	CatSiteOrder    string
-	CatSiteAvail    string
-}
-
-func APIHandler(database *db.DB, authMw *auth.Auth) http.Handler {
+func APIHandler(database *db.DB, st *store.Store, authMw *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api")
 		switch path {
 		case "/home":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIHome(w, r, database)
+				handleAPIHome(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/bootstrap":
-			handleAPIBootstrap(w, r, database)
+			handleAPIBootstrap(w, r, database, st, authMw)
+		case "/events":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIEvents(w, r, database, st)
+			})).ServeHTTP(w, r)
 		case "/video/sites":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIVideoSites(w, r, database)
+				handleAPIVideoSites(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/login":
 			if r.Method != http.MethodPost {
@@ -49,56 +42,120 @@ func APIHandler(database *db.DB, authMw *auth.Auth) http.Handler {
 			parseForm(r)
 			username := r.FormValue("username")
 			password := r.FormValue("password")
+			remember := boolFromForm(r.FormValue("remember"))
 			// support JSON body too
 			if strings.TrimSpace(username) == "" && strings.TrimSpace(password) == "" && strings.Contains(r.Header.Get("Content-Type"), "application/json") {
 				var body struct {
 					Username string `json:"username"`
 					Password string `json:"password"`
+					Remember any    `json:"remember"`
 				}
 				_ = readJSONLoose(r, &body)
 				username = body.Username
 				password = body.Password
+				remember = boolFromForm(fmt.Sprint(body.Remember))
 			}
-			status, msg := authMw.Login(w, username, password)
-			if msg != "" {
-				writeJSON(w, status, map[string]any{"success": false, "message": msg})
+			writeLoginResult(w, authMw.Login(w, r, username, password, remember))
+		case "/login/header":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w)
 				return
 			}
-			writeJSON(w, 200, map[string]any{"success": true})
+			parseForm(r)
+			writeLoginResult(w, authMw.HeaderLogin(w, r, boolFromForm(r.FormValue("remember"))))
+		case "/register":
+			handleAPIRegister(w, r, database, st, authMw)
+		case "/oidc/login":
+			handleAPIOIDCLogin(w, r, database)
+		case "/oidc/callback":
+			handleAPIOIDCCallback(w, r, database, st, authMw)
+		case "/login/2fa":
+			handleAPILogin2FA(w, r, authMw)
+		case "/login/2fa/setup":
+			handleAPILogin2FASetup(w, r, authMw)
 		case "/logout":
-			if r.Method != http.MethodGet {
+			if r.Method != http.MethodPost {
 				methodNotAllowed(w)
 				return
 			}
 			authMw.Logout(w, r)
-			http.Redirect(w, r, "/", http.StatusFound)
+			writeJSON(w, 200, map[string]any{"success": true})
 		case "/searchhistory":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPISearchHistory(w, r, database)
+				handleAPISearchHistory(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/playhistory/one":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIPlayHistoryOne(w, r, database)
+				handleAPIPlayHistoryOne(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/playhistory":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIPlayHistory(w, r, database)
+				handleAPIPlayHistory(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/favorites":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIFavorites(w, r, database)
+				handleAPIFavorites(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/favorites/status":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIFavoritesStatus(w, r, database)
+				handleAPIFavoritesStatus(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/favorites/toggle":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIFavoritesToggle(w, r, database)
+				handleAPIFavoritesToggle(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/profiles":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIProfiles(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/profiles/delete":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIProfileDelete(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/profiles/switch":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIProfileSwitch(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/sessions":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserSessions(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/sessions/revoke-all":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserSessionsRevokeAll(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/2fa", "/user/2fa/setup", "/user/2fa/enable", "/user/2fa/disable", "/user/2fa/recovery-codes":
+			action := strings.TrimPrefix(strings.TrimPrefix(path, "/user/2fa"), "/")
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUser2FA(w, r, st, authMw, action)
+			})).ServeHTTP(w, r)
+		case "/user/password":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserPassword(w, r, database, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/profile":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserProfile(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/user/delete":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserDelete(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/tokens":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserTokens(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/export":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserExport(w, r, database, st)
+			})).ServeHTTP(w, r)
+		case "/user/import":
+			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleAPIUserImport(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/user/settings":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSettings(w, r, database)
+				handleAPIUserSettings(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/user/pan-login-settings":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -106,23 +163,23 @@ func APIHandler(database *db.DB, authMw *auth.Auth) http.Handler {
 			})).ServeHTTP(w, r)
 		case "/user/sites":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSites(w, r, database)
+				handleAPIUserSites(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/user/sites/availability":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSitesAvailability(w, r, database)
+				handleAPIUserSitesAvailability(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/user/sites/status":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSitesStatus(w, r, database)
+				handleAPIUserSitesStatus(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/user/sites/home":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSitesHome(w, r, database)
+				handleAPIUserSitesHome(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/user/sites/order":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleAPIUserSitesOrder(w, r, database)
+				handleAPIUserSitesOrder(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/douban/image":
 			authMw.RequireAuthAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -134,15 +191,16 @@ func APIHandler(database *db.DB, authMw *auth.Auth) http.Handler {
 	})
 }
 
-func handleAPIBootstrap(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIBootstrap(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
 	siteName := database.GetSetting("site_name")
+	csrfToken := authMw.CSRFToken(w, r)
 	u := auth.CurrentUser(r)
 	if u == nil || u.Status != "active" {
-		writeJSON(w, 200, map[string]any{"authenticated": false, "siteName": siteName})
+		writeJSON(w, 200, map[string]any{"authenticated": false, "siteName": siteName, "csrfToken": csrfToken, "oidc": oidcPublicJSON(database), "registrationOpen": registrationOpen(database), "headerLogin": auth.HeaderLoginPending(r)})
 		return
 	}
 
@@ -174,57 +232,54 @@ func handleAPIBootstrap(w http.ResponseWriter, r *http.Request, database *db.DB)
 			}
 			settings["smartPanExtractMode"] = mode
 
-			var (
-				userCatBase  string
-				userCatKey   string
-				userCatProxy string
-				threadCount  int
-				searchOrder  string
-				searchCover  string
-			)
-			_ = database.SQL().QueryRow(`
-				SELECT cat_api_base, cat_api_key, cat_proxy, search_thread_count, cat_search_order, cat_search_cover_site
-				FROM users WHERE id=? LIMIT 1
-			`, u.ID).Scan(&userCatBase, &userCatKey, &userCatProxy, &threadCount, &searchOrder, &searchCover)
+			row, _ := st.Users.ByID(u.ID)
+			threadCount := row.SearchThreadCount
 			if threadCount < 1 {
 				threadCount = 5
 			}
-			settings["userCatPawOpenApiBase"] = userCatBase
-			settings["userCatPawOpenApiKey"] = userCatKey
-			settings["userCatPawOpenProxy"] = userCatProxy
+			settings["userCatPawOpenApiBase"] = row.CatAPIBase
+			settings["userCatPawOpenApiKey"] = row.CatAPIKey
+			settings["userCatPawOpenProxy"] = row.CatProxy
 			settings["searchThreadCount"] = threadCount
 
-			if u.Role == "user" {
-				settings["searchSiteOrder"] = parseJSONStringArray(searchOrder)
-				settings["searchCoverSite"] = strings.TrimSpace(searchCover)
+			if !u.Can(auth.PermUseSharedSites) {
+				settings["searchSiteOrder"] = loadUserSearchOrder(st, u.ID)
+				settings["searchCoverSite"] = strings.TrimSpace(row.SearchCoverSite)
 			} else {
-				sites := mergeVideoSourceSites(database)
-				settings["searchSiteOrder"] = parseJSONStringArray(database.GetSetting("video_source_site_order"))
+				sites := mergeVideoSourceSites(st)
+				order := make([]string, 0, len(sites))
+				for _, s := range sites {
+					if k, _ := s["key"].(string); k != "" {
+						order = append(order, k)
+					}
+				}
+				settings["searchSiteOrder"] = order
 				settings["searchCoverSite"] = resolveSearchCoverSite(sites, database.GetSetting("video_source_search_cover_site"))
 			}
 		}
 	}
 
 	var userCount int
-	if page == "dashboard" && u.Role == "admin" {
-		_ = database.SQL().QueryRow(`SELECT COUNT(1) FROM users`).Scan(&userCount)
+	if page == "dashboard" && u.Can(auth.PermViewStats) {
+		userCount, _ = st.Users.Count()
 	}
 
 	if page == "index" || page == "douban" || page == "play" || page == "site" {
-		settings["homeSites"] = fetchUserHomeSites(database, u)
+		settings["homeSites"] = fetchUserHomeSites(st, u)
 	}
 
 	writeJSON(w, 200, map[string]any{
 		"authenticated": true,
 		"siteName":      siteName,
-		"user":          map[string]any{"username": u.Username, "role": u.Role},
+		"csrfToken":     csrfToken,
+		"user":          map[string]any{"username": u.Username, "displayName": u.DisplayName, "role": u.Role, "permissions": u.Permissions, "profileId": u.ProfileID, "mustChangePassword": u.MustChangePassword},
 		"settings":      settings,
 		"users":         []any{},
 		"userCount":     userCount,
 	})
 }
 
-func handleAPIHome(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIHome(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
@@ -242,166 +297,49 @@ func handleAPIHome(w http.ResponseWriter, r *http.Request, database *db.DB) {
 	playHistoryLimit := parseIntQuery(q.Get("playHistoryLimit"), 20, 1, 50)
 	favoritesLimit := parseIntQuery(q.Get("favoritesLimit"), 50, 1, 200)
 
-	doubanImgProxy := defaultString(database.GetSetting("douban_img_proxy"), "direct-browser")
-	doubanImgCustom := database.GetSetting("douban_img_custom")
-
 	out := map[string]any{"success": true}
 
 	if includePlayHistory {
-		limit := minInt(500, maxInt(50, playHistoryLimit*10))
-		rows, err := database.SQL().Query(`
-				SELECT
-				  content_key,
-				  site_key,
-				  site_name,
-				  spider_api,
-				  video_id,
-				  video_title,
-				  video_poster,
-				  video_remark,
-				  pan_label,
-				  play_flag,
-				  episode_index,
-				  episode_name,
-				  updated_at
-				FROM play_history
-			WHERE user_id = ?
-			ORDER BY updated_at DESC
-			LIMIT ?
-		`, u.ID, limit)
-		if err == nil {
-			defer rows.Close()
-			seen := map[string]struct{}{}
-			list := []map[string]any{}
-			for rows.Next() {
-				var (
-					contentKey   string
-					siteKey      string
-					siteName     string
-					spiderAPI    string
-					videoID      string
-					videoTitle   string
-					videoPoster  string
-					videoRemark  string
-					panLabel     string
-					playFlag     string
-					episodeIndex int
-					episodeName  string
-					updatedAt    int64
-				)
-				_ = rows.Scan(&contentKey, &siteKey, &siteName, &spiderAPI, &videoID, &videoTitle, &videoPoster, &videoRemark, &panLabel, &playFlag, &episodeIndex, &episodeName, &updatedAt)
-				if isNetDiskHistoryItem(videoID, playFlag) {
-					continue
-				}
-				key := strings.TrimSpace(contentKey)
-				if key == "" {
-					key = normalizeContentKey(videoTitle)
-					contentKey = key
-				}
-				if key == "" {
-					key = siteKey + "::" + videoID
-				}
-				if key == "" {
-					continue
-				}
-				if _, ok := seen[key]; ok {
-					continue
-				}
-				seen[key] = struct{}{}
-				list = append(list, map[string]any{
-					"contentKey":   contentKey,
-					"siteKey":      siteKey,
-					"siteName":     siteName,
-					"spiderApi":    spiderAPI,
-					"videoId":      videoID,
-					"videoTitle":   videoTitle,
-					"videoPoster":  rewriteVideoPosterURL(videoPoster, doubanImgProxy, doubanImgCustom),
-					"videoRemark":  videoRemark,
-					"panLabel":     panLabel,
-					"playFlag":     playFlag,
-					"episodeIndex": episodeIndex,
-					"episodeName":  episodeName,
-					"updatedAt":    updatedAt,
-				})
-				if len(list) >= playHistoryLimit {
-					break
-				}
-			}
+		if list, err := recentPlayHistory(st, u.ID, u.ProfileID, playHistoryLimit); err == nil {
 			out["playHistory"] = list
 		}
 	}
 
 	if includeFavorites {
-		rows, err := database.SQL().Query(`
-			SELECT site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at
-			FROM favorites
-			WHERE user_id = ?
-			ORDER BY updated_at DESC
-			LIMIT ?
-		`, u.ID, favoritesLimit)
-		if err == nil {
-			defer rows.Close()
-			list := []map[string]any{}
-			for rows.Next() {
-				var (
-					siteKey     string
-					siteName    string
-					spiderAPI   string
-					videoID     string
-					videoTitle  string
-					videoPoster string
-					videoRemark string
-					updatedAt   int64
-				)
-				_ = rows.Scan(&siteKey, &siteName, &spiderAPI, &videoID, &videoTitle, &videoPoster, &videoRemark, &updatedAt)
-				list = append(list, map[string]any{
-					"siteKey":     siteKey,
-					"siteName":    siteName,
-					"spiderApi":   spiderAPI,
-					"videoId":     videoID,
-					"videoTitle":  videoTitle,
-					"videoPoster": rewriteVideoPosterURL(videoPoster, doubanImgProxy, doubanImgCustom),
-					"videoRemark": videoRemark,
-					"updatedAt":   updatedAt,
-				})
-			}
+		if list, err := recentFavorites(st, u.ID, u.ProfileID, favoritesLimit); err == nil {
 			out["favorites"] = list
 		}
 	}
 
-	if includePanLoginSettings && u.Role == "shared" {
-		out["panLoginSettings"] = parseJSONMap(database.GetSetting("pan_login_settings"))
+	if includePanLoginSettings && u.Can(auth.PermUseSharedPan) {
+		if settings, err := database.PanLoginSettings(); err == nil {
+			out["panLoginSettings"] = settings
+		} else {
+			log.Printf("pan settings: %v", err)
+		}
 	}
 
 	writeJSON(w, 200, out)
 }
 
-func handleAPIVideoSites(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIVideoSites(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
-	sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-	statusMap := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-	homeMap := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-	order := parseJSONStringArray(database.GetSetting("video_source_site_order"))
-	ordered := applySiteOrder(sites, order)
-	out := make([]map[string]any, 0, len(ordered))
-	for _, s := range ordered {
-		enabled, ok := statusMap[s.Key]
-		if !ok {
-			enabled = true
-		}
-		home, ok := homeMap[s.Key]
-		if !ok {
-			home = defaultHomeForSite(s)
-		}
+	state, err := loadVideoSourceSites(st)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	out := make([]map[string]any, 0, len(state.Sites))
+	for _, s := range state.Sites {
 		row := map[string]any{
 			"key":     s.Key,
 			"name":    s.Name,
 			"api":     s.API,
-			"enabled": enabled,
-			"home":    home,
+			"enabled": state.Status[s.Key],
+			"home":    state.Home[s.Key],
 		}
 		if s.Type != nil {
 			row["type"] = *s.Type
@@ -411,7 +349,7 @@ func handleAPIVideoSites(w http.ResponseWriter, r *http.Request, database *db.DB
 	writeJSON(w, 200, map[string]any{"success": true, "sites": out})
 }
 
-func handleAPISearchHistory(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPISearchHistory(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	u := auth.CurrentUser(r)
 	if u == nil {
 		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "Unauthorized"})
@@ -419,16 +357,13 @@ func handleAPISearchHistory(w http.ResponseWriter, r *http.Request, database *db
 	}
 	switch r.Method {
 	case http.MethodGet:
-		rows, err := database.SQL().Query(`SELECT keyword FROM search_history WHERE user_id=? ORDER BY updated_at DESC LIMIT 20`, u.ID)
+		keywords, err := st.SearchHistory.List(u.ID, u.ProfileID, 20)
 		if err != nil {
 			writeJSON(w, 200, []string{})
 			return
 		}
-		defer rows.Close()
 		list := []string{}
-		for rows.Next() {
-			var kw string
-			_ = rows.Scan(&kw)
+		for _, kw := range keywords {
 			kw = strings.TrimSpace(kw)
 			if kw != "" {
 				list = append(list, kw)
@@ -450,20 +385,16 @@ func handleAPISearchHistory(w http.ResponseWriter, r *http.Request, database *db
 			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "Keyword is required"})
 			return
 		}
-		_, _ = database.SQL().Exec(`
-			INSERT INTO search_history(user_id, keyword, updated_at)
-			VALUES(?,?,?)
-			ON CONFLICT(user_id, keyword) DO UPDATE SET updated_at = excluded.updated_at
-		`, u.ID, kw, time.Now().Unix())
-		handleAPISearchHistory(w, withMethod(r, http.MethodGet), database)
+		_ = st.SearchHistory.Touch(u.ID, u.ProfileID, kw, time.Now().Unix())
+		handleAPISearchHistory(w, withMethod(r, http.MethodGet), st)
 	case http.MethodDelete:
 		kw := strings.TrimSpace(r.URL.Query().Get("keyword"))
 		if kw != "" {
-			_, _ = database.SQL().Exec(`DELETE FROM search_history WHERE user_id=? AND keyword=?`, u.ID, kw)
+			_ = st.SearchHistory.Delete(u.ID, u.ProfileID, kw)
 		} else {
-			_, _ = database.SQL().Exec(`DELETE FROM search_history WHERE user_id=?`, u.ID)
+			_ = st.SearchHistory.Clear(u.ID, u.ProfileID)
 		}
-		handleAPISearchHistory(w, withMethod(r, http.MethodGet), database)
+		handleAPISearchHistory(w, withMethod(r, http.MethodGet), st)
 	default:
 		methodNotAllowed(w)
 	}
@@ -483,7 +414,86 @@ func isNetDiskHistoryItem(videoID string, playFlag string) bool {
 	return false
 }
 
-func handleAPIPlayHistoryOne(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func playHistoryJSON(h store.PlayHistory, doubanImgProxy, doubanImgCustom string) map[string]any {
+	return map[string]any{
+		"contentKey":   h.ContentKey,
+		"siteKey":      h.SiteKey,
+		"siteName":     h.SiteName,
+		"spiderApi":    h.SpiderAPI,
+		"videoId":      h.VideoID,
+		"videoTitle":   h.VideoTitle,
+		"videoPoster":  rewriteVideoPosterURL(h.VideoPoster, doubanImgProxy, doubanImgCustom),
+		"videoRemark":  h.VideoRemark,
+		"panLabel":     h.PanLabel,
+		"playFlag":     h.PlayFlag,
+		"episodeIndex": h.EpisodeIndex,
+		"episodeName":  h.EpisodeName,
+		"updatedAt":    h.UpdatedAt,
+	}
+}
+
+// recentPlayHistory lists up to limit play records, one per content, skipping
+// net-disk entries. It scans more rows than needed to make up for duplicates.
+func recentPlayHistory(st *store.Store, userID, profileID int64, limit int) ([]map[string]any, error) {
+	doubanImgProxy := defaultString(st.Settings.Get("douban_img_proxy"), "direct-browser")
+	doubanImgCustom := st.Settings.Get("douban_img_custom")
+	records, err := st.PlayHistory.List(userID, profileID, minInt(500, maxInt(50, limit*10)))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]struct{}{}
+	list := []map[string]any{}
+	for _, h := range records {
+		if isNetDiskHistoryItem(h.VideoID, h.PlayFlag) {
+			continue
+		}
+		key := strings.TrimSpace(h.ContentKey)
+		if key == "" {
+			key = normalizeContentKey(h.VideoTitle)
+			h.ContentKey = key
+		}
+		if key == "" {
+			key = h.SiteKey + "::" + h.VideoID
+		}
+		if key == "" {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		list = append(list, playHistoryJSON(h, doubanImgProxy, doubanImgCustom))
+		if len(list) >= limit {
+			break
+		}
+	}
+	return list, nil
+}
+
+func recentFavorites(st *store.Store, userID, profileID int64, limit int) ([]map[string]any, error) {
+	doubanImgProxy := defaultString(st.Settings.Get("douban_img_proxy"), "direct-browser")
+	doubanImgCustom := st.Settings.Get("douban_img_custom")
+	favorites, err := st.Favorites.List(userID, profileID, limit)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]any{}
+	for _, f := range favorites {
+		list = append(list, map[string]any{
+			"siteKey":     f.SiteKey,
+			"siteName":    f.SiteName,
+			"spiderApi":   f.SpiderAPI,
+			"videoId":     f.VideoID,
+			"videoTitle":  f.VideoTitle,
+			"videoPoster": rewriteVideoPosterURL(f.VideoPoster, doubanImgProxy, doubanImgCustom),
+			"videoRemark": f.VideoRemark,
+			"updatedAt":   f.UpdatedAt,
+		})
+	}
+	return list, nil
+}
+
+func handleAPIPlayHistoryOne(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
@@ -495,132 +505,33 @@ func handleAPIPlayHistoryOne(w http.ResponseWriter, r *http.Request, database *d
 		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "Invalid params"})
 		return
 	}
-	var (
-		contentKey   string
-		siteName     string
-		spiderAPI    string
-		videoTitle   string
-		videoPoster  string
-		videoRemark  string
-		panLabel     string
-		playFlag     string
-		episodeIndex int
-		episodeName  string
-		updatedAt    int64
-	)
-	err := database.SQL().QueryRow(`
-		SELECT content_key, site_name, spider_api, video_title, video_poster, video_remark, pan_label, play_flag, episode_index, episode_name, updated_at
-		FROM play_history
-		WHERE user_id=? AND site_key=? AND video_id=?
-		ORDER BY updated_at DESC
-		LIMIT 1
-	`, u.ID, siteKey, videoID).Scan(&contentKey, &siteName, &spiderAPI, &videoTitle, &videoPoster, &videoRemark, &panLabel, &playFlag, &episodeIndex, &episodeName, &updatedAt)
+	h, err := st.PlayHistory.Latest(u.ID, u.ProfileID, siteKey, videoID)
 	if err != nil {
 		writeJSON(w, 200, nil)
 		return
 	}
-	if isNetDiskHistoryItem(videoID, playFlag) {
+	if isNetDiskHistoryItem(videoID, h.PlayFlag) {
 		writeJSON(w, 200, nil)
 		return
 	}
-	if strings.TrimSpace(contentKey) == "" {
-		contentKey = normalizeContentKey(videoTitle)
+	if strings.TrimSpace(h.ContentKey) == "" {
+		h.ContentKey = normalizeContentKey(h.VideoTitle)
 	}
-	doubanImgProxy := defaultString(database.GetSetting("douban_img_proxy"), "direct-browser")
-	doubanImgCustom := database.GetSetting("douban_img_custom")
-	writeJSON(w, 200, map[string]any{
-		"contentKey":   contentKey,
-		"siteKey":      siteKey,
-		"siteName":     siteName,
-		"spiderApi":    spiderAPI,
-		"videoId":      videoID,
-		"videoTitle":   videoTitle,
-		"videoPoster":  rewriteVideoPosterURL(videoPoster, doubanImgProxy, doubanImgCustom),
-		"videoRemark":  videoRemark,
-		"panLabel":     panLabel,
-		"playFlag":     playFlag,
-		"episodeIndex": episodeIndex,
-		"episodeName":  episodeName,
-		"updatedAt":    updatedAt,
-	})
+	doubanImgProxy := defaultString(st.Settings.Get("douban_img_proxy"), "direct-browser")
+	doubanImgCustom := st.Settings.Get("douban_img_custom")
+	writeJSON(w, 200, playHistoryJSON(h, doubanImgProxy, doubanImgCustom))
 }
 
-func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	u := auth.CurrentUser(r)
 	switch r.Method {
 	case http.MethodGet:
-		doubanImgProxy := defaultString(database.GetSetting("douban_img_proxy"), "direct-browser")
-		doubanImgCustom := database.GetSetting("douban_img_custom")
 		limit := parseIntQuery(r.URL.Query().Get("limit"), 20, 1, 50)
-		sourceLimit := minInt(500, maxInt(50, limit*10))
-		rows, err := database.SQL().Query(`
-				SELECT content_key, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, pan_label, play_flag, episode_index, episode_name, updated_at
-				FROM play_history
-				WHERE user_id=?
-				ORDER BY updated_at DESC
-				LIMIT ?
-			`, u.ID, sourceLimit)
+		list, err := recentPlayHistory(st, u.ID, u.ProfileID, limit)
 		if err != nil {
 			writeJSON(w, 200, []any{})
 			return
 		}
-		defer rows.Close()
-		seen := map[string]struct{}{}
-		list := []map[string]any{}
-		for rows.Next() {
-			var (
-				contentKey   string
-				siteKey      string
-				siteName     string
-				spiderAPI    string
-				videoID      string
-				videoTitle   string
-				videoPoster  string
-				videoRemark  string
-				panLabel     string
-				playFlag     string
-				episodeIndex int
-				episodeName  string
-				updatedAt    int64
-			)
-			_ = rows.Scan(&contentKey, &siteKey, &siteName, &spiderAPI, &videoID, &videoTitle, &videoPoster, &videoRemark, &panLabel, &playFlag, &episodeIndex, &episodeName, &updatedAt)
-			if isNetDiskHistoryItem(videoID, playFlag) {
-				continue
-			}
-			key := strings.TrimSpace(contentKey)
-			if key == "" {
-				key = normalizeContentKey(videoTitle)
-				contentKey = key
-			}
-			if key == "" {
-				key = siteKey + "::" + videoID
-			}
-			if key == "" {
-				continue
-			}
-			if _, ok := seen[key]; ok {
-				continue
-			}
-			seen[key] = struct{}{}
-			list = append(list, map[string]any{
-				"contentKey":   contentKey,
-				"siteKey":      siteKey,
-				"siteName":     siteName,
-				"spiderApi":    spiderAPI,
-				"videoId":      videoID,
-				"videoTitle":   videoTitle,
-				"videoPoster":  rewriteVideoPosterURL(videoPoster, doubanImgProxy, doubanImgCustom),
-				"videoRemark":  videoRemark,
-				"panLabel":     panLabel,
-				"playFlag":     playFlag,
-				"episodeIndex": episodeIndex,
-				"episodeName":  episodeName,
-				"updatedAt":    updatedAt,
-			})
-			if len(list) >= limit {
-				break
-			}
-		}
 		writeJSON(w, 200, list)
 	case http.MethodPost:
 		var body map[string]any
@@ -682,15 +593,7 @@ func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, database *db.D
 			contentKey = siteKey + "::" + videoID
 		}
 
-		lockedPoster := ""
-		_ = database.SQL().QueryRow(`
-			SELECT video_poster
-			FROM play_history
-			WHERE user_id = ? AND content_key = ? AND video_poster <> ''
-			ORDER BY updated_at DESC
-			LIMIT 1
-		`, u.ID, contentKey).Scan(&lockedPoster)
-		lockedPoster = strings.TrimSpace(lockedPoster)
+		lockedPoster, _ := st.PlayHistory.Poster(u.ID, u.ProfileID, contentKey)
 
 		finalPoster := videoPoster
 		if !forcePosterUpdate || strings.TrimSpace(videoPoster) == "" {
@@ -699,32 +602,24 @@ func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, database *db.D
 			}
 		}
 
-		// Keep only one record per content (videoTitle) per user: always the latest played site.
-		_, _ = database.SQL().Exec(`
-			DELETE FROM play_history
-			WHERE user_id = ? AND (content_key = ? OR video_title = ?)
-		`, u.ID, contentKey, videoTitle)
-
-		now := time.Now().Unix()
-		_, _ = database.SQL().Exec(`
-				INSERT INTO play_history(
-				  user_id, content_key, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark,
-				  pan_label, play_flag, episode_index, episode_name, updated_at
-				)
-				VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)
-				ON CONFLICT(user_id, site_key, video_id) DO UPDATE SET
-				  content_key = excluded.content_key,
-				  site_name = excluded.site_name,
-				  spider_api = excluded.spider_api,
-				  video_title = excluded.video_title,
-				  video_poster = excluded.video_poster,
-				  video_remark = excluded.video_remark,
-				  pan_label = excluded.pan_label,
-				  play_flag = excluded.play_flag,
-				  episode_index = excluded.episode_index,
-				  episode_name = excluded.episode_name,
-				  updated_at = excluded.updated_at
-			`, u.ID, contentKey, siteKey, siteName, spiderAPI, videoID, videoTitle, finalPoster, videoRemark, panLabel, playFlag, episodeIndex, episodeName, now)
+		// Keep only one record per content (videoTitle) per profile: always the latest played site.
+		_ = st.PlayHistory.Record(store.PlayHistory{
+			UserID:       u.ID,
+			ProfileID:    u.ProfileID,
+			ContentKey:   contentKey,
+			SiteKey:      siteKey,
+			SiteName:     siteName,
+			SpiderAPI:    spiderAPI,
+			VideoID:      videoID,
+			VideoTitle:   videoTitle,
+			VideoPoster:  finalPoster,
+			VideoRemark:  videoRemark,
+			PanLabel:     panLabel,
+			PlayFlag:     playFlag,
+			EpisodeIndex: episodeIndex,
+			EpisodeName:  episodeName,
+			UpdatedAt:    time.Now().Unix(),
+		})
 		writeJSON(w, 200, map[string]any{"success": true})
 	case http.MethodDelete:
 		contentKey := strings.TrimSpace(r.URL.Query().Get("contentKey"))
@@ -734,17 +629,11 @@ func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, database *db.D
 			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数不完整"})
 			return
 		}
-		deleted := int64(0)
+		var deleted int64
 		if contentKey != "" {
-			res, err := database.SQL().Exec(`DELETE FROM play_history WHERE user_id=? AND content_key=?`, u.ID, contentKey)
-			if err == nil && res != nil {
-				deleted, _ = res.RowsAffected()
-			}
+			deleted, _ = st.PlayHistory.DeleteContent(u.ID, u.ProfileID, contentKey)
 		} else {
-			res, err := database.SQL().Exec(`DELETE FROM play_history WHERE user_id=? AND site_key=? AND video_id=?`, u.ID, siteKey, videoID)
-			if err == nil && res != nil {
-				deleted, _ = res.RowsAffected()
-			}
+			deleted, _ = st.PlayHistory.DeleteVideo(u.ID, u.ProfileID, siteKey, videoID)
 		}
 		writeJSON(w, 200, map[string]any{"success": true, "deleted": deleted})
 	default:
@@ -752,55 +641,22 @@ func handleAPIPlayHistory(w http.ResponseWriter, r *http.Request, database *db.D
 	}
 }
 
-func handleAPIFavorites(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIFavorites(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
 	u := auth.CurrentUser(r)
-	doubanImgProxy := defaultString(database.GetSetting("douban_img_proxy"), "direct-browser")
-	doubanImgCustom := database.GetSetting("douban_img_custom")
 	limit := parseIntQuery(strings.TrimSpace(r.URL.Query().Get("limit")), 200, 1, 200)
-	rows, err := database.SQL().Query(`
-		SELECT site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at
-		FROM favorites
-		WHERE user_id=?
-		ORDER BY updated_at DESC
-		LIMIT ?
-	`, u.ID, limit)
+	list, err := recentFavorites(st, u.ID, u.ProfileID, limit)
 	if err != nil {
 		writeJSON(w, 200, []any{})
 		return
 	}
-	defer rows.Close()
-	list := []map[string]any{}
-	for rows.Next() {
-		var (
-			siteKey     string
-			siteName    string
-			spiderAPI   string
-			videoID     string
-			videoTitle  string
-			videoPoster string
-			videoRemark string
-			updatedAt   int64
-		)
-		_ = rows.Scan(&siteKey, &siteName, &spiderAPI, &videoID, &videoTitle, &videoPoster, &videoRemark, &updatedAt)
-		list = append(list, map[string]any{
-			"siteKey":     siteKey,
-			"siteName":    siteName,
-			"spiderApi":   spiderAPI,
-			"videoId":     videoID,
-			"videoTitle":  videoTitle,
-			"videoPoster": rewriteVideoPosterURL(videoPoster, doubanImgProxy, doubanImgCustom),
-			"videoRemark": videoRemark,
-			"updatedAt":   updatedAt,
-		})
-	}
 	writeJSON(w, 200, list)
 }
 
-func handleAPIFavoritesStatus(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIFavoritesStatus(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
@@ -812,12 +668,11 @@ func handleAPIFavoritesStatus(w http.ResponseWriter, r *http.Request, database *
 		writeJSON(w, 200, map[string]any{"favorited": false})
 		return
 	}
-	var v int
-	err := database.SQL().QueryRow(`SELECT 1 FROM favorites WHERE user_id=? AND site_key=? AND video_id=? LIMIT 1`, u.ID, siteKey, videoID).Scan(&v)
-	writeJSON(w, 200, map[string]any{"favorited": err == nil})
+	favorited, _ := st.Favorites.Exists(u.ID, u.ProfileID, siteKey, videoID)
+	writeJSON(w, 200, map[string]any{"favorited": favorited})
 }
 
-func handleAPIFavoritesToggle(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIFavoritesToggle(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -841,77 +696,56 @@ func handleAPIFavoritesToggle(w http.ResponseWriter, r *http.Request, database *
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
 		return
 	}
-	var exists int
-	_ = database.SQL().QueryRow(`SELECT COUNT(1) FROM favorites WHERE user_id=? AND site_key=? AND video_id=?`, u.ID, siteKey, videoID).Scan(&exists)
-	if exists > 0 {
-		_, _ = database.SQL().Exec(`DELETE FROM favorites WHERE user_id=? AND site_key=? AND video_id=?`, u.ID, siteKey, videoID)
+	if exists, _ := st.Favorites.Exists(u.ID, u.ProfileID, siteKey, videoID); exists {
+		_, _ = st.Favorites.Delete(u.ID, u.ProfileID, siteKey, videoID)
 		writeJSON(w, 200, map[string]any{"success": true, "favorited": false})
 		return
 	}
-	now := time.Now().Unix()
-	siteName := getS("siteName")
-	videoPoster := getS("videoPoster")
-	videoRemark := getS("videoRemark")
-	_, _ = database.SQL().Exec(`
-		INSERT INTO favorites(user_id, site_key, site_name, spider_api, video_id, video_title, video_poster, video_remark, updated_at)
-		VALUES(?,?,?,?,?,?,?,?,?)
-		ON CONFLICT(user_id, site_key, video_id) DO UPDATE SET
-		  site_name=excluded.site_name,
-		  spider_api=excluded.spider_api,
-		  video_title=excluded.video_title,
-		  video_poster=excluded.video_poster,
-		  video_remark=excluded.video_remark,
-		  updated_at=excluded.updated_at
-	`, u.ID, siteKey, siteName, spiderAPI, videoID, videoTitle, videoPoster, videoRemark, now)
+	_ = st.Favorites.Upsert(store.Favorite{
+		UserID:      u.ID,
+		ProfileID:   u.ProfileID,
+		SiteKey:     siteKey,
+		SiteName:    getS("siteName"),
+		SpiderAPI:   spiderAPI,
+		VideoID:     videoID,
+		VideoTitle:  videoTitle,
+		VideoPoster: getS("videoPoster"),
+		VideoRemark: getS("videoRemark"),
+		UpdatedAt:   time.Now().Unix(),
+	})
 	writeJSON(w, 200, map[string]any{"success": true, "favorited": true})
 }
 
-func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	u := auth.CurrentUser(r)
 	switch r.Method {
 	case http.MethodGet:
-		var (
-			catBase     string
-			catKey      string
-			catProxy    string
-			threadCount int
-			searchOrder string
-			searchCover string
-		)
-		_ = database.SQL().QueryRow(`
-			SELECT cat_api_base, cat_api_key, cat_proxy, search_thread_count, cat_search_order, cat_search_cover_site
-			FROM users WHERE id=? LIMIT 1
-		`, u.ID).Scan(&catBase, &catKey, &catProxy, &threadCount, &searchOrder, &searchCover)
+		row, _ := st.Users.ByID(u.ID)
+		threadCount := row.SearchThreadCount
 		if threadCount < 1 {
 			threadCount = 5
 		}
 		writeJSON(w, 200, map[string]any{
 			"success": true,
 			"settings": map[string]any{
-				"catApiBase":        catBase,
-				"catApiKey":         catKey,
-				"catProxy":          catProxy,
+				"catApiBase":        row.CatAPIBase,
+				"catApiKey":         row.CatAPIKey,
+				"catProxy":          row.CatProxy,
 				"searchThreadCount": threadCount,
-				"searchSiteOrder":   parseJSONStringArray(searchOrder),
-				"searchCoverSite":   strings.TrimSpace(searchCover),
+				"searchSiteOrder":   loadUserSearchOrder(st, u.ID),
+				"searchCoverSite":   strings.TrimSpace(row.SearchCoverSite),
 			},
 		})
 	case http.MethodPut:
 		var body map[string]any
 		_ = readJSONLoose(r, &body)
 
-		var prev userSettingsRow
-		_ = database.SQL().QueryRow(`
-			SELECT
-			  cat_api_base, cat_api_key, cat_proxy,
-			  search_thread_count, cat_search_order, cat_search_cover_site,
-			  cat_sites, cat_site_status, cat_site_home, cat_site_order, cat_site_availability
-			FROM users WHERE id = ? LIMIT 1
-		`, u.ID).Scan(
-			&prev.CatAPIBase, &prev.CatAPIKey, &prev.CatProxy,
-			&prev.ThreadCount, &prev.SearchOrder, &prev.SearchCoverSite,
-			&prev.CatSites, &prev.CatSiteStatus, &prev.CatSiteHome, &prev.CatSiteOrder, &prev.CatSiteAvail,
-		)
+		prev, _ := st.Users.ByID(u.ID)
+		prevSites, err := loadUserSiteState(st, u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
 
 		getOptionalString := func(k string) (string, bool) {
 			v, ok := body[k]
@@ -943,7 +777,7 @@ func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.
 				return
 			}
 		}
-		if u.Role == "user" && normalizedApiBase == "" {
+		if !u.Can(auth.PermUseSharedSites) && normalizedApiBase == "" {
 			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "CatPawOpen 接口地址未设置"})
 			return
 		}
@@ -967,7 +801,7 @@ func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.
 			stRaw, hasST = body["search_thread_count"]
 		}
 		if !hasST || stRaw == nil {
-			stRaw = prev.ThreadCount
+			stRaw = prev.SearchThreadCount
 		}
 		threadCount := 5
 		if n, ok := intFromAnyFloor(stRaw); ok {
@@ -1023,13 +857,9 @@ func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.
 			if v, ok := body["sites"]; ok && v != nil {
 				nextSites, ok := parseSitesAny(v)
 				if ok {
-					prevStatus := parseJSONBoolMap(prev.CatSiteStatus)
-					prevHome := parseJSONBoolMap(prev.CatSiteHome)
-					prevOrder := parseJSONStringArray(prev.CatSiteOrder)
-					prevAvail := parseAvailabilityJSON(prev.CatSiteAvail)
-					reconciled := reconcileSites(nextSites, prevStatus, prevHome, nil, prevOrder, prevAvail)
+					reconciled := reconcileSites(nextSites, prevSites.Status, prevSites.Home, prevSites.Search, prevSites.Order, prevSites.Availability)
 					reconciledSitesForSearch = reconciled.Sites
-					changed, err := persistUserCatSites(database, u.ID, prev, reconciled)
+					changed, err := persistUserCatSites(st, u.ID, reconciled)
 					if err != nil {
 						sitesSync["ok"] = false
 						sitesSync["message"] = "站点列表更新失败"
@@ -1052,76 +882,28 @@ func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.
 				return keys
 			}
 			hasUserAPI := strings.TrimSpace(prev.CatAPIBase) != ""
-			canFallback := u.Role != "user"
+			canFallback := u.Can(auth.PermUseSharedSites)
 			if hasUserAPI {
-				sites := normalizeSitesFromJSON(prev.CatSites)
-				keys := make([]string, 0, len(sites))
-				for _, s := range sites {
-					keys = append(keys, s.Key)
-				}
-				return keys
+				return append([]string{}, prevSites.Order...)
 			}
 			if canFallback {
-				sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
+				sites := listVideoSourceSites(st)
 				keys := make([]string, 0, len(sites))
 				for _, s := range sites {
 					keys = append(keys, s.Key)
 				}
 				return keys
 			}
-			sites := normalizeSitesFromJSON(prev.CatSites)
-			keys := make([]string, 0, len(sites))
-			for _, s := range sites {
-				keys = append(keys, s.Key)
-			}
-			return keys
-		}
-
-		normalizeSearchOrder := func(keys []string, currentOrder []string) []string {
-			all := keys
-			keySet := map[string]struct{}{}
-			for _, k := range all {
-				if k == "" {
-					continue
-				}
-				keySet[k] = struct{}{}
-			}
-			next := []string{}
-			seen := map[string]struct{}{}
-			for _, k := range currentOrder {
-				key := strings.TrimSpace(k)
-				if key == "" {
-					continue
-				}
-				if _, ok := keySet[key]; !ok {
-					continue
-				}
-				if _, ok := seen[key]; ok {
-					continue
-				}
-				seen[key] = struct{}{}
-				next = append(next, key)
-			}
-			for _, key := range all {
-				if key == "" {
-					continue
-				}
-				if _, ok := seen[key]; ok {
-					continue
-				}
-				seen[key] = struct{}{}
-				next = append(next, key)
-			}
-			return next
+			return append([]string{}, prevSites.Order...)
 		}
 
 		availableKeys := resolveAvailableSearchKeys()
-		prevSearchOrder := parseJSONStringArray(prev.SearchOrder)
+		prevSearchOrder := loadUserSearchOrder(st, u.ID)
 		orderInput := prevSearchOrder
 		if hasProvidedSearchOrder {
 			orderInput = providedSearchOrder
 		}
-		nextSearchOrder := normalizeSearchOrder(availableKeys, orderInput)
+		nextSearchOrder := mergeKeyOrder(availableKeys, orderInput)
 
 		prevCover := strings.TrimSpace(prev.SearchCoverSite)
 		coverCandidate := prevCover
@@ -1135,29 +917,33 @@ func handleAPIUserSettings(w http.ResponseWriter, r *http.Request, database *db.
 			nextCover = nextSearchOrder[0]
 		}
 
-		prevOrderStr := prev.SearchOrder
-		nextOrderStr := marshalJSON(nextSearchOrder)
-		prevCoverStr := prev.SearchCoverSite
-		nextCoverStr := nextCover
-
+		searchOrderChanged := marshalJSON(prevSearchOrder) != marshalJSON(nextSearchOrder)
 		settingsChanged :=
 			prev.CatAPIBase != normalizedApiBase ||
 				prev.CatAPIKey != catApiKey ||
 				prev.CatProxy != catProxy ||
-				prev.ThreadCount != threadCount ||
-				prevOrderStr != nextOrderStr ||
-				prevCoverStr != nextCoverStr
-
-		if settingsChanged {
-			_, err := database.SQL().Exec(`
-				UPDATE users
-				SET cat_api_base = ?, cat_api_key = ?, cat_proxy = ?, search_thread_count = ?, cat_search_order = ?, cat_search_cover_site = ?
-				WHERE id = ?
-			`, normalizedApiBase, catApiKey, catProxy, threadCount, nextOrderStr, nextCoverStr, u.ID)
-			if err != nil {
+				prev.SearchThreadCount != threadCount ||
+				prev.SearchCoverSite != nextCover
+
+		if settingsChanged || searchOrderChanged {
+			var patch store.UserPatch
+			if settingsChanged {
+				patch = store.UserPatch{
+					CatAPIBase:        &normalizedApiBase,
+					CatAPIKey:         &catApiKey,
+					CatProxy:          &catProxy,
+					SearchThreadCount: &threadCount,
+					SearchCoverSite:   &nextCover,
+				}
+			}
+			if searchOrderChanged {
+				patch.SearchSiteOrder = nextSearchOrder
+			}
+			if err := st.Users.Update(u.ID, patch); err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
 				return
 			}
+			database.NotifyUserSitesChanged(u.ID)
 		}
 
 		writeJSON(w, 200, map[string]any{"success": true, "sitesSync": sitesSync, "cookieSync": cookieSync})
@@ -1269,28 +1055,6 @@ func parseSitesAny(v any) ([]site, bool) {
 	return out, true
 }
 
-func persistUserCatSites(database *db.DB, userID int64, prev userSettingsRow, next reconciledSiteState) (changed bool, err error) {
-	nextSites := marshalJSON(next.Sites)
-	nextStatus := marshalJSON(next.Status)
-	nextHome := marshalJSON(next.Home)
-	nextOrder := marshalJSON(next.Order)
-	nextAvail := marshalJSON(next.Availability)
-
-	if prev.CatSites == nextSites && prev.CatSiteStatus == nextStatus && prev.CatSiteHome == nextHome && prev.CatSiteOrder == nextOrder && prev.CatSiteAvail == nextAvail {
-		return false, nil
-	}
-
-	_, err = database.SQL().Exec(`
-		UPDATE users
-		SET cat_sites = ?, cat_site_status = ?, cat_site_home = ?, cat_site_order = ?, cat_site_availability = ?
-		WHERE id = ?
-	`, nextSites, nextStatus, nextHome, nextOrder, nextAvail, userID)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
-}
-
 func containsString(list []string, needle string) bool {
 	for _, s := range list {
 		if s == needle {
@@ -1306,25 +1070,30 @@ func handleAPIUserPanLoginSettings(w http.ResponseWriter, r *http.Request, datab
 		return
 	}
 	u := auth.CurrentUser(r)
-	if u.Role != "shared" {
+	if !u.Can(auth.PermUseSharedPan) {
 		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权限"})
 		return
 	}
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "网盘凭据无法解密，请联系管理员"})
+		return
+	}
 	writeJSON(w, 200, map[string]any{"success": true, "settings": store})
 }
 
-func handleAPIUserSites(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSites(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
 	u := auth.CurrentUser(r)
-	// Admin/shared users:
+	// Users of the shared site list:
 	// - If the user has their own CatPawOpen configured => use their own stored site list.
 	// - Otherwise => use the global video source list managed by the dashboard.
-	if u != nil && (u.Role == "admin" || u.Role == "shared") {
-		hasUserAPI, err := userHasCatAPIBase(database, u)
+	if u.Can(auth.PermUseSharedSites) {
+		hasUserAPI, err := userHasCatAPIBase(st, u)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 			return
@@ -1332,13 +1101,13 @@ func handleAPIUserSites(w http.ResponseWriter, r *http.Request, database *db.DB)
 		if !hasUserAPI {
 			writeJSON(w, 200, map[string]any{
 				"success":            true,
-				"sites":              mergeVideoSourceSites(database),
+				"sites":              mergeVideoSourceSites(st),
 				"requiresCatApiBase": false,
 			})
 			return
 		}
 	}
-	state, err := resolveUserCatSites(database, u)
+	state, err := resolveUserCatSites(st, u)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 		return
@@ -1347,13 +1116,26 @@ func handleAPIUserSites(w http.ResponseWriter, r *http.Request, database *db.DB)
 	for k, v := range state.Availability {
 		availabilityAny[k] = v
 	}
-	searchMap := parseJSONBoolMap(database.GetSetting("video_source_site_search"))
-	errorMap := parseJSONStringMap(database.GetSetting("video_source_site_error"))
-	merged := mergeSitesWithState(state.Sites, state.Status, state.Home, state.Order, availabilityAny, searchMap, errorMap)
+	searchMap := map[string]bool{}
+	for k, v := range state.Search {
+		searchMap[k] = v
+	}
+	global, err := loadVideoSourceSites(st)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	// Sites disabled for search globally stay disabled for every user.
+	for k, v := range global.Search {
+		if !v {
+			searchMap[k] = false
+		}
+	}
+	merged := mergeSitesWithState(state.Sites, state.Status, state.Home, state.Order, availabilityAny, searchMap, global.Errors)
 	writeJSON(w, 200, map[string]any{"success": true, "sites": merged, "requiresCatApiBase": !state.HasUserAPI && !state.CanFallback})
 }
 
-func handleAPIUserSitesAvailability(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSitesAvailability(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1370,56 +1152,40 @@ func handleAPIUserSitesAvailability(w http.ResponseWriter, r *http.Request, data
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
 		return
 	}
-	// Admin/shared without user CatPawOpen: update global availability state.
-	if u != nil && (u.Role == "admin" || u.Role == "shared") {
-		hasUserAPI, err := userHasCatAPIBase(database, u)
+	// Shared site list users without their own CatPawOpen: update global availability state.
+	if u.Can(auth.PermUseSharedSites) {
+		hasUserAPI, err := userHasCatAPIBase(st, u)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 			return
 		}
 		if !hasUserAPI {
-			sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-			keySet := map[string]struct{}{}
-			for _, s := range sites {
-				if s.Key == "" {
-					continue
-				}
-				keySet[s.Key] = struct{}{}
-			}
-			if _, ok := keySet[key]; !ok {
-				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
+			found, err := st.Sites.Edit(key, func(s *store.Site) { s.Availability = avail })
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 				return
 			}
-			availability := parseAvailabilityJSON(database.GetSetting("video_source_site_availability"))
-			if availability[key] == avail {
-				writeJSON(w, 200, map[string]any{"success": true})
+			if !found {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 				return
 			}
-			availability[key] = avail
-			_ = database.SetSetting("video_source_site_availability", marshalJSON(availability))
 			writeJSON(w, 200, map[string]any{"success": true})
 			return
 		}
 	}
-	state, err := resolveUserCatSites(database, u)
+	found, err := updateUserSite(st, u, key, func(s *store.Site) { s.Availability = avail })
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 		return
 	}
-	if _, ok := userSiteKeySet(state.Sites)[key]; !ok {
+	if !found {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 		return
 	}
-	if state.Availability[key] == avail {
-		writeJSON(w, 200, map[string]any{"success": true})
-		return
-	}
-	state.Availability[key] = avail
-	_, _ = database.SQL().Exec(`UPDATE users SET cat_site_availability=? WHERE id=?`, marshalJSON(state.Availability), u.ID)
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
-func handleAPIUserSitesStatus(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSitesStatus(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1435,60 +1201,40 @@ func handleAPIUserSitesStatus(w http.ResponseWriter, r *http.Request, database *
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
 		return
 	}
-	// Admin/shared without user CatPawOpen: update global enabled state.
-	if u != nil && (u.Role == "admin" || u.Role == "shared") {
-		hasUserAPI, err := userHasCatAPIBase(database, u)
+	// Shared site list users without their own CatPawOpen: update global enabled state.
+	if u.Can(auth.PermUseSharedSites) {
+		hasUserAPI, err := userHasCatAPIBase(st, u)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 			return
 		}
 		if !hasUserAPI {
-			sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-			keySet := map[string]struct{}{}
-			for _, s := range sites {
-				if s.Key == "" {
-					continue
-				}
-				keySet[s.Key] = struct{}{}
-			}
-			if _, ok := keySet[key]; !ok {
-				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
+			found, err := st.Sites.Edit(key, func(s *store.Site) { s.Enabled = *body.Enabled })
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 				return
 			}
-			statusMap := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-			cur, ok := statusMap[key]
-			if !ok {
-				cur = true
-			}
-			if cur == *body.Enabled {
-				writeJSON(w, 200, map[string]any{"success": true})
+			if !found {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 				return
 			}
-			statusMap[key] = *body.Enabled
-			_ = database.SetSetting("video_source_site_status", marshalJSON(statusMap))
 			writeJSON(w, 200, map[string]any{"success": true})
 			return
 		}
 	}
-	state, err := resolveUserCatSites(database, u)
+	found, err := updateUserSite(st, u, key, func(s *store.Site) { s.Enabled = *body.Enabled })
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 		return
 	}
-	if _, ok := userSiteKeySet(state.Sites)[key]; !ok {
+	if !found {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 		return
 	}
-	if state.Status[key] == *body.Enabled {
-		writeJSON(w, 200, map[string]any{"success": true})
-		return
-	}
-	state.Status[key] = *body.Enabled
-	_, _ = database.SQL().Exec(`UPDATE users SET cat_site_status=? WHERE id=?`, marshalJSON(state.Status), u.ID)
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
-func handleAPIUserSitesHome(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSitesHome(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1504,52 +1250,40 @@ func handleAPIUserSitesHome(w http.ResponseWriter, r *http.Request, database *db
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
 		return
 	}
-	// Admin/shared without user CatPawOpen: update global home toggle.
-	if u != nil && (u.Role == "admin" || u.Role == "shared") {
-		hasUserAPI, err := userHasCatAPIBase(database, u)
+	// Shared site list users without their own CatPawOpen: update global home toggle.
+	if u.Can(auth.PermUseSharedSites) {
+		hasUserAPI, err := userHasCatAPIBase(st, u)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 			return
 		}
 		if !hasUserAPI {
-			sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-			keySet := map[string]struct{}{}
-			for _, s := range sites {
-				if s.Key == "" {
-					continue
-				}
-				keySet[s.Key] = struct{}{}
+			found, err := st.Sites.Edit(key, func(s *store.Site) { s.Home = *body.Home })
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+				return
 			}
-			if _, ok := keySet[key]; !ok {
+			if !found {
 				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 				return
 			}
-			homeMap := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-			homeMap[key] = *body.Home
-			_ = database.SetSetting("video_source_site_home", marshalJSON(homeMap))
 			writeJSON(w, 200, map[string]any{"success": true})
 			return
 		}
 	}
-	state, err := resolveUserCatSites(database, u)
+	found, err := updateUserSite(st, u, key, func(s *store.Site) { s.Home = *body.Home })
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 		return
 	}
-	if _, ok := userSiteKeySet(state.Sites)[key]; !ok {
+	if !found {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
 		return
 	}
-	if state.Home[key] == *body.Home {
-		writeJSON(w, 200, map[string]any{"success": true})
-		return
-	}
-	state.Home[key] = *body.Home
-	_, _ = database.SQL().Exec(`UPDATE users SET cat_site_home=? WHERE id=?`, marshalJSON(state.Home), u.ID)
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
-func handleAPIUserSitesOrder(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleAPIUserSitesOrder(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1559,86 +1293,26 @@ func handleAPIUserSitesOrder(w http.ResponseWriter, r *http.Request, database *d
 		Order []string `json:"order"`
 	}
 	_ = readJSONLoose(r, &body)
-	// Admin/shared without user CatPawOpen: update global order.
-	if u != nil && (u.Role == "admin" || u.Role == "shared") {
-		hasUserAPI, err := userHasCatAPIBase(database, u)
+	// Shared site list users without their own CatPawOpen: update global order.
+	if u.Can(auth.PermUseSharedSites) {
+		hasUserAPI, err := userHasCatAPIBase(st, u)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 			return
 		}
 		if !hasUserAPI {
-			sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-			keySet := map[string]struct{}{}
-			for _, s := range sites {
-				if s.Key == "" {
-					continue
-				}
-				keySet[s.Key] = struct{}{}
-			}
-			next := []string{}
-			seen := map[string]struct{}{}
-			for _, k := range body.Order {
-				key := strings.TrimSpace(k)
-				if key == "" {
-					continue
-				}
-				if _, ok := keySet[key]; !ok {
-					continue
-				}
-				if _, ok := seen[key]; ok {
-					continue
-				}
-				seen[key] = struct{}{}
-				next = append(next, key)
-			}
-			for _, s := range sites {
-				if s.Key == "" {
-					continue
-				}
-				if _, ok := seen[s.Key]; ok {
-					continue
-				}
-				seen[s.Key] = struct{}{}
-				next = append(next, s.Key)
+			if err := saveVideoSourceSiteOrder(st, body.Order); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+				return
 			}
-			_ = database.SetSetting("video_source_site_order", marshalJSON(next))
 			writeJSON(w, 200, map[string]any{"success": true})
 			return
 		}
 	}
-	state, err := resolveUserCatSites(database, u)
-	if err != nil {
+	if err := saveUserSiteOrder(st, u.ID, body.Order); err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
 		return
 	}
-	keySet := userSiteKeySet(state.Sites)
-	next := []string{}
-	seen := map[string]struct{}{}
-	for _, k := range body.Order {
-		key := strings.TrimSpace(k)
-		if key == "" {
-			continue
-		}
-		if _, ok := keySet[key]; !ok {
-			continue
-		}
-		if _, ok := seen[key]; ok {
-			continue
-		}
-		seen[key] = struct{}{}
-		next = append(next, key)
-	}
-	for _, s := range state.Sites {
-		if s.Key == "" {
-			continue
-		}
-		if _, ok := seen[s.Key]; ok {
-			continue
-		}
-		seen[s.Key] = struct{}{}
-		next = append(next, s.Key)
-	}
-	_, _ = database.SQL().Exec(`UPDATE users SET cat_site_order=? WHERE id=?`, marshalJSON(next), u.ID)
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+const maxAPITokensPerUser = 50
+
+func apiTokenJSON(t store.APIToken) map[string]any {
+	return map[string]any{
+		"id":         t.ID,
+		"name":       t.Name,
+		"prefix":     t.Prefix,
+		"scopes":     t.Scopes,
+		"createdAt":  t.CreatedAt,
+		"expiresAt":  t.ExpiresAt,
+		"lastUsedAt": t.LastUsedAt,
+	}
+}
+
+// handleAPIUserTokens lists, creates and revokes the caller's personal access
+// tokens. It needs a login session: a token cannot mint or revoke tokens.
+func handleAPIUserTokens(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后管理访问令牌"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := st.APITokens.ListForUser(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		list := []map[string]any{}
+		for _, t := range tokens {
+			list = append(list, apiTokenJSON(t))
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "tokens": list, "scopes": auth.Scopes})
+	case http.MethodPost:
+		var body struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expiresInDays"`
+		}
+		if err := readJSONLoose(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		name := strings.TrimSpace(body.Name)
+		if name == "" || utf8.RuneCountInString(name) > 64 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "令牌名称不能为空且不超过 64 个字符"})
+			return
+		}
+		scopes := []string{}
+		for _, s := range body.Scopes {
+			s = strings.TrimSpace(s)
+			if !auth.ValidScope(s) {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "权限范围无效"})
+				return
+			}
+			if !containsString(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		if len(scopes) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请选择权限范围"})
+			return
+		}
+		if body.ExpiresInDays < 0 || body.ExpiresInDays > 3650 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "有效期必须是 0-3650 天（0 表示永不过期）"})
+			return
+		}
+		existing, err := st.APITokens.ListForUser(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		if len(existing) >= maxAPITokensPerUser {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "访问令牌数量已达上限"})
+			return
+		}
+		var expiresAt time.Time
+		if body.ExpiresInDays > 0 {
+			expiresAt = time.Now().Add(time.Duration(body.ExpiresInDays) * 24 * time.Hour)
+		}
+		secret, t, err := authMw.CreateAPIToken(u.ID, name, scopes, expiresAt)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "创建失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "token": secret, "info": apiTokenJSON(t)})
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+		if err != nil || id <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		ok, err := st.APITokens.Delete(u.ID, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "令牌不存在"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true})
+	default:
+		methodNotAllowed(w)
+	}
+}
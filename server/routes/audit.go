@@ -0,0 +1,314 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// maxAuditSummary caps the stored size of a before or after summary.
+const maxAuditSummary = 8 << 10
+
+type auditKey struct{}
+
+// auditRecord collects what a handler reports about its change.
+type auditRecord struct {
+	target        string
+	before, after string
+	skip          bool
+}
+
+// auditNote sets the target of the request's audit entry and summarizes the
+// state before and after the change. Summaries must leave secrets out; use
+// auditNotePan for pan credentials.
+func auditNote(r *http.Request, target string, before, after any) {
+	rec, ok := r.Context().Value(auditKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	rec.target, rec.before, rec.after, rec.skip = target, auditSummary(before), auditSummary(after), false
+}
+
+// auditSkip leaves the request out of the audit log unless auditNote is
+// called later, for polling requests that usually change nothing.
+func auditSkip(r *http.Request) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.skip = true
+	}
+}
+
+func auditSummary(v any) string {
+	if v == nil {
+		return ""
+	}
+	s := marshalJSON(v)
+	if len(s) > maxAuditSummary {
+		s = strings.ToValidUTF8(s[:maxAuditSummary], "") + "…"
+	}
+	return s
+}
+
+// auditPanState copies a pan's stored login fields so that auditNotePan can
+// tell what a change did. The copy holds the credentials themselves and must
+// never reach auditNote.
+func auditPanState(cur map[string]any) map[string]string {
+	out := make(map[string]string, len(cur))
+	for k, v := range cur {
+		if v != nil {
+			out[k] = strings.TrimSpace(fmt.Sprint(v))
+		}
+	}
+	return out
+}
+
+// auditNotePan records which login fields of a pan were set, changed or
+// cleared since before was taken. Only that word is stored: the audit log is
+// readable without manage_pan_credentials, so nothing derived from a
+// credential may end up in it.
+func auditNotePan(r *http.Request, target string, before map[string]string, cur map[string]any) {
+	after := auditPanState(cur)
+	changes := map[string]string{}
+	for k, v := range after {
+		if c := auditSecretChange(before[k], v); c != "" {
+			changes[k] = c
+		}
+	}
+	for k, b := range before {
+		if _, ok := after[k]; !ok && b != "" {
+			changes[k] = "cleared"
+		}
+	}
+	auditNote(r, target, nil, changes)
+}
+
+// auditSecretChange describes how a credential changed as "set", "changed"
+// or "cleared", or "" when it did not.
+func auditSecretChange(before, after string) string {
+	switch {
+	case before == after:
+		return ""
+	case before == "":
+		return "set"
+	case after == "":
+		return "cleared"
+	default:
+		return "changed"
+	}
+}
+
+func auditSettings(database *db.DB, keys ...string) map[string]string {
+	out := make(map[string]string, len(keys))
+	for _, k := range keys {
+		out[k] = database.GetSetting(k)
+	}
+	return out
+}
+
+// auditSites describes each site by its flags and last check result.
+func auditSites(st *store.Store) map[string]string {
+	state, err := loadVideoSourceSites(st)
+	if err != nil {
+		return map[string]string{}
+	}
+	out := make(map[string]string, len(state.Sites))
+	for _, s := range state.Sites {
+		flags := []string{}
+		for _, f := range []struct {
+			name string
+			on   bool
+		}{{"enabled", state.Status[s.Key]}, {"home", state.Home[s.Key]}, {"search", state.Search[s.Key]}} {
+			if f.on {
+				flags = append(flags, f.name)
+			}
+		}
+		if a := state.Availability[s.Key]; a != "" {
+			flags = append(flags, a)
+		}
+		out[s.Key] = strings.Join(flags, " ")
+	}
+	return out
+}
+
+func auditSiteOrder(st *store.Store) []string {
+	out := []string{}
+	for _, s := range listVideoSourceSites(st) {
+		out = append(out, s.Key)
+	}
+	return out
+}
+
+// auditNoteDiff is auditNote keeping only the keys whose values differ
+// between before and after. Values holding JSON lists or objects, as many
+// settings do, are kept as JSON.
+func auditNoteDiff(r *http.Request, target string, before, after map[string]string) {
+	b, a := map[string]any{}, map[string]any{}
+	for k, v := range before {
+		if w, ok := after[k]; !ok || w != v {
+			b[k] = auditValue(v)
+		}
+	}
+	for k, v := range after {
+		if w, ok := before[k]; !ok || w != v {
+			a[k] = auditValue(v)
+		}
+	}
+	auditNote(r, target, b, a)
+}
+
+func auditValue(v string) any {
+	t := strings.TrimSpace(v)
+	if (strings.HasPrefix(t, "[") || strings.HasPrefix(t, "{")) && json.Valid([]byte(t)) {
+		return json.RawMessage(t)
+	}
+	return v
+}
+
+func auditUser(u store.User) map[string]any {
+	return map[string]any{
+		"username":           u.Username,
+		"role":               u.Role,
+		"status":             u.Status,
+		"catApiBase":         u.CatAPIBase,
+		"catProxy":           u.CatProxy,
+		"mustChangePassword": u.MustChangePassword,
+	}
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withAudit writes an audit_log entry for every state-changing request a
+// signed-in user makes, with the target and summaries the handler reported.
+func withAudit(st *store.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := auth.CurrentUser(r)
+		if u == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &auditRecord{}
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+		if rec.skip {
+			return
+		}
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		_, err := st.Audit.Append(store.AuditEntry{
+			CreatedAt: time.Now().UnixMilli(),
+			ActorID:   u.ID,
+			Actor:     u.Username,
+			IP:        proxy.ClientIP(r),
+			Action:    strings.TrimPrefix(r.URL.Path, "/dashboard/"),
+			Target:    rec.target,
+			Before:    rec.before,
+			After:     rec.after,
+			Status:    aw.status,
+		})
+		if err != nil {
+			log.Printf("audit: %v", err)
+		}
+	})
+}
+
+// parseAuditTime reads a millisecond timestamp or a local YYYY-MM-DD date.
+// With endOfDay a date means the start of the following day.
+func parseAuditTime(v string, endOfDay bool) int64 {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return 0
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.UnixMilli()
+}
+
+func auditSummaryJSON(s string) any {
+	if s != "" && json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	return s
+}
+
+// handleDashboardAudit pages through the audit log, newest first, filtered
+// by actor, action prefix, target and time range.
+func handleDashboardAudit(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	q := r.URL.Query()
+	page := parseIntQuery(q.Get("page"), 1, 1, 1<<20)
+	pageSize := parseIntQuery(q.Get("pageSize"), 50, 1, 200)
+	list, total, err := st.Audit.List(store.AuditFilter{
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Action: strings.TrimPrefix(strings.TrimSpace(q.Get("action")), "/"),
+		Target: strings.TrimSpace(q.Get("target")),
+		Since:  parseAuditTime(q.Get("from"), false),
+		Until:  parseAuditTime(q.Get("to"), true),
+		Limit:  pageSize,
+		Offset: (page - 1) * pageSize,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	entries := []map[string]any{}
+	for _, e := range list {
+		entries = append(entries, map[string]any{
+			"id":        e.ID,
+			"createdAt": e.CreatedAt,
+			"actorId":   e.ActorID,
+			"actor":     e.Actor,
+			"ip":        e.IP,
+			"action":    e.Action,
+			"target":    e.Target,
+			"before":    auditSummaryJSON(e.Before),
+			"after":     auditSummaryJSON(e.After),
+			"status":    e.Status,
+		})
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "entries": entries, "total": total, "page": page, "pageSize": pageSize})
+}
@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestAuditOfUserManagement(t *testing.T) {
+	st, authMw, _, cookies := signedIn(t, "opsy", "Ops-pass-12", "ops")
+	_ = st.Roles.Put(store.Role{Name: "ops", Permissions: []string{auth.PermManageUsers}})
+	_ = st.Roles.Put(store.Role{Name: "boss", Permissions: []string{auth.PermManageUsers, auth.PermManageRoles}})
+	_, _ = st.Users.Create(store.User{Username: "carol", Role: "boss", Status: "active"})
+	_, _ = st.Users.Create(store.User{Username: "dave", Role: "user", Status: "active"})
+	h := authMw.Middleware(withAudit(st, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dashboard/user/ban":
+			handleDashboardUserBan(w, r, st, authMw)
+		case "/dashboard/user/delete":
+			handleDashboardUserDelete(w, r, st, authMw)
+		}
+	})))
+
+	tests := []struct {
+		path, user string
+		status     int
+		target     string
+		before     string
+		after      string
+	}{
+		// Refused requests are logged without what the actor may not see.
+		{"/dashboard/user/ban", "carol", http.StatusForbidden, "", "", ""},
+		{"/dashboard/user/delete", "carol", http.StatusForbidden, "", "", ""},
+		{"/dashboard/user/ban", "dave", http.StatusOK, "dave", `{"status":"active"}`, `{"status":"banned"}`},
+	}
+	for i, tt := range tests {
+		if rec := postForm(h, tt.path, cookies, url.Values{"username": {tt.user}}); rec.Code != tt.status {
+			t.Fatalf("%s %s: status %d, want %d", tt.path, tt.user, rec.Code, tt.status)
+		}
+		list, total, err := st.Audit.List(store.AuditFilter{Limit: 1})
+		if err != nil || total != i+1 {
+			t.Fatalf("audit entries = %d, %v; want %d", total, err, i+1)
+		}
+		e := list[0]
+		if e.Actor != "opsy" || e.Status != tt.status || e.Target != tt.target || e.Before != tt.before || e.After != tt.after {
+			t.Errorf("%s %s: audit entry %+v", tt.path, tt.user, e)
+		}
+	}
+}
+
+func TestAuditOfPanCredentials(t *testing.T) {
+	database := openTestDB(t)
+	st, authMw, _, cookies := signedIn(t, "root", "Root-pass-1", "admin")
+	h := authMw.Middleware(withAudit(st, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleDashboardPanSettings(w, r, database)
+	})))
+
+	tests := []struct {
+		name  string
+		form  url.Values
+		after string
+	}{
+		{"set", url.Values{"type": {"account"}, "username": {"me"}, "password": {"hunter2"}}, `{"password":"set","username":"set"}`},
+		{"changed", url.Values{"type": {"account"}, "username": {"me"}, "password": {"hunter3"}}, `{"password":"changed"}`},
+		{"cleared", url.Values{"type": {"account"}, "username": {"me"}, "password": {""}}, `{"password":"cleared"}`},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("key", "baidu")
+			if rec := postForm(h, "/dashboard/pan/settings", cookies, tt.form); rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			list, total, err := st.Audit.List(store.AuditFilter{Limit: 1})
+			if err != nil || total != i+1 {
+				t.Fatalf("audit entries = %d, %v; want %d", total, err, i+1)
+			}
+			e := list[0]
+			if e.Target != "baidu" || e.Before != "" || e.After != tt.after {
+				t.Errorf("audit entry %+v, want after %s", e, tt.after)
+			}
+		})
+	}
+}
+
+func TestAuditOfRetentionAndRestore(t *testing.T) {
+	database := openTestDB(t)
+	st, authMw, _, cookies := signedIn(t, "root", "Root-pass-1", "admin")
+	h := authMw.Middleware(withAudit(st, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dashboard/retention/settings":
+			handleDashboardRetentionSettings(w, r, database)
+		case "/dashboard/backup/restore":
+			handleDashboardBackupRestore(w, r, database)
+		}
+	})))
+	version, err := database.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, body string
+		status           int
+		before, after    string
+	}{
+		{"retention", "/dashboard/retention/settings", `{"policy":{"play_history":{"maxRows":100}}}`, http.StatusOK,
+			`{}`, `{"play_history":{"maxRows":100,"maxDays":0}}`},
+		{"refused restore", "/dashboard/backup/restore", "not a database", http.StatusBadRequest,
+			`{"schemaVersion":` + strconv.Itoa(version) + `}`, `{"bytes":14}`},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := postJSON(h, tt.path, cookies, tt.body); rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			list, total, err := st.Audit.List(store.AuditFilter{Limit: 1})
+			if err != nil || total != i+1 {
+				t.Fatalf("audit entries = %d, %v; want %d", total, err, i+1)
+			}
+			e := list[0]
+			if e.Actor != "root" || e.Status != tt.status || e.Before != tt.before || e.After != tt.after {
+				t.Errorf("audit entry %+v, want before %s after %s", e, tt.before, tt.after)
+			}
+		})
+	}
+}
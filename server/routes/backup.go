@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+)
+
+const maxRestoreUploadBytes = 1 << 30
+
+func handleDashboardBackupDownload(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	name := db.SnapshotFileName(time.Now())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := database.WriteSnapshot(w); err != nil {
+		// VACUUM INTO fails before anything is streamed, so the error can still be reported.
+		w.Header().Del("Content-Disposition")
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "备份失败"})
+	}
+}
+
+func handleDashboardBackupSnapshot(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	keep := db.ParseIntDefault(database.GetSetting("backup_keep"), 7)
+	path, err := database.WriteScheduledSnapshot(keep)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "备份失败"})
+		return
+	}
+	auditNote(r, filepath.Base(path), nil, map[string]any{"keep": keep})
+	snapshots, _ := database.ListSnapshots()
+	writeJSON(w, 200, map[string]any{"success": true, "snapshots": snapshots})
+}
+
+func handleDashboardBackupRestore(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRestoreUploadBytes)
+
+	var src io.Reader = r.Body
+	upload := ""
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请上传数据库文件"})
+			return
+		}
+		defer func() { _ = file.Close() }()
+		src, upload = file, header.Filename
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(database.Path()), ".restore-")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "恢复失败"})
+		return
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	tmp := filepath.Join(tmpDir, "upload.db")
+	f, err := os.Create(tmp)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "恢复失败"})
+		return
+	}
+	n, err := io.Copy(f, src)
+	_ = f.Close()
+	if err != nil || n == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "上传失败"})
+		return
+	}
+	// Note the upload before checking it, so refused restores are on record
+	// too.
+	before, _ := database.SchemaVersion()
+	auditNote(r, upload, map[string]any{"schemaVersion": before}, map[string]any{"bytes": n})
+
+	err = database.Restore(tmp)
+	if errors.Is(err, db.ErrInvalidSnapshot) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "恢复失败：" + err.Error()})
+		return
+	}
+	version, _ := database.SchemaVersion()
+	auditNote(r, upload, map[string]any{"schemaVersion": before}, map[string]any{"bytes": n, "schemaVersion": version})
+	writeJSON(w, 200, map[string]any{"success": true, "schemaVersion": version})
+}
+
+func handleDashboardBackupSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := database.ListSnapshots()
+		if err != nil {
+			snapshots = []db.Snapshot{}
+		}
+		writeJSON(w, 200, map[string]any{
+			"success":       true,
+			"intervalHours": db.ParseIntDefault(database.GetSetting("backup_interval_hours"), 0),
+			"keep":          db.ParseIntDefault(database.GetSetting("backup_keep"), 7),
+			"dir":           database.SnapshotDir(),
+			"snapshots":     snapshots,
+		})
+	case http.MethodPost:
+		parseForm(r)
+		interval, err := strconv.Atoi(strings.TrimSpace(r.FormValue("intervalHours")))
+		if err != nil || interval < 0 || interval > 24*30 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "备份间隔必须是 0-720 的整数（0 表示关闭）"})
+			return
+		}
+		keep, err := strconv.Atoi(strings.TrimSpace(r.FormValue("keep")))
+		if err != nil || keep < 1 || keep > 365 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "保留份数必须是 1-365 的整数"})
+			return
+		}
+		before := auditSettings(database, "backup_interval_hours", "backup_keep")
+		_ = database.SetSetting("backup_interval_hours", strconv.Itoa(interval))
+		_ = database.SetSetting("backup_keep", strconv.Itoa(keep))
+		auditNoteDiff(r, "", before, auditSettings(database, "backup_interval_hours", "backup_keep"))
+		writeJSON(w, 200, map[string]any{"success": true, "intervalHours": interval, "keep": keep})
+	default:
+		methodNotAllowed(w)
+	}
+}
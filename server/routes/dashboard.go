@@ -1,115 +1,117 @@
 package routes
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strings"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/jenfonro/meowfilm/internal/auth"
 	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/maintenance"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
 )
 
-func DashboardHandler(database *db.DB, authMw *auth.Auth) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func DashboardHandler(database *db.DB, st *store.Store, jan *maintenance.Janitor, authMw *auth.Auth) http.Handler {
+	return withAudit(st, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/dashboard")
 		switch path {
 		case "/site/save":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardSiteSave(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/catpawopen/save":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardCatPawOpenSave(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/catpawopen/delete":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardCatPawOpenDelete(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/site/settings":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardSiteSettings(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/goproxy/save":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardGoProxySave(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/settings":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardPanSettings(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/baidu/qr/start":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBaiduQRStart(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/baidu/qr/image":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBaiduQRImage(w, r)
 			})).ServeHTTP(w, r)
 		case "/pan/baidu/qr/cookie":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBaiduQRCookie(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/quark/qr/start":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardQuarkQRStart(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/quark/qr/image":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardQuarkQRImage(w, r)
 			})).ServeHTTP(w, r)
 		case "/pan/quark/qr/cookie":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardQuarkQRCookie(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/uc/qr/start":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardUCQRStart(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/uc/qr/image":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardUCQRImage(w, r)
 			})).ServeHTTP(w, r)
 		case "/pan/uc/qr/cookie":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardUCQRCookie(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/115/qr/start":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboard115QRStart(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/115/qr/image":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboard115QRImage(w, r)
 			})).ServeHTTP(w, r)
 		case "/pan/115/qr/cookie":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboard115QRCookie(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/bili/qr/start":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBiliQRStart(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/pan/bili/qr/image":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBiliQRImage(w, r)
 			})).ServeHTTP(w, r)
 		case "/pan/bili/qr/cookie":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardBiliQRCookie(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/video/pans/list":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManagePanCredentials, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardVideoPansList(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/video/source/save":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSave(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSave(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/settings":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.Method != http.MethodGet {
 					methodNotAllowed(w)
 					return
@@ -117,71 +119,176 @@ func DashboardHandler(database *db.DB, authMw *auth.Auth) http.Handler {
 				writeJSON(w, 200, map[string]any{"success": true, "videoSourceUrl": ""})
 			})).ServeHTTP(w, r)
 		case "/video/source/sites":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.Method != http.MethodGet {
 					methodNotAllowed(w)
 					return
 				}
-				sites := mergeVideoSourceSites(database)
+				sites := mergeVideoSourceSites(st)
 				cover := resolveSearchCoverSite(sites, database.GetSetting("video_source_search_cover_site"))
 				writeJSON(w, 200, map[string]any{"success": true, "sites": sites, "coverSite": cover})
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/status":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSiteStatus(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSiteStatus(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/home":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSiteHome(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSiteHome(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/search":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSiteSearch(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSiteSearch(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/cover":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceCoverSite(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceCoverSite(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/order":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSiteOrder(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSiteOrder(w, r, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/check":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSitesCheck(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSitesCheck(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/video/source/sites/import":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardVideoSourceSitesImport(w, r, database)
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardVideoSourceSitesImport(w, r, database, st)
 			})).ServeHTTP(w, r)
 		case "/magic/settings":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMw.RequirePermission(auth.PermManageSites, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				handleDashboardMagicSettings(w, r, database)
 			})).ServeHTTP(w, r)
+		case "/backup/download":
+			authMw.RequireFullAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardBackupDownload(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/backup/snapshot":
+			authMw.RequirePermission(auth.PermManageBackups, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardBackupSnapshot(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/backup/restore":
+			authMw.RequireFullAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardBackupRestore(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/backup/settings":
+			authMw.RequirePermission(auth.PermManageBackups, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardBackupSettings(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/maintenance/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardMaintenanceSettings(w, r, database, jan)
+			})).ServeHTTP(w, r)
+		case "/maintenance/run":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardMaintenanceRun(w, r, jan)
+			})).ServeHTTP(w, r)
+		case "/retention/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRetentionSettings(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/retention/user":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRetentionUser(w, r, database, st)
+			})).ServeHTTP(w, r)
+		case "/retention/preview":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRetentionPreview(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/login/lockouts":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardLoginLockouts(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/login/unlock":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardLoginUnlock(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/login/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardLoginSettings(w, r, database, st)
+			})).ServeHTTP(w, r)
+		case "/oidc/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardOIDCSettings(w, r, database, authMw)
+			})).ServeHTTP(w, r)
+		case "/password/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardPasswordSettings(w, r, database)
+			})).ServeHTTP(w, r)
+		case "/2fa/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboard2FASettings(w, r, database, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/user/2fa/reset":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUser2FAReset(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/sessions":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardSessions(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/sessions/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardSessionSettings(w, r, database, st)
+			})).ServeHTTP(w, r)
+		case "/sessions/revoke":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardSessionsRevoke(w, r, st, authMw)
+			})).ServeHTTP(w, r)
 		case "/user/list":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardUserList(w, r, database)
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserList(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/user/approve":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserApprove(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/invitations":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardInvitations(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/invitations/delete":
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardInvitationDelete(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/roles":
+			authMw.RequirePermission(auth.PermManageRoles, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRoles(w, r, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/roles/delete":
+			authMw.RequirePermission(auth.PermManageRoles, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRoleDelete(w, r, st)
+			})).ServeHTTP(w, r)
+		case "/registration/settings":
+			authMw.RequirePermission(auth.PermManageSettings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardRegistrationSettings(w, r, database)
 			})).ServeHTTP(w, r)
 		case "/user/add":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardUserAdd(w, r, database)
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserAdd(w, r, database, st, authMw)
 			})).ServeHTTP(w, r)
 		case "/user/ban":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardUserBan(w, r, database)
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserBan(w, r, st, authMw)
 			})).ServeHTTP(w, r)
 		case "/user/delete":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardUserDelete(w, r, database)
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserDelete(w, r, st, authMw)
 			})).ServeHTTP(w, r)
 		case "/user/update":
-			authMw.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				handleDashboardUserUpdate(w, r, database)
+			authMw.RequirePermission(auth.PermManageUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardUserUpdate(w, r, database, st, authMw)
+			})).ServeHTTP(w, r)
+		case "/audit":
+			authMw.RequirePermission(auth.PermViewAuditLog, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handleDashboardAudit(w, r, st)
 			})).ServeHTTP(w, r)
 		default:
+			auditSkip(r)
 			http.NotFound(w, r)
 		}
-	})
+	}))
 }
 
 func handleDashboardSiteSave(w http.ResponseWriter, r *http.Request, database *db.DB) {
@@ -199,6 +306,8 @@ func handleDashboardSiteSave(w http.ResponseWriter, r *http.Request, database *d
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
 		return
 	}
+	siteKeys := []string{"site_name", "douban_data_proxy", "douban_data_custom", "douban_img_proxy", "douban_img_custom"}
+	before := auditSettings(database, siteKeys...)
 	if siteName != "" {
 		_ = database.SetSetting("site_name", siteName)
 	}
@@ -206,6 +315,7 @@ func handleDashboardSiteSave(w http.ResponseWriter, r *http.Request, database *d
 	_ = database.SetSetting("douban_data_custom", doubanDataCustom)
 	_ = database.SetSetting("douban_img_proxy", doubanImgProxy)
 	_ = database.SetSetting("douban_img_custom", doubanImgCustom)
+	auditNoteDiff(r, "", before, auditSettings(database, siteKeys...))
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
@@ -217,6 +327,7 @@ func handleDashboardCatPawOpenSave(w http.ResponseWriter, r *http.Request, datab
 	parseForm(r)
 	servers := parseCatPawOpenServers(database.GetSetting("catpawopen_servers"))
 	prevBase := resolveCatPawOpenActiveBase(servers, database.GetSetting("catpawopen_active"))
+	before := map[string]any{"servers": append([]catPawOpenServer{}, servers...), "active": database.GetSetting("catpawopen_active")}
 	serverKey := strings.TrimSpace(r.FormValue("catPawOpenServerKey"))
 	name := strings.TrimSpace(r.FormValue("catPawOpenName"))
 	base := r.FormValue("catPawOpenApiBase")
@@ -275,6 +386,7 @@ func handleDashboardCatPawOpenSave(w http.ResponseWriter, r *http.Request, datab
 	serversJSON, _ := json.Marshal(servers)
 	_ = database.SetSetting("catpawopen_servers", string(serversJSON))
 	_ = database.SetSetting("catpawopen_active", name)
+	auditNote(r, name, before, map[string]any{"servers": servers, "active": name})
 	writeJSON(w, 200, map[string]any{
 		"success":        true,
 		"apiBaseChanged": strings.TrimSpace(prevBase) != strings.TrimSpace(normalizedBase),
@@ -312,8 +424,10 @@ func handleDashboardCatPawOpenDelete(w http.ResponseWriter, r *http.Request, dat
 
 	serversJSON, _ := json.Marshal(next)
 	_ = database.SetSetting("catpawopen_servers", string(serversJSON))
-	active := pickCatPawOpenActiveName(next, database.GetSetting("catpawopen_active"))
+	prevActive := database.GetSetting("catpawopen_active")
+	active := pickCatPawOpenActiveName(next, prevActive)
 	_ = database.SetSetting("catpawopen_active", active)
+	auditNote(r, key, map[string]any{"servers": servers, "active": prevActive}, map[string]any{"servers": next, "active": active})
 
 	writeJSON(w, 200, map[string]any{
 		"success": true,
@@ -330,17 +444,17 @@ func handleDashboardSiteSettings(w http.ResponseWriter, r *http.Request, databas
 	servers := parseCatPawOpenServers(database.GetSetting("catpawopen_servers"))
 	active := pickCatPawOpenActiveName(servers, database.GetSetting("catpawopen_active"))
 	writeJSON(w, 200, map[string]any{
-		"success":              true,
-		"siteName":             database.GetSetting("site_name"),
-		"catPawOpenServers":    servers,
-		"catPawOpenActive":     active,
-		"goProxyEnabled":       strings.TrimSpace(database.GetSetting("goproxy_enabled")) == "1",
-		"goProxyAutoSelect":    strings.TrimSpace(database.GetSetting("goproxy_auto_select")) == "1",
-		"goProxyServersJson":   defaultString(database.GetSetting("goproxy_servers"), "[]"),
-		"doubanDataProxy":      defaultString(database.GetSetting("douban_data_proxy"), "direct"),
-		"doubanDataCustom":     database.GetSetting("douban_data_custom"),
-		"doubanImgProxy":       defaultString(database.GetSetting("douban_img_proxy"), "direct-browser"),
-		"doubanImgCustom":      database.GetSetting("douban_img_custom"),
+		"success":            true,
+		"siteName":           database.GetSetting("site_name"),
+		"catPawOpenServers":  servers,
+		"catPawOpenActive":   active,
+		"goProxyEnabled":     strings.TrimSpace(database.GetSetting("goproxy_enabled")) == "1",
+		"goProxyAutoSelect":  strings.TrimSpace(database.GetSetting("goproxy_auto_select")) == "1",
+		"goProxyServersJson": defaultString(database.GetSetting("goproxy_servers"), "[]"),
+		"doubanDataProxy":    defaultString(database.GetSetting("douban_data_proxy"), "direct"),
+		"doubanDataCustom":   database.GetSetting("douban_data_custom"),
+		"doubanImgProxy":     defaultString(database.GetSetting("douban_img_proxy"), "direct-browser"),
+		"doubanImgCustom":    database.GetSetting("douban_img_custom"),
 	})
 }
 
@@ -354,6 +468,11 @@ func handleDashboardGoProxySave(w http.ResponseWriter, r *http.Request, database
 	autoSelect := boolFromForm(r.FormValue("goProxyAutoSelect"))
 	serversJSON := r.FormValue("goProxyServersJson")
 	servers := normalizeGoProxyServers(serversJSON)
+	before := map[string]any{
+		"enabled":    strings.TrimSpace(database.GetSetting("goproxy_enabled")) == "1",
+		"autoSelect": strings.TrimSpace(database.GetSetting("goproxy_auto_select")) == "1",
+		"servers":    normalizeGoProxyServers(database.GetSetting("goproxy_servers")),
+	}
 	if enabled {
 		_ = database.SetSetting("goproxy_enabled", "1")
 	} else {
@@ -366,6 +485,7 @@ func handleDashboardGoProxySave(w http.ResponseWriter, r *http.Request, database
 	}
 	b, _ := json.Marshal(servers)
 	_ = database.SetSetting("goproxy_servers", string(b))
+	auditNote(r, "", before, map[string]any{"enabled": enabled, "autoSelect": autoSelect, "servers": servers})
 	writeJSON(w, 200, map[string]any{"success": true, "goProxySync": map[string]any{"ok": nil, "skipped": true}})
 }
 
@@ -374,7 +494,12 @@ func handleDashboardPanSettings(w http.ResponseWriter, r *http.Request, database
 	switch r.Method {
 	case http.MethodGet:
 		key := strings.TrimSpace(r.URL.Query().Get("key"))
-		store := parseJSONMap(database.GetSetting("pan_login_settings"))
+		store, err := database.PanLoginSettings()
+		if err != nil {
+			log.Printf("pan settings: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "网盘凭据无法解密，请检查主密钥"})
+			return
+		}
 		if key != "" {
 			v, ok := store[key]
 			if !ok {
@@ -395,11 +520,15 @@ func handleDashboardPanSettings(w http.ResponseWriter, r *http.Request, database
 			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "type 参数无效"})
 			return
 		}
-		store := parseJSONMap(database.GetSetting("pan_login_settings"))
+		store, err := database.PanLoginSettings()
+		if err != nil {
+			log.Printf("pan settings: %v", err)
+		}
 		cur, _ := store[key].(map[string]any)
 		if cur == nil {
 			cur = map[string]any{}
 		}
+		before := auditPanState(cur)
 		var payload any
 		if typ == "cookie" {
 			cookie := r.FormValue("cookie")
@@ -423,8 +552,8 @@ func handleDashboardPanSettings(w http.ResponseWriter, r *http.Request, database
 			payload = map[string]any{"username": username, "password": password}
 		}
 		store[key] = cur
-		b, _ := json.Marshal(store)
-		_ = database.SetSetting("pan_login_settings", string(b))
+		_ = database.SetPanLoginSettings(store)
+		auditNotePan(r, key, before, cur)
 		writeJSON(w, 200, map[string]any{"success": true, "settings": store, "sync": map[string]any{"ok": nil, "skipped": true}, "payload": payload})
 	default:
 		methodNotAllowed(w)
@@ -443,29 +572,31 @@ func handleDashboardVideoPansList(w http.ResponseWriter, r *http.Request, databa
 			_ = json.Unmarshal([]byte(listRaw), &list)
 		}
 		norm := normalizePansAny(list)
+		before := auditSettings(database, "catpawopen_pans_list")
 		b, _ := json.Marshal(norm)
 		_ = database.SetSetting("catpawopen_pans_list", string(b))
+		auditNoteDiff(r, "", before, auditSettings(database, "catpawopen_pans_list"))
 		writeJSON(w, 200, map[string]any{"success": true, "pans": norm})
 	default:
 		methodNotAllowed(w)
 	}
 }
 
-func handleDashboardVideoSourceSave(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSave(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
 	}
 	writeJSON(w, 200, map[string]any{
 		"success":        true,
-		"sites":          mergeVideoSourceSites(database),
+		"sites":          mergeVideoSourceSites(st),
 		"sitesRefreshed": false,
 		"pans":           normalizePansList(database.GetSetting("catpawopen_pans_list")),
 		"panSync":        map[string]any{"ok": nil, "skipped": true},
 	})
 }
 
-func handleDashboardVideoSourceSiteStatus(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSiteStatus(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -477,14 +608,15 @@ func handleDashboardVideoSourceSiteStatus(w http.ResponseWriter, r *http.Request
 		return
 	}
 	enabled := boolFromForm(r.FormValue("enabled"))
-	m := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-	m[key] = enabled
-	b, _ := json.Marshal(m)
-	_ = database.SetSetting("video_source_site_status", string(b))
+	before := auditSites(st)[key]
+	if !updateVideoSourceSite(w, st, key, func(s *store.Site) { s.Enabled = enabled }) {
+		return
+	}
+	auditNote(r, key, before, auditSites(st)[key])
 	writeJSON(w, 200, map[string]any{"success": true, "key": key, "enabled": enabled})
 }
 
-func handleDashboardVideoSourceSiteHome(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSiteHome(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -496,14 +628,15 @@ func handleDashboardVideoSourceSiteHome(w http.ResponseWriter, r *http.Request,
 		return
 	}
 	home := boolFromForm(r.FormValue("home"))
-	m := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-	m[key] = home
-	b, _ := json.Marshal(m)
-	_ = database.SetSetting("video_source_site_home", string(b))
+	before := auditSites(st)[key]
+	if !updateVideoSourceSite(w, st, key, func(s *store.Site) { s.Home = home }) {
+		return
+	}
+	auditNote(r, key, before, auditSites(st)[key])
 	writeJSON(w, 200, map[string]any{"success": true, "key": key, "home": home})
 }
 
-func handleDashboardVideoSourceSiteSearch(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSiteSearch(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -518,13 +651,27 @@ func handleDashboardVideoSourceSiteSearch(w http.ResponseWriter, r *http.Request
 	if strings.Contains(strings.ToLower(key), "baseset") {
 		searchEnabled = false
 	}
-	m := parseJSONBoolMap(database.GetSetting("video_source_site_search"))
-	m[key] = searchEnabled
-	b, _ := json.Marshal(m)
-	_ = database.SetSetting("video_source_site_search", string(b))
+	before := auditSites(st)[key]
+	if !updateVideoSourceSite(w, st, key, func(s *store.Site) { s.Search = searchEnabled }) {
+		return
+	}
+	auditNote(r, key, before, auditSites(st)[key])
 	writeJSON(w, 200, map[string]any{"success": true, "key": key, "search": searchEnabled})
 }
 
+func updateVideoSourceSite(w http.ResponseWriter, st *store.Store, key string, fn func(s *store.Site)) bool {
+	found, err := st.Sites.Edit(key, fn)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+		return false
+	}
+	if !found {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "站点不存在"})
+		return false
+	}
+	return true
+}
+
 func resolveSearchCoverSite(sites []map[string]any, preferredRaw string) string {
 	preferred := strings.TrimSpace(preferredRaw)
 	keySet := map[string]struct{}{}
@@ -558,20 +705,22 @@ func resolveSearchCoverSite(sites []map[string]any, preferredRaw string) string
 	return first
 }
 
-func handleDashboardVideoSourceCoverSite(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceCoverSite(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
 	}
 	parseForm(r)
 	key := strings.TrimSpace(r.FormValue("key"))
-	sites := mergeVideoSourceSites(database)
+	sites := mergeVideoSourceSites(st)
 	cover := resolveSearchCoverSite(sites, key)
+	before := auditSettings(database, "video_source_search_cover_site")
 	_ = database.SetSetting("video_source_search_cover_site", cover)
+	auditNoteDiff(r, cover, before, auditSettings(database, "video_source_search_cover_site"))
 	writeJSON(w, 200, map[string]any{"success": true, "coverSite": cover})
 }
 
-func handleDashboardVideoSourceSiteOrder(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSiteOrder(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -580,25 +729,16 @@ func handleDashboardVideoSourceSiteOrder(w http.ResponseWriter, r *http.Request,
 	orderRaw := strings.TrimSpace(r.FormValue("order"))
 	var order []string
 	_ = json.Unmarshal([]byte(orderRaw), &order)
-	uniq := []string{}
-	seen := map[string]struct{}{}
-	for _, k := range order {
-		k = strings.TrimSpace(k)
-		if k == "" {
-			continue
-		}
-		if _, ok := seen[k]; ok {
-			continue
-		}
-		seen[k] = struct{}{}
-		uniq = append(uniq, k)
+	before := auditSiteOrder(st)
+	if err := saveVideoSourceSiteOrder(st, order); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+		return
 	}
-	b, _ := json.Marshal(uniq)
-	_ = database.SetSetting("video_source_site_order", string(b))
+	auditNote(r, "", before, auditSiteOrder(st))
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
-func handleDashboardVideoSourceSitesCheck(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSitesCheck(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -648,41 +788,14 @@ func handleDashboardVideoSourceSitesCheck(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	availabilityMap := parseAvailabilityJSON(database.GetSetting("video_source_site_availability"))
-	for k, v := range results {
-		availabilityMap[k] = normalizeAvailability(v)
-	}
-	_ = database.SetSetting("video_source_site_availability", marshalJSON(availabilityMap))
-
-	statusMap := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-	homeMap := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-	searchMap := parseJSONBoolMap(database.GetSetting("video_source_site_search"))
-	for k, v := range results {
-		if v == "invalid" {
-			statusMap[k] = false
-		}
-		if v == "category_error" {
-			homeMap[k] = false
-		}
-		if v == "search_error" {
-			searchMap[k] = false
-		}
-	}
-	_ = database.SetSetting("video_source_site_status", marshalJSON(statusMap))
-	_ = database.SetSetting("video_source_site_home", marshalJSON(homeMap))
-	_ = database.SetSetting("video_source_site_search", marshalJSON(searchMap))
-
-	errorMap := parseJSONStringMap(database.GetSetting("video_source_site_error"))
-	for k := range results {
-		if msg, ok := errorInput[k]; ok && strings.TrimSpace(msg) != "" {
-			errorMap[k] = strings.TrimSpace(msg)
-		} else {
-			delete(errorMap, k)
-		}
+	before := auditSites(st)
+	if err := applyVideoSourceCheck(st, results, errorInput); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+		return
 	}
-	_ = database.SetSetting("video_source_site_error", marshalJSON(errorMap))
+	auditNoteDiff(r, "", before, auditSites(st))
 
-	sites := mergeVideoSourceSites(database)
+	sites := mergeVideoSourceSites(st)
 	cover := resolveSearchCoverSite(sites, database.GetSetting("video_source_search_cover_site"))
 	writeJSON(w, 200, map[string]any{
 		"success":   true,
@@ -692,7 +805,7 @@ func handleDashboardVideoSourceSitesCheck(w http.ResponseWriter, r *http.Request
 	})
 }
 
-func handleDashboardVideoSourceSitesImport(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardVideoSourceSitesImport(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -714,40 +827,30 @@ func handleDashboardVideoSourceSitesImport(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	prevStatus := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-	prevHome := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-	prevSearch := parseJSONBoolMap(database.GetSetting("video_source_site_search"))
-	prevOrder := parseJSONStringArray(database.GetSetting("video_source_site_order"))
-	prevAvailability := parseAvailabilityJSON(database.GetSetting("video_source_site_availability"))
-	reconciled := reconcileSites(normalized, prevStatus, prevHome, prevSearch, prevOrder, prevAvailability)
-
-	for _, s := range reconciled.Sites {
-		if isConfigCenterSite(s) {
-			reconciled.Search[s.Key] = false
-		}
-	}
-
-	prevErrors := parseJSONStringMap(database.GetSetting("video_source_site_error"))
-	nextErrors := map[string]string{}
-	for _, s := range reconciled.Sites {
-		if msg, ok := prevErrors[s.Key]; ok && strings.TrimSpace(msg) != "" {
-			nextErrors[s.Key] = strings.TrimSpace(msg)
-		}
+	before := auditSites(st)
+	if err := replaceVideoSourceSites(st, normalized); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+		return
 	}
+	auditNoteDiff(r, "", before, auditSites(st))
 
-	_ = database.SetSetting("video_source_sites", marshalJSON(reconciled.Sites))
-	_ = database.SetSetting("video_source_site_status", marshalJSON(reconciled.Status))
-	_ = database.SetSetting("video_source_site_home", marshalJSON(reconciled.Home))
-	_ = database.SetSetting("video_source_site_search", marshalJSON(reconciled.Search))
-	_ = database.SetSetting("video_source_site_order", marshalJSON(reconciled.Order))
-	_ = database.SetSetting("video_source_site_availability", marshalJSON(reconciled.Availability))
-	_ = database.SetSetting("video_source_site_error", marshalJSON(nextErrors))
-
-	sites := mergeVideoSourceSites(database)
+	sites := mergeVideoSourceSites(st)
 	cover := resolveSearchCoverSite(sites, database.GetSetting("video_source_search_cover_site"))
 	writeJSON(w, 200, map[string]any{"success": true, "sites": sites, "coverSite": cover})
 }
 
+// magicSettingKeys are the settings saved by handleDashboardMagicSettings.
+var magicSettingKeys = []string{
+	"magic_episode_clean_regex_rules",
+	"magic_episode_rules",
+	"magic_movie_rules",
+	"magic_aggregate_rules",
+	"magic_aggregate_regex_rules",
+	"smart_source_priority_tokens",
+	"smart_pan_match_tokens",
+	"smart_pan_extract_mode",
+}
+
 func handleDashboardMagicSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
 	switch r.Method {
 	case http.MethodGet:
@@ -764,13 +867,13 @@ func handleDashboardMagicSettings(w http.ResponseWriter, r *http.Request, databa
 			smartPanExtractMode = "rule-first"
 		}
 		writeJSON(w, 200, map[string]any{
-			"success":                true,
-			"episodeCleanRegex":      episodeCleanRegex,
-			"episodeCleanRegexRules": cleanRules,
-			"episodeRules":           parseJSONStringArray(database.GetSetting("magic_episode_rules")),
-			"movieRules":             parseJSONStringArray(database.GetSetting("magic_movie_rules")),
-			"aggregateRules":         parseJSONStringArray(database.GetSetting("magic_aggregate_rules")),
-			"aggregateRegexRules":    parseJSONStringArray(database.GetSetting("magic_aggregate_regex_rules")),
+			"success":                   true,
+			"episodeCleanRegex":         episodeCleanRegex,
+			"episodeCleanRegexRules":    cleanRules,
+			"episodeRules":              parseJSONStringArray(database.GetSetting("magic_episode_rules")),
+			"movieRules":                parseJSONStringArray(database.GetSetting("magic_movie_rules")),
+			"aggregateRules":            parseJSONStringArray(database.GetSetting("magic_aggregate_rules")),
+			"aggregateRegexRules":       parseJSONStringArray(database.GetSetting("magic_aggregate_regex_rules")),
 			"smartSourcePriorityTokens": smartSourcePriorityTokens,
 			"smartPanMatchTokens":       smartPanMatchTokens,
 			"smartPanExtractMode":       smartPanExtractMode,
@@ -778,6 +881,7 @@ func handleDashboardMagicSettings(w http.ResponseWriter, r *http.Request, databa
 	case http.MethodPost:
 		var body map[string]any
 		_ = readJSONLoose(r, &body)
+		before := auditSettings(database, magicSettingKeys...)
 
 		episodeCleanRegex, _ := body["episodeCleanRegex"].(string)
 
@@ -865,6 +969,7 @@ func handleDashboardMagicSettings(w http.ResponseWriter, r *http.Request, databa
 			saveStrArrSetting(database, "magic_aggregate_rules", legacy)
 		}
 		_ = migrateMagicAggregateKeywordRulesToRegex(database)
+		auditNoteDiff(r, "", before, auditSettings(database, magicSettingKeys...))
 
 		outClean := parseJSONStringArray(database.GetSetting("magic_episode_clean_regex_rules"))
 		outEpisodeClean := ""
@@ -878,13 +983,13 @@ func handleDashboardMagicSettings(w http.ResponseWriter, r *http.Request, databa
 			smartPanExtractMode = "rule-first"
 		}
 		writeJSON(w, 200, map[string]any{
-			"success":                true,
-			"episodeCleanRegex":      outEpisodeClean,
-			"episodeCleanRegexRules": outClean,
-			"episodeRules":           parseJSONStringArray(database.GetSetting("magic_episode_rules")),
-			"movieRules":             parseJSONStringArray(database.GetSetting("magic_movie_rules")),
-			"aggregateRules":         parseJSONStringArray(database.GetSetting("magic_aggregate_rules")),
-			"aggregateRegexRules":    parseJSONStringArray(database.GetSetting("magic_aggregate_regex_rules")),
+			"success":                   true,
+			"episodeCleanRegex":         outEpisodeClean,
+			"episodeCleanRegexRules":    outClean,
+			"episodeRules":              parseJSONStringArray(database.GetSetting("magic_episode_rules")),
+			"movieRules":                parseJSONStringArray(database.GetSetting("magic_movie_rules")),
+			"aggregateRules":            parseJSONStringArray(database.GetSetting("magic_aggregate_rules")),
+			"aggregateRegexRules":       parseJSONStringArray(database.GetSetting("magic_aggregate_regex_rules")),
 			"smartSourcePriorityTokens": smartSourcePriorityTokens,
 			"smartPanMatchTokens":       smartPanMatchTokens,
 			"smartPanExtractMode":       smartPanExtractMode,
@@ -918,78 +1023,79 @@ func normalizeSmartCommaTokens(input string) []string {
 	return out
 }
 
-func handleDashboardUserList(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardUserList(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
-	rows, err := database.SQL().Query(`
-		SELECT username, role, status, cat_api_base, cat_proxy
-		FROM users
-		ORDER BY CASE WHEN role = 'admin' THEN 0 ELSE 1 END, username
-	`)
+	list, err := st.Users.List()
 	if err != nil {
 		writeJSON(w, 200, map[string]any{"success": true, "users": []any{}})
 		return
 	}
-	defer rows.Close()
 	users := []map[string]any{}
-	for rows.Next() {
-		var username, role, status, catAPIBase, catProxy string
-		_ = rows.Scan(&username, &role, &status, &catAPIBase, &catProxy)
+	for _, u := range list {
 		users = append(users, map[string]any{
-			"username":     username,
-			"role":         role,
-			"status":       status,
-			"cat_api_base": catAPIBase,
-			"cat_proxy":    catProxy,
+			"username":           u.Username,
+			"displayName":        u.DisplayName,
+			"role":               u.Role,
+			"status":             u.Status,
+			"cat_api_base":       u.CatAPIBase,
+			"cat_proxy":          u.CatProxy,
+			"mustChangePassword": u.MustChangePassword,
 		})
 	}
 	writeJSON(w, 200, map[string]any{"success": true, "users": users, "userCount": len(users)})
 }
 
-func handleDashboardUserAdd(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardUserAdd(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
 	}
 	parseForm(r)
 	username := strings.TrimSpace(r.FormValue("username"))
-	password := strings.TrimSpace(r.FormValue("password"))
-	roleRaw := strings.TrimSpace(r.FormValue("role"))
-	role := "user"
-	if roleRaw == "shared" {
-		role = "shared"
-	}
+	pw := strings.TrimSpace(r.FormValue("password"))
+	role := defaultString(strings.TrimSpace(r.FormValue("role")), "user")
 	catAPIBase := strings.TrimSpace(r.FormValue("catApiBase"))
 	catProxy := strings.TrimSpace(r.FormValue("catProxy"))
 
-	if username == "" || password == "" {
+	if username == "" || pw == "" {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "添加用户失败，可能是用户名已存在或参数无效"})
 		return
 	}
+	if _, msg := assignableRole(authMw, auth.CurrentUser(r), role); msg != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": msg})
+		return
+	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err := passwordPolicy(database).Check(username, pw); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": err.Error()})
+		return
+	}
+	hashed, err := password.Hash(pw)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "添加用户失败，可能是用户名已存在或参数无效"})
 		return
 	}
-	_, err = database.SQL().Exec(
-		`INSERT INTO users(username, password, role, status, cat_api_base, cat_proxy) VALUES (?, ?, ?, 'active', ?, ?)`,
-		username,
-		string(hashed),
-		role,
-		catAPIBase,
-		catProxy,
-	)
-	if err != nil {
+	u := store.User{
+		Username:           username,
+		PasswordHash:       hashed,
+		Role:               role,
+		Status:             "active",
+		CatAPIBase:         catAPIBase,
+		CatProxy:           catProxy,
+		MustChangePassword: boolFromForm(r.FormValue("mustChangePassword")),
+	}
+	if _, err := st.Users.Create(u); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "添加用户失败，可能是用户名已存在或参数无效"})
 		return
 	}
+	auditNote(r, username, nil, auditUser(u))
 	writeJSON(w, 200, map[string]any{"success": true})
 }
 
-func handleDashboardUserBan(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardUserBan(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1000,29 +1106,28 @@ func handleDashboardUserBan(w http.ResponseWriter, r *http.Request, database *db
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名不能为空"})
 		return
 	}
-	var role, status string
-	if err := database.SQL().QueryRow(`SELECT role, status FROM users WHERE username = ? LIMIT 1`, username).Scan(&role, &status); err != nil {
+	u, err := st.Users.ByUsername(username)
+	if err != nil || authMw.FullAccess(u.Role) {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "操作失败"})
 		return
 	}
-	if role == "admin" {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "操作失败"})
+	if !canManageUser(authMw, auth.CurrentUser(r), u) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
 		return
 	}
 	next := "active"
-	if status == "active" {
+	if u.Status == "active" || u.Status == statusPending {
 		next = "banned"
 	}
-	res, _ := database.SQL().Exec(`UPDATE users SET status = ? WHERE username = ? AND role <> 'admin'`, next, username)
-	changed, _ := res.RowsAffected()
-	if changed <= 0 {
+	if err := st.Users.Update(u.ID, store.UserPatch{Status: &next}); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "操作失败"})
 		return
 	}
+	auditNote(r, u.Username, map[string]any{"status": u.Status}, map[string]any{"status": next})
 	writeJSON(w, 200, map[string]any{"success": true, "status": next})
 }
 
-func handleDashboardUserDelete(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardUserDelete(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1033,54 +1138,34 @@ func handleDashboardUserDelete(w http.ResponseWriter, r *http.Request, database
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名不能为空"})
 		return
 	}
-	var id int64
-	var role string
-	if err := database.SQL().QueryRow(`SELECT id, role FROM users WHERE username = ? LIMIT 1`, username).Scan(&id, &role); err != nil {
+	u, err := st.Users.ByUsername(username)
+	if err != nil || authMw.FullAccess(u.Role) {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "删除失败"})
 		return
 	}
-	if role == "admin" {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "删除失败"})
+	if !canManageUser(authMw, auth.CurrentUser(r), u) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
 		return
 	}
-
-	tx, err := database.SQL().Begin()
+	deleted, err := st.Users.Delete(u.ID)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "删除失败"})
 		return
 	}
-	defer func() { _ = tx.Rollback() }()
-
-	tokens, _ := tx.Exec(`DELETE FROM auth_tokens WHERE user_id = ?`, id)
-	history, _ := tx.Exec(`DELETE FROM search_history WHERE user_id = ?`, id)
-	playHistory, _ := tx.Exec(`DELETE FROM play_history WHERE user_id = ?`, id)
-	favorites, _ := tx.Exec(`DELETE FROM favorites WHERE user_id = ?`, id)
-	userRes, _ := tx.Exec(`DELETE FROM users WHERE id = ? AND role <> 'admin'`, id)
-
-	userDeleted, _ := userRes.RowsAffected()
-	if userDeleted <= 0 {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "删除失败"})
-		return
-	}
-	_ = tx.Commit()
-
-	tokenDeleted, _ := tokens.RowsAffected()
-	historyDeleted, _ := history.RowsAffected()
-	playHistoryDeleted, _ := playHistory.RowsAffected()
-	favoritesDeleted, _ := favorites.RowsAffected()
+	auditNote(r, u.Username, auditUser(u), nil)
 	writeJSON(w, 200, map[string]any{
 		"success": true,
 		"deleted": map[string]any{
-			"tokenDeleted":       tokenDeleted,
-			"historyDeleted":     historyDeleted,
-			"playHistoryDeleted": playHistoryDeleted,
-			"favoritesDeleted":   favoritesDeleted,
-			"userDeleted":        userDeleted,
+			"tokenDeleted":       deleted.Tokens,
+			"historyDeleted":     deleted.SearchHistory,
+			"playHistoryDeleted": deleted.PlayHistory,
+			"favoritesDeleted":   deleted.Favorites,
+			"userDeleted":        1,
 		},
 	})
 }
 
-func handleDashboardUserUpdate(w http.ResponseWriter, r *http.Request, database *db.DB) {
+func handleDashboardUserUpdate(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w)
 		return
@@ -1105,94 +1190,100 @@ func handleDashboardUserUpdate(w http.ResponseWriter, r *http.Request, database
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名不能为空"})
 		return
 	}
-	if newUsername == "" && newPassword == "" && roleRaw == "" && !hasCatAPIBase && !hasCatProxy {
+	_, hasMustChange := r.PostForm["mustChangePassword"]
+	if newUsername == "" && newPassword == "" && roleRaw == "" && !hasCatAPIBase && !hasCatProxy && !hasMustChange {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "未提供修改内容"})
 		return
 	}
 
-	var id int64
-	if err := database.SQL().QueryRow(`SELECT id FROM users WHERE username = ? LIMIT 1`, username).Scan(&id); err != nil {
-		if err == sql.ErrNoRows {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
-			return
-		}
+	cur, err := st.Users.ByUsername(username)
+	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
 		return
 	}
-
-	var curUsername, curRole string
-	if err := database.SQL().QueryRow(`SELECT username, role FROM users WHERE id = ? LIMIT 1`, id).Scan(&curUsername, &curRole); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
+	actor := auth.CurrentUser(r)
+	if !canManageUser(authMw, actor, cur) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
 		return
 	}
+	auditNote(r, cur.Username, auditUser(cur), nil)
+	id := cur.ID
 
-	finalUsername := curUsername
-	finalRole := curRole
-	if newUsername != "" && newUsername != finalUsername {
-		if _, err := database.SQL().Exec(`UPDATE users SET username = ? WHERE id = ?`, newUsername, id); err != nil {
+	// Everything is checked before the single write below, so a rejected
+	// request leaves the user as it was.
+	patch := store.UserPatch{}
+	finalUsername := cur.Username
+	if newUsername != "" && newUsername != cur.Username {
+		if _, err := st.Users.ByUsername(newUsername); err == nil {
 			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名已存在或不合法"})
 			return
 		}
+		patch.Username = &newUsername
 		finalUsername = newUsername
 	}
 
-	if newPassword != "" {
-		hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), 10)
-		if err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "修改失败"})
+	if roleRaw != "" {
+		if authMw.FullAccess(cur.Role) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "管理员角色不可修改"})
 			return
 		}
-		res, _ := database.SQL().Exec(`UPDATE users SET password = ? WHERE id = ?`, string(hashed), id)
-		changed, _ := res.RowsAffected()
-		if changed <= 0 {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "修改失败"})
+		if _, msg := assignableRole(authMw, actor, roleRaw); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": msg})
 			return
 		}
+		patch.Role = &roleRaw
 	}
 
-	if roleRaw != "" {
-		if finalRole == "admin" {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "管理员角色不可修改"})
-			return
-		}
-		nextRole := ""
-		if roleRaw == "shared" {
-			nextRole = "shared"
-		} else if roleRaw == "user" {
-			nextRole = "user"
-		}
-		if nextRole == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "角色无效"})
+	if newPassword != "" {
+		if err := passwordPolicy(database).Check(finalUsername, newPassword); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": err.Error()})
 			return
 		}
-		res, _ := database.SQL().Exec(`UPDATE users SET role = ? WHERE id = ?`, nextRole, id)
-		changed, _ := res.RowsAffected()
-		if changed <= 0 {
+		hash, err := password.Hash(newPassword)
+		if err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "修改失败"})
 			return
 		}
-		finalRole = nextRole
+		patch.PasswordHash = &hash
 	}
 
+	if hasMustChange {
+		mustChange := boolFromForm(r.FormValue("mustChangePassword"))
+		patch.MustChangePassword = &mustChange
+	}
 	if hasCatAPIBase {
-		_, _ = database.SQL().Exec(`UPDATE users SET cat_api_base = ? WHERE id = ?`, catAPIBase, id)
+		patch.CatAPIBase = &catAPIBase
 	}
 	if hasCatProxy {
-		_, _ = database.SQL().Exec(`UPDATE users SET cat_proxy = ? WHERE id = ?`, catProxy, id)
+		patch.CatProxy = &catProxy
+	}
+	if err := st.Users.Update(id, patch); err != nil {
+		msg := "修改失败"
+		if errors.Is(err, store.ErrConflict) {
+			msg = "用户名已存在或不合法"
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": msg})
+		return
+	}
+	if roleRaw != "" || hasCatAPIBase {
+		database.NotifyUserSitesChanged(id)
 	}
 
-	var rowRole, rowCatBase, rowCatProxy string
-	_ = database.SQL().QueryRow(`SELECT role, cat_api_base, cat_proxy FROM users WHERE id = ? LIMIT 1`, id).Scan(&rowRole, &rowCatBase, &rowCatProxy)
-	if strings.TrimSpace(rowRole) != "" {
-		finalRole = rowRole
+	row, err := st.Users.ByID(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
 	}
+	after := auditUser(row)
+	after["passwordChanged"] = newPassword != ""
+	auditNote(r, cur.Username, auditUser(cur), after)
 
 	writeJSON(w, 200, map[string]any{
 		"success":    true,
-		"username":   finalUsername,
-		"role":       defaultString(finalRole, "user"),
-		"catApiBase": rowCatBase,
-		"catProxy":   rowCatProxy,
+		"username":   row.Username,
+		"role":       defaultString(row.Role, "user"),
+		"catApiBase": row.CatAPIBase,
+		"catProxy":   row.CatProxy,
 	})
 }
 
@@ -1249,14 +1340,3 @@ func normalizePansAny(list any) []map[string]any {
 	}
 	return out
 }
-
-func mergeVideoSourceSites(database *db.DB) []map[string]any {
-	sites := normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
-	statusMap := parseJSONBoolMap(database.GetSetting("video_source_site_status"))
-	homeMap := parseJSONBoolMap(database.GetSetting("video_source_site_home"))
-	searchMap := parseJSONBoolMap(database.GetSetting("video_source_site_search"))
-	order := parseJSONStringArray(database.GetSetting("video_source_site_order"))
-	availability := parseJSONMap(database.GetSetting("video_source_site_availability"))
-	errorMap := parseJSONStringMap(database.GetSetting("video_source_site_error"))
-	return mergeSitesWithState(sites, statusMap, homeMap, order, availability, searchMap, errorMap)
-}
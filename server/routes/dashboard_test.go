@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// openTestDB opens a fresh database in a temporary directory.
+func openTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	return openTestDBWithKey(t, nil)
+}
+
+// openTestDBWithKey is openTestDB with master as MEOWFILM_MASTER_KEY (none
+// when nil).
+func openTestDBWithKey(t *testing.T, master []byte) *db.DB {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("MEOWFILM_DATA_DIR", dir)
+	t.Setenv("MEOWFILM_DB_FILE", filepath.Join(dir, "data.db"))
+	t.Setenv("MEOWFILM_MASTER_KEY", "")
+	t.Setenv("MEOWFILM_MASTER_KEY_FILE", "")
+	if master != nil {
+		t.Setenv("MEOWFILM_MASTER_KEY", base64.StdEncoding.EncodeToString(master))
+	}
+	database, err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+func TestDashboardUserUpdateIsAllOrNothing(t *testing.T) {
+	database := openTestDB(t)
+	st, authMw, _, cookies := signedIn(t, "root", "Root-pass-1", "admin")
+	bob := store.User{Username: "bob", PasswordHash: "old-hash", Role: "user", Status: "active"}
+	bob.ID, _ = st.Users.Create(bob)
+	_, _ = st.Users.Create(store.User{Username: "taken", Role: "user", Status: "active"})
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleDashboardUserUpdate(w, r, database, st, authMw)
+	}))
+
+	tests := []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"weak password", url.Values{"newUsername": {"bobby"}, "newPassword": {"1"}, "catProxy": {"http://p"}}, http.StatusBadRequest},
+		{"unknown role", url.Values{"newUsername": {"bobby"}, "newPassword": {"Bob-pass-12"}, "role": {"nope"}}, http.StatusBadRequest},
+		{"admin role", url.Values{"newUsername": {"bobby"}, "role": {"admin"}}, http.StatusBadRequest},
+		{"name taken", url.Values{"newUsername": {"taken"}, "newPassword": {"Bob-pass-12"}, "role": {"shared"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("username", "bob")
+			if rec := postForm(h, "/dashboard/user/update", cookies, tt.form); rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			got, err := st.Users.ByID(bob.ID)
+			if err != nil || got.Username != "bob" || got.PasswordHash != "old-hash" || got.Role != "user" || got.CatProxy != "" {
+				t.Errorf("user changed by a rejected request: %+v, %v", got, err)
+			}
+		})
+	}
+
+	form := url.Values{"username": {"bob"}, "newUsername": {"bobby"}, "newPassword": {"Bob-pass-12"}, "role": {"shared"}, "catProxy": {"http://p"}}
+	if rec := postForm(h, "/dashboard/user/update", cookies, form); rec.Code != http.StatusOK {
+		t.Fatalf("valid update: status %d: %s", rec.Code, rec.Body)
+	}
+	got, _ := st.Users.ByID(bob.ID)
+	if got.Username != "bobby" || got.PasswordHash == "old-hash" || got.Role != "shared" || got.CatProxy != "http://p" {
+		t.Errorf("after update: %+v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+const eventsKeepAlive = 25 * time.Second
+
+// handleAPIEvents streams change notifications as Server-Sent Events:
+//
+//	event: settings  data: {"version":N,"key":"..."}  a global setting changed
+//	event: sites     data: {"version":N}              the caller's site list changed
+//
+// The first event is "ready" carrying the current settings version, so a
+// reconnecting client can tell whether it missed anything.
+func handleAPIEvents(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	if u == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "Unauthorized"})
+		return
+	}
+
+	changes, cancel := database.Subscribe()
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !writeEvent(w, rc, "ready", map[string]any{"version": database.SettingsVersion()}) {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			if !writeChangeEvent(w, rc, st, u, c) {
+				return
+			}
+		}
+	}
+}
+
+func writeChangeEvent(w http.ResponseWriter, rc *http.ResponseController, st *store.Store, u *auth.User, c db.Change) bool {
+	switch c.Kind {
+	case db.ChangeSettings:
+		if !writeEvent(w, rc, "settings", map[string]any{"version": c.Version, "key": c.Key}) {
+			return false
+		}
+		// Users of the shared site list without their own CatPawOpen browse
+		// it directly, so a change there is a change to their sites too.
+		if (c.Key == "sites" || c.Key == "") && u.Can(auth.PermUseSharedSites) {
+			if hasUserAPI, err := userHasCatAPIBase(st, u); err == nil && !hasUserAPI {
+				return writeEvent(w, rc, "sites", map[string]any{"version": c.Version})
+			}
+		}
+		return true
+	case db.ChangeUserSites:
+		if c.UserID != u.ID {
+			return true
+		}
+		return writeEvent(w, rc, "sites", map[string]any{"version": c.Version})
+	default:
+		return true
+	}
+}
+
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, name string, data any) bool {
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, marshalJSON(data)); err != nil {
+		return false
+	}
+	return rc.Flush() == nil
+}
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestEventsSitesOnlyReachOwner(t *testing.T) {
+	database := openTestDB(t)
+	st := store.NewSQLite(database)
+	authMw := auth.New(st, auth.Options{})
+	srv := httptest.NewServer(authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIEvents(w, r, database, st)
+	})))
+	t.Cleanup(srv.Close)
+
+	// stream signs username in and returns the names of the events it
+	// receives, once the subscription is live.
+	stream := func(username string) (int64, <-chan string) {
+		t.Helper()
+		id, err := st.Users.Create(store.User{Username: username, Role: "user", Status: "active"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := authMw.StartSession(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), id, false); err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		events := make(chan string, 8)
+		go func() {
+			defer close(events)
+			sc := bufio.NewScanner(resp.Body)
+			for sc.Scan() {
+				if name, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+					events <- name
+				}
+			}
+		}()
+		if got := <-events; got != "ready" {
+			t.Fatalf("%s: first event %q, want ready", username, got)
+		}
+		return id, events
+	}
+	aliceID, alice := stream("alice")
+	_, bob := stream("bob")
+
+	database.NotifyUserSitesChanged(aliceID)
+	// A settings change follows so each stream has something to read.
+	if err := database.SetSetting("site_name", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{<-alice, <-alice}; got[0] != "sites" || got[1] != "settings" {
+		t.Errorf("alice got %v, want [sites settings]", got)
+	}
+	if got := <-bob; got != "settings" {
+		t.Errorf("bob got %q before settings; another user's sites events leaked", got)
+	}
+}
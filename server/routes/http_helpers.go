@@ -54,3 +54,24 @@ func boolFromForm(v string) bool {
 	s := strings.ToLower(strings.TrimSpace(v))
 	return s == "1" || s == "true" || s == "on" || s == "yes"
 }
+
+// formFields reads the named fields from a form body or, for JSON requests,
+// from a flat JSON object with string values.
+func formFields(r *http.Request, names ...string) map[string]string {
+	out := map[string]string{}
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var body map[string]any
+		_ = readJSONLoose(r, &body)
+		for _, n := range names {
+			if v, ok := body[n].(string); ok {
+				out[n] = v
+			}
+		}
+		return out
+	}
+	parseForm(r)
+	for _, n := range names {
+		out[n] = r.FormValue(n)
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func loginPolicyJSON(p auth.LoginPolicy) map[string]any {
+	return map[string]any{
+		"maxFailures":    p.MaxFailures,
+		"ipMaxFailures":  p.IPMaxFailures,
+		"lockoutMinutes": int(p.Lockout / time.Minute),
+		"backoffSeconds": int(p.BackoffBase / time.Second),
+	}
+}
+
+// handleDashboardLoginLockouts lists usernames, client IPs and profiles with
+// recent failed logins or PIN entries; locked ones carry a non-zero
+// lockedUntil.
+func handleDashboardLoginLockouts(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	list, err := st.LoginFailures.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	lockedOnly := r.URL.Query().Get("locked") == "1"
+	now := time.Now().UnixMilli()
+	out := []map[string]any{}
+	for _, f := range list {
+		locked := f.LockedUntil > now
+		if lockedOnly && !locked {
+			continue
+		}
+		lockedUntil := int64(0)
+		if locked {
+			lockedUntil = f.LockedUntil
+		}
+		out = append(out, map[string]any{
+			"scope":         f.Scope,
+			"key":           f.Key,
+			"failures":      f.Failures,
+			"lastFailureAt": f.LastFailureAt,
+			"lockedUntil":   lockedUntil,
+			"locked":        locked,
+		})
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "entries": out})
+}
+
+// handleDashboardLoginUnlock clears the failures of one username or IP.
+func handleDashboardLoginUnlock(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	scope := strings.TrimSpace(r.FormValue("scope"))
+	key := strings.TrimSpace(r.FormValue("key"))
+	if scope != store.LoginScopeUser && scope != store.LoginScopeIP && scope != store.LoginScopeProfile {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "类型必须是 user、ip 或 profile"})
+		return
+	}
+	if scope == store.LoginScopeUser {
+		key = strings.ToLower(key)
+	}
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "缺少解锁对象"})
+		return
+	}
+	if err := st.LoginFailures.Delete(scope, key); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "解锁失败"})
+		return
+	}
+	auditNote(r, scope+":"+key, nil, nil)
+	writeJSON(w, 200, map[string]any{"success": true})
+}
+
+func handleDashboardLoginSettings(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{"success": true, "policy": loginPolicyJSON(auth.LoadLoginPolicy(st.Settings))})
+	case http.MethodPost:
+		parseForm(r)
+		fields := []struct {
+			form, key, label string
+			max              int
+		}{
+			{"maxFailures", "login_max_failures", "账号失败次数上限", 1000},
+			{"ipMaxFailures", "login_ip_max_failures", "IP 失败次数上限", 10000},
+			{"lockoutMinutes", "login_lockout_minutes", "锁定时长（分钟）", 7 * 24 * 60},
+			{"backoffSeconds", "login_backoff_seconds", "退避基数（秒）", 600},
+		}
+		values := map[string]int{}
+		for _, f := range fields {
+			raw := strings.TrimSpace(r.FormValue(f.form))
+			if raw == "" {
+				continue
+			}
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 || n > f.max {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": f.label + "必须是 0-" + strconv.Itoa(f.max) + " 的整数"})
+				return
+			}
+			values[f.key] = n
+		}
+		keys := make([]string, 0, len(fields))
+		for _, f := range fields {
+			keys = append(keys, f.key)
+		}
+		before := auditSettings(database, keys...)
+		for _, f := range fields {
+			if n, ok := values[f.key]; ok {
+				_ = database.SetSetting(f.key, strconv.Itoa(n))
+			}
+		}
+		auditNoteDiff(r, "", before, auditSettings(database, keys...))
+		writeJSON(w, 200, map[string]any{"success": true, "policy": loginPolicyJSON(auth.LoadLoginPolicy(st.Settings))})
+	default:
+		methodNotAllowed(w)
+	}
+}
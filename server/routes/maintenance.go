@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/maintenance"
+)
+
+// ExpireQRSessions drops pan QR login sessions that have expired and returns
+// how many were removed.
+func ExpireQRSessions(now time.Time) int {
+	sessions := []*sync.Map{&baiduQRSessions, &quarkQRSessions, &ucQRSessions, &pan115QRSessions, &biliQRSessions}
+	count := func() int {
+		n := 0
+		for _, m := range sessions {
+			m.Range(func(_, _ any) bool {
+				n++
+				return true
+			})
+		}
+		return n
+	}
+	before := count()
+	cleanupBaiduQRSessions(now)
+	cleanupQuarkQRSessions(now)
+	cleanupUCQRSessions(now)
+	cleanup115QRSessions(now)
+	cleanupBiliQRSessions(now)
+	return maxInt(0, before-count())
+}
+
+func handleDashboardMaintenanceSettings(w http.ResponseWriter, r *http.Request, database *db.DB, jan *maintenance.Janitor) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{
+			"success":    true,
+			"vacuumDays": db.ParseIntDefault(database.GetSetting("maintenance_vacuum_days"), 0),
+			"tasks":      jan.Status(),
+		})
+	case http.MethodPost:
+		parseForm(r)
+		days, err := strconv.Atoi(strings.TrimSpace(r.FormValue("vacuumDays")))
+		if err != nil || days < 0 || days > 365 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "VACUUM 间隔必须是 0-365 的整数（0 表示关闭）"})
+			return
+		}
+		before := auditSettings(database, "maintenance_vacuum_days")
+		_ = database.SetSetting("maintenance_vacuum_days", strconv.Itoa(days))
+		auditNoteDiff(r, "", before, auditSettings(database, "maintenance_vacuum_days"))
+		writeJSON(w, 200, map[string]any{"success": true, "vacuumDays": days})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func handleDashboardMaintenanceRun(w http.ResponseWriter, r *http.Request, jan *maintenance.Janitor) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	task := strings.TrimSpace(r.FormValue("task"))
+	status, err := jan.RunNow(task)
+	if errors.Is(err, maintenance.ErrUnknownTask) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "任务不存在"})
+		return
+	}
+	auditNote(r, task, nil, status)
+	if status.Error != "" {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "任务执行失败", "task": status})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "task": status})
+}
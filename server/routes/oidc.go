@@ -0,0 +1,401 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/oidc"
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+const (
+	oidcStateCookie = "meowfilm_oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+var (
+	oidcClient = oidc.NewClient()
+	// oidcStates maps a login's state parameter to its *oidcPending.
+	oidcStates sync.Map
+)
+
+type oidcPending struct {
+	req         oidc.AuthRequest
+	redirectURL string
+	remember    bool
+	expiresAt   time.Time
+}
+
+// oidcSettings is the "oidc_settings" setting. The client secret is stored
+// sealed like other credentials.
+type oidcSettings struct {
+	Enabled      bool     `json:"enabled"`
+	DisplayName  string   `json:"displayName"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"` // empty: derived from the request
+	Scopes       []string `json:"scopes"`
+	// UsernameClaim names new users; preferred_username by default.
+	UsernameClaim string `json:"usernameClaim"`
+	// RoleClaim values are looked up in RoleMapping; the most privileged
+	// match wins, then DefaultRole. No role means the login is refused.
+	RoleClaim     string            `json:"roleClaim"`
+	RoleMapping   map[string]string `json:"roleMapping"`
+	DefaultRole   string            `json:"defaultRole"`
+	AutoProvision bool              `json:"autoProvision"`
+	// LinkByUsername lets a first SSO login take over the local user with
+	// the same name.
+	LinkByUsername bool `json:"linkByUsername"`
+	// TrustIdPMFA skips the local second factor for SSO logins, for
+	// providers that already enforce their own.
+	TrustIdPMFA bool `json:"trustIdpMfa"`
+}
+
+// loadOIDCSettings reads the settings and decrypts the client secret. When
+// the secret cannot be decrypted the rest of the settings are still returned,
+// with an empty secret, alongside the error.
+func loadOIDCSettings(database *db.DB) (oidcSettings, error) {
+	var s oidcSettings
+	_ = json.Unmarshal([]byte(database.GetSetting("oidc_settings")), &s)
+	if s.UsernameClaim == "" {
+		s.UsernameClaim = "preferred_username"
+	}
+	if len(s.Scopes) == 0 {
+		s.Scopes = []string{"openid", "profile", "email"}
+	}
+	secret, err := database.OpenSecret(s.ClientSecret)
+	if err != nil {
+		s.ClientSecret = ""
+		return s, fmt.Errorf("oidc client secret: %w", err)
+	}
+	s.ClientSecret = secret
+	return s, nil
+}
+
+func saveOIDCSettings(database *db.DB, s oidcSettings) error {
+	secret, err := database.SealSecret(s.ClientSecret)
+	if err != nil {
+		return err
+	}
+	s.ClientSecret = secret
+	return database.SetSetting("oidc_settings", marshalJSON(s))
+}
+
+func (s oidcSettings) ready() bool {
+	return s.Enabled && s.Issuer != "" && s.ClientID != ""
+}
+
+func (s oidcSettings) config(redirectURL string) oidc.Config {
+	return oidc.Config{
+		Issuer:       s.Issuer,
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       s.Scopes,
+	}
+}
+
+// role maps the claims onto a local role, or "" when the user has none.
+// Mapped roles that no longer exist are skipped.
+func (s oidcSettings) role(authMw *auth.Auth, claims oidc.Claims) string {
+	best := ""
+	if s.RoleClaim != "" {
+		for _, v := range claims.Strings(s.RoleClaim) {
+			if r := s.RoleMapping[v]; authMw.RoleRank(r) > authMw.RoleRank(best) {
+				best = r
+			}
+		}
+	}
+	if best == "" && authMw.RoleRank(s.DefaultRole) > 0 {
+		best = s.DefaultRole
+	}
+	return best
+}
+
+func oidcPublicJSON(database *db.DB) map[string]any {
+	// A secret that cannot be decrypted is reported by the login itself.
+	s, _ := loadOIDCSettings(database)
+	return map[string]any{"enabled": s.ready(), "displayName": defaultString(s.DisplayName, "单点登录")}
+}
+
+func oidcFail(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/?oidcError="+url.QueryEscape(msg), http.StatusFound)
+}
+
+// handleAPIOIDCLogin redirects to the identity provider.
+func handleAPIOIDCLogin(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	s, err := loadOIDCSettings(database)
+	if !s.ready() {
+		oidcFail(w, r, "未启用单点登录")
+		return
+	}
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		oidcFail(w, r, "单点登录配置无法解密，请联系管理员")
+		return
+	}
+	redirectURL := s.RedirectURL
+	if redirectURL == "" {
+		redirectURL = proxy.Scheme(r) + "://" + r.Host + "/api/oidc/callback"
+	}
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		oidcFail(w, r, "请求失败")
+		return
+	}
+	target, err := oidcClient.AuthURL(r.Context(), s.config(redirectURL), req)
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		oidcFail(w, r, "无法连接身份提供方")
+		return
+	}
+
+	now := time.Now()
+	oidcStates.Range(func(k, v any) bool {
+		if v.(*oidcPending).expiresAt.Before(now) {
+			oidcStates.Delete(k)
+		}
+		return true
+	})
+	oidcStates.Store(req.State, &oidcPending{req: req, redirectURL: redirectURL, remember: boolFromForm(r.URL.Query().Get("remember")), expiresAt: now.Add(oidcStateTTL)})
+	// The cookie binds the state to this browser, so a callback URL cannot be
+	// replayed into someone else's session.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    req.State,
+		Path:     "/api/oidc/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   proxy.IsHTTPS(r),
+		MaxAge:   int(oidcStateTTL.Seconds()),
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleAPIOIDCCallback finishes the login started by handleAPIOIDCLogin.
+func handleAPIOIDCCallback(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	q := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1, HttpOnly: true})
+	if e := q.Get("error"); e != "" {
+		oidcFail(w, r, "身份提供方拒绝登录："+e)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	v, ok := oidcStates.LoadAndDelete(state)
+	if err != nil || state == "" || c.Value != state || !ok || v.(*oidcPending).expiresAt.Before(time.Now()) {
+		oidcFail(w, r, "登录已过期，请重试")
+		return
+	}
+	pending := v.(*oidcPending)
+	s, err := loadOIDCSettings(database)
+	if !s.ready() {
+		oidcFail(w, r, "未启用单点登录")
+		return
+	}
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		oidcFail(w, r, "单点登录配置无法解密，请联系管理员")
+		return
+	}
+	claims, err := oidcClient.Exchange(r.Context(), s.config(pending.redirectURL), pending.req, q.Get("code"))
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		oidcFail(w, r, "身份验证失败")
+		return
+	}
+
+	user, msg := oidcUser(st, authMw, s, claims)
+	if msg != "" {
+		oidcFail(w, r, msg)
+		return
+	}
+	if user.Status != "active" {
+		oidcFail(w, r, "该账户已禁用")
+		return
+	}
+	if s.TrustIdPMFA {
+		if err := authMw.StartSession(w, r, user.ID, pending.remember); err != nil {
+			oidcFail(w, r, "请求失败")
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	res := authMw.SignIn(w, r, user, pending.remember)
+	switch {
+	case res.Message != "":
+		oidcFail(w, r, res.Message)
+	case res.TwoFactor != nil:
+		// The login page finishes the challenge through /api/login/2fa.
+		target := "/?twoFactorChallenge=" + url.QueryEscape(res.TwoFactor.ID)
+		if res.TwoFactor.Setup {
+			target += "&setupRequired=1"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	default:
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// oidcUser finds, links or provisions the local user for claims and keeps
+// their role in sync with the role claim. It returns a message when the
+// login must be refused.
+func oidcUser(st *store.Store, authMw *auth.Auth, s oidcSettings, claims oidc.Claims) (store.User, string) {
+	issuer, subject := strings.TrimRight(s.Issuer, "/"), claims.String("sub")
+	role := s.role(authMw, claims)
+	if role == "" {
+		return store.User{}, "该账号未被授权访问"
+	}
+	now := time.Now().UnixMilli()
+
+	if id, err := st.Identities.Get(issuer, subject); err == nil {
+		user, err := st.Users.ByID(id.UserID)
+		if err != nil {
+			return store.User{}, "请求失败"
+		}
+		_ = st.Identities.Touch(issuer, subject, now)
+		if err := syncOIDCRole(st, authMw, s, &user, role); err != nil {
+			return store.User{}, "请求失败"
+		}
+		return user, ""
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return store.User{}, "请求失败"
+	}
+
+	username := strings.TrimSpace(claims.String(s.UsernameClaim))
+	if username == "" {
+		return store.User{}, "身份提供方未返回用户名"
+	}
+	user, err := st.Users.ByUsername(username)
+	switch {
+	case err == nil && s.LinkByUsername:
+		if err := syncOIDCRole(st, authMw, s, &user, role); err != nil {
+			return store.User{}, "请求失败"
+		}
+	case err == nil:
+		return store.User{}, "用户名已存在，请联系管理员关联账号"
+	case !errors.Is(err, store.ErrNotFound):
+		return store.User{}, "请求失败"
+	case !s.AutoProvision:
+		return store.User{}, "账号未开通，请联系管理员"
+	default:
+		// Provisioned users have no password and can only sign in through SSO.
+		user = store.User{Username: username, Role: role, Status: "active"}
+		if user.ID, err = st.Users.Create(user); err != nil {
+			return store.User{}, "创建用户失败"
+		}
+	}
+	if err := st.Identities.Link(store.Identity{Issuer: issuer, Subject: subject, UserID: user.ID, CreatedAt: now, LastLoginAt: now}); err != nil {
+		return store.User{}, "请求失败"
+	}
+	return user, ""
+}
+
+// syncOIDCRole moves user to the role the claims map to when a role claim is
+// configured. The last active user with full access keeps their role, so a
+// group change at the provider cannot lock everyone out of the dashboard.
+func syncOIDCRole(st *store.Store, authMw *auth.Auth, s oidcSettings, user *store.User, role string) error {
+	if s.RoleClaim == "" || user.Role == role {
+		return nil
+	}
+	if !authMw.FullAccess(role) {
+		last, err := authMw.LastFullAccessUser(*user)
+		if err != nil || last {
+			return err
+		}
+	}
+	if err := st.Users.Update(user.ID, store.UserPatch{Role: &role}); err != nil {
+		return err
+	}
+	user.Role = role
+	return nil
+}
+
+func handleDashboardOIDCSettings(w http.ResponseWriter, r *http.Request, database *db.DB, authMw *auth.Auth) {
+	switch r.Method {
+	case http.MethodGet:
+		s, err := loadOIDCSettings(database)
+		hasSecret := s.ClientSecret != ""
+		s.ClientSecret = ""
+		resp := map[string]any{"success": true, "settings": s, "hasClientSecret": hasSecret, "roles": roleNames(authMw)}
+		if err != nil {
+			log.Printf("oidc: %v", err)
+			resp["message"] = "Client Secret 无法解密，请重新填写"
+		}
+		writeJSON(w, 200, resp)
+	case http.MethodPost:
+		var next oidcSettings
+		if err := readJSONLoose(r, &next); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		next.Issuer = strings.TrimRight(strings.TrimSpace(next.Issuer), "/")
+		next.ClientID = strings.TrimSpace(next.ClientID)
+		next.RedirectURL = strings.TrimSpace(next.RedirectURL)
+		next.UsernameClaim = strings.TrimSpace(next.UsernameClaim)
+		next.RoleClaim = strings.TrimSpace(next.RoleClaim)
+		next.DisplayName = strings.TrimSpace(next.DisplayName)
+		if next.Enabled && (next.Issuer == "" || next.ClientID == "") {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "启用单点登录需要填写 Issuer 与 Client ID"})
+			return
+		}
+		for _, raw := range []string{next.Issuer, next.RedirectURL} {
+			if raw == "" {
+				continue
+			}
+			if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "地址格式无效"})
+				return
+			}
+		}
+		if next.DefaultRole != "" && authMw.RoleRank(next.DefaultRole) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "默认角色无效"})
+			return
+		}
+		for _, role := range next.RoleMapping {
+			if authMw.RoleRank(role) == 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "角色映射无效"})
+				return
+			}
+		}
+		prev, err := loadOIDCSettings(database)
+		if next.ClientSecret == "" {
+			if err != nil {
+				log.Printf("oidc: %v", err)
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "Client Secret 无法解密，请重新填写"})
+				return
+			}
+			next.ClientSecret = prev.ClientSecret
+		}
+		if err := saveOIDCSettings(database, next); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+			return
+		}
+		before, after := prev, next
+		before.ClientSecret, after.ClientSecret = "", auditSecretChange(prev.ClientSecret, next.ClientSecret)
+		auditNote(r, "", before, after)
+		writeJSON(w, 200, map[string]any{"success": true})
+	default:
+		methodNotAllowed(w)
+	}
+}
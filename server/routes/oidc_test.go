@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/oidc"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestOIDCSettingsSurviveKeyRotation(t *testing.T) {
+	database := openTestDBWithKey(t, bytes.Repeat([]byte{1}, 32))
+
+	want := oidcSettings{Enabled: true, Issuer: "https://idp.example", ClientID: "meowfilm", ClientSecret: "client-secret"}
+	if err := saveOIDCSettings(database, want); err != nil {
+		t.Fatal(err)
+	}
+	newKey := bytes.Repeat([]byte{2}, 32)
+	if err := database.RotateMasterKey(newKey); err != nil {
+		t.Fatalf("RotateMasterKey: %v", err)
+	}
+	got, err := loadOIDCSettings(database)
+	if err != nil || got.ClientSecret != want.ClientSecret || got.ClientID != want.ClientID {
+		t.Fatalf("after rotation: %+v, %v", got, err)
+	}
+
+	// A secret sealed under a data key that is gone is an error, not an
+	// empty secret.
+	if err := database.SetSetting("oidc_settings", `{"enabled":true,"issuer":"https://idp.example","clientId":"meowfilm","clientSecret":"enc:v1:999:AAAA"}`); err != nil {
+		t.Fatal(err)
+	}
+	got, err = loadOIDCSettings(database)
+	if err == nil {
+		t.Fatal("loadOIDCSettings hid an undecryptable secret")
+	}
+	if got.ClientID != "meowfilm" || got.ClientSecret != "" {
+		t.Errorf("settings with the error: %+v", got)
+	}
+}
+
+func TestOIDCRoleClaimKeepsLastAdmin(t *testing.T) {
+	s := oidcSettings{
+		Issuer:         "https://idp.example",
+		UsernameClaim:  "preferred_username",
+		RoleClaim:      "groups",
+		RoleMapping:    map[string]string{"staff": "user", "ops": "admin"},
+		LinkByUsername: true,
+	}
+	tests := []struct {
+		name string
+		// linked signs in through an existing identity rather than by
+		// username.
+		linked bool
+	}{
+		{"linked identity", true},
+		{"linked by username", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemory()
+			authMw := auth.New(st, auth.Options{})
+			root := store.User{Username: "root", Role: "admin", Status: "active"}
+			root.ID, _ = st.Users.Create(root)
+			if tt.linked {
+				_ = st.Identities.Link(store.Identity{Issuer: s.Issuer, Subject: "sub-root", UserID: root.ID})
+			}
+			claims := oidc.Claims{"sub": "sub-root", "preferred_username": "root", "groups": []any{"staff"}}
+
+			user, msg := oidcUser(st, authMw, s, claims)
+			if msg != "" || user.Role != "admin" {
+				t.Fatalf("only admin: role %q, message %q", user.Role, msg)
+			}
+			if got, _ := st.Users.ByID(root.ID); got.Role != "admin" {
+				t.Fatalf("the last admin was demoted to %q", got.Role)
+			}
+
+			// With another admin around the claim applies.
+			_, _ = st.Users.Create(store.User{Username: "second", Role: "admin", Status: "active"})
+			if user, msg = oidcUser(st, authMw, s, claims); msg != "" || user.Role != "user" {
+				t.Errorf("with another admin: role %q, message %q", user.Role, msg)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -328,6 +329,7 @@ func handleDashboard115QRStart(w http.ResponseWriter, r *http.Request, database
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	now := time.Now()
 	cleanup115QRSessions(now)
 
@@ -396,6 +398,7 @@ func handleDashboard115QRCookie(w http.ResponseWriter, r *http.Request, database
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	var body struct {
 		QID string `json:"qid"`
 	}
@@ -473,15 +476,19 @@ func handleDashboard115QRCookie(w http.ResponseWriter, r *http.Request, database
 	s.Cookie = cookie
 	s.LastStatus = "confirmed"
 
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+	}
 	cur, _ := store["115"].(map[string]any)
 	if cur == nil {
 		cur = map[string]any{}
 	}
+	before := auditPanState(cur)
 	cur["cookie"] = cookie
 	store["115"] = cur
-	b, _ := json.Marshal(store)
-	_ = database.SetSetting("pan_login_settings", string(b))
+	_ = database.SetPanLoginSettings(store)
+	auditNotePan(r, "115", before, cur)
 
 	writeJSON(w, 200, map[string]any{"success": true, "status": "confirmed", "cookie": cookie})
 }
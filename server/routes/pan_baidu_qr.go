@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -382,6 +383,7 @@ func handleDashboardBaiduQRStart(w http.ResponseWriter, r *http.Request, databas
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 
 	now := time.Now()
 	cleanupBaiduQRSessions(now)
@@ -460,6 +462,7 @@ func handleDashboardBaiduQRCookie(w http.ResponseWriter, r *http.Request, databa
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	var body struct {
 		QID string `json:"qid"`
 	}
@@ -515,15 +518,19 @@ func handleDashboardBaiduQRCookie(w http.ResponseWriter, r *http.Request, databa
 	s.Cookie = cookie
 
 	// Persist into pan_login_settings for admin to review/edit later.
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+	}
 	cur, _ := store["baidu"].(map[string]any)
 	if cur == nil {
 		cur = map[string]any{}
 	}
+	before := auditPanState(cur)
 	cur["cookie"] = cookie
 	store["baidu"] = cur
-	b, _ := json.Marshal(store)
-	_ = database.SetSetting("pan_login_settings", string(b))
+	_ = database.SetPanLoginSettings(store)
+	auditNotePan(r, "baidu", before, cur)
 
 	writeJSON(w, 200, map[string]any{"success": true, "status": "confirmed", "cookie": cookie})
 }
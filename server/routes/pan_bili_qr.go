@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
@@ -299,6 +300,7 @@ func handleDashboardBiliQRStart(w http.ResponseWriter, r *http.Request, database
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	now := time.Now()
 	cleanupBiliQRSessions(now)
 
@@ -374,6 +376,7 @@ func handleDashboardBiliQRCookie(w http.ResponseWriter, r *http.Request, databas
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	var body struct {
 		QID string `json:"qid"`
 	}
@@ -442,15 +445,19 @@ func handleDashboardBiliQRCookie(w http.ResponseWriter, r *http.Request, databas
 	}
 	s.Cookie = cookie
 
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+	}
 	cur, _ := store["bili"].(map[string]any)
 	if cur == nil {
 		cur = map[string]any{}
 	}
+	before := auditPanState(cur)
 	cur["cookie"] = cookie
 	store["bili"] = cur
-	b, _ := json.Marshal(store)
-	_ = database.SetSetting("pan_login_settings", string(b))
+	_ = database.SetPanLoginSettings(store)
+	auditNotePan(r, "bili", before, cur)
 
 	writeJSON(w, 200, map[string]any{"success": true, "status": "confirmed", "cookie": cookie})
 }
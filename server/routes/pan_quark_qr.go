@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -453,6 +454,7 @@ func handleDashboardQuarkQRStart(w http.ResponseWriter, r *http.Request, databas
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	now := time.Now()
 	cleanupQuarkQRSessions(now)
 
@@ -532,6 +534,7 @@ func handleDashboardQuarkQRCookie(w http.ResponseWriter, r *http.Request, databa
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	var body struct {
 		QID string `json:"qid"`
 	}
@@ -584,15 +587,19 @@ func handleDashboardQuarkQRCookie(w http.ResponseWriter, r *http.Request, databa
 	}
 	s.Cookie = cookie
 
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+	}
 	cur, _ := store["quark"].(map[string]any)
 	if cur == nil {
 		cur = map[string]any{}
 	}
+	before := auditPanState(cur)
 	cur["cookie"] = cookie
 	store["quark"] = cur
-	b, _ := json.Marshal(store)
-	_ = database.SetSetting("pan_login_settings", string(b))
+	_ = database.SetPanLoginSettings(store)
+	auditNotePan(r, "quark", before, cur)
 
 	writeJSON(w, 200, map[string]any{"success": true, "status": "confirmed", "cookie": cookie})
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -366,6 +367,7 @@ func handleDashboardUCQRStart(w http.ResponseWriter, r *http.Request, database *
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	now := time.Now()
 	cleanupUCQRSessions(now)
 
@@ -445,6 +447,7 @@ func handleDashboardUCQRCookie(w http.ResponseWriter, r *http.Request, database
 		methodNotAllowed(w)
 		return
 	}
+	auditSkip(r)
 	var body struct {
 		QID string `json:"qid"`
 	}
@@ -497,15 +500,19 @@ func handleDashboardUCQRCookie(w http.ResponseWriter, r *http.Request, database
 	}
 	s.Cookie = cookie
 
-	store := parseJSONMap(database.GetSetting("pan_login_settings"))
+	store, err := database.PanLoginSettings()
+	if err != nil {
+		log.Printf("pan settings: %v", err)
+	}
 	cur, _ := store["uc"].(map[string]any)
 	if cur == nil {
 		cur = map[string]any{}
 	}
+	before := auditPanState(cur)
 	cur["cookie"] = cookie
 	store["uc"] = cur
-	b, _ := json.Marshal(store)
-	_ = database.SetSetting("pan_login_settings", string(b))
+	_ = database.SetPanLoginSettings(store)
+	auditNotePan(r, "uc", before, cur)
 
 	writeJSON(w, 200, map[string]any{"success": true, "status": "confirmed", "cookie": cookie})
 }
@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// maxProfiles caps the profiles of one account, the default one included.
+const maxProfiles = 8
+
+const (
+	maxProfileNameLength   = 20
+	maxProfileAvatarLength = 512
+)
+
+var profilePINPattern = regexp.MustCompile(`^[0-9]{4,8}$`)
+
+// accountProfiles returns the user's profiles with the default profile
+// first. The default profile is named after the account until renamed.
+func accountProfiles(st *store.Store, u *auth.User) ([]store.Profile, error) {
+	list, err := st.Profiles.List(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 || list[0].ID != store.DefaultProfileID {
+		list = append([]store.Profile{{UserID: u.ID, ID: store.DefaultProfileID}}, list...)
+	}
+	if list[0].Name == "" {
+		list[0].Name = defaultString(u.DisplayName, u.Username)
+	}
+	return list, nil
+}
+
+func findProfile(list []store.Profile, id int64) (store.Profile, bool) {
+	for _, p := range list {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return store.Profile{}, false
+}
+
+func profileJSON(p store.Profile, active int64) map[string]any {
+	return map[string]any{
+		"id":      p.ID,
+		"name":    p.Name,
+		"avatar":  p.Avatar,
+		"hasPin":  p.PINHash != "",
+		"default": p.ID == store.DefaultProfileID,
+		"active":  p.ID == active,
+	}
+}
+
+func cleanProfileText(s string, maxLen int) (string, bool) {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) > maxLen {
+		return "", false
+	}
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// unlockProfile checks the PIN needed to act on p, writing the error
+// response when it is wrong. The active profile is already unlocked.
+func unlockProfile(w http.ResponseWriter, r *http.Request, authMw *auth.Auth, p store.Profile, pin string) bool {
+	if p.ID == auth.CurrentUser(r).ProfileID {
+		return true
+	}
+	ok, wait := authMw.CheckProfilePIN(p, strings.TrimSpace(pin))
+	if wait > 0 {
+		secs := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		writeJSON(w, http.StatusTooManyRequests, map[string]any{"success": false, "message": "PIN 错误次数过多，请 " + strconv.Itoa(secs) + " 秒后再试"})
+		return false
+	}
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "PIN 错误", "pinRequired": true})
+		return false
+	}
+	return true
+}
+
+// handleAPIProfiles lists the account's profiles, and creates a profile or
+// saves the name and avatar of one given by id. newPin sets the PIN and
+// clearPin removes it. Editing a profile other than the active one needs its
+// PIN.
+func handleAPIProfiles(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	u := auth.CurrentUser(r)
+	list, err := accountProfiles(st, u)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		out := []map[string]any{}
+		for _, p := range list {
+			out = append(out, profileJSON(p, u.ProfileID))
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "profiles": out, "activeProfileId": u.ProfileID})
+	case http.MethodPost:
+		f := formFields(r, "id", "name", "avatar", "pin", "newPin", "clearPin")
+		var p store.Profile
+		if strings.TrimSpace(f["id"]) == "" {
+			if len(list) >= maxProfiles {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "档案数量已达上限（" + strconv.Itoa(maxProfiles) + " 个）"})
+				return
+			}
+			p = store.Profile{UserID: u.ID, ID: -1, CreatedAt: time.Now().UnixMilli()}
+		} else {
+			id, err := strconv.ParseInt(strings.TrimSpace(f["id"]), 10, 64)
+			cur, ok := findProfile(list, id)
+			if err != nil || !ok {
+				writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "档案不存在"})
+				return
+			}
+			if !unlockProfile(w, r, authMw, cur, f["pin"]) {
+				return
+			}
+			p = cur
+			if p.CreatedAt == 0 {
+				p.CreatedAt = time.Now().UnixMilli()
+			}
+		}
+		name, ok := cleanProfileText(f["name"], maxProfileNameLength)
+		if !ok || name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "档案名称不能为空且不超过 20 个字符"})
+			return
+		}
+		avatar, ok := cleanProfileText(f["avatar"], maxProfileAvatarLength)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "头像无效"})
+			return
+		}
+		p.Name, p.Avatar = name, avatar
+		if pin := strings.TrimSpace(f["newPin"]); pin != "" {
+			if !profilePINPattern.MatchString(pin) {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "PIN 必须是 4-8 位数字"})
+				return
+			}
+			hash, err := password.Hash(pin)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+				return
+			}
+			p.PINHash = hash
+		} else if boolFromForm(f["clearPin"]) {
+			p.PINHash = ""
+		}
+		if p.ID < 0 {
+			p.ID, err = st.Profiles.Create(p)
+		} else {
+			err = st.Profiles.Put(p)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "profile": profileJSON(p, u.ProfileID)})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleAPIProfileDelete removes a profile with its history and favorites.
+// The default profile cannot be deleted.
+func handleAPIProfileDelete(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	f := formFields(r, "id", "pin")
+	id, err := strconv.ParseInt(strings.TrimSpace(f["id"]), 10, 64)
+	if err == nil && id == store.DefaultProfileID {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "默认档案不可删除"})
+		return
+	}
+	p, err := st.Profiles.Get(u.ID, id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "档案不存在"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if !unlockProfile(w, r, authMw, p, f["pin"]) {
+		return
+	}
+	if _, err := st.Profiles.Delete(u.ID, id); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "删除失败"})
+		return
+	}
+	active := u.ProfileID
+	if active == id {
+		active = store.DefaultProfileID
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "activeProfileId": active})
+}
+
+// handleAPIProfileSwitch moves the current session to another profile,
+// checking its PIN. Only sessions signed in with a password or SSO can
+// switch; access tokens always use the default profile.
+func handleAPIProfileSwitch(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	f := formFields(r, "id", "pin")
+	list, err := accountProfiles(st, u)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(f["id"]), 10, 64)
+	p, ok := findProfile(list, id)
+	if err != nil || !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "档案不存在"})
+		return
+	}
+	if !unlockProfile(w, r, authMw, p, f["pin"]) {
+		return
+	}
+	if err := authMw.SwitchProfile(r, p.ID); err != nil {
+		if errors.Is(err, auth.ErrNoSession) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "当前登录方式不支持切换档案"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "切换失败"})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "profile": profileJSON(p, p.ID)})
+}
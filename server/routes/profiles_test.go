@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestProfilesNeedPIN(t *testing.T) {
+	st, authMw, u, cookies := signedIn(t, "alice", "right-pass-1", "user")
+	_ = st.Settings.Set("login_max_failures", "3")
+	_ = st.Settings.Set("login_backoff_seconds", "0")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/profiles", func(w http.ResponseWriter, r *http.Request) { handleAPIProfiles(w, r, st, authMw) })
+	mux.HandleFunc("/api/profiles/delete", func(w http.ResponseWriter, r *http.Request) { handleAPIProfileDelete(w, r, st, authMw) })
+	mux.HandleFunc("/api/profiles/switch", func(w http.ResponseWriter, r *http.Request) { handleAPIProfileSwitch(w, r, st, authMw) })
+	h := authMw.Middleware(mux)
+
+	rec := postForm(h, "/api/profiles", cookies, url.Values{"name": {"Kid"}, "newPin": {"1234"}})
+	var created struct {
+		Profile struct {
+			ID int64 `json:"id"`
+		} `json:"profile"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || rec.Code != 200 {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	kid := strconv.FormatInt(created.Profile.ID, 10)
+
+	// Each refused attempt counts against the profile's PIN.
+	tests := []struct {
+		name   string
+		target string
+		form   url.Values
+	}{
+		{"edit without PIN", "/api/profiles", url.Values{"id": {kid}, "name": {"Renamed"}}},
+		{"switch with wrong PIN", "/api/profiles/switch", url.Values{"id": {kid}, "pin": {"0000"}}},
+		{"delete with wrong PIN", "/api/profiles/delete", url.Values{"id": {kid}, "pin": {"4321"}}},
+	}
+	for _, tt := range tests {
+		if rec := postForm(h, tt.target, cookies, tt.form); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403: %s", tt.name, rec.Code, rec.Body)
+		}
+	}
+	key := strconv.FormatInt(u.ID, 10) + ":" + kid
+	if f, err := st.LoginFailures.Get(store.LoginScopeProfile, key); err != nil || f.Failures != 3 {
+		t.Fatalf("profile failures = %+v, %v; want 3", f, err)
+	}
+	if rec := postForm(h, "/api/profiles/switch", cookies, url.Values{"id": {kid}, "pin": {"1234"}}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked switch: status %d, want 429", rec.Code)
+	}
+	if p, _ := st.Profiles.Get(u.ID, created.Profile.ID); p.Name != "Kid" {
+		t.Errorf("name = %q, a refused edit was saved", p.Name)
+	}
+
+	_ = st.LoginFailures.Delete(store.LoginScopeProfile, key)
+	if rec := postForm(h, "/api/profiles/switch", cookies, url.Values{"id": {kid}, "pin": {"1234"}}); rec.Code != 200 {
+		t.Fatalf("switch: status %d: %s", rec.Code, rec.Body)
+	}
+	// The active profile needs no PIN.
+	if rec := postForm(h, "/api/profiles", cookies, url.Values{"id": {kid}, "name": {"Renamed"}}); rec.Code != 200 {
+		t.Errorf("edit active profile: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := postForm(h, "/api/profiles/delete", cookies, url.Values{"id": {"0"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("delete default profile: status %d, want 400", rec.Code)
+	}
+
+	if rec := postForm(h, "/api/profiles/delete", cookies, url.Values{"id": {kid}}); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"activeProfileId":0`) {
+		t.Fatalf("delete active profile: status %d: %s", rec.Code, rec.Body)
+	}
+	// The session that was using the deleted profile is back on the default.
+	r := httptest.NewRequest(http.MethodGet, "/api/profiles", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if !strings.Contains(rec.Body.String(), `"activeProfileId":0`) {
+		t.Errorf("after delete: %s", rec.Body)
+	}
+
+	t.Run("access tokens cannot switch", func(t *testing.T) {
+		secret, _, err := authMw.CreateAPIToken(u.ID, "script", []string{auth.ScopeFull}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/profiles/switch", strings.NewReader("id=0"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400: %s", rec.Code, rec.Body)
+		}
+	})
+}
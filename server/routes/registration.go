@@ -0,0 +1,282 @@
+package routes
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/password"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// Self-registered accounts without an invitation wait in this status until
+// an admin approves them.
+const statusPending = "pending"
+
+const maxUsernameLength = 32
+
+func registrationOpen(database *db.DB) bool {
+	return strings.TrimSpace(database.GetSetting("registration_open")) == "1"
+}
+
+func validUsername(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxUsernameLength {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// invitationAlphabet leaves out characters that are easy to misread.
+const invitationAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func newInvitationCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(invitationAlphabet[int(c)%len(invitationAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+func normalizeInvitationCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func invitationJSON(inv store.Invitation, now int64) map[string]any {
+	return map[string]any{
+		"code":       inv.Code,
+		"role":       inv.Role,
+		"catApiBase": inv.CatAPIBase,
+		"maxUses":    inv.MaxUses,
+		"uses":       inv.Uses,
+		"expiresAt":  inv.ExpiresAt,
+		"createdAt":  inv.CreatedAt,
+		"usable":     inv.Usable(now),
+	}
+}
+
+// handleAPIRegister creates an account. With an invitation code the account
+// is active right away and gets the invitation's role; otherwise open
+// registration must be enabled and the account waits for approval.
+func handleAPIRegister(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	f := formFields(r, "username", "password", "inviteCode")
+	username := strings.TrimSpace(f["username"])
+	code := normalizeInvitationCode(f["inviteCode"])
+	if code == "" && !registrationOpen(database) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "未开放注册，请使用邀请码"})
+		return
+	}
+	if !validUsername(username) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名不能为空、不能包含空白字符且不超过 32 个字符"})
+		return
+	}
+	if err := passwordPolicy(database).Check(username, f["password"]); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": err.Error()})
+		return
+	}
+	// Codes are checked before the password is hashed, under the client's
+	// login backoff, so guessing them is neither free nor a way to make the
+	// server hash for nothing.
+	now := time.Now().UnixMilli()
+	ok, wait, err := authMw.CheckFromClient(r, func() (bool, error) {
+		if code == "" {
+			return true, nil
+		}
+		inv, err := st.Invitations.Get(code)
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil && inv.Usable(now), err
+	})
+	switch {
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "注册失败"})
+		return
+	case wait > 0:
+		writeTooManyAttempts(w, wait, "邀请码")
+		return
+	case !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "邀请码无效或已失效"})
+		return
+	}
+	hash, err := password.Hash(f["password"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "注册失败"})
+		return
+	}
+
+	u := store.User{Username: username, PasswordHash: hash}
+	if code != "" {
+		u.Status = "active"
+		_, err = st.Invitations.Redeem(code, now, u)
+	} else {
+		u.Role, u.Status = "user", statusPending
+		_, err = st.Users.Create(u)
+	}
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "邀请码无效或已失效"})
+		return
+	case errors.Is(err, store.ErrConflict):
+		writeJSON(w, http.StatusConflict, map[string]any{"success": false, "message": "用户名已存在"})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "注册失败"})
+		return
+	}
+	if u.Status == statusPending {
+		writeJSON(w, 200, map[string]any{"success": true, "pending": true, "message": "注册成功，请等待管理员审核"})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "pending": false})
+}
+
+// handleDashboardInvitations lists invitation codes and creates new ones.
+func handleDashboardInvitations(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+		list, err := st.Invitations.List()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		out := []map[string]any{}
+		for _, inv := range list {
+			out = append(out, invitationJSON(inv, now.UnixMilli()))
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "invitations": out})
+	case http.MethodPost:
+		parseForm(r)
+		role := defaultString(strings.TrimSpace(r.FormValue("role")), "user")
+		if _, msg := assignableRole(authMw, auth.CurrentUser(r), role); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": msg})
+			return
+		}
+		maxUses := db.ParseIntDefault(r.FormValue("maxUses"), 1)
+		if maxUses < 0 || maxUses > 1000 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "使用次数必须是 0-1000 的整数（0 表示不限）"})
+			return
+		}
+		days := db.ParseIntDefault(r.FormValue("expiresInDays"), 7)
+		if days < 0 || days > 365 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "有效期必须是 0-365 天（0 表示永不过期）"})
+			return
+		}
+		inv := store.Invitation{
+			Role:       role,
+			CatAPIBase: strings.TrimSpace(r.FormValue("catApiBase")),
+			MaxUses:    maxUses,
+			CreatedBy:  auth.CurrentUser(r).ID,
+			CreatedAt:  now.UnixMilli(),
+		}
+		if days > 0 {
+			inv.ExpiresAt = now.Add(time.Duration(days) * 24 * time.Hour).UnixMilli()
+		}
+		var err error
+		if inv.Code, err = newInvitationCode(); err == nil {
+			err = st.Invitations.Create(inv)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "创建失败"})
+			return
+		}
+		// The code is left out: it stays redeemable and the audit log is
+		// readable without manage_users.
+		auditNote(r, "", nil, map[string]any{"role": inv.Role, "catApiBase": inv.CatAPIBase, "maxUses": inv.MaxUses, "expiresAt": inv.ExpiresAt})
+		writeJSON(w, 200, map[string]any{"success": true, "invitation": invitationJSON(inv, now.UnixMilli())})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func handleDashboardInvitationDelete(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	code := normalizeInvitationCode(r.FormValue("code"))
+	ok, err := st.Invitations.Delete(code)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "删除失败"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "邀请码不存在"})
+		return
+	}
+	auditNote(r, code, nil, nil)
+	writeJSON(w, 200, map[string]any{"success": true})
+}
+
+func handleDashboardRegistrationSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		parseForm(r)
+		open := "0"
+		if boolFromForm(r.FormValue("open")) {
+			open = "1"
+		}
+		before := auditSettings(database, "registration_open")
+		_ = database.SetSetting("registration_open", open)
+		auditNoteDiff(r, "", before, auditSettings(database, "registration_open"))
+	default:
+		methodNotAllowed(w)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "open": registrationOpen(database)})
+}
+
+// handleDashboardUserApprove activates a pending account, or deletes it
+// when approve is false.
+func handleDashboardUserApprove(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	u, err := st.Users.ByUsername(strings.TrimSpace(r.FormValue("username")))
+	if err != nil || u.Status != statusPending {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "该用户不在待审核状态"})
+		return
+	}
+	if r.FormValue("approve") != "" && !boolFromForm(r.FormValue("approve")) {
+		if _, err := st.Users.Delete(u.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "操作失败"})
+			return
+		}
+		auditNote(r, u.Username, auditUser(u), nil)
+		writeJSON(w, 200, map[string]any{"success": true, "status": "rejected"})
+		return
+	}
+	active := "active"
+	if err := st.Users.Update(u.ID, store.UserPatch{Status: &active}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "操作失败"})
+		return
+	}
+	auditNote(r, u.Username, map[string]any{"status": u.Status}, map[string]any{"status": active})
+	writeJSON(w, 200, map[string]any{"success": true, "status": active})
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestRegisterWithInvitation(t *testing.T) {
+	database := openTestDB(t)
+	st := store.NewSQLite(database)
+	now := time.Now().UnixMilli()
+	for _, inv := range []store.Invitation{
+		{Code: "ONCE", Role: "shared", CatAPIBase: "http://cat/", MaxUses: 1, CreatedAt: now},
+		{Code: "EXPIRED", Role: "user", ExpiresAt: now - 1000, CreatedAt: now},
+	} {
+		if err := st.Invitations.Create(inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = st.Settings.Set("login_backoff_seconds", "0")
+	authMw := auth.New(st, auth.Options{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIRegister(w, r, database, st, authMw)
+	})
+
+	// The cases run in order against the same invitations.
+	tests := []struct {
+		name     string
+		username string
+		code     string
+		want     int
+	}{
+		{"registration closed", "nobody", "", http.StatusForbidden},
+		{"unknown code", "nobody", "MISSING", http.StatusBadRequest},
+		{"expired code", "nobody", "expired", http.StatusBadRequest},
+		// A refused redemption must not count as a use.
+		{"taken username", "admin", "once", http.StatusConflict},
+		{"redeemed", "alice", " once ", 200},
+		{"used up", "bob", "ONCE", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		form := url.Values{"username": {tt.username}, "password": {"Long-enough-pass-1"}, "inviteCode": {tt.code}}
+		if rec := postForm(h, "/api/register", nil, form); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	alice, err := st.Users.ByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Role != "shared" || alice.Status != "active" || alice.CatAPIBase != "http://cat/" {
+		t.Errorf("alice = %+v, want the invitation's role and CatPawOpen", alice)
+	}
+	if inv, _ := st.Invitations.Get("ONCE"); inv.Uses != 1 {
+		t.Errorf("uses = %d, want 1", inv.Uses)
+	}
+	for _, name := range []string{"nobody", "bob"} {
+		if _, err := st.Users.ByUsername(name); err == nil {
+			t.Errorf("%s was created", name)
+		}
+	}
+}
+
+func TestRegisterThrottlesBadCodes(t *testing.T) {
+	database := openTestDB(t)
+	st := store.NewSQLite(database)
+	_ = st.Settings.Set("login_ip_max_failures", "2")
+	if err := st.Invitations.Create(store.Invitation{Code: "GOOD", Role: "user", CreatedAt: time.Now().UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	authMw := auth.New(st, auth.Options{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIRegister(w, r, database, st, authMw)
+	})
+	register := func(code string) int {
+		form := url.Values{"username": {"alice"}, "password": {"Long-enough-pass-1"}, "inviteCode": {code}}
+		return postForm(h, "/api/register", nil, form).Code
+	}
+
+	if got := register("WRONG-1"); got != http.StatusBadRequest {
+		t.Fatalf("first wrong code: status %d, want 400", got)
+	}
+	// The backoff covers every code from this client, valid ones included.
+	if got := register("GOOD"); got != http.StatusTooManyRequests {
+		t.Errorf("during backoff: status %d, want 429", got)
+	}
+	_ = st.Settings.Set("login_backoff_seconds", "0")
+	if got := register("WRONG-2"); got != http.StatusBadRequest {
+		t.Fatalf("second wrong code: status %d, want 400", got)
+	}
+	if got := register("GOOD"); got != http.StatusTooManyRequests {
+		t.Errorf("after the IP limit: status %d, want 429", got)
+	}
+	if _, err := st.Users.ByUsername("alice"); err == nil {
+		t.Error("alice was created while locked out")
+	}
+	if inv, _ := st.Invitations.Get("GOOD"); inv.Uses != 0 {
+		t.Errorf("uses = %d, want 0", inv.Uses)
+	}
+}
@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func handleDashboardRetentionSettings(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{"success": true, "kinds": db.RetentionKinds, "policy": database.GlobalRetention()})
+	case http.MethodPost:
+		var body struct {
+			Policy db.RetentionPolicy `json:"policy"`
+		}
+		if err := readJSONLoose(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		before := database.GlobalRetention()
+		if err := database.SetGlobalRetention(body.Policy); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "保留策略无效"})
+			return
+		}
+		auditNote(r, "", before, database.GlobalRetention())
+		writeJSON(w, 200, map[string]any{"success": true, "policy": database.GlobalRetention()})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleDashboardRetentionUser reads or replaces a user's overrides. Kinds
+// left out of the posted policy follow the global policy again.
+func handleDashboardRetentionUser(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	var (
+		username string
+		policy   db.RetentionPolicy
+	)
+	switch r.Method {
+	case http.MethodGet:
+		username = strings.TrimSpace(r.URL.Query().Get("username"))
+	case http.MethodPost:
+		var body struct {
+			Username string             `json:"username"`
+			Policy   db.RetentionPolicy `json:"policy"`
+		}
+		if err := readJSONLoose(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		username = strings.TrimSpace(body.Username)
+		policy = body.Policy
+	default:
+		methodNotAllowed(w)
+		return
+	}
+	if username == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户名不能为空"})
+		return
+	}
+	u, err := st.Users.ByUsername(username)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
+		return
+	}
+	var before db.RetentionPolicy
+	if r.Method == http.MethodPost {
+		before, _ = database.UserRetention(u.ID)
+		if err := database.SetUserRetention(u.ID, policy); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "保留策略无效"})
+			return
+		}
+	}
+	overrides, err := database.UserRetention(u.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "读取失败"})
+		return
+	}
+	if r.Method == http.MethodPost {
+		auditNote(r, u.Username, before, overrides)
+	}
+	effective := database.GlobalRetention()
+	for kind, rule := range overrides {
+		effective[kind] = rule
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "username": u.Username, "policy": overrides, "effective": effective})
+}
+
+func handleDashboardRetentionPreview(w http.ResponseWriter, r *http.Request, database *db.DB) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	report, err := database.ApplyRetention(time.Now(), true)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "预览失败"})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "report": report})
+}
@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+func roleJSON(role store.Role, users int) map[string]any {
+	return map[string]any{
+		"name":        role.Name,
+		"label":       role.Label,
+		"permissions": role.Permissions,
+		"builtin":     role.Builtin,
+		"users":       users,
+	}
+}
+
+// roleNames lists every built-in and custom role name.
+func roleNames(authMw *auth.Auth) []string {
+	roles, err := authMw.Roles()
+	if err != nil {
+		return auth.BuiltinRoleNames()
+	}
+	out := make([]string, 0, len(roles))
+	for _, role := range roles {
+		out = append(out, role.Name)
+	}
+	return out
+}
+
+// assignableRole checks that actor may give the role called name to a user:
+// it must exist, must not grant full access, and must not grant anything actor
+// lacks. It returns a message when the role cannot be assigned.
+func assignableRole(authMw *auth.Auth, actor *auth.User, name string) (store.Role, string) {
+	role, err := authMw.Role(name)
+	if err != nil || authMw.FullAccess(role.Name) {
+		return store.Role{}, "角色无效"
+	}
+	if !actor.CanAll(role.Permissions) {
+		return store.Role{}, "不能分配超出自身权限的角色"
+	}
+	return role, ""
+}
+
+// canManageUser reports whether actor may change target: target's role must
+// not grant anything actor lacks, so admins can only be managed by users
+// holding every permission. It fails closed when the role cannot be looked
+// up.
+func canManageUser(authMw *auth.Auth, actor *auth.User, target store.User) bool {
+	role, err := authMw.Role(target.Role)
+	if err != nil {
+		return false
+	}
+	return actor.CanAll(role.Permissions)
+}
+
+// handleDashboardRoles lists the roles with the permission catalog, and
+// creates or updates a custom role.
+func handleDashboardRoles(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	switch r.Method {
+	case http.MethodGet:
+		roles, err := authMw.Roles()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		out := []map[string]any{}
+		for _, role := range roles {
+			n, _ := st.Roles.CountUsers(role.Name)
+			out = append(out, roleJSON(role, n))
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "roles": out, "permissions": auth.Permissions})
+	case http.MethodPost:
+		parseForm(r)
+		name := strings.TrimSpace(r.FormValue("name"))
+		if !roleNamePattern.MatchString(name) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "角色名须以小写字母开头，由 2-32 个小写字母、数字、下划线或连字符组成"})
+			return
+		}
+		if _, ok := auth.BuiltinRole(name); ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "内置角色不可修改"})
+			return
+		}
+		actor := auth.CurrentUser(r)
+		perms := []string{}
+		for _, v := range r.Form["permissions"] {
+			for _, p := range strings.Split(v, ",") {
+				p = strings.TrimSpace(p)
+				if p == "" || containsString(perms, p) {
+					continue
+				}
+				if !auth.ValidPermission(p) {
+					writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "权限无效：" + p})
+					return
+				}
+				perms = append(perms, p)
+			}
+		}
+		if !actor.CanAll(perms) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "不能授予自身没有的权限"})
+			return
+		}
+		role := store.Role{Name: name, Label: strings.TrimSpace(r.FormValue("label")), Permissions: perms, CreatedAt: time.Now().UnixMilli()}
+		var before any
+		if prev, err := st.Roles.Get(name); err == nil {
+			// Editing a role changes what its current holders can do.
+			if !actor.CanAll(prev.Permissions) {
+				writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "不能修改超出自身权限的角色"})
+				return
+			}
+			role.CreatedAt = prev.CreatedAt
+			before = map[string]any{"label": prev.Label, "permissions": prev.Permissions}
+		} else if !errors.Is(err, store.ErrNotFound) {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		if err := st.Roles.Put(role); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "保存失败"})
+			return
+		}
+		n, _ := st.Roles.CountUsers(name)
+		auditNote(r, name, before, map[string]any{"label": role.Label, "permissions": role.Permissions})
+		writeJSON(w, 200, map[string]any{"success": true, "role": roleJSON(role, n)})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleDashboardRoleDelete removes a custom role nobody is assigned. Like
+// editing, it is refused when the role grants anything the actor lacks.
+func handleDashboardRoleDelete(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if _, ok := auth.BuiltinRole(name); ok {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "内置角色不可删除"})
+		return
+	}
+	prev, err := st.Roles.Get(name)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "角色不存在"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if !auth.CurrentUser(r).CanAll(prev.Permissions) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "不能删除超出自身权限的角色"})
+		return
+	}
+	n, err := st.Roles.CountUsers(name)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if n > 0 {
+		writeJSON(w, http.StatusConflict, map[string]any{"success": false, "message": "仍有用户使用该角色，请先调整这些用户的角色"})
+		return
+	}
+	ok, err := st.Roles.Delete(name)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "删除失败"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "角色不存在"})
+		return
+	}
+	auditNote(r, name, map[string]any{"label": prev.Label, "permissions": prev.Permissions}, nil)
+	writeJSON(w, 200, map[string]any{"success": true})
+}
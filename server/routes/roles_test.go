@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestRoleChecks(t *testing.T) {
+	st := store.NewMemory()
+	admin, _ := auth.BuiltinRole("admin")
+	for _, role := range []store.Role{
+		{Name: "root", Label: "超级", Permissions: admin.Permissions},
+		{Name: "editor", Label: "编辑", Permissions: []string{auth.PermManageSites}},
+		{Name: "manager", Label: "用户管理", Permissions: []string{auth.PermManageUsers, auth.PermManageSites}},
+	} {
+		if err := st.Roles.Put(role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	authMw := auth.New(st, auth.Options{})
+	actors := map[string]*auth.User{
+		"admin":   {Role: "admin", Permissions: admin.Permissions},
+		"manager": {Role: "manager", Permissions: []string{auth.PermManageUsers, auth.PermManageSites}},
+		"users":   {Role: "users-only", Permissions: []string{auth.PermManageUsers}},
+	}
+	tests := []struct {
+		actor, role string
+		// assign is the message assignableRole returns, empty when allowed.
+		assign string
+		manage bool
+		// fullAccess is what FullAccess reports for the role.
+		fullAccess bool
+	}{
+		{"admin", "admin", "角色无效", true, true},
+		{"admin", "root", "角色无效", true, true},
+		{"admin", "manager", "", true, false},
+		{"admin", "gone", "角色无效", false, false},
+		{"manager", "user", "", true, false},
+		{"manager", "editor", "", true, false},
+		{"manager", "manager", "", true, false},
+		{"manager", "shared", "不能分配超出自身权限的角色", false, false},
+		{"manager", "admin", "角色无效", false, true},
+		{"manager", "root", "角色无效", false, true},
+		{"users", "editor", "不能分配超出自身权限的角色", false, false},
+		{"users", "user", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.actor+"/"+tt.role, func(t *testing.T) {
+			actor := actors[tt.actor]
+			if _, msg := assignableRole(authMw, actor, tt.role); msg != tt.assign {
+				t.Errorf("assignableRole = %q, want %q", msg, tt.assign)
+			}
+			if got := canManageUser(authMw, actor, store.User{Role: tt.role}); got != tt.manage {
+				t.Errorf("canManageUser = %v, want %v", got, tt.manage)
+			}
+			if got := authMw.FullAccess(tt.role); got != tt.fullAccess {
+				t.Errorf("FullAccess = %v, want %v", got, tt.fullAccess)
+			}
+		})
+	}
+}
+
+func TestProtectedRoleHandlers(t *testing.T) {
+	database := openTestDB(t)
+	st, authMw, _, cookies := signedIn(t, "root", "Root-pass-1", "admin")
+	admin, _ := auth.BuiltinRole("admin")
+	_ = st.Roles.Put(store.Role{Name: "super", Permissions: admin.Permissions})
+	carol := store.User{Username: "carol", Role: "super", Status: "active"}
+	carol.ID, _ = st.Users.Create(carol)
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dashboard/user/ban":
+			handleDashboardUserBan(w, r, st, authMw)
+		case "/dashboard/user/delete":
+			handleDashboardUserDelete(w, r, st, authMw)
+		case "/dashboard/user/update":
+			handleDashboardUserUpdate(w, r, database, st, authMw)
+		}
+	}))
+
+	tests := []struct {
+		path string
+		form url.Values
+	}{
+		{"/dashboard/user/ban", url.Values{"username": {"carol"}}},
+		{"/dashboard/user/delete", url.Values{"username": {"carol"}}},
+		{"/dashboard/user/update", url.Values{"username": {"carol"}, "role": {"user"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if rec := postForm(h, tt.path, cookies, tt.form); rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body)
+			}
+			got, err := st.Users.ByID(carol.ID)
+			if err != nil || got.Status != "active" || got.Role != "super" {
+				t.Errorf("full-access user changed: %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestRoleDeleteNeedsEveryPermission(t *testing.T) {
+	st, authMw, _, cookies := signedIn(t, "opsy", "Ops-pass-12", "ops")
+	_ = st.Roles.Put(store.Role{Name: "ops", Permissions: []string{auth.PermManageRoles}})
+	_ = st.Roles.Put(store.Role{Name: "boss", Permissions: []string{auth.PermManageRoles, auth.PermManageUsers}})
+	_ = st.Roles.Put(store.Role{Name: "viewer", Permissions: []string{}})
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleDashboardRoleDelete(w, r, st)
+	}))
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"boss", http.StatusForbidden},
+		{"missing", http.StatusNotFound},
+		{"viewer", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := postForm(h, "/dashboard/roles/delete", cookies, url.Values{"name": {tt.name}}); rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+	if _, err := st.Roles.Get("boss"); err != nil {
+		t.Errorf("boss role deleted: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func sessionJSON(t store.Token, currentID int64) map[string]any {
+	return map[string]any{
+		"id":         t.ID,
+		"createdAt":  t.CreatedAt,
+		"expiresAt":  t.ExpiresAt,
+		"lastSeenAt": t.LastSeenAt,
+		"userAgent":  t.UserAgent,
+		"ip":         t.IP,
+		"remember":   t.Remember,
+		"current":    currentID != 0 && t.ID == currentID,
+	}
+}
+
+// activeSessions drops sessions that have expired but not been purged yet.
+func activeSessions(list []store.Token) []store.Token {
+	now := time.Now().UnixMilli()
+	out := []store.Token{}
+	for _, t := range list {
+		if t.ExpiresAt > now {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// handleAPIUserSessions lists the caller's login sessions and revokes one of
+// them by id.
+func handleAPIUserSessions(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后管理会话"})
+		return
+	}
+	current := auth.SessionID(r)
+	switch r.Method {
+	case http.MethodGet:
+		list, err := st.Tokens.List(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		sessions := []map[string]any{}
+		for _, t := range activeSessions(list) {
+			sessions = append(sessions, sessionJSON(t, current))
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "sessions": sessions})
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+		if err != nil || id <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+			return
+		}
+		t, err := st.Tokens.ByID(id)
+		if err != nil || t.UserID != u.ID {
+			writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "会话不存在"})
+			return
+		}
+		if id == current {
+			authMw.Logout(w, r)
+		} else if err := st.Tokens.Delete(id); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "current": id == current})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleAPIUserSessionsRevokeAll logs the caller out everywhere. With
+// keepCurrent=1 the session making the request survives.
+func handleAPIUserSessionsRevokeAll(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后管理会话"})
+		return
+	}
+	parseForm(r)
+	keep := int64(0)
+	if strings.TrimSpace(r.FormValue("keepCurrent")) == "1" {
+		keep = auth.SessionID(r)
+	}
+	n, err := st.Tokens.DeleteForUser(u.ID, keep)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	if keep == 0 {
+		authMw.Logout(w, r)
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "revoked": n})
+}
+
+// handleDashboardSessions is the admin view of login sessions across users,
+// optionally filtered by username.
+func handleDashboardSessions(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	users, err := st.Users.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	names := map[int64]string{}
+	var userID int64
+	filter := strings.TrimSpace(r.URL.Query().Get("username"))
+	for _, u := range users {
+		names[u.ID] = u.Username
+		if filter != "" && u.Username == filter {
+			userID = u.ID
+		}
+	}
+	if filter != "" && userID == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
+		return
+	}
+	list, err := st.Tokens.List(userID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	current := auth.SessionID(r)
+	sessions := []map[string]any{}
+	for _, t := range activeSessions(list) {
+		item := sessionJSON(t, current)
+		item["username"] = names[t.UserID]
+		sessions = append(sessions, item)
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "sessions": sessions})
+}
+
+// handleDashboardSessionsRevoke ends one session by id, or every session of
+// a user by username.
+func handleDashboardSessionsRevoke(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	if username := strings.TrimSpace(r.FormValue("username")); username != "" {
+		u, err := st.Users.ByUsername(username)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "用户不存在"})
+			return
+		}
+		if !canManageUser(authMw, auth.CurrentUser(r), u) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
+			return
+		}
+		n, err := st.Tokens.DeleteForUser(u.ID, auth.SessionID(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		auditNote(r, u.Username, nil, map[string]any{"revoked": n})
+		writeJSON(w, 200, map[string]any{"success": true, "revoked": n})
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(r.FormValue("id")), 10, 64)
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "参数无效"})
+		return
+	}
+	t, err := st.Tokens.ByID(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "会话不存在"})
+		return
+	}
+	owner, err := st.Users.ByID(t.UserID)
+	if err == nil && !canManageUser(authMw, auth.CurrentUser(r), owner) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
+		return
+	}
+	if err := st.Tokens.Delete(id); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	auditNote(r, owner.Username, nil, map[string]any{"revoked": 1, "session": id})
+	writeJSON(w, 200, map[string]any{"success": true, "revoked": 1})
+}
+
+func sessionPolicyJSON(p auth.SessionPolicy) map[string]any {
+	return map[string]any{
+		"absoluteDays":   int(p.Absolute / (24 * time.Hour)),
+		"idleDays":       int(p.Idle / (24 * time.Hour)),
+		"shortIdleHours": int(p.ShortIdle / time.Hour),
+	}
+}
+
+// handleDashboardSessionSettings reads and changes how long login sessions
+// last. Changes apply to existing sessions on their next request.
+func handleDashboardSessionSettings(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{"success": true, "policy": sessionPolicyJSON(auth.LoadSessionPolicy(st.Settings))})
+	case http.MethodPost:
+		parseForm(r)
+		fields := []struct {
+			form, key, label string
+			least, most      int
+		}{
+			{"absoluteDays", "session_absolute_days", "最长有效期（天）", 0, 3650},
+			{"idleDays", "session_idle_days", "记住登录的闲置期限（天）", 1, 3650},
+			{"shortIdleHours", "session_short_idle_hours", "未记住登录的闲置期限（小时）", 1, 24 * 30},
+		}
+		values := map[string]int{}
+		for _, f := range fields {
+			raw := strings.TrimSpace(r.FormValue(f.form))
+			if raw == "" {
+				continue
+			}
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < f.least || n > f.most {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": f.label + "必须是 " + strconv.Itoa(f.least) + "-" + strconv.Itoa(f.most) + " 的整数"})
+				return
+			}
+			values[f.key] = n
+		}
+		keys := make([]string, 0, len(fields))
+		for _, f := range fields {
+			keys = append(keys, f.key)
+		}
+		before := auditSettings(database, keys...)
+		for _, f := range fields {
+			if n, ok := values[f.key]; ok {
+				_ = database.SetSetting(f.key, strconv.Itoa(n))
+			}
+		}
+		auditNoteDiff(r, "", before, auditSettings(database, keys...))
+		writeJSON(w, 200, map[string]any{"success": true, "policy": sessionPolicyJSON(auth.LoadSessionPolicy(st.Settings))})
+	default:
+		methodNotAllowed(w)
+	}
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestUserSessionsRevoke(t *testing.T) {
+	st, authMw, alice, cookies := signedIn(t, "alice", "right-pass-1", "user")
+	sessionIDs := func(userID int64) []int64 {
+		t.Helper()
+		list, err := st.Tokens.List(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, s := range list {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+	current := sessionIDs(alice.ID)[0]
+	newSession := func(userID int64) int64 {
+		t.Helper()
+		before := len(sessionIDs(userID))
+		if err := authMw.StartSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/login", nil), userID, false); err != nil {
+			t.Fatal(err)
+		}
+		ids := sessionIDs(userID)
+		if len(ids) != before+1 {
+			t.Fatalf("sessions = %v", ids)
+		}
+		var newest int64
+		for _, id := range ids {
+			newest = max(newest, id)
+		}
+		return newest
+	}
+	bobID, err := st.Users.Create(store.User{Username: "bob", Role: "user", Status: "active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSession := newSession(bobID)
+	other := newSession(alice.ID)
+
+	revoke := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserSessions(w, r, st, authMw)
+	}))
+	del := func(id int64) int {
+		r := httptest.NewRequest(http.MethodDelete, "/api/user/sessions?id="+strconv.FormatInt(id, 10), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		revoke.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if got := del(bobSession); got != http.StatusNotFound {
+		t.Errorf("revoke another user's session: status %d, want 404", got)
+	}
+	if _, err := st.Tokens.ByID(bobSession); err != nil {
+		t.Errorf("bob's session is gone: %v", err)
+	}
+	if got := del(other); got != 200 {
+		t.Errorf("revoke own session: status %d", got)
+	}
+	if _, err := st.Tokens.ByID(other); err == nil {
+		t.Error("revoked session still exists")
+	}
+
+	revokeAll := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserSessionsRevokeAll(w, r, st, authMw)
+	}))
+	newSession(alice.ID)
+	if rec := postForm(revokeAll, "/api/user/sessions/revoke-all", cookies, url.Values{"keepCurrent": {"1"}}); rec.Code != 200 {
+		t.Fatalf("revoke all but current: status %d: %s", rec.Code, rec.Body)
+	}
+	if ids := sessionIDs(alice.ID); len(ids) != 1 || ids[0] != current {
+		t.Errorf("sessions after keepCurrent = %v, want only %d", ids, current)
+	}
+	if rec := postForm(revokeAll, "/api/user/sessions/revoke-all", cookies, nil); rec.Code != 200 {
+		t.Fatalf("revoke all: status %d: %s", rec.Code, rec.Body)
+	}
+	if ids := sessionIDs(alice.ID); len(ids) != 0 {
+		t.Errorf("sessions after revoke all = %v", ids)
+	}
+	if ids := sessionIDs(bobID); len(ids) != 1 {
+		t.Errorf("bob's sessions = %v, want untouched", ids)
+	}
+}
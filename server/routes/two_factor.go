@@ -0,0 +1,298 @@
+package routes
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+	"rsc.io/qr"
+)
+
+// totpQRImage renders the provisioning URI as a PNG data URL, or "" if it
+// cannot be encoded; the secret can still be typed in by hand.
+func totpQRImage(uri string) string {
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return ""
+	}
+	code.Scale = 6
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())
+}
+
+// checkCurrentPassword confirms the signed-in user's password, writing the
+// error response when it is wrong or too many attempts have failed.
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, authMw *auth.Auth, row store.User, pass, wrong string) bool {
+	ok, wait := authMw.CheckPassword(r, row, pass)
+	if wait > 0 {
+		writeTooManyAttempts(w, wait, "密码")
+		return false
+	}
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": wrong})
+		return false
+	}
+	return true
+}
+
+// writeTooManyAttempts refuses a request while wrong passwords or codes are
+// backing off; what names the thing that was wrong.
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration, what string) {
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeJSON(w, http.StatusTooManyRequests, map[string]any{"success": false, "message": what + "错误次数过多，请 " + strconv.Itoa(secs) + " 秒后再试"})
+}
+
+func totpSetupJSON(p auth.TOTPProvisioning) map[string]any {
+	return map[string]any{
+		"success":    true,
+		"secret":     p.Secret,
+		"otpauthUrl": p.URI,
+		"qrImage":    totpQRImage(p.URI),
+	}
+}
+
+// writeLoginResult reports a login step. A pending second factor is not an
+// error but is not a login either, so success stays false.
+func writeLoginResult(w http.ResponseWriter, res auth.LoginResult) {
+	if res.Message != "" {
+		writeJSON(w, res.Status, map[string]any{"success": false, "message": res.Message})
+		return
+	}
+	if c := res.TwoFactor; c != nil {
+		msg := "请输入两步验证码"
+		if c.Setup {
+			msg = "请先设置两步验证"
+		}
+		writeJSON(w, 200, map[string]any{
+			"success":           false,
+			"twoFactorRequired": true,
+			"setupRequired":     c.Setup,
+			"challenge":         c.ID,
+			"expiresAt":         c.ExpiresAt,
+			"message":           msg,
+		})
+		return
+	}
+	out := map[string]any{"success": true}
+	if len(res.RecoveryCodes) > 0 {
+		out["recoveryCodes"] = res.RecoveryCodes
+	}
+	writeJSON(w, 200, out)
+}
+
+// handleAPILogin2FA finishes a login that needs a second factor.
+func handleAPILogin2FA(w http.ResponseWriter, r *http.Request, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	f := formFields(r, "challenge", "code")
+	if strings.TrimSpace(f["code"]) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请输入验证码"})
+		return
+	}
+	writeLoginResult(w, authMw.LoginSecondFactor(w, r, f["challenge"], f["code"]))
+}
+
+// handleAPILogin2FASetup hands out a TOTP secret to a user whose role
+// requires 2FA but who has not enrolled yet.
+func handleAPILogin2FASetup(w http.ResponseWriter, r *http.Request, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	f := formFields(r, "challenge")
+	p, err := authMw.ChallengeTOTP(f["challenge"])
+	if errors.Is(err, auth.ErrTOTPNotPending) {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"success": false, "message": "验证已过期，请重新登录"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	writeJSON(w, 200, totpSetupJSON(p))
+}
+
+// handleAPIUser2FA manages the caller's own 2FA. It needs a login session.
+func handleAPIUser2FA(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth, action string) {
+	u := auth.CurrentUser(r)
+	if auth.TokenScopes(r) != nil {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "请登录后管理两步验证"})
+		return
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+		t, err := st.TwoFactor.Get(u.ID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		remaining := 0
+		if t.Enabled {
+			remaining = len(t.RecoveryCodes)
+		}
+		writeJSON(w, 200, map[string]any{
+			"success":                true,
+			"enabled":                t.Enabled,
+			"required":               authMw.TwoFactorRequired(u.Role),
+			"recoveryCodesRemaining": remaining,
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	f := formFields(r, "code", "password")
+	enabled := authMw.TwoFactorEnabled(u.ID)
+
+	switch action {
+	case "setup":
+		if enabled {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "已启用两步验证"})
+			return
+		}
+		p, err := authMw.BeginTOTP(u.ID, u.Username)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		writeJSON(w, 200, totpSetupJSON(p))
+	case "enable":
+		codes, wait, err := authMw.ConfirmTOTP(r, u.ID, f["code"])
+		switch {
+		case wait > 0:
+			writeTooManyAttempts(w, wait, "验证码")
+		case errors.Is(err, auth.ErrTOTPNotPending):
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请先获取两步验证密钥"})
+		case errors.Is(err, auth.ErrTOTPInvalid):
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "验证码错误"})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		default:
+			writeJSON(w, 200, map[string]any{"success": true, "recoveryCodes": codes})
+		}
+	case "disable", "recovery-codes":
+		if !enabled {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "未启用两步验证"})
+			return
+		}
+		if action == "disable" && authMw.TwoFactorRequired(u.Role) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "当前角色必须启用两步验证"})
+			return
+		}
+		// New recovery codes bypass 2FA as surely as turning it off, so both
+		// need the password as well as a code. The code is checked first: a
+		// right password clears the user's failures and would otherwise
+		// reset the count of wrong codes.
+		row, err := st.Users.ByID(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		ok, wait, err := authMw.VerifySecondFactor(r, u.ID, f["code"])
+		if wait > 0 {
+			writeTooManyAttempts(w, wait, "验证码")
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "验证码错误"})
+			return
+		}
+		if !checkCurrentPassword(w, r, authMw, row, f["password"], "密码错误") {
+			return
+		}
+		if action == "disable" {
+			if err := st.TwoFactor.Delete(u.ID); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+				return
+			}
+			writeJSON(w, 200, map[string]any{"success": true})
+			return
+		}
+		codes, err := authMw.RegenerateRecoveryCodes(u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "recoveryCodes": codes})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleDashboard2FASettings reads and sets the roles that must use 2FA.
+func handleDashboard2FASettings(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store, authMw *auth.Auth) {
+	known := roleNames(authMw)
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, map[string]any{"success": true, "requiredRoles": auth.TwoFactorRoles(st.Settings), "roles": known})
+	case http.MethodPost:
+		parseForm(r)
+		roles := []string{}
+		for _, v := range r.Form["requiredRoles"] {
+			for _, role := range strings.Split(v, ",") {
+				role = strings.TrimSpace(role)
+				if role == "" {
+					continue
+				}
+				if !containsString(known, role) {
+					writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "角色无效"})
+					return
+				}
+				if !containsString(roles, role) {
+					roles = append(roles, role)
+				}
+			}
+		}
+		before := auditSettings(database, "totp_required_roles")
+		_ = database.SetSetting("totp_required_roles", strings.Join(roles, ","))
+		auditNoteDiff(r, "", before, auditSettings(database, "totp_required_roles"))
+		writeJSON(w, 200, map[string]any{"success": true, "requiredRoles": roles})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleDashboardUser2FAReset removes a user's 2FA, e.g. after a lost phone.
+// If their role requires 2FA they enroll again at the next login.
+func handleDashboardUser2FAReset(w http.ResponseWriter, r *http.Request, st *store.Store, authMw *auth.Auth) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	parseForm(r)
+	user, err := st.Users.ByUsername(strings.TrimSpace(r.FormValue("username")))
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "message": "用户不存在"})
+		return
+	}
+	if err == nil && !canManageUser(authMw, auth.CurrentUser(r), user) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"success": false, "message": "无权管理该用户"})
+		return
+	}
+	if err == nil {
+		err = st.TwoFactor.Delete(user.ID)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "请求失败"})
+		return
+	}
+	auditNote(r, user.Username, nil, nil)
+	writeJSON(w, 200, map[string]any{"success": true})
+}
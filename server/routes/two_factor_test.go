@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func TestTOTPQRImage(t *testing.T) {
+	uri := "otpauth://totp/MeowFilm:alice?secret=JBSWY3DPEHPK3PXP&issuer=MeowFilm&algorithm=SHA1&digits=6&period=30"
+	got := totpQRImage(uri)
+	data, ok := strings.CutPrefix(got, "data:image/png;base64,")
+	if !ok {
+		t.Fatalf("totpQRImage = %.40q, want a PNG data URL", got)
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != b.Dy() || b.Dx() < 21*6 {
+		t.Errorf("image bounds = %v", b)
+	}
+}
+
+func TestUser2FARecoveryCodesNeedPassword(t *testing.T) {
+	st, authMw, u, cookies := signedIn(t, "alice", "right-pass-1", "user")
+	_ = st.Settings.Set("login_max_failures", "3")
+	_ = st.Settings.Set("login_backoff_seconds", "0")
+	if err := st.TwoFactor.Put(store.TwoFactor{UserID: u.ID, Secret: "JBSWY3DPEHPK3PXP", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := authMw.RegenerateRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUser2FA(w, r, st, authMw, "recovery-codes")
+	}))
+	post := func(code, pass string) *httptest.ResponseRecorder {
+		return postForm(h, "/api/user/2fa/recovery-codes", cookies, url.Values{"code": {code}, "password": {pass}})
+	}
+
+	if rec := post(recovery[0], ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "密码错误") {
+		t.Errorf("without the password: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(recovery[1], "right-pass-1"); rec.Code != 200 {
+		t.Errorf("with the password: %d %s", rec.Code, rec.Body)
+	}
+	for i := 1; i <= 3; i++ {
+		if rec := post("aaaaa-bbbbb", "right-pass-1"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("wrong code %d: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := post("aaaaa-bbbbb", "right-pass-1"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("after 3 wrong codes: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,389 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+const (
+	userArchiveFormat  = "meowfilm-user-archive"
+	userArchiveVersion = 1
+
+	maxUserArchiveBytes = 32 << 20
+)
+
+// userArchive is the JSON document produced by /api/user/export. Timestamps
+// of favorites and history entries are Unix seconds, as stored.
+type userArchive struct {
+	Format        string                `json:"format"`
+	Version       int                   `json:"version"`
+	ExportedAt    int64                 `json:"exportedAt"`
+	Username      string                `json:"username"`
+	Settings      userArchiveSettings   `json:"settings"`
+	Favorites     []userArchiveFavorite `json:"favorites"`
+	PlayHistory   []userArchivePlay     `json:"playHistory"`
+	SearchHistory []userArchiveSearch   `json:"searchHistory"`
+}
+
+type userArchiveSettings struct {
+	CatAPIBase        string   `json:"catApiBase"`
+	CatAPIKey         string   `json:"catApiKey"`
+	CatProxy          string   `json:"catProxy"`
+	SearchThreadCount int      `json:"searchThreadCount"`
+	SearchCoverSite   string   `json:"searchCoverSite"`
+	SearchSiteOrder   []string `json:"searchSiteOrder"`
+}
+
+type userArchiveFavorite struct {
+	SiteKey     string `json:"siteKey"`
+	SiteName    string `json:"siteName"`
+	SpiderAPI   string `json:"spiderApi"`
+	VideoID     string `json:"videoId"`
+	VideoTitle  string `json:"videoTitle"`
+	VideoPoster string `json:"videoPoster"`
+	VideoRemark string `json:"videoRemark"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+type userArchivePlay struct {
+	ContentKey   string `json:"contentKey"`
+	SiteKey      string `json:"siteKey"`
+	SiteName     string `json:"siteName"`
+	SpiderAPI    string `json:"spiderApi"`
+	VideoID      string `json:"videoId"`
+	VideoTitle   string `json:"videoTitle"`
+	VideoPoster  string `json:"videoPoster"`
+	VideoRemark  string `json:"videoRemark"`
+	PanLabel     string `json:"panLabel"`
+	PlayFlag     string `json:"playFlag"`
+	EpisodeIndex int    `json:"episodeIndex"`
+	EpisodeName  string `json:"episodeName"`
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+type userArchiveSearch struct {
+	Keyword   string `json:"keyword"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func handleAPIUserExport(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	row, err := st.Users.ByID(u.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导出失败"})
+		return
+	}
+	favorites, err := st.Favorites.List(u.ID, u.ProfileID, -1)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导出失败"})
+		return
+	}
+	history, err := st.PlayHistory.List(u.ID, u.ProfileID, -1)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导出失败"})
+		return
+	}
+	searches, err := st.SearchHistory.Entries(u.ID, u.ProfileID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导出失败"})
+		return
+	}
+
+	now := time.Now()
+	archive := userArchive{
+		Format:     userArchiveFormat,
+		Version:    userArchiveVersion,
+		ExportedAt: now.UnixMilli(),
+		Username:   row.Username,
+		Settings: userArchiveSettings{
+			CatAPIBase:        row.CatAPIBase,
+			CatAPIKey:         row.CatAPIKey,
+			CatProxy:          row.CatProxy,
+			SearchThreadCount: row.SearchThreadCount,
+			SearchCoverSite:   row.SearchCoverSite,
+			SearchSiteOrder:   loadUserSearchOrder(st, u.ID),
+		},
+		Favorites:     []userArchiveFavorite{},
+		PlayHistory:   []userArchivePlay{},
+		SearchHistory: []userArchiveSearch{},
+	}
+	for _, f := range favorites {
+		archive.Favorites = append(archive.Favorites, userArchiveFavorite{
+			SiteKey:     f.SiteKey,
+			SiteName:    f.SiteName,
+			SpiderAPI:   f.SpiderAPI,
+			VideoID:     f.VideoID,
+			VideoTitle:  f.VideoTitle,
+			VideoPoster: f.VideoPoster,
+			VideoRemark: f.VideoRemark,
+			UpdatedAt:   f.UpdatedAt,
+		})
+	}
+	for _, h := range history {
+		archive.PlayHistory = append(archive.PlayHistory, userArchivePlay{
+			ContentKey:   h.ContentKey,
+			SiteKey:      h.SiteKey,
+			SiteName:     h.SiteName,
+			SpiderAPI:    h.SpiderAPI,
+			VideoID:      h.VideoID,
+			VideoTitle:   h.VideoTitle,
+			VideoPoster:  h.VideoPoster,
+			VideoRemark:  h.VideoRemark,
+			PanLabel:     h.PanLabel,
+			PlayFlag:     h.PlayFlag,
+			EpisodeIndex: h.EpisodeIndex,
+			EpisodeName:  h.EpisodeName,
+			UpdatedAt:    h.UpdatedAt,
+		})
+	}
+	for _, e := range searches {
+		archive.SearchHistory = append(archive.SearchHistory, userArchiveSearch{Keyword: e.Keyword, UpdatedAt: e.UpdatedAt})
+	}
+
+	name := "meowfilm-" + row.Username + "-" + now.Format("20060102-150405") + ".json"
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.NewReplacer(`"`, "", `\`, "").Replace(name)+`"`)
+	writeJSON(w, 200, archive)
+}
+
+// handleAPIUserImport merges an archive from /api/user/export into the
+// caller's data. Favorites, play history and search history entries are kept
+// from whichever side has the newer updatedAt. Settings only fill fields that
+// are empty here, unless "overwriteSettings=1" is passed.
+func handleAPIUserImport(w http.ResponseWriter, r *http.Request, database *db.DB, st *store.Store) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	u := auth.CurrentUser(r)
+	overwrite := strings.TrimSpace(r.URL.Query().Get("overwriteSettings")) == "1"
+
+	var src io.Reader = http.MaxBytesReader(w, r.Body, maxUserArchiveBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUserArchiveBytes)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "请上传导出文件"})
+			return
+		}
+		defer func() { _ = file.Close() }()
+		src = file
+	}
+	var archive userArchive
+	if err := json.NewDecoder(src).Decode(&archive); err != nil || archive.Format != userArchiveFormat {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "导出文件无效"})
+		return
+	}
+	if archive.Version < 1 || archive.Version > userArchiveVersion {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "导出文件版本不受支持"})
+		return
+	}
+
+	// Work out every change first, then write them in one transaction so a
+	// failed import leaves nothing half done.
+	in := store.UserImport{ProfileID: u.ProfileID}
+	var settings []string
+	var err error
+	if in.Favorites, err = mergeUserFavorites(st, u.ID, u.ProfileID, archive.Favorites); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导入失败"})
+		return
+	}
+	if in.PlayHistory, err = mergeUserPlayHistory(st, u.ID, u.ProfileID, archive.PlayHistory); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导入失败"})
+		return
+	}
+	if in.SearchHistory, err = mergeUserSearchHistory(st, u.ID, u.ProfileID, archive.SearchHistory); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导入失败"})
+		return
+	}
+	if in.Patch, settings, err = mergeUserSettings(st, u.ID, archive.Settings, overwrite); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导入失败"})
+		return
+	}
+	if err := st.Users.Import(u.ID, in); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"success": false, "message": "导入失败"})
+		return
+	}
+	if in.Patch.CatAPIBase != nil {
+		database.NotifyUserSitesChanged(u.ID)
+	}
+	writeJSON(w, 200, map[string]any{
+		"success": true,
+		"imported": map[string]any{
+			"favorites":     len(in.Favorites),
+			"playHistory":   len(in.PlayHistory),
+			"searchHistory": len(in.SearchHistory),
+			"settings":      settings,
+		},
+	})
+}
+
+// mergeUserFavorites returns the archived favorites that are new or newer
+// than the local ones.
+func mergeUserFavorites(st *store.Store, userID, profileID int64, items []userArchiveFavorite) ([]store.Favorite, error) {
+	existing, err := st.Favorites.List(userID, profileID, -1)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]int64{}
+	for _, f := range existing {
+		have[f.SiteKey+"\x00"+f.VideoID] = f.UpdatedAt
+	}
+	out := []store.Favorite{}
+	for _, f := range items {
+		f.SiteKey = strings.TrimSpace(f.SiteKey)
+		f.SpiderAPI = strings.TrimSpace(f.SpiderAPI)
+		f.VideoID = strings.TrimSpace(f.VideoID)
+		f.VideoTitle = strings.TrimSpace(f.VideoTitle)
+		if f.SiteKey == "" || f.SpiderAPI == "" || f.VideoID == "" || f.VideoTitle == "" {
+			continue
+		}
+		key := f.SiteKey + "\x00" + f.VideoID
+		if at, ok := have[key]; ok && at >= f.UpdatedAt {
+			continue
+		}
+		out = append(out, store.Favorite{
+			SiteKey:     f.SiteKey,
+			SiteName:    f.SiteName,
+			SpiderAPI:   f.SpiderAPI,
+			VideoID:     f.VideoID,
+			VideoTitle:  f.VideoTitle,
+			VideoPoster: f.VideoPoster,
+			VideoRemark: f.VideoRemark,
+			UpdatedAt:   f.UpdatedAt,
+		})
+		have[key] = f.UpdatedAt
+	}
+	return out, nil
+}
+
+// mergeUserPlayHistory keeps one record per content, like
+// handleAPIPlayHistory: an imported record only replaces the local one for
+// the same content when it is newer. Records are returned oldest first.
+func mergeUserPlayHistory(st *store.Store, userID, profileID int64, items []userArchivePlay) ([]store.PlayHistory, error) {
+	existing, err := st.PlayHistory.List(userID, profileID, -1)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := func(key, title, siteKey, videoID string) string {
+		if k := strings.TrimSpace(key); k != "" {
+			return k
+		}
+		if k := normalizeContentKey(title); k != "" {
+			return k
+		}
+		return siteKey + "::" + videoID
+	}
+	have := map[string]int64{}
+	for _, h := range existing {
+		k := contentKey(h.ContentKey, h.VideoTitle, h.SiteKey, h.VideoID)
+		if h.UpdatedAt > have[k] {
+			have[k] = h.UpdatedAt
+		}
+	}
+	sorted := append([]userArchivePlay(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].UpdatedAt < sorted[j].UpdatedAt })
+	out := []store.PlayHistory{}
+	for _, h := range sorted {
+		h.SiteKey = strings.TrimSpace(h.SiteKey)
+		h.VideoID = strings.TrimSpace(h.VideoID)
+		h.VideoTitle = strings.TrimSpace(h.VideoTitle)
+		if h.SiteKey == "" || h.VideoID == "" || h.VideoTitle == "" || isNetDiskHistoryItem(h.VideoID, h.PlayFlag) {
+			continue
+		}
+		k := contentKey(h.ContentKey, h.VideoTitle, h.SiteKey, h.VideoID)
+		if at, ok := have[k]; ok && at >= h.UpdatedAt {
+			continue
+		}
+		out = append(out, store.PlayHistory{
+			ContentKey:   k,
+			SiteKey:      h.SiteKey,
+			SiteName:     h.SiteName,
+			SpiderAPI:    h.SpiderAPI,
+			VideoID:      h.VideoID,
+			VideoTitle:   h.VideoTitle,
+			VideoPoster:  h.VideoPoster,
+			VideoRemark:  h.VideoRemark,
+			PanLabel:     h.PanLabel,
+			PlayFlag:     h.PlayFlag,
+			EpisodeIndex: h.EpisodeIndex,
+			EpisodeName:  h.EpisodeName,
+			UpdatedAt:    h.UpdatedAt,
+		})
+		have[k] = h.UpdatedAt
+	}
+	return out, nil
+}
+
+// mergeUserSearchHistory returns the archived keywords that are new or were
+// used more recently than here.
+func mergeUserSearchHistory(st *store.Store, userID, profileID int64, items []userArchiveSearch) ([]store.SearchEntry, error) {
+	existing, err := st.SearchHistory.Entries(userID, profileID)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]int64{}
+	for _, e := range existing {
+		have[e.Keyword] = e.UpdatedAt
+	}
+	out := []store.SearchEntry{}
+	for _, e := range items {
+		kw := strings.Join(strings.Fields(e.Keyword), " ")
+		if kw == "" {
+			continue
+		}
+		if at, ok := have[kw]; ok && at >= e.UpdatedAt {
+			continue
+		}
+		out = append(out, store.SearchEntry{Keyword: kw, UpdatedAt: e.UpdatedAt})
+		have[kw] = e.UpdatedAt
+	}
+	return out, nil
+}
+
+// mergeUserSettings returns the patch that applies the archived users-row
+// settings and the names of the fields it changes.
+func mergeUserSettings(st *store.Store, userID int64, in userArchiveSettings, overwrite bool) (store.UserPatch, []string, error) {
+	cur, err := st.Users.ByID(userID)
+	if err != nil {
+		return store.UserPatch{}, nil, err
+	}
+	changed := []string{}
+	patch := store.UserPatch{}
+	take := func(name string, local string, incoming string, dst **string) {
+		incoming = strings.TrimSpace(incoming)
+		if incoming == "" || incoming == local || (local != "" && !overwrite) {
+			return
+		}
+		*dst = &incoming
+		changed = append(changed, name)
+	}
+	take("catApiBase", cur.CatAPIBase, normalizeCatPawOpenAPIBase(in.CatAPIBase), &patch.CatAPIBase)
+	take("catApiKey", cur.CatAPIKey, in.CatAPIKey, &patch.CatAPIKey)
+	take("catProxy", cur.CatProxy, in.CatProxy, &patch.CatProxy)
+	take("searchCoverSite", cur.SearchCoverSite, in.SearchCoverSite, &patch.SearchCoverSite)
+	if n := in.SearchThreadCount; n >= 1 && n <= 50 && n != cur.SearchThreadCount && (overwrite || cur.SearchThreadCount < 1) {
+		patch.SearchThreadCount = &n
+		changed = append(changed, "searchThreadCount")
+	}
+	prevOrder := loadUserSearchOrder(st, userID)
+	if len(in.SearchSiteOrder) > 0 && (overwrite || len(prevOrder) == 0) {
+		next := mergeKeyOrder(in.SearchSiteOrder, in.SearchSiteOrder)
+		if marshalJSON(next) != marshalJSON(prevOrder) {
+			patch.SearchSiteOrder = next
+			changed = append(changed, "searchSiteOrder")
+		}
+	}
+	return patch, changed, nil
+}
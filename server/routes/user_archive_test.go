@@ -0,0 +1,118 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/auth"
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// TestUserArchiveRoundTrip exports one user's data, imports it into another
+// account twice and checks that the second import changes nothing.
+func TestUserArchiveRoundTrip(t *testing.T) {
+	database := openTestDB(t)
+	st := store.NewSQLite(database)
+	authMw := auth.New(st, auth.Options{})
+	session := func(username string) (int64, []*http.Cookie) {
+		id, err := st.Users.Create(store.User{Username: username, Role: "user", Status: "active"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := authMw.StartSession(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), id, false); err != nil {
+			t.Fatal(err)
+		}
+		return id, rec.Result().Cookies()
+	}
+	aliceID, aliceCookies := session("alice")
+	bobID, bobCookies := session("bob")
+
+	catKey := "cat-key"
+	if err := st.Users.Update(aliceID, store.UserPatch{CatAPIKey: &catKey, SearchSiteOrder: []string{"b", "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = st.Favorites.Upsert(store.Favorite{UserID: aliceID, SiteKey: "a", SpiderAPI: "http://cat/spider/a", VideoID: "1", VideoTitle: "Film", UpdatedAt: 100})
+	_ = st.PlayHistory.Record(store.PlayHistory{UserID: aliceID, ContentKey: "film", SiteKey: "a", VideoID: "1", VideoTitle: "Film", EpisodeIndex: 3, UpdatedAt: 200})
+	_ = st.SearchHistory.Touch(aliceID, 0, "film", 300)
+
+	exportH := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserExport(w, r, database, st)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/api/user/export", nil)
+	for _, c := range aliceCookies {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	exportH.ServeHTTP(rec, r)
+	if rec.Code != 200 {
+		t.Fatalf("export: status %d: %s", rec.Code, rec.Body)
+	}
+	archive := rec.Body.String()
+
+	importH := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUserImport(w, r, database, st)
+	}))
+	type counts struct {
+		Favorites     int      `json:"favorites"`
+		PlayHistory   int      `json:"playHistory"`
+		SearchHistory int      `json:"searchHistory"`
+		Settings      []string `json:"settings"`
+	}
+	importArchive := func() counts {
+		t.Helper()
+		rec := postJSON(importH, "/api/user/import", bobCookies, archive)
+		var body struct {
+			Success  bool   `json:"success"`
+			Imported counts `json:"imported"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || !body.Success {
+			t.Fatalf("import: status %d: %s", rec.Code, rec.Body)
+		}
+		return body.Imported
+	}
+	if got := importArchive(); got.Favorites != 1 || got.PlayHistory != 1 || got.SearchHistory != 1 || len(got.Settings) != 2 {
+		t.Errorf("first import = %+v", got)
+	}
+	if got := importArchive(); got.Favorites != 0 || got.PlayHistory != 0 || got.SearchHistory != 0 || len(got.Settings) != 0 {
+		t.Errorf("second import = %+v, want nothing", got)
+	}
+
+	favorites, _ := st.Favorites.List(bobID, 0, -1)
+	history, _ := st.PlayHistory.List(bobID, 0, -1)
+	searches, _ := st.SearchHistory.Entries(bobID, 0)
+	if len(favorites) != 1 || favorites[0].VideoTitle != "Film" || favorites[0].UpdatedAt != 100 {
+		t.Errorf("favorites = %+v", favorites)
+	}
+	if len(history) != 1 || history[0].EpisodeIndex != 3 || history[0].UpdatedAt != 200 {
+		t.Errorf("play history = %+v", history)
+	}
+	if len(searches) != 1 || searches[0].Keyword != "film" {
+		t.Errorf("search history = %+v", searches)
+	}
+	bob, _ := st.Users.ByID(bobID)
+	if order, _ := st.Users.SearchOrder(bobID); bob.CatAPIKey != catKey || len(order) != 2 || order[0] != "b" {
+		t.Errorf("settings: key %q, order %v", bob.CatAPIKey, order)
+	}
+
+	t.Run("failed import writes nothing", func(t *testing.T) {
+		carolID, _ := session("carol")
+		err := st.Users.Import(carolID, store.UserImport{
+			Favorites:     []store.Favorite{{SiteKey: "a", SpiderAPI: "http://cat/spider/a", VideoID: "1", VideoTitle: "Film", UpdatedAt: 100}},
+			SearchHistory: []store.SearchEntry{{Keyword: "film", UpdatedAt: 300}},
+			// The order repeats a site key, which the database rejects.
+			Patch: store.UserPatch{SearchSiteOrder: []string{"a", "a"}},
+		})
+		if !errors.Is(err, store.ErrConflict) {
+			t.Fatalf("Import err = %v, want conflict", err)
+		}
+		favorites, _ := st.Favorites.List(carolID, 0, -1)
+		searches, _ := st.SearchHistory.Entries(carolID, 0)
+		if len(favorites) != 0 || len(searches) != 0 {
+			t.Errorf("rows left behind: %d favorites, %d searches", len(favorites), len(searches))
+		}
+	})
+}
@@ -4,72 +4,204 @@ import (
 	"strings"
 
 	"github.com/jenfonro/meowfilm/internal/auth"
-	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/store"
 )
 
 type userCatSitesState struct {
 	Sites        []site
 	Status       map[string]bool
 	Home         map[string]bool
+	Search       map[string]bool
 	Order        []string
 	Availability map[string]string
 	HasUserAPI   bool
 	CanFallback  bool
 }
 
-func resolveUserCatSites(database *db.DB, u *auth.User) (userCatSitesState, error) {
-	var row struct {
-		CatSites        string
-		CatStatus       string
-		CatHome         string
-		CatOrder        string
-		CatAvailability string
-		CatAPIBase      string
-	}
-	if err := database.SQL().QueryRow(`
-		SELECT cat_sites, cat_site_status, cat_site_home, cat_site_order, cat_site_availability, cat_api_base
-		FROM users WHERE id = ? LIMIT 1
-	`, u.ID).Scan(&row.CatSites, &row.CatStatus, &row.CatHome, &row.CatOrder, &row.CatAvailability, &row.CatAPIBase); err != nil {
+func resolveUserCatSites(st *store.Store, u *auth.User) (userCatSitesState, error) {
+	row, err := st.Users.ByID(u.ID)
+	if err != nil {
 		return userCatSitesState{}, err
 	}
 
 	hasUserAPI := strings.TrimSpace(row.CatAPIBase) != ""
-	canFallback := u.Role != "user"
+	canFallback := u.Can(auth.PermUseSharedSites)
+
+	stored, err := loadUserSiteState(st, u.ID)
+	if err != nil {
+		return userCatSitesState{}, err
+	}
 
 	var sites []site
 	if hasUserAPI {
-		sites = normalizeSitesFromJSON(row.CatSites)
+		sites = stored.Sites
 	} else if canFallback {
-		sites = normalizeSitesFromJSON(database.GetSetting("video_source_sites"))
+		sites = listVideoSourceSites(st)
 	} else {
 		sites = []site{}
 	}
 
-	statusMap := parseJSONBoolMap(row.CatStatus)
-	homeMap := parseJSONBoolMap(row.CatHome)
-	order := parseJSONStringArray(row.CatOrder)
-	availability := parseAvailabilityJSON(row.CatAvailability)
-
 	return userCatSitesState{
 		Sites:        sites,
-		Status:       statusMap,
-		Home:         homeMap,
-		Order:        order,
-		Availability: availability,
+		Status:       stored.Status,
+		Home:         stored.Home,
+		Search:       stored.Search,
+		Order:        stored.Order,
+		Availability: stored.Availability,
 		HasUserAPI:   hasUserAPI,
 		CanFallback:  canFallback,
 	}, nil
 }
 
-func userHasCatAPIBase(database *db.DB, u *auth.User) (bool, error) {
-	if database == nil || u == nil {
+// loadUserSiteState reads the sites of a user's own CatPawOpen, in order.
+func loadUserSiteState(st *store.Store, userID int64) (reconciledSiteState, error) {
+	list, err := st.UserSites.List(userID)
+	if err != nil {
+		return siteStateOf(nil).reconciledSiteState, err
+	}
+	return siteStateOf(list).reconciledSiteState, nil
+}
+
+// persistUserCatSites replaces a user's sites with next in one transaction.
+// It reports whether anything differed from the stored list.
+func persistUserCatSites(st *store.Store, userID int64, next reconciledSiteState) (bool, error) {
+	return st.UserSites.Replace(userID, func(cur []store.Site) ([]store.Site, bool) {
+		ordered := applySiteOrder(next.Sites, next.Order)
+		if sameUserSiteState(siteStateOf(cur).reconciledSiteState, ordered, next) {
+			return nil, false
+		}
+		out := make([]store.Site, 0, len(ordered))
+		for _, s := range ordered {
+			enabled, ok := next.Status[s.Key]
+			if !ok {
+				enabled = true
+			}
+			home, ok := next.Home[s.Key]
+			if !ok {
+				home = defaultHomeForSite(s)
+			}
+			search, ok := next.Search[s.Key]
+			if !ok {
+				search = true
+			}
+			out = append(out, store.Site{
+				Key:          s.Key,
+				Name:         s.Name,
+				API:          s.API,
+				Type:         s.Type,
+				Enabled:      enabled,
+				Home:         home,
+				Search:       search,
+				Availability: normalizeAvailability(next.Availability[s.Key]),
+			})
+		}
+		return out, true
+	})
+}
+
+func sameUserSiteState(prev reconciledSiteState, ordered []site, next reconciledSiteState) bool {
+	if len(prev.Sites) != len(ordered) {
+		return false
+	}
+	for i, s := range ordered {
+		p := prev.Sites[i]
+		if p.Key != s.Key || p.Name != s.Name || p.API != s.API {
+			return false
+		}
+		if (p.Type == nil) != (s.Type == nil) || (p.Type != nil && *p.Type != *s.Type) {
+			return false
+		}
+		if prev.Status[s.Key] != next.Status[s.Key] || prev.Home[s.Key] != next.Home[s.Key] {
+			return false
+		}
+		if prev.Availability[s.Key] != normalizeAvailability(next.Availability[s.Key]) {
+			return false
+		}
+		if search, ok := next.Search[s.Key]; ok && prev.Search[s.Key] != search {
+			return false
+		}
+	}
+	return true
+}
+
+// saveUserSiteOrder reorders a user's sites: keys from order first, then
+// the remaining sites in their current order.
+func saveUserSiteOrder(st *store.Store, userID int64, order []string) error {
+	_, err := st.UserSites.Replace(userID, func(cur []store.Site) ([]store.Site, bool) {
+		return reorderSites(cur, order), true
+	})
+	return err
+}
+
+// mergeKeyOrder keeps the known keys from order (deduplicated), followed by
+// the rest of keys in their original order.
+func mergeKeyOrder(keys []string, order []string) []string {
+	keySet := map[string]struct{}{}
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		keySet[k] = struct{}{}
+	}
+	next := []string{}
+	seen := map[string]struct{}{}
+	for _, k := range order {
+		key := strings.TrimSpace(k)
+		if key == "" {
+			continue
+		}
+		if _, ok := keySet[key]; !ok {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		next = append(next, key)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		next = append(next, key)
+	}
+	return next
+}
+
+// loadUserSearchOrder returns the user's search order, or an empty one when
+// it cannot be read.
+func loadUserSearchOrder(st *store.Store, userID int64) []string {
+	order, err := st.Users.SearchOrder(userID)
+	if err != nil {
+		return []string{}
+	}
+	return order
+}
+
+// updateUserSite applies fn to a single site of the user's own CatPawOpen.
+// Plain users without their own CatPawOpen have no sites, so nothing is
+// found for them.
+func updateUserSite(st *store.Store, u *auth.User, key string, fn func(s *store.Site)) (found bool, err error) {
+	hasUserAPI, err := userHasCatAPIBase(st, u)
+	if err != nil || !hasUserAPI {
+		return false, err
+	}
+	return st.UserSites.Edit(u.ID, key, fn)
+}
+
+func userHasCatAPIBase(st *store.Store, u *auth.User) (bool, error) {
+	if st == nil || u == nil {
 		return false, nil
 	}
-	var base string
-	if err := database.SQL().QueryRow(`SELECT cat_api_base FROM users WHERE id=? LIMIT 1`, u.ID).Scan(&base); err != nil {
+	row, err := st.Users.ByID(u.ID)
+	if err != nil {
 		return false, err
 	}
-	return strings.TrimSpace(base) != "", nil
+	return strings.TrimSpace(row.CatAPIBase) != "", nil
 }
 
 func userSiteKeySet(sites []site) map[string]struct{} {
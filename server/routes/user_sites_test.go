@@ -0,0 +1,171 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+func postJSON(h http.Handler, target string, cookies []*http.Cookie, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func siteKeys(list []store.Site) string {
+	keys := []string{}
+	for _, s := range list {
+		keys = append(keys, s.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+// TestUserSitesHandlers checks that site toggles and reordering land in the
+// user's own list when they have a CatPawOpen, and in the shared list when
+// they browse it.
+func TestUserSitesHandlers(t *testing.T) {
+	sites := []store.Site{
+		{Key: "a", Name: "A", API: "http://cat/spider/a", Enabled: true, Home: true, Search: true},
+		{Key: "b", Name: "B", API: "http://cat/spider/b", Enabled: true, Home: true, Search: true},
+		{Key: "c", Name: "C", API: "http://cat/spider/c", Enabled: true, Home: true, Search: true},
+	}
+	tests := []struct {
+		name    string
+		role    string
+		catBase string
+		// edited returns the list the requests should change.
+		edited func(st *store.Store, userID int64) ([]store.Site, error)
+	}{
+		{
+			name:    "own CatPawOpen",
+			role:    "user",
+			catBase: "http://cat/",
+			edited: func(st *store.Store, userID int64) ([]store.Site, error) {
+				return st.UserSites.List(userID)
+			},
+		},
+		{
+			name: "shared site list",
+			role: "shared",
+			edited: func(st *store.Store, _ int64) ([]store.Site, error) {
+				return st.Sites.List()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, authMw, u, cookies := signedIn(t, "alice", "right-pass-1", tt.role)
+			if err := st.Users.Update(u.ID, store.UserPatch{CatAPIBase: &tt.catBase}); err != nil {
+				t.Fatal(err)
+			}
+			seed := func(cur []store.Site) ([]store.Site, bool) { return append([]store.Site{}, sites...), true }
+			if _, err := st.Sites.Replace(seed); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.UserSites.Replace(u.ID, seed); err != nil {
+				t.Fatal(err)
+			}
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/user/sites/status", func(w http.ResponseWriter, r *http.Request) { handleAPIUserSitesStatus(w, r, st) })
+			mux.HandleFunc("/api/user/sites/home", func(w http.ResponseWriter, r *http.Request) { handleAPIUserSitesHome(w, r, st) })
+			mux.HandleFunc("/api/user/sites/order", func(w http.ResponseWriter, r *http.Request) { handleAPIUserSitesOrder(w, r, st) })
+			h := authMw.Middleware(mux)
+
+			for _, req := range []struct{ target, body string }{
+				{"/api/user/sites/status", `{"key":"b","enabled":false}`},
+				{"/api/user/sites/home", `{"key":"c","home":false}`},
+				{"/api/user/sites/order", `{"order":["c","a"]}`},
+			} {
+				if rec := postJSON(h, req.target, cookies, req.body); rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d, body %s", req.target, rec.Code, rec.Body)
+				}
+			}
+			if rec := postJSON(h, "/api/user/sites/status", cookies, `{"key":"missing","enabled":false}`); rec.Code != http.StatusBadRequest {
+				t.Errorf("unknown site: status %d, want 400", rec.Code)
+			}
+
+			got, err := tt.edited(st, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := siteKeys(got); keys != "c,a,b" {
+				t.Errorf("order = %s, want c,a,b", keys)
+			}
+			for _, s := range got {
+				if s.Key == "b" && s.Enabled {
+					t.Error("site b still enabled")
+				}
+				if s.Key == "c" && s.Home {
+					t.Error("site c still on the home page")
+				}
+			}
+
+			// The other list is left alone.
+			other, _ := st.Sites.List()
+			if tt.catBase == "" {
+				other, _ = st.UserSites.List(u.ID)
+			}
+			if keys := siteKeys(other); keys != "a,b,c" {
+				t.Errorf("other list order = %s, want a,b,c", keys)
+			}
+			for _, s := range other {
+				if !s.Enabled || !s.Home {
+					t.Errorf("other list changed: %+v", s)
+				}
+			}
+		})
+	}
+}
+
+func TestUserSitesPersistAndList(t *testing.T) {
+	st, authMw, u, cookies := signedIn(t, "alice", "right-pass-1", "user")
+	base := "http://cat/"
+	if err := st.Users.Update(u.ID, store.UserPatch{CatAPIBase: &base}); err != nil {
+		t.Fatal(err)
+	}
+	next := reconcileSites([]site{
+		{Key: "a", Name: "A", API: "http://cat/spider/a"},
+		{Key: "b", Name: "B", API: "http://cat/spider/b"},
+	}, nil, nil, nil, nil, nil)
+	for i, want := range []bool{true, false} {
+		changed, err := persistUserCatSites(st, u.ID, next)
+		if err != nil || changed != want {
+			t.Fatalf("persist %d = %v, %v; want %v", i+1, changed, err, want)
+		}
+	}
+	// Sites switched off for search globally stay off for every user.
+	if _, err := st.Sites.Replace(func([]store.Site) ([]store.Site, bool) {
+		return []store.Site{{Key: "b", API: "http://other/spider/b"}}, true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := authMw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handleAPIUserSites(w, r, st) }))
+	r := httptest.NewRequest(http.MethodGet, "/api/user/sites", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	var body struct {
+		Sites []struct {
+			Key    string `json:"key"`
+			Search bool   `json:"search"`
+		} `json:"sites"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if len(body.Sites) != 2 || body.Sites[0].Key != "a" || !body.Sites[0].Search || body.Sites[1].Key != "b" || body.Sites[1].Search {
+		t.Errorf("sites = %+v, want a searchable and b not", body.Sites)
+	}
+}
@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/jenfonro/meowfilm/internal/store"
+)
+
+// videoSourceState is the global site list kept in the sites table.
+type videoSourceState struct {
+	reconciledSiteState
+	Errors map[string]string
+}
+
+// siteStateOf splits a stored site list into the per-key maps the handlers
+// work with.
+func siteStateOf(list []store.Site) videoSourceState {
+	state := videoSourceState{
+		reconciledSiteState: reconciledSiteState{
+			Sites:        []site{},
+			Status:       map[string]bool{},
+			Home:         map[string]bool{},
+			Search:       map[string]bool{},
+			Order:        []string{},
+			Availability: map[string]string{},
+		},
+		Errors: map[string]string{},
+	}
+	for _, s := range list {
+		state.Sites = append(state.Sites, site{Key: s.Key, Name: s.Name, API: s.API, Type: s.Type})
+		state.Status[s.Key] = s.Enabled
+		state.Home[s.Key] = s.Home
+		state.Search[s.Key] = s.Search
+		state.Order = append(state.Order, s.Key)
+		state.Availability[s.Key] = normalizeAvailability(s.Availability)
+		if msg := strings.TrimSpace(s.Error); msg != "" {
+			state.Errors[s.Key] = msg
+		}
+	}
+	return state
+}
+
+// reorderSites puts the keys from order first, then the remaining sites in
+// their current order.
+func reorderSites(list []store.Site, order []string) []store.Site {
+	byKey := make(map[string]store.Site, len(list))
+	keys := make([]string, 0, len(list))
+	for _, s := range list {
+		byKey[s.Key] = s
+		keys = append(keys, s.Key)
+	}
+	out := make([]store.Site, 0, len(list))
+	for _, key := range mergeKeyOrder(keys, order) {
+		out = append(out, byKey[key])
+	}
+	return out
+}
+
+// loadVideoSourceSites reads the global site list.
+func loadVideoSourceSites(st *store.Store) (videoSourceState, error) {
+	list, err := st.Sites.List()
+	if err != nil {
+		return siteStateOf(nil), err
+	}
+	return siteStateOf(list), nil
+}
+
+func mergeVideoSourceSites(st *store.Store) []map[string]any {
+	state, err := loadVideoSourceSites(st)
+	if err != nil {
+		return []map[string]any{}
+	}
+	availability := make(map[string]any, len(state.Availability))
+	for k, v := range state.Availability {
+		availability[k] = v
+	}
+	return mergeSitesWithState(state.Sites, state.Status, state.Home, state.Order, availability, state.Search, state.Errors)
+}
+
+func listVideoSourceSites(st *store.Store) []site {
+	state, err := loadVideoSourceSites(st)
+	if err != nil {
+		return []site{}
+	}
+	return state.Sites
+}
+
+// saveVideoSourceSiteOrder reorders the global sites: keys from order first,
+// then the remaining sites in their current order.
+func saveVideoSourceSiteOrder(st *store.Store, order []string) error {
+	_, err := st.Sites.Replace(func(cur []store.Site) ([]store.Site, bool) {
+		return reorderSites(cur, order), true
+	})
+	return err
+}
+
+// replaceVideoSourceSites swaps in a freshly imported site list, keeping the
+// flags, position and last check result of sites that are still present.
+func replaceVideoSourceSites(st *store.Store, imported []site) error {
+	_, err := st.Sites.Replace(func(cur []store.Site) ([]store.Site, bool) {
+		prev := siteStateOf(cur)
+		next := reconcileSites(imported, prev.Status, prev.Home, prev.Search, prev.Order, prev.Availability)
+		out := []store.Site{}
+		for _, s := range applySiteOrder(next.Sites, next.Order) {
+			out = append(out, store.Site{
+				Key:          s.Key,
+				Name:         s.Name,
+				API:          s.API,
+				Type:         s.Type,
+				Enabled:      next.Status[s.Key],
+				Home:         next.Home[s.Key],
+				Search:       next.Search[s.Key] && !isConfigCenterSite(s),
+				Availability: normalizeAvailability(next.Availability[s.Key]),
+				Error:        prev.Errors[s.Key],
+			})
+		}
+		return out, true
+	})
+	return err
+}
+
+// applyVideoSourceCheck stores availability check results. Failed checks also
+// switch off the part of the site that failed.
+func applyVideoSourceCheck(st *store.Store, results map[string]string, errs map[string]string) error {
+	_, err := st.Sites.Replace(func(cur []store.Site) ([]store.Site, bool) {
+		for i := range cur {
+			availability, ok := results[cur[i].Key]
+			if !ok {
+				continue
+			}
+			s := &cur[i]
+			s.Availability = availability
+			s.Error = strings.TrimSpace(errs[s.Key])
+			switch availability {
+			case "invalid":
+				s.Enabled = false
+			case "category_error":
+				s.Home = false
+			case "search_error":
+				s.Search = false
+			}
+		}
+		return cur, true
+	})
+	return err
+}
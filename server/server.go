@@ -8,13 +8,16 @@ import (
 
 	"github.com/jenfonro/meowfilm/internal/auth"
 	"github.com/jenfonro/meowfilm/internal/db"
+	"github.com/jenfonro/meowfilm/internal/proxy"
+	"github.com/jenfonro/meowfilm/internal/store"
 	"github.com/jenfonro/meowfilm/server/routes"
 	"github.com/jenfonro/meowfilm/server/static"
 )
 
 type Config struct {
-	Addr       string
-	TrustProxy bool
+	Addr string
+	// TrustedProxies are the peers whose forwarding headers are believed.
+	TrustedProxies proxy.Trusted
 }
 
 type Server struct {
@@ -22,6 +25,7 @@ type Server struct {
 	db   *db.DB
 	mux  *http.ServeMux
 	h    http.Handler
+	stop chan struct{}
 }
 
 func New(cfg Config) (*Server, error) {
@@ -34,15 +38,33 @@ func New(cfg Config) (*Server, error) {
 		return nil, err
 	}
 
-	authMw := auth.New(database, auth.Options{
-		TrustProxy:   cfg.TrustProxy,
-		CookieSecure: os.Getenv("MEOWFILM_COOKIE_SECURE") == "1",
+	header, err := auth.HeaderAuthFromEnv()
+	if err != nil {
+		_ = database.Close()
+		return nil, err
+	}
+	if header != nil && !cfg.TrustedProxies.Enabled() {
+		_ = database.Close()
+		return nil, errors.New("MEOWFILM_AUTH_HEADER 需要同时设置 MEOWFILM_TRUST_PROXY")
+	}
+
+	st := store.NewSQLite(database)
+	authMw := auth.New(st, auth.Options{
+		CookieSecure:   os.Getenv("MEOWFILM_COOKIE_SECURE") == "1",
+		Header:         header,
+		TrustedOrigins: auth.ParseTrustedOrigins(os.Getenv("MEOWFILM_TRUSTED_ORIGINS")),
 	})
+	if err := authMw.CheckHeaderRoles(); err != nil {
+		_ = database.Close()
+		return nil, err
+	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/api/", routes.APIHandler(database, authMw))
-	dashboardAPI := routes.DashboardHandler(database, authMw)
+	jan := newJanitor(database, st)
+
+	mux.Handle("/api/", routes.APIHandler(database, st, authMw))
+	dashboardAPI := routes.DashboardHandler(database, st, jan, authMw)
 	staticHandler := static.Handler(authMw)
 	mux.Handle("/dashboard/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/dashboard/" {
@@ -53,18 +75,32 @@ func New(cfg Config) (*Server, error) {
 	}))
 	mux.Handle("/", static.Handler(authMw))
 
-	root := authMw.Middleware(mux)
+	root := cfg.TrustedProxies.Middleware(authMw.Middleware(authMw.CSRF(mux)))
 	handler := static.NoStoreForHTMLCSSJS(root)
 
-	return &Server{addr: cfg.Addr, db: database, mux: mux, h: handler}, nil
+	stop := make(chan struct{})
+	go jan.Run(stop)
+
+	return &Server{addr: cfg.Addr, db: database, mux: mux, h: handler, stop: stop}, nil
 }
 
 func (s *Server) Addr() string          { return s.addr }
 func (s *Server) Handler() http.Handler { return s.h }
 
+// CloseEvents ends open event streams so an HTTP shutdown does not wait on them.
+func (s *Server) CloseEvents() {
+	if s != nil && s.db != nil {
+		s.db.CloseSubscriptions()
+	}
+}
+
 func (s *Server) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
 	return s.db.Close()
 }
@@ -111,9 +111,6 @@ func Handler(authMw *auth.Auth) http.Handler {
 				_, _ = io.WriteString(w, dashboardHTML)
 			})).ServeHTTP(w, r)
 			return
-		case "/logout":
-			http.Redirect(w, r, "/api/logout", http.StatusFound)
-			return
 		}
 
 		// Fall back to embedded static dist.